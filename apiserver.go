@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// validateAPIServerURL checks that rawurl names an apiserver we can hand
+// to kubelets: an https URL with a host, no credentials, and nothing
+// after it.
+// Plain http is only accepted when allowInsecure is set.
+func validateAPIServerURL(rawurl string, allowInsecure bool) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if !allowInsecure {
+			return fmt.Errorf("%q: scheme must be https (see -allow-insecure-apiserver)", rawurl)
+		}
+	default:
+		return fmt.Errorf("%q: scheme must be https", rawurl)
+	}
+	if u.Hostname() == "" {
+		return fmt.Errorf("%q: missing host", rawurl)
+	}
+	if u.User != nil {
+		return fmt.Errorf("%q: must not have credentials", u.Redacted())
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("%q: must not have a path, query or fragment", rawurl)
+	}
+	return nil
+}
+
+// defaultAPIServerPort is the port assumed for -apiserver URLs without
+// one, the apiserver's own default.
+const defaultAPIServerPort = "6443"
+
+// withDefaultAPIServerPort returns rawurl with defaultAPIServerPort
+// added if it has a host but no port. Only URLs given to us locally get
+// this; gossiped ones already mean what their senders meant.
+func withDefaultAPIServerPort(rawurl string) string {
+	if !strings.Contains(rawurl, "://") {
+		rawurl = "https://" + rawurl
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Hostname() == "" || u.Port() != "" || strings.HasSuffix(u.Host, ":") {
+		return rawurl
+	}
+	u.Host = net.JoinHostPort(u.Hostname(), defaultAPIServerPort)
+	return u.String()
+}
+
+// defaultPorts are the ports that normalizeAPIServerURL leaves out.
+var defaultPorts = map[string]string{"https": "443", "http": "80"}
+
+// normalizeAPIServerURL returns rawurl with https assumed if it has no
+// scheme, the scheme and host lowercased, the scheme's default port
+// dropped, and any trailing slash stripped, so that spellings of the
+// same apiserver compare equal.
+// Anything that doesn't parse is returned as it is.
+func normalizeAPIServerURL(rawurl string) string {
+	if !strings.Contains(rawurl, "://") {
+		rawurl = "https://" + rawurl
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return rawurl
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); port != "" && port == defaultPorts[u.Scheme] {
+		u.Host = strings.TrimSuffix(u.Host, ":"+port)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = strings.TrimSuffix(u.RawPath, "/")
+	return u.String()
+}
+
+// apiserverHostPort is the host and port to connect to rawurl on.
+func apiserverHostPort(rawurl string) (host, port string, err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", "", err
+	}
+	port = u.Port()
+	if port == "" {
+		port = defaultPorts[u.Scheme]
+	}
+	return u.Hostname(), port, nil
+}
+
+func normalizeAPIServerURLs(urls []string) []string {
+	if urls == nil {
+		return nil
+	}
+	normalized := make([]string, 0, len(urls))
+	for _, u := range urls {
+		normalized = append(normalized, normalizeAPIServerURL(u))
+	}
+	return normalized
+}
+
+// apiserverset is a stringset of normalized apiserver URLs, port 6443
+// unless given, and the priority and labels given to any of them, as
+// <url>,priority=<n>,weight=<n>,<label>=<value>.
+type apiserverset struct {
+	stringset
+	priorities map[string]apiserverPriority
+	labels     map[string]map[string]string
+}
+
+func (as *apiserverset) Set(value string) error {
+	fields := strings.Split(value, ",")
+	u := normalizeAPIServerURL(withDefaultAPIServerPort(fields[0]))
+	if len(fields) > 1 {
+		pri, labels, err := parseAPIServerOptions(fields[1:])
+		if err != nil {
+			return fmt.Errorf("%s: %v", fields[0], err)
+		}
+		if pri != nil {
+			if as.priorities == nil {
+				as.priorities = map[string]apiserverPriority{}
+			}
+			as.priorities[u] = *pri
+		}
+		if labels != nil {
+			if as.labels == nil {
+				as.labels = map[string]map[string]string{}
+			}
+			as.labels[u] = labels
+		}
+	}
+	return as.stringset.Set(u)
+}
+
+// Apiservers without an explicit priority or weight get these.
+const (
+	defaultAPIServerPriority = 100
+	defaultAPIServerWeight   = 100
+)
+
+// apiserverPriority orders apiservers like DNS SRV records do: lowest
+// priority first, and among equal priorities, highest weight first.
+type apiserverPriority struct {
+	Priority int
+	Weight   int
+}
+
+// parseAPIServerOptions parses the key=value options after an -apiserver
+// URL. priority and weight give its priority, which is nil if neither
+// does; any other key is a label.
+func parseAPIServerOptions(fields []string) (*apiserverPriority, map[string]string, error) {
+	var pri *apiserverPriority
+	var labels map[string]string
+	for _, field := range fields {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, nil, fmt.Errorf("%q is not key=value", field)
+		}
+		if kv[0] != "priority" && kv[0] != "weight" {
+			if labels == nil {
+				labels = map[string]string{}
+			}
+			labels[kv[0]] = kv[1]
+			continue
+		}
+		n, err := strconv.Atoi(kv[1])
+		if err != nil || n < 1 {
+			return nil, nil, fmt.Errorf("%s: %q is not a positive integer", kv[0], kv[1])
+		}
+		if pri == nil {
+			pri = &apiserverPriority{Priority: defaultAPIServerPriority, Weight: defaultAPIServerWeight}
+		}
+		if kv[0] == "priority" {
+			pri.Priority = n
+		} else {
+			pri.Weight = n
+		}
+	}
+	return pri, labels, nil
+}
+
+// leasePriority is the priority a lease gives its URL, where zero,
+// from peers that predate priorities, means the default.
+func leasePriority(l *APIServerLease) apiserverPriority {
+	pri := apiserverPriority{Priority: l.Priority, Weight: l.Weight}
+	if pri.Priority == 0 {
+		pri.Priority = defaultAPIServerPriority
+	}
+	if pri.Weight == 0 {
+		pri.Weight = defaultAPIServerWeight
+	}
+	return pri
+}
+
+// before reports whether pri sorts before other.
+func (pri apiserverPriority) before(other apiserverPriority) bool {
+	if pri.Priority != other.Priority {
+		return pri.Priority < other.Priority
+	}
+	return pri.Weight > other.Weight
+}
+
+// apiserverPriorities is the priority the unexpired leases give each
+// URL. Where seeds disagree about a URL, the one putting it first wins,
+// so every peer agrees on the order.
+func apiserverPriorities(leases []*APIServerLease, now time.Time) func(u string) apiserverPriority {
+	priorities := map[string]apiserverPriority{}
+	for _, l := range leases {
+		if l.expired(now) {
+			continue
+		}
+		u := normalizeAPIServerURL(l.URL)
+		if pri, ok := priorities[u]; !ok || leasePriority(l).before(pri) {
+			priorities[u] = leasePriority(l)
+		}
+	}
+	return func(u string) apiserverPriority {
+		if pri, ok := priorities[normalizeAPIServerURL(u)]; ok {
+			return pri
+		}
+		return apiserverPriority{Priority: defaultAPIServerPriority, Weight: defaultAPIServerWeight}
+	}
+}
+
+// prioritizeAPIServerURLs sorts urls by apiserverPriorities, then by URL.
+func prioritizeAPIServerURLs(urls []string, leases []*APIServerLease, now time.Time) []string {
+	priority := apiserverPriorities(leases, now)
+	sorted := append([]string{}, urls...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		pi, pj := priority(sorted[i]), priority(sorted[j])
+		if pi != pj {
+			return pi.before(pj)
+		}
+		return sorted[i] < sorted[j]
+	})
+	return sorted
+}
+
+// apiserverLabels merges the labels the unexpired leases give each URL,
+// key by key: the lease of the peer that started advertising the URL
+// last wins, then the lowest peer, so every peer agrees on them.
+func apiserverLabels(leases []*APIServerLease, now time.Time) map[string]map[string]string {
+	type writer struct {
+		value string
+		since time.Time
+		peer  mesh.PeerName
+	}
+	writers := map[string]map[string]writer{}
+	for _, l := range leases {
+		if l.expired(now) || len(l.Labels) == 0 {
+			continue
+		}
+		u := normalizeAPIServerURL(l.URL)
+		if writers[u] == nil {
+			writers[u] = map[string]writer{}
+		}
+		for k, v := range l.Labels {
+			w, ok := writers[u][k]
+			if ok && (w.since.After(l.Since) || (w.since.Equal(l.Since) && w.peer < l.Peer)) {
+				continue
+			}
+			writers[u][k] = writer{value: v, since: l.Since, peer: l.Peer}
+		}
+	}
+	labels := map[string]map[string]string{}
+	for u, ws := range writers {
+		labels[u] = map[string]string{}
+		for k, w := range ws {
+			labels[u][k] = w.value
+		}
+	}
+	return labels
+}
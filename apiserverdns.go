@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// resolvedMaxAge is how long a resolution of an apiserver hostname is
+// gossiped for, if nobody resolves it again.
+const resolvedMaxAge = 24 * time.Hour
+
+// ResolvedAPIServer is what an apiserver URL's host last resolved to, on
+// a peer with working DNS. Peers without it can connect to one of the
+// IPs instead, still verifying the serving certificate against the host.
+type ResolvedAPIServer struct {
+	URL      string
+	IPs      []string
+	Peer     mesh.PeerName
+	Resolved time.Time
+}
+
+func (r *ResolvedAPIServer) stale(now time.Time) bool {
+	return now.Sub(r.Resolved) > resolvedMaxAge
+}
+
+// mergeResolvedAPIServers keeps the latest resolution of each URL.
+func mergeResolvedAPIServers(ours, theirs []*ResolvedAPIServer) (result, delta []*ResolvedAPIServer) {
+	all := append(append([]*ResolvedAPIServer(nil), ours...), theirs...)
+	keep, changed := mergeKeyed(len(ours), len(theirs),
+		func(i int) string { return all[i].URL },
+		func(i, j int) bool { return preferResolvedAPIServer(all[i], all[j]) })
+	for _, i := range keep {
+		result = append(result, all[i])
+	}
+	for _, i := range changed {
+		delta = append(delta, all[i])
+	}
+	sortResolvedAPIServers(result)
+	sortResolvedAPIServers(delta)
+	return result, delta
+}
+
+// preferResolvedAPIServer decides between two resolutions of the same
+// URL: the latest, then the lowest peer name.
+func preferResolvedAPIServer(a, b *ResolvedAPIServer) bool {
+	if !a.Resolved.Equal(b.Resolved) {
+		return a.Resolved.After(b.Resolved)
+	}
+	return a.Peer < b.Peer
+}
+
+func sortResolvedAPIServers(resolved []*ResolvedAPIServer) {
+	sort.Slice(resolved, func(i, j int) bool { return resolved[i].URL < resolved[j].URL })
+}
+
+// resolveAPIServers looks up the host of each URL that isn't an IP
+// address, skipping those that fail, and returns the IPv4 and IPv6
+// addresses of the rest, sorted.
+func resolveAPIServers(urls []string, lookup func(host string) ([]string, error), self mesh.PeerName, now time.Time) (resolved []*ResolvedAPIServer, errs map[string]error) {
+	errs = map[string]error{}
+	for _, rawurl := range urls {
+		u, err := url.Parse(rawurl)
+		if err != nil || u.Hostname() == "" || net.ParseIP(u.Hostname()) != nil {
+			continue
+		}
+		ips, err := lookup(u.Hostname())
+		if err != nil {
+			errs[rawurl] = err
+			continue
+		}
+		if len(ips) == 0 {
+			continue
+		}
+		ips = append([]string{}, ips...)
+		sort.Strings(ips)
+		resolved = append(resolved, &ResolvedAPIServer{URL: rawurl, IPs: ips, Peer: self, Resolved: now})
+	}
+	return resolved, errs
+}
+
+// resolveAPIServerHosts resolves the gossiped apiserver URLs every
+// interval until quit is closed, and gossips what they resolve to.
+func (p *peer) resolveAPIServerHosts(interval time.Duration, lookup func(host string) ([]string, error), quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.resolveRound(lookup, time.Now())
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// resolveRound resolves the apiserver URLs we know of once.
+func (p *peer) resolveRound(lookup func(host string) ([]string, error), now time.Time) {
+	p.st.mtx.RLock()
+	urls := p.st.set.ApiserverURLs
+	p.st.mtx.RUnlock()
+	resolved, errs := resolveAPIServers(urls, lookup, p.self, now.UTC())
+	for u, err := range errs {
+		p.logger.Debugf("Resolving apiserver %s: %v", u, err)
+	}
+	if len(resolved) > 0 {
+		p.st.mergeComplete(ClusterInfo{ResolvedAPIServers: resolved})
+	}
+}
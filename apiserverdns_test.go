@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMergeResolvedAPIServers(t *testing.T) {
+	t0 := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	a0 := &ResolvedAPIServer{URL: "https://a", IPs: []string{"10.0.0.1"}, Peer: 2, Resolved: t0}
+	a1 := &ResolvedAPIServer{URL: "https://a", IPs: []string{"10.0.0.2"}, Peer: 3, Resolved: t0.Add(time.Minute)}
+	a0low := &ResolvedAPIServer{URL: "https://a", IPs: []string{"10.0.0.3"}, Peer: 1, Resolved: t0}
+	b := &ResolvedAPIServer{URL: "https://b", IPs: []string{"fd00::1"}, Peer: 1, Resolved: t0}
+	for _, testcase := range []struct {
+		ours, theirs  []*ResolvedAPIServer
+		result, delta []*ResolvedAPIServer
+	}{
+		{nil, []*ResolvedAPIServer{a0}, []*ResolvedAPIServer{a0}, []*ResolvedAPIServer{a0}},
+		{[]*ResolvedAPIServer{a0}, []*ResolvedAPIServer{a1}, []*ResolvedAPIServer{a1}, []*ResolvedAPIServer{a1}},
+		{[]*ResolvedAPIServer{a1}, []*ResolvedAPIServer{a0}, []*ResolvedAPIServer{a1}, nil},
+		{[]*ResolvedAPIServer{a0}, []*ResolvedAPIServer{a0low}, []*ResolvedAPIServer{a0low}, []*ResolvedAPIServer{a0low}},
+		{[]*ResolvedAPIServer{b}, []*ResolvedAPIServer{a0}, []*ResolvedAPIServer{a0, b}, []*ResolvedAPIServer{a0}},
+	} {
+		result, delta := mergeResolvedAPIServers(testcase.ours, testcase.theirs)
+		if !reflect.DeepEqual(testcase.result, result) {
+			t.Errorf("mergeResolvedAPIServers(%v, %v): want result %v, have %v", testcase.ours, testcase.theirs, testcase.result, result)
+		}
+		if !reflect.DeepEqual(testcase.delta, delta) {
+			t.Errorf("mergeResolvedAPIServers(%v, %v): want delta %v, have %v", testcase.ours, testcase.theirs, testcase.delta, delta)
+		}
+	}
+}
+
+func TestPeerResolvesAPIServers(t *testing.T) {
+	lookup := func(host string) ([]string, error) {
+		switch host {
+		case "api.internal":
+			return []string{"fd00::10", "10.0.0.10"}, nil
+		case "10.0.0.1":
+			t.Error("looked up an IP address")
+		}
+		return nil, errors.New("no such host")
+	}
+	now := time.Now().UTC()
+	p := newTestPeer()
+	p.st.mergeComplete(ClusterInfo{ApiserverURLs: []string{"https://api.internal:6443", "https://10.0.0.1:6443", "https://gone.internal:6443"}})
+	p.resolveRound(lookup, now)
+	want := []resolvedAPIServerView{{URL: "https://api.internal:6443", IPs: []string{"10.0.0.10", "fd00::10"}, Resolved: now, Peer: p.self.String()}}
+	if have := p.snapshot().ResolvedAPIServers; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	// Resolutions go stale if nobody renews them.
+	p.st.expire(now.Add(resolvedMaxAge + time.Hour))
+	if have := p.st.set.ResolvedAPIServers; len(have) != 0 {
+		t.Errorf("want stale resolutions dropped, have %v", have)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// readAPIServerFile adds the apiservers in path, one per line and each
+// as for -apiserver, to as. Blank lines and # comments are skipped.
+func readAPIServerFile(path string, as *apiserverset) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if err := as.Set(line); err != nil {
+			return fmt.Errorf("%s:%d: %v", path, n, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// loadAPIServers is the apiservers in flags, and in file if set, once
+// they all pass validateAPIServerURL, and there are no more than max.
+func loadAPIServers(flags *apiserverset, file string, allowInsecure bool, max int) (*apiserverset, error) {
+	as := &apiserverset{stringset: stringset{}}
+	for _, u := range flags.slice() {
+		as.stringset.Set(u)
+	}
+	for u, pri := range flags.priorities {
+		if as.priorities == nil {
+			as.priorities = map[string]apiserverPriority{}
+		}
+		as.priorities[u] = pri
+	}
+	for u, labels := range flags.labels {
+		if as.labels == nil {
+			as.labels = map[string]map[string]string{}
+		}
+		as.labels[u] = labels
+	}
+	if file != "" {
+		if err := readAPIServerFile(file, as); err != nil {
+			return nil, err
+		}
+	}
+	for _, u := range as.slice() {
+		if err := validateAPIServerURL(u, allowInsecure); err != nil {
+			return nil, err
+		}
+	}
+	if max > 0 && len(as.stringset) > max {
+		return nil, fmt.Errorf("%d URLs given, but -max-apiserver-urls is %d", len(as.stringset), max)
+	}
+	return as, nil
+}
+
+// reloadAPIServers swaps the apiservers we advertise for those in as,
+// and lets our peers know straight away.
+func (p *peer) reloadAPIServers(as *apiserverset) {
+	added, removed := p.st.advertise(as, time.Now())
+	if len(added) == 0 && len(removed) == 0 {
+		p.logger.Infof("Apiservers unchanged")
+		return
+	}
+	for _, u := range added {
+		p.logger.Infof("Advertising apiserver %s", u)
+	}
+	for _, u := range removed {
+		p.logger.Infof("No longer advertising apiserver %s; it expires with its lease", u)
+	}
+	p.onChange()
+	p.broadcast()
+}
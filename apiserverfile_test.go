@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+func writeAPIServerFile(t *testing.T, dir, content string) string {
+	path := filepath.Join(dir, "apiservers")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadAPIServers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet-mesh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	flags := &apiserverset{stringset: stringset{}}
+	flags.Set("https://flag:6443,priority=5")
+	path := writeAPIServerFile(t, dir, "# control plane\nhttps://a:6443\n\n  https://B  # defaults to 6443\nhttps://c:6443,zone=z1\n")
+	as, err := loadAPIServers(flags, path, false, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{"https://a:6443", "https://b:6443", "https://c:6443", "https://flag:6443"}, as.slice(); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	if want, have := map[string]map[string]string{"https://c:6443": {"zone": "z1"}}, as.labels; !reflect.DeepEqual(want, have) {
+		t.Errorf("want labels %v, have %v", want, have)
+	}
+	if _, ok := as.priorities["https://flag:6443"]; !ok {
+		t.Errorf("want the -apiserver priorities kept, have %v", as.priorities)
+	}
+	if len(flags.slice()) != 1 {
+		t.Errorf("want the -apiserver flags left alone, have %v", flags.slice())
+	}
+
+	for _, testcase := range []struct {
+		content string
+		max     int
+		want    string
+	}{
+		{"https://a:6443\nhttp://b:8080\n", 0, "scheme must be https"},
+		{"https://a:6443\nhttps://a:6443,priority=x\n", 0, "apiservers:2:"},
+		{"https://a:6443\nhttps://b:6443\n", 2, "3 URLs given"},
+	} {
+		path := writeAPIServerFile(t, dir, testcase.content)
+		if _, err := loadAPIServers(flags, path, false, testcase.max); err == nil || !strings.Contains(err.Error(), testcase.want) {
+			t.Errorf("%q: want an error containing %q, have %v", testcase.content, testcase.want, err)
+		}
+	}
+	if _, err := loadAPIServers(flags, filepath.Join(dir, "missing"), false, 0); err == nil {
+		t.Error("want an error for a missing file")
+	}
+}
+
+func TestPeerReloadAPIServers(t *testing.T) {
+	logger := newTextLogger(ioutil.Discard, "", 0)
+	p := newNodeBootstrapPeer(mesh.PeerName(1), "seed", nil, []string{"https://a:6443", "https://b:6443"}, peerOptions{skipCAValidation: true, apiserverTTL: time.Hour}, logger)
+	as := &apiserverset{stringset: stringset{}}
+	as.Set("https://b:6443")
+	as.Set("https://c:6443,zone=z1")
+	p.reloadAPIServers(as)
+	if want, have := []string{"https://a:6443", "https://b:6443", "https://c:6443"}, p.st.set.ApiserverURLs; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	if want, have := map[string]map[string]string{"https://c:6443": {"zone": "z1"}}, p.snapshot().ApiserverLabels; !reflect.DeepEqual(want, have) {
+		t.Errorf("want labels %v, have %v", want, have)
+	}
+
+	// The URL we dropped ages out with its lease; the rest stay.
+	later := time.Now().Add(61 * time.Minute)
+	p.st.refresh(later)
+	p.st.expire(later)
+	if want, have := []string{"https://b:6443", "https://c:6443"}, p.st.set.ApiserverURLs; !reflect.DeepEqual(want, have) {
+		t.Errorf("after the TTL: want %v, have %v", want, have)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+
+	"github.com/weaveworks/mesh"
+)
+
+// loadRootCAs reads every certificate in the PEM file at path.
+// Other PEM blocks, such as keys, are skipped with a warning.
+// A file without any PEM blocks is read as a single DER certificate.
+// It is an error for the file to contain no certificates at all.
+func loadRootCAs(path string, logger *levelLogger) ([]*x509.Certificate, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseRootCAs(buf, path, logger)
+}
+
+// parseRootCAs parses buf, read from path, as loadRootCAs does.
+func parseRootCAs(buf []byte, path string, logger *levelLogger) ([]*x509.Certificate, error) {
+	var (
+		certs  []*x509.Certificate
+		blocks int
+		rest   = buf
+	)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		blocks++
+		if block.Type != "CERTIFICATE" {
+			logger.Warnf("Skipping %q PEM block in %s", block.Type, path)
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		certs = append(certs, cert)
+	}
+	if blocks == 0 {
+		cert, err := x509.ParseCertificate(buf)
+		if err != nil {
+			return nil, fmt.Errorf("%s: neither PEM nor a DER certificate: %v", path, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%s: no PEM certificates found", path)
+	}
+	return certs, nil
+}
+
+// readRootCAs loads the root CAs from every one of paths and checks that
+// they are fit to distribute, as far as opts ask for.
+func readRootCAs(paths []string, opts peerOptions, logger *levelLogger) ([]*x509.Certificate, error) {
+	var (
+		certs []*x509.Certificate
+		now   = time.Now()
+	)
+	for _, path := range paths {
+		cas, err := loadRootCAs(path, logger)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkRootCAs(cas, path, now, opts); err != nil {
+			return nil, err
+		}
+		certs = append(certs, cas...)
+	}
+	return certs, nil
+}
+
+// checkRootCAs checks that cas, from path, are fit to distribute, as far
+// as opts ask for.
+func checkRootCAs(cas []*x509.Certificate, path string, now time.Time, opts peerOptions) error {
+	for _, cert := range cas {
+		if now.After(cert.NotAfter) && !opts.allowExpiredCA {
+			return fmt.Errorf("%s: %s expired %v ago, at %v (see -allow-expired-ca)", path, cert.Subject.CommonName, now.Sub(cert.NotAfter), cert.NotAfter)
+		}
+		if err := validateRootCA(cert, now, opts.allowExpiredCA); err != nil && !opts.skipCAValidation {
+			return fmt.Errorf("%s: %s: %v (see -skip-ca-validation)", path, cert.Subject.CommonName, err)
+		}
+	}
+	return nil
+}
+
+// newRootCAPublicKeys sorts certs into root CAs, which nothing else in
+// certs issued, each carrying the chain of intermediates issued under it.
+func newRootCAPublicKeys(certs []*x509.Certificate, generation uint64, origin mesh.PeerName) []*RootCAPublicKey {
+	var roots, rest []*x509.Certificate
+	for _, cert := range certs {
+		if issuedByAny(cert, certs) {
+			rest = append(rest, cert)
+		} else {
+			roots = append(roots, cert)
+		}
+	}
+
+	var cas []*RootCAPublicKey
+	for _, root := range roots {
+		ca := newRootCAPublicKey(root, generation, origin)
+		chain := []*x509.Certificate{root}
+		for grown := true; grown; {
+			grown = false
+			for i := 0; i < len(rest); i++ {
+				if !issuedByAny(rest[i], chain) {
+					continue
+				}
+				chain = append(chain, rest[i])
+				ca.Chain = append(ca.Chain, rest[i].Raw)
+				rest = append(rest[:i], rest[i+1:]...)
+				i--
+				grown = true
+			}
+		}
+		cas = append(cas, ca)
+	}
+	// Whatever is left issued itself in a loop, so take it as it is.
+	for _, cert := range rest {
+		cas = append(cas, newRootCAPublicKey(cert, generation, origin))
+	}
+	return cas
+}
+
+func issuedByAny(cert *x509.Certificate, parents []*x509.Certificate) bool {
+	for _, parent := range parents {
+		if parent != cert && bytes.Equal(cert.RawIssuer, parent.RawSubject) && cert.CheckSignatureFrom(parent) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRootCA checks that cert is fit to be distributed as a root CA:
+// it must be a CA, be allowed to sign certificates, and be valid at now,
+// although expired certificates are let through if allowExpired is set.
+func validateRootCA(cert *x509.Certificate, now time.Time, allowExpired bool) error {
+	if !cert.BasicConstraintsValid || !cert.IsCA {
+		return errors.New("not a CA certificate")
+	}
+	if cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return errors.New("key usage does not include certificate signing")
+	}
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("not valid before %v", cert.NotBefore)
+	}
+	if now.After(cert.NotAfter) && !allowExpired {
+		return fmt.Errorf("expired %v ago, at %v", now.Sub(cert.NotAfter), cert.NotAfter)
+	}
+	return nil
+}
+
+// validateRootCAPublicKey is validateRootCA for gossiped certificates.
+// The gossiped fields must match the certificate, a self-issued root must
+// really be self-signed, and each certificate in the chain must have been
+// issued by the root, or by one before it.
+func validateRootCAPublicKey(ca *RootCAPublicKey, now time.Time, allowExpired bool) error {
+	cert, err := x509.ParseCertificate(ca.Bytes)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(ca.Signature, cert.Signature) {
+		return errors.New("signature doesn't match the certificate")
+	}
+	if bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		if err := cert.CheckSignatureFrom(cert); err != nil {
+			return fmt.Errorf("%s is not self-signed: %v", cert.Subject.CommonName, err)
+		}
+	}
+	if err := validateRootCA(cert, now, allowExpired); err != nil {
+		return err
+	}
+	chain := []*x509.Certificate{cert}
+	for i, der := range ca.Chain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("chain[%d]: %v", i, err)
+		}
+		if !issuedByAny(cert, chain) {
+			return fmt.Errorf("chain[%d]: %s was not issued by the certificates before it", i, cert.Subject.CommonName)
+		}
+		if err := validateRootCA(cert, now, allowExpired); err != nil {
+			return fmt.Errorf("chain[%d]: %v", i, err)
+		}
+		chain = append(chain, cert)
+	}
+	return nil
+}
+
+// spkiHash is the SHA-256 of cert's SubjectPublicKeyInfo, as used by
+// kubeadm's --discovery-token-ca-cert-hash.
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// parseCAHash checks that s is a "sha256:<hex>" public key hash,
+// and returns it in canonical form.
+func parseCAHash(s string) (string, error) {
+	s = strings.ToLower(s)
+	if !strings.HasPrefix(s, "sha256:") {
+		return "", fmt.Errorf("%q: must be of the form sha256:<hex>", s)
+	}
+	if b, err := hex.DecodeString(strings.TrimPrefix(s, "sha256:")); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("%q: not a SHA-256 hash", s)
+	}
+	return s, nil
+}
+
+// checkCAHash checks that ca's public key is one of pins.
+func checkCAHash(ca *RootCAPublicKey, pins map[string]struct{}) error {
+	cert, err := x509.ParseCertificate(ca.Bytes)
+	if err != nil {
+		return err
+	}
+	hash := spkiHash(cert)
+	if _, ok := pins[hash]; !ok {
+		return fmt.Errorf("public key hash %s is not pinned by -ca-hash", hash)
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestCert returns a self-signed certificate built from template,
+// filling in whatever the test didn't care about.
+func newTestCert(t *testing.T, template x509.Certificate) *x509.Certificate {
+	cert, _ := newTestCertSignedBy(t, template, nil, nil)
+	return cert
+}
+
+// newTestCertSignedBy is newTestCert, but issued by parent, if not nil.
+func newTestCertSignedBy(t *testing.T, template x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if template.SerialNumber == nil {
+		template.SerialNumber = big.NewInt(1)
+	}
+	if template.Subject.CommonName == "" {
+		template.Subject = pkix.Name{CommonName: "test-ca"}
+	}
+	if template.NotBefore.IsZero() {
+		template.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if template.NotAfter.IsZero() {
+		template.NotAfter = time.Now().Add(time.Hour)
+	}
+	if parent == nil {
+		parent, parentKey = &template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+var testCATemplate = x509.Certificate{
+	BasicConstraintsValid: true,
+	IsCA:                  true,
+	KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+}
+
+func TestValidateRootCA(t *testing.T) {
+	now := time.Now()
+	leaf := testCATemplate
+	leaf.IsCA = false
+	noCertSign := testCATemplate
+	noCertSign.KeyUsage = x509.KeyUsageDigitalSignature
+	expired := testCATemplate
+	expired.NotBefore, expired.NotAfter = now.Add(-2*time.Hour), now.Add(-time.Hour)
+	notYetValid := testCATemplate
+	notYetValid.NotBefore, notYetValid.NotAfter = now.Add(time.Hour), now.Add(2*time.Hour)
+
+	for _, testcase := range []struct {
+		name         string
+		template     x509.Certificate
+		allowExpired bool
+		valid        bool
+	}{
+		{"CA", testCATemplate, false, true},
+		{"leaf", leaf, false, false},
+		{"no cert sign", noCertSign, false, false},
+		{"expired", expired, false, false},
+		{"expired but allowed", expired, true, true},
+		{"not yet valid", notYetValid, true, false},
+	} {
+		err := validateRootCA(newTestCert(t, testcase.template), now, testcase.allowExpired)
+		if want, have := testcase.valid, err == nil; want != have {
+			t.Errorf("%s: want valid=%v, have %v", testcase.name, want, err)
+		}
+	}
+}
+
+func TestLoadRootCAs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet-mesh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	der := newTestCert(t, testCATemplate).Raw
+	var (
+		certA = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: newTestCert(t, testCATemplate).Raw})
+		certB = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: newTestCert(t, testCATemplate).Raw})
+		key   = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("not really")})
+	)
+	for _, testcase := range []struct {
+		name     string
+		contents []byte // nil means don't create the file
+		want     int
+		wantErr  bool
+	}{
+		{"missing", nil, 0, true},
+		{"empty", []byte{}, 0, true},
+		{"not PEM", []byte("hello, world\n"), 0, true},
+		{"key only", key, 0, true},
+		{"bad certificate", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("garbage")}), 0, true},
+		{"one", certA, 1, false},
+		{"bundle", bytes.Join([][]byte{certA, key, certB}, nil), 2, false},
+		{"DER", der, 1, false},
+		{"truncated DER", der[:len(der)/2], 0, true},
+	} {
+		path := filepath.Join(dir, testcase.name)
+		if testcase.contents != nil {
+			if err := ioutil.WriteFile(path, testcase.contents, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		certs, err := loadRootCAs(path, newTextLogger(ioutil.Discard, "", 0))
+		if want, have := testcase.wantErr, err != nil; want != have {
+			t.Errorf("%s: want error=%v, have %v", testcase.name, want, err)
+			continue
+		}
+		if want, have := testcase.want, len(certs); want != have {
+			t.Errorf("%s: want %d certificates, have %d", testcase.name, want, have)
+		}
+	}
+}
+
+func TestParseCAHash(t *testing.T) {
+	valid := "sha256:" + strings.Repeat("ab", 32)
+	for _, testcase := range []struct {
+		in, want string
+		valid    bool
+	}{
+		{valid, valid, true},
+		{strings.ToUpper(valid), valid, true},
+		{strings.Repeat("ab", 32), "", false},
+		{"sha1:" + strings.Repeat("ab", 20), "", false},
+		{"sha256:abcd", "", false},
+		{"sha256:" + strings.Repeat("zz", 32), "", false},
+	} {
+		have, err := parseCAHash(testcase.in)
+		if want := testcase.valid; want != (err == nil) {
+			t.Errorf("%q: want valid=%v, have %v", testcase.in, want, err)
+		}
+		if want := testcase.want; want != have {
+			t.Errorf("%q: want %q, have %q", testcase.in, want, have)
+		}
+	}
+}
+
+func TestNewRootCAPublicKeysChains(t *testing.T) {
+	named := func(name string) x509.Certificate {
+		template := testCATemplate
+		template.Subject = pkix.Name{CommonName: name}
+		return template
+	}
+	root, rootKey := newTestCertSignedBy(t, named("root"), nil, nil)
+	intermediate, intermediateKey := newTestCertSignedBy(t, named("intermediate"), root, rootKey)
+	issuing, _ := newTestCertSignedBy(t, named("issuing"), intermediate, intermediateKey)
+	other := newTestCert(t, named("other"))
+
+	// Chain files usually list children first; we want parents first.
+	cas := newRootCAPublicKeys([]*x509.Certificate{issuing, intermediate, root, other}, 0, 999)
+	if want, have := 2, len(cas); want != have {
+		t.Fatalf("want %d root CAs, have %d", want, have)
+	}
+	if want, have := [][]byte{intermediate.Raw, issuing.Raw}, cas[0].Chain; !reflect.DeepEqual(want, have) {
+		t.Errorf("root chain: want %d intermediates in issuing order, have %d", len(want), len(have))
+	}
+	if want, have := 0, len(cas[1].Chain); want != have {
+		t.Errorf("other chain: want %d intermediates, have %d", want, have)
+	}
+	if err := validateRootCAPublicKey(cas[0], time.Now(), false); err != nil {
+		t.Errorf("validate chain: %v", err)
+	}
+
+	// A root must not be able to take on intermediates it didn't issue.
+	mixed := *cas[1]
+	mixed.Chain = cas[0].Chain
+	if err := validateRootCAPublicKey(&mixed, time.Now(), false); err == nil {
+		t.Errorf("validate mixed chain: want error, have none")
+	}
+}
+
+func TestValidateRootCAPublicKey(t *testing.T) {
+	now := time.Now()
+	cert := newTestCert(t, testCATemplate)
+	other, otherKey := newTestCertSignedBy(t, testCATemplate, nil, nil)
+
+	forged := newRootCAPublicKey(cert, 0, 999)
+	forged.Signature = other.Signature
+
+	truncated := newRootCAPublicKey(cert, 0, 999)
+	truncated.Bytes = truncated.Bytes[:len(truncated.Bytes)/2]
+
+	// Same subject as cert, but signed by another key.
+	resigned, _ := newTestCertSignedBy(t, testCATemplate, other, otherKey)
+
+	for _, testcase := range []struct {
+		name  string
+		ca    *RootCAPublicKey
+		valid bool
+	}{
+		{"valid", newRootCAPublicKey(cert, 0, 999), true},
+		{"forged signature field", forged, false},
+		{"truncated", truncated, false},
+		{"not self-signed", newRootCAPublicKey(resigned, 0, 999), false},
+	} {
+		err := validateRootCAPublicKey(testcase.ca, now, false)
+		if want, have := testcase.valid, err == nil; want != have {
+			t.Errorf("%s: want valid=%v, have %v", testcase.name, want, err)
+		}
+	}
+}
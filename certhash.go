@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// fetchServingCertHash connects to rawurl and returns the spkiHash of
+// the serving certificate it presents, which must verify against roots
+// for rawurl's host: without any, it could be anyone's.
+func fetchServingCertHash(rawurl string, roots []*RootCAPublicKey, timeout time.Duration) (string, error) {
+	if len(roots) == 0 {
+		return "", errors.New("no root CA to verify the serving certificate against")
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	host, port, err := apiserverHostPort(rawurl)
+	if err != nil {
+		return "", err
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", net.JoinHostPort(host, port), &tls.Config{
+		// We verify below, against the roots we have.
+		InsecureSkipVerify: true,
+		ServerName:         u.Hostname(),
+	})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return "", errors.New("no serving certificate")
+	}
+	opts := x509.VerifyOptions{DNSName: u.Hostname(), Roots: x509.NewCertPool(), Intermediates: x509.NewCertPool()}
+	for _, ca := range roots {
+		if cert, err := x509.ParseCertificate(ca.Bytes); err == nil {
+			opts.Roots.AddCert(cert)
+		}
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return "", err
+	}
+	return spkiHash(certs[0]), nil
+}
+
+// servingCertHashes is the serving certificate hashes the unexpired
+// leases give each URL. There may be several, from seeds behind a load
+// balancer, or mid-renewal.
+func servingCertHashes(leases []*APIServerLease, now time.Time) map[string][]string {
+	seen := map[string]map[string]bool{}
+	for _, l := range leases {
+		if l.expired(now) || l.ServingCertHash == "" {
+			continue
+		}
+		u := normalizeAPIServerURL(l.URL)
+		if seen[u] == nil {
+			seen[u] = map[string]bool{}
+		}
+		seen[u][l.ServingCertHash] = true
+	}
+	hashes := map[string][]string{}
+	for u, hs := range seen {
+		for h := range hs {
+			hashes[u] = append(hashes[u], h)
+		}
+		sort.Strings(hashes[u])
+	}
+	return hashes
+}
+
+// fetchServingCerts fetches the serving certificate hash of each
+// apiserver we advertise every interval, so that renewals propagate.
+func (p *peer) fetchServingCerts(interval, timeout time.Duration, fetch func(rawurl string, roots []*RootCAPublicKey, timeout time.Duration) (string, error), quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.fetchServingCertRound(timeout, fetch, time.Now())
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+	}
+}
+
+// fetchServingCertRound fetches them once, and if any changed, renews
+// our leases with them and tells our peers. Until we know a root CA
+// there is nothing to verify them against, so nothing to fetch.
+func (p *peer) fetchServingCertRound(timeout time.Duration, fetch func(rawurl string, roots []*RootCAPublicKey, timeout time.Duration) (string, error), now time.Time) {
+	p.st.mtx.RLock()
+	urls, roots := p.st.advertised, p.st.trustedRootCAs()
+	p.st.mtx.RUnlock()
+	if len(roots) == 0 {
+		p.logger.Debugf("No root CA yet to verify apiserver serving certificates against")
+		return
+	}
+	hashes := map[string]string{}
+	for _, u := range urls {
+		hash, err := fetch(u, roots, timeout)
+		if err != nil {
+			// Keep gossiping what we last saw; the probes will tell
+			// whether it's down.
+			p.logger.Warnf("Fetching the serving certificate of apiserver %s: %v", u, err)
+			continue
+		}
+		hashes[u] = hash
+	}
+	if !p.st.setServingCertHashes(hashes) {
+		return
+	}
+	for u, hash := range hashes {
+		p.logger.Infof("Apiserver %s serves a certificate with public key %s", u, hash)
+	}
+	p.st.refresh(now)
+	p.broadcast()
+}
+
+// setServingCertHashes records hashes, by URL, for our leases, and
+// reports whether any changed.
+func (st *state) setServingCertHashes(hashes map[string]string) (changed bool) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	if st.servingCertHashes == nil {
+		st.servingCertHashes = map[string]string{}
+	}
+	for u, hash := range hashes {
+		if st.servingCertHashes[u] != hash {
+			st.servingCertHashes[u] = hash
+			changed = true
+		}
+	}
+	return changed
+}
+
+func containsString(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+func TestFetchServingCertHash(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	want := spkiHash(server.Certificate())
+	roots := []*RootCAPublicKey{newRootCAPublicKey(server.Certificate(), 0, 0)}
+	untrusted := []*RootCAPublicKey{newRootCAPublicKey(newTestCert(t, testCATemplate), 0, 0)}
+	for _, testcase := range []struct {
+		name  string
+		roots []*RootCAPublicKey
+		ok    bool
+	}{
+		{"trusted", roots, true},
+		// Before we know any root CA, it could be anyone's.
+		{"no roots", nil, false},
+		{"untrusted", untrusted, false},
+	} {
+		have, err := fetchServingCertHash(server.URL, testcase.roots, time.Second)
+		switch {
+		case testcase.ok && (err != nil || have != want):
+			t.Errorf("%s: want %s, have %q, %v", testcase.name, want, have, err)
+		case !testcase.ok && err == nil:
+			t.Errorf("%s: want an error, have %s", testcase.name, have)
+		}
+	}
+}
+
+func TestServingCertHashes(t *testing.T) {
+	now := time.Now()
+	leases := []*APIServerLease{
+		{URL: "https://a:6443", Peer: 1, Refreshed: now, ServingCertHash: "sha256:bb"},
+		{URL: "https://a:6443", Peer: 2, Refreshed: now, ServingCertHash: "sha256:aa"},
+		{URL: "https://a:6443", Peer: 3, Refreshed: now, ServingCertHash: "sha256:aa"},
+		{URL: "https://b:6443", Peer: 1, Refreshed: now},
+		{URL: "https://c:6443", Peer: 1, Refreshed: now.Add(-2 * time.Hour), TTL: time.Hour, ServingCertHash: "sha256:cc"},
+	}
+	want := map[string][]string{"https://a:6443": {"sha256:aa", "sha256:bb"}}
+	if have := servingCertHashes(leases, now); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestPeerGossipsServingCertHashes(t *testing.T) {
+	logger := newTextLogger(ioutil.Discard, "", 0)
+	hashes := map[string]string{"https://a:6443": "sha256:aa"}
+	fetch := func(rawurl string, _ []*RootCAPublicKey, _ time.Duration) (string, error) {
+		if hash, ok := hashes[rawurl]; ok {
+			return hash, nil
+		}
+		return "", errors.New("refused")
+	}
+	now := time.Now()
+	// Without a root CA, none are fetched, to be gossiped.
+	unrooted := newNodeBootstrapPeer(mesh.PeerName(1), "seed", nil, []string{"https://a:6443"}, peerOptions{skipCAValidation: true}, logger)
+	unrooted.fetchServingCertRound(time.Second, fetch, now)
+	if have := unrooted.snapshot().ApiserverCertHashes; len(have) > 0 {
+		t.Errorf("without a root CA: want no hashes, have %v", have)
+	}
+
+	seed := newNodeBootstrapPeer(mesh.PeerName(1), "seed", []*RootCAPublicKey{caA}, []string{"https://a:6443", "https://b:6443"}, peerOptions{skipCAValidation: true}, logger)
+	seed.fetchServingCertRound(time.Second, fetch, now)
+	var logs bytes.Buffer
+	p := newNodeBootstrapPeer(mesh.PeerName(2), "test", nil, nil, peerOptions{skipCAValidation: true}, newTextLogger(&logs, "", 0))
+	p.st.mergeComplete(seed.st.copy().set)
+	if want, have := map[string][]string{"https://a:6443": {"sha256:aa"}}, p.snapshot().ApiserverCertHashes; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	// A renewal propagates with the next round.
+	hashes["https://a:6443"] = "sha256:a2"
+	seed.fetchServingCertRound(time.Second, fetch, now.Add(time.Minute))
+	p.st.mergeComplete(seed.st.copy().set)
+	if want, have := map[string][]string{"https://a:6443": {"sha256:a2"}}, p.snapshot().ApiserverCertHashes; !reflect.DeepEqual(want, have) {
+		t.Errorf("after a renewal: want %v, have %v", want, have)
+	}
+
+	// A probe that sees another certificate is worth a warning.
+	cfg := probeConfig{probe: func(rawurl string, _ []*RootCAPublicKey, _ time.Duration) (string, error) {
+		return "sha256:evil", nil
+	}}
+	p.probeRound(cfg, 0, time.Now())
+	if !strings.Contains(logs.String(), "https://a:6443 served a certificate with public key sha256:evil, but its seeds gossip sha256:a2") {
+		t.Errorf("want a warning about the mismatch, have\n%s", logs.String())
+	}
+	if strings.Contains(logs.String(), "https://b:6443 served") {
+		t.Errorf("want no warning where no hash is gossiped, have\n%s", logs.String())
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/weaveworks/mesh"
+)
+
+// nodeBootstrapChannelV1 is the gossip channel for ClusterInfo in the
+// current wire format, compressed over -compress-over. Peers from before
+// it only gossip on nodeBootstrapChannel, v0, so while -channel-compat
+// is set we gossip there too, in the format of -wire-version and never
+// compressed, as those peers expect. Changes that v0 peers would
+// misread can then go on v1 alone.
+const nodeBootstrapChannelV1 = "kubernetes-node-bootstrap-v1"
+
+// gossipChannel is one of the channels a peer gossips ClusterInfo on,
+// and how it encodes it there.
+type gossipChannel struct {
+	name         string
+	wireVersion  byte // 0 for the current one
+	compressOver int
+	send         mesh.Gossip // owned by the peer's actions loop
+
+	mtx  sync.Mutex
+	seen map[mesh.PeerName]struct{} // peers we have heard from on it
+}
+
+func newGossipChannel(name string, wireVersion byte, compressOver int) *gossipChannel {
+	return &gossipChannel{
+		name:         name,
+		wireVersion:  wireVersion,
+		compressOver: compressOver,
+		seen:         map[mesh.PeerName]struct{}{},
+	}
+}
+
+// encoding makes d, if it is ours and not nil, encode for ch, sealed
+// for ch by s if s isn't nil.
+func (ch *gossipChannel) encoding(d mesh.GossipData, s *sealer) mesh.GossipData {
+	if st, ok := d.(*state); ok && st != nil {
+		st.sealer, st.wireVersion, st.compressOver = s.forChannel(ch.name), ch.wireVersion, ch.compressOver
+	}
+	return d
+}
+
+// saw notes that we heard from src on ch.
+func (ch *gossipChannel) saw(src mesh.PeerName) {
+	ch.mtx.Lock()
+	defer ch.mtx.Unlock()
+	ch.seen[src] = struct{}{}
+}
+
+func (ch *gossipChannel) hasSeen(src mesh.PeerName) bool {
+	ch.mtx.Lock()
+	defer ch.mtx.Unlock()
+	_, ok := ch.seen[src]
+	return ok
+}
+
+// channelView is a gossip channel, for /state and the status summary:
+// how many peers we have heard from on it since we started, and how
+// many of those on no other channel of ours.
+type channelView struct {
+	Name  string `json:"name"`
+	Peers int    `json:"peers"`
+	Only  int    `json:"only"`
+}
+
+func (v channelView) String() string {
+	return fmt.Sprintf("%s from %d peer(s), %d only there", v.Name, v.Peers, v.Only)
+}
+
+// channelViews is a view of each of channels.
+func channelViews(channels []*gossipChannel) []channelView {
+	seen := make([]map[mesh.PeerName]struct{}, len(channels))
+	for i, ch := range channels {
+		ch.mtx.Lock()
+		seen[i] = make(map[mesh.PeerName]struct{}, len(ch.seen))
+		for src := range ch.seen {
+			seen[i][src] = struct{}{}
+		}
+		ch.mtx.Unlock()
+	}
+	views := make([]channelView, len(channels))
+	for i, ch := range channels {
+		views[i] = channelView{Name: ch.name, Peers: len(seen[i])}
+		for src := range seen[i] {
+			only := true
+			for j := range channels {
+				if _, ok := seen[j][src]; ok && j != i {
+					only = false
+				}
+			}
+			if only {
+				views[i].Only++
+			}
+		}
+	}
+	sort.SliceStable(views, func(i, j int) bool { return views[i].Name < views[j].Name })
+	return views
+}
+
+// channelGossiper is the mesh.Gossiper for one of a peer's channels
+// after the first, which is the peer itself.
+type channelGossiper struct {
+	p  *peer
+	ch *gossipChannel
+}
+
+var _ mesh.Gossiper = channelGossiper{}
+
+func (g channelGossiper) Gossip() mesh.GossipData {
+	return g.p.gossip(g.ch)
+}
+
+func (g channelGossiper) OnGossip(buf []byte) (mesh.GossipData, error) {
+	return g.p.onGossip(g.ch, buf)
+}
+
+func (g channelGossiper) OnGossipBroadcast(src mesh.PeerName, buf []byte) (mesh.GossipData, error) {
+	return g.p.onGossipBroadcast(g.ch, src, buf)
+}
+
+func (g channelGossiper) OnGossipUnicast(src mesh.PeerName, buf []byte) error {
+	return g.p.onGossipUnicast(g.ch, src, buf)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/weaveworks/mesh"
+)
+
+// recordingGossip records what a peer sends on one channel.
+type recordingGossip struct {
+	mtx        sync.Mutex
+	broadcasts [][]byte
+	unicasts   map[mesh.PeerName][][]byte
+}
+
+func (g *recordingGossip) GossipUnicast(dst mesh.PeerName, msg []byte) error {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if g.unicasts == nil {
+		g.unicasts = map[mesh.PeerName][][]byte{}
+	}
+	g.unicasts[dst] = append(g.unicasts[dst], msg)
+	return nil
+}
+
+func (g *recordingGossip) GossipBroadcast(update mesh.GossipData) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.broadcasts = append(g.broadcasts, update.Encode()...)
+}
+
+func (g *recordingGossip) sent() (broadcasts [][]byte, unicasts map[mesh.PeerName][][]byte) {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	return g.broadcasts, g.unicasts
+}
+
+// unicastGossip delivers unicasts from one gossiper to another.
+type unicastGossip struct {
+	self  mesh.PeerName
+	peers map[mesh.PeerName]mesh.Gossiper
+}
+
+func (g *unicastGossip) GossipUnicast(dst mesh.PeerName, msg []byte) error {
+	p, ok := g.peers[dst]
+	if !ok {
+		return errors.New("no route")
+	}
+	return p.OnGossipUnicast(g.self, msg)
+}
+
+func (g *unicastGossip) GossipBroadcast(mesh.GossipData) {}
+
+func TestChannelViews(t *testing.T) {
+	v1, v0 := newGossipChannel(nodeBootstrapChannelV1, 0, 0), newGossipChannel(nodeBootstrapChannel, 0, 0)
+	for _, src := range []mesh.PeerName{1, 2, 3} {
+		v1.saw(src)
+	}
+	for _, src := range []mesh.PeerName{3, 4, 5} {
+		v0.saw(src)
+	}
+	want := []channelView{
+		{Name: nodeBootstrapChannel, Peers: 3, Only: 2},
+		{Name: nodeBootstrapChannelV1, Peers: 3, Only: 2},
+	}
+	if have := channelViews([]*gossipChannel{v1, v0}); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+	want = []channelView{{Name: nodeBootstrapChannelV1, Peers: 3, Only: 3}}
+	if have := channelViews([]*gossipChannel{v1}); !reflect.DeepEqual(want, have) {
+		t.Errorf("v1 alone: want %+v, have %+v", want, have)
+	}
+}
+
+func TestPeerGossipsOnBothChannels(t *testing.T) {
+	p := newNodeBootstrapPeer(mesh.PeerName(1), "test", []*RootCAPublicKey{caA}, []string{"https://a:6443"}, peerOptions{
+		skipCAValidation: true,
+		channelCompat:    true,
+		wireVersion:      legacyWireVersion,
+		compressOver:     1,
+	}, newTextLogger(ioutil.Discard, "", 0))
+	defer p.stop()
+	if len(p.channels) != 2 || p.channels[0].name != nodeBootstrapChannelV1 || p.channels[1].name != nodeBootstrapChannel {
+		t.Fatalf("want v1 then v0, have %+v", p.channels)
+	}
+	v1, v0 := &recordingGossip{}, &recordingGossip{}
+	p.register(v1)
+	p.registerOn(p.channels[1], v0)
+
+	// v1 in the current format, compressed; v0 as -wire-version says,
+	// and never compressed, for the peers from before either.
+	check := func(what string, v1buf, v0buf []byte) {
+		if want := byte(wireVersion | compressedWire); v1buf[0] != want {
+			t.Errorf("%s on v1: want version byte %#x, have %#x", what, want, v1buf[0])
+		}
+		if want := byte(legacyWireVersion); v0buf[0] != want {
+			t.Errorf("%s on v0: want version byte %#x, have %#x", what, want, v0buf[0])
+		}
+		for _, buf := range [][]byte{v1buf, v0buf} {
+			if set, err := decodeClusterInfo(buf, nil); err != nil || !reflect.DeepEqual(set.ApiserverURLs, []string{"https://a:6443"}) {
+				t.Errorf("%s: want our state, have %+v, %v", what, set, err)
+			}
+		}
+	}
+	check("gossip", p.Gossip().Encode()[0], channelGossiper{p, p.channels[1]}.Gossip().Encode()[0])
+
+	p.broadcastNow()
+	p.unicastComplete(2)
+	// The actions loop runs one at a time, so once it runs this, it
+	// has sent those.
+	done := make(chan struct{})
+	p.actions <- func() { close(done) }
+	<-done
+	v1broadcasts, v1unicasts := v1.sent()
+	v0broadcasts, v0unicasts := v0.sent()
+	if len(v1broadcasts) != 1 || len(v0broadcasts) != 1 {
+		t.Fatalf("want a broadcast on each channel, have %d on v1 and %d on v0", len(v1broadcasts), len(v0broadcasts))
+	}
+	check("broadcast", v1broadcasts[0], v0broadcasts[0])
+	// We have yet to hear peer 2 on v1, so it may be from before it.
+	if len(v1unicasts[2]) != 1 || len(v0unicasts[2]) != 1 {
+		t.Fatalf("want a full sync to peer 2 on each channel, have %d on v1 and %d on v0", len(v1unicasts[2]), len(v0unicasts[2]))
+	}
+	check("full sync", v1unicasts[2][0], v0unicasts[2][0])
+}
+
+func TestPeerPrefersV1(t *testing.T) {
+	p := newNodeBootstrapPeer(mesh.PeerName(1), "test", nil, nil, peerOptions{
+		skipCAValidation: true,
+		channelCompat:    true,
+	}, newTextLogger(ioutil.Discard, "", 0))
+	defer p.stop()
+	v0 := channelGossiper{p, p.channels[1]}
+	payload := func(urls ...string) []byte {
+		return encodeGossip(ClusterInfo{ApiserverURLs: urls}, nil)
+	}
+
+	// Peer 2 is from before v1: we hear it on v0 only, and merge that.
+	if _, err := v0.OnGossipBroadcast(2, payload("https://old:6443")); err != nil {
+		t.Fatal(err)
+	}
+	// Peer 3 gossips on both, so what it sends on v0 is passed on, for
+	// the likes of peer 2, but not merged.
+	if _, err := p.OnGossipBroadcast(3, payload("https://new:6443")); err != nil {
+		t.Fatal(err)
+	}
+	relayed, err := v0.OnGossipBroadcast(3, payload("https://stale:6443"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relayed == nil || relayed.Encode()[0][0] != wireVersion {
+		t.Errorf("want v0 from peer 3 relayed on v0, have %v", relayed)
+	}
+	if err := v0.OnGossipUnicast(3, payload("https://stale:6443")); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{"https://new:6443", "https://old:6443"}, p.snapshot().ApiserverURLs; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	want := []channelView{
+		{Name: nodeBootstrapChannel, Peers: 2, Only: 1},
+		{Name: nodeBootstrapChannelV1, Peers: 1, Only: 0},
+	}
+	if have := p.snapshot().Channels; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+}
+
+func TestPeerWithoutChannelCompat(t *testing.T) {
+	p := newNodeBootstrapPeer(mesh.PeerName(1), "test", nil, nil, peerOptions{}, newTextLogger(ioutil.Discard, "", 0))
+	defer p.stop()
+	if len(p.channels) != 1 || p.channels[0].name != nodeBootstrapChannelV1 {
+		t.Errorf("want v1 alone, have %+v", p.channels)
+	}
+	router, q, err := newPeerRouter(peerConfig{name: 2, mesh: mesh.Config{Host: "127.0.0.1", Port: mesh.Port}, opts: peerOptions{channelCompat: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.stop()
+	if router == nil || len(q.channels) != 2 {
+		t.Errorf("want both channels on the router, have %+v", q.channels)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// commands are the modes of the binary, picked by its first argument.
+// Without one, it runs a peer, as run does.
+var commands = []string{"run", "status"}
+
+// command splits the command off args, or "run" if args starts with a
+// flag or is empty.
+func command(args []string) (string, []string, error) {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return "run", args, nil
+	}
+	for _, c := range commands {
+		if args[0] == c {
+			return c, args[1:], nil
+		}
+	}
+	return "", nil, fmt.Errorf("unknown command %q, want one of %s", args[0], strings.Join(commands, ", "))
+}
+
+// statusCommand is kubelet-mesh status: it prints the /state of the
+// running peer at -http, indented.
+func statusCommand(args []string, stdout, stderr io.Writer) error {
+	fs := flag.NewFlagSet("kubelet-mesh status", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	base := fs.String("http", "http://localhost:6784", "URL of the peer's -http-listen; without a scheme, http://")
+	authFile := fs.String("http-basic-auth", "", "file with the <user>:<password> of the peer's -http-basic-auth (optional)")
+	timeout := fs.Duration("timeout", 5*time.Second, "how long to wait for the peer")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("status: unexpected argument %q", fs.Arg(0))
+	}
+	url := *base
+	if !strings.Contains(url, "://") {
+		url = "http://" + url
+	}
+	url = strings.TrimSuffix(url, "/") + "/state"
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("http: %v", err)
+	}
+	if *authFile != "" {
+		s, err := readPassword(*authFile)
+		if err != nil {
+			return fmt.Errorf("http-basic-auth: %v", err)
+		}
+		auth, err := parseBasicAuth(s)
+		if err != nil {
+			return fmt.Errorf("http-basic-auth: %s: %v", *authFile, err)
+		}
+		req.SetBasicAuth(auth.user, auth.password)
+	}
+	resp, err := (&http.Client{Timeout: *timeout}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("GET %s: %v", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s: %s", url, resp.Status, bytes.TrimSpace(body))
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, body, "", "  "); err != nil {
+		return fmt.Errorf("GET %s: %v", url, err)
+	}
+	out.WriteByte('\n')
+	_, err = stdout.Write(out.Bytes())
+	return err
+}
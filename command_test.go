@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/weaveworks/mesh"
+)
+
+func TestCommand(t *testing.T) {
+	for _, testcase := range []struct {
+		args []string
+		mode string
+		rest []string
+		ok   bool
+	}{
+		{nil, "run", nil, true},
+		{[]string{"-peer", "10.0.0.1"}, "run", []string{"-peer", "10.0.0.1"}, true},
+		{[]string{"run", "-peer", "10.0.0.1"}, "run", []string{"-peer", "10.0.0.1"}, true},
+		{[]string{"join", "-peer", "10.0.0.1"}, "", nil, false},
+		{[]string{"status"}, "status", []string{}, true},
+		{[]string{"stauts"}, "", nil, false},
+	} {
+		mode, rest, err := command(testcase.args)
+		if testcase.ok != (err == nil) {
+			t.Errorf("%v: want ok %v, have %v", testcase.args, testcase.ok, err)
+			continue
+		}
+		if mode != testcase.mode || !reflect.DeepEqual(rest, testcase.rest) {
+			t.Errorf("%v: want %q %v, have %q %v", testcase.args, testcase.mode, testcase.rest, mode, rest)
+		}
+	}
+}
+
+func TestStatusCommand(t *testing.T) {
+	p := newNodeBootstrapPeer(mesh.PeerName(1), "test", []*RootCAPublicKey{caA}, []string{"https://a:6443"}, peerOptions{skipCAValidation: true}, newTextLogger(ioutil.Discard, "", 0))
+	defer p.stop()
+	auth := basicAuth{user: "admin", password: "secret"}
+	server := httptest.NewServer(withBasicAuth(newStatusHandler(p, nil), auth))
+	defer server.Close()
+	dir, err := ioutil.TempDir("", "kubelet-mesh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	authFile := filepath.Join(dir, "auth")
+	if err := ioutil.WriteFile(authFile, []byte("admin:secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout bytes.Buffer
+	// Without a scheme, and with a trailing slash.
+	if err := statusCommand([]string{"-http", strings.TrimPrefix(server.URL, "http://") + "/", "-http-basic-auth", authFile}, &stdout, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	var have stateSnapshot
+	if err := json.Unmarshal(stdout.Bytes(), &have); err != nil {
+		t.Fatalf("%v in\n%s", err, stdout.String())
+	}
+	if want := []string{"https://a:6443"}; !reflect.DeepEqual(want, have.ApiserverURLs) {
+		t.Errorf("want apiservers %v, have %v", want, have.ApiserverURLs)
+	}
+	if !strings.Contains(stdout.String(), "\n  \"") {
+		t.Errorf("want it indented, have\n%s", stdout.String())
+	}
+
+	for _, testcase := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-http", server.URL}, "401 Unauthorized: unauthorized"},
+		{[]string{"-http", server.URL, "extra"}, `unexpected argument "extra"`},
+		{[]string{"-http", server.URL, "-http-basic-auth", filepath.Join(dir, "missing")}, "http-basic-auth: "},
+	} {
+		if err := statusCommand(testcase.args, ioutil.Discard, ioutil.Discard); err == nil || !strings.Contains(err.Error(), testcase.want) {
+			t.Errorf("%v: want an error with %q, have %v", testcase.args, testcase.want, err)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// parse parses args into fs, as registered by cfg.register, and then the
+// -config file, if there is one.
+func (cfg *Config) parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if cfg.configFile == "" {
+		return nil
+	}
+	return loadConfigFile(fs, cfg.configFile)
+}
+
+// loadConfigFile sets the flags of fs that the -config file at path sets
+// and the command line doesn't: the command line wins, and for a flag
+// that may be repeated, its values replace the file's list rather than
+// add to it. A key that is no flag of fs is an error, so that a typo
+// can't silently leave the default in place.
+func loadConfigFile(fs *flag.FlagSet, path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	settings, err := parseConfigFile(buf)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	// By value rather than name, so that setting a flag on the command
+	// line also wins over its aliases in the file.
+	onCommandLine := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { onCommandLine[flagValueID(f)] = true })
+	for _, s := range settings {
+		f := fs.Lookup(s.key)
+		switch {
+		case f == nil:
+			return fmt.Errorf("%s: line %d: no flag -%s%s", path, s.line, s.key, didYouMean(fs, s.key))
+		case flagValueID(f) == flagValueID(fs.Lookup("config")):
+			return fmt.Errorf("%s: line %d: -%s only works on the command line", path, s.line, s.key)
+		case onCommandLine[flagValueID(f)]:
+			continue
+		}
+		for _, v := range s.values {
+			if err := fs.Set(s.key, v); err != nil {
+				return fmt.Errorf("%s: line %d: -%s: %v", path, s.line, s.key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// flagValueID is the same for f and its aliases, which share a Value.
+func flagValueID(f *flag.Flag) string {
+	switch v := reflect.ValueOf(f.Value); v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice:
+		return fmt.Sprintf("%T@%x", f.Value, v.Pointer())
+	}
+	return f.Name
+}
+
+// didYouMean suggests the flag of fs that name is most likely a typo of.
+func didYouMean(fs *flag.FlagSet, name string) string {
+	best, bestDistance := "", 3
+	fs.VisitAll(func(f *flag.Flag) {
+		if d := editDistance(name, f.Name); d < bestDistance {
+			best, bestDistance = f.Name, d
+		}
+	})
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (did you mean -%s?)", best)
+}
+
+// editDistance is the Levenshtein distance from a to b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cur[j] = prev[j-1]
+			if a[i-1] != b[j-1] {
+				cur[j]++
+			}
+			if d := prev[j] + 1; d < cur[j] {
+				cur[j] = d
+			}
+			if d := cur[j-1] + 1; d < cur[j] {
+				cur[j] = d
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// configSetting is one key of a -config file, with a value for a scalar,
+// and any number for a list.
+type configSetting struct {
+	key    string
+	values []string
+	line   int
+}
+
+// parseConfigFile parses the YAML of a -config file: a mapping from flag
+// names, without the dash, to a scalar, or for a flag that may be
+// repeated, to a list, in flow ([a, b]) or block style. That is all the
+// YAML it understands; anything else, such as nested mappings, anchors
+// or multi-line strings, is an error rather than a guess.
+func parseConfigFile(buf []byte) ([]configSetting, error) {
+	var (
+		settings []configSetting
+		seen     = map[string]int{}
+		list     *configSetting // the setting whose block list this is, if any
+	)
+	// endList makes sure a key that started a block list got items.
+	endList := func() error {
+		if list != nil && len(list.values) == 0 {
+			return fmt.Errorf("line %d: no value for %s", list.line, list.key)
+		}
+		list = nil
+		return nil
+	}
+	for i, line := range strings.Split(string(buf), "\n") {
+		n := i + 1
+		line = strings.TrimRight(stripConfigComment(strings.TrimSuffix(line, "\r")), " \t")
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed == "" || (trimmed == "---" && len(settings) == 0) {
+			continue
+		}
+		if strings.ContainsRune(line[:len(line)-len(trimmed)], '\t') {
+			return nil, fmt.Errorf("line %d: tabs can't indent YAML", n)
+		}
+		if trimmed == "-" || strings.HasPrefix(trimmed, "- ") {
+			if list == nil {
+				return nil, fmt.Errorf("line %d: a list item, but not under a flag", n)
+			}
+			v, err := parseConfigScalar(strings.TrimSpace(trimmed[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			list.values = append(list.values, v)
+			continue
+		}
+		if len(trimmed) < len(line) {
+			return nil, fmt.Errorf("line %d: unexpected indentation; flags go at the top level", n)
+		}
+		if err := endList(); err != nil {
+			return nil, err
+		}
+		colon := strings.Index(line, ":")
+		if colon < 0 || (colon+1 < len(line) && line[colon+1] != ' ') {
+			return nil, fmt.Errorf("line %d: want flag: value", n)
+		}
+		key, rest := line[:colon], strings.TrimSpace(line[colon+1:])
+		if key == "" || strings.ContainsAny(key, " \"'") {
+			return nil, fmt.Errorf("line %d: %q is no flag name", n, key)
+		}
+		if prev, ok := seen[key]; ok {
+			return nil, fmt.Errorf("line %d: %s is already set on line %d", n, key, prev)
+		}
+		seen[key] = n
+		s := configSetting{key: key, line: n}
+		switch {
+		case rest == "":
+			// A block list, we hope.
+		case strings.HasPrefix(rest, "["):
+			values, err := parseConfigFlowList(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			s.values = values
+		default:
+			v, err := parseConfigScalar(rest)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n, err)
+			}
+			s.values = []string{v}
+		}
+		settings = append(settings, s)
+		if rest == "" {
+			list = &settings[len(settings)-1]
+		}
+	}
+	if err := endList(); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// stripConfigComment cuts a # comment from the end of line: a # that
+// starts the line or follows a space, outside quotes.
+func stripConfigComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote == '"' && c == '\\', quote == '\'' && c == '\'' && i+1 < len(line) && line[i+1] == '\'':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && startsConfigScalar(line[:i]):
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// startsConfigScalar reports whether what follows before starts a
+// scalar, so that a quote there opens a quoted string, rather than being
+// part of a plain one, as in it's.
+func startsConfigScalar(before string) bool {
+	before = strings.TrimRight(before, " \t")
+	return before == "" || strings.ContainsRune(":-[,", rune(before[len(before)-1]))
+}
+
+// parseConfigScalar is the string a YAML scalar is: plain, or in single
+// or double quotes, which plain can't start with what YAML would read as
+// something else.
+func parseConfigScalar(s string) (string, error) {
+	switch {
+	case s == "":
+		return "", fmt.Errorf("no value")
+	case s[0] == '"':
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", fmt.Errorf("bad double-quoted string %s", s)
+		}
+		return v, nil
+	case s[0] == '\'':
+		if len(s) < 2 || s[len(s)-1] != '\'' {
+			return "", fmt.Errorf("bad single-quoted string %s", s)
+		}
+		inner := s[1 : len(s)-1]
+		if strings.Count(inner, "'") != 2*strings.Count(inner, "''") {
+			return "", fmt.Errorf("bad single-quoted string %s", s)
+		}
+		return strings.Replace(inner, "''", "'", -1), nil
+	case strings.ContainsRune("[]{}&*!|>%@`,", rune(s[0])):
+		return "", fmt.Errorf("unsupported YAML %s; quote it if it is a string", s)
+	case strings.Contains(s, ": "):
+		return "", fmt.Errorf("nested mappings are unsupported; quote %s if it is a string", s)
+	}
+	return s, nil
+}
+
+// parseConfigFlowList is the scalars in a YAML flow sequence, [a, b].
+func parseConfigFlowList(s string) ([]string, error) {
+	if !strings.HasSuffix(s, "]") {
+		return nil, fmt.Errorf("unterminated list %s", s)
+	}
+	inner := strings.TrimSpace(s[1 : len(s)-1])
+	if inner == "" {
+		return nil, nil
+	}
+	var (
+		values []string
+		quote  byte
+		start  int
+	)
+	item := func(end int) error {
+		v, err := parseConfigScalar(strings.TrimSpace(inner[start:end]))
+		values = append(values, v)
+		start = end + 1
+		return err
+	}
+	for i := 0; i < len(inner); i++ {
+		switch c := inner[i]; {
+		case quote == '"' && c == '\\', quote == '\'' && c == '\'' && i+1 < len(inner) && inner[i+1] == '\'':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && startsConfigScalar(inner[:i]):
+			quote = c
+		case c == ',':
+			if err := item(i); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := item(len(inner)); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
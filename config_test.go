@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfigFile(t *testing.T) {
+	for _, testcase := range []struct {
+		name string
+		in   string
+		want []configSetting
+		err  string
+	}{
+		{"empty", "", nil, ""},
+		{"comments", "---\n# all defaults\n\n", nil, ""},
+		{"scalars", "nickname: node-1\npassword: 'it''s # no comment'  # comment\nmesh: \"[::]:6783\"\r\n", []configSetting{
+			{key: "nickname", values: []string{"node-1"}, line: 1},
+			{key: "password", values: []string{"it's # no comment"}, line: 2},
+			{key: "mesh", values: []string{"[::]:6783"}, line: 3},
+		}, ""},
+		{"plain apostrophe", "nickname: bob's # laptop", []configSetting{{key: "nickname", values: []string{"bob's"}, line: 1}}, ""},
+		{"flow list", "peer: [10.0.0.1, '10.0.0.2', \"a,b\"]\nca-hash: []", []configSetting{
+			{key: "peer", values: []string{"10.0.0.1", "10.0.0.2", "a,b"}, line: 1},
+			{key: "ca-hash", line: 2},
+		}, ""},
+		{"block list", "peer:\n  - 10.0.0.1\n  # between\n  - 10.0.0.2\nroot-ca:\n- /etc/ca.crt\nwatch-root-ca: true", []configSetting{
+			{key: "peer", values: []string{"10.0.0.1", "10.0.0.2"}, line: 1},
+			{key: "root-ca", values: []string{"/etc/ca.crt"}, line: 5},
+			{key: "watch-root-ca", values: []string{"true"}, line: 7},
+		}, ""},
+		{"no value", "peer:\nnickname: a", nil, "line 1: no value for peer"},
+		{"no value at the end", "peer:", nil, "line 1: no value for peer"},
+		{"duplicate", "peer: a\npeer: b", nil, "line 2: peer is already set on line 1"},
+		{"nested", "mesh:\n  listen: 0.0.0.0", nil, "line 2: unexpected indentation"},
+		{"inline mapping", "mesh: {listen: 0.0.0.0}", nil, "line 1: unsupported YAML"},
+		{"block scalar", "password: |", nil, "line 1: unsupported YAML"},
+		{"tabs", "peer:\n\t- a", nil, "line 2: tabs"},
+		{"stray item", "- a", nil, "line 1: a list item, but not under a flag"},
+		{"no colon", "peer 10.0.0.1", nil, "line 1: want flag: value"},
+		{"unterminated", "peer: [a, b", nil, "line 1: unterminated list"},
+		{"bad quote", "password: \"abc", nil, "line 1: bad double-quoted string"},
+	} {
+		have, err := parseConfigFile([]byte(testcase.in))
+		if testcase.err != "" {
+			if err == nil || !strings.Contains(err.Error(), testcase.err) {
+				t.Errorf("%s: want error %q, have %v", testcase.name, testcase.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", testcase.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(testcase.want, have) {
+			t.Errorf("%s: want %+v, have %+v", testcase.name, testcase.want, have)
+		}
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet-mesh-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kubelet-mesh.yaml")
+	file := "nickname: from-file\npeer: [10.0.0.1, 10.0.0.2]\nremove-apiserver-keep: 1h\nwatch-root-ca: true\n"
+	if err := ioutil.WriteFile(path, []byte(file), 0600); err != nil {
+		t.Fatal(err)
+	}
+	parse := func(args ...string) (Config, error) {
+		cfg := newConfig()
+		fs := flag.NewFlagSet("kubelet-mesh", flag.ContinueOnError)
+		fs.SetOutput(ioutil.Discard)
+		cfg.register(fs)
+		return cfg, cfg.parse(fs, args)
+	}
+
+	cfg, err := parse("-config", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.nickname != "from-file" || !reflect.DeepEqual(cfg.peers.slice(), []string{"10.0.0.1", "10.0.0.2"}) || cfg.tombstoneKeep != time.Hour || !cfg.watchRootCA {
+		t.Errorf("want the file's settings, have nickname %q, peers %v, tombstone-keep %v, watch-root-ca %v", cfg.nickname, cfg.peers.slice(), cfg.tombstoneKeep, cfg.watchRootCA)
+	}
+
+	// The command line wins, whether before or after -config, and even
+	// over an alias, and a list on it replaces the file's.
+	cfg, err = parse("-nickname", "from-flag", "-config-file", path, "-peer", "10.0.0.3", "-tombstone-keep", "2h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.nickname != "from-flag" || !reflect.DeepEqual(cfg.peers.slice(), []string{"10.0.0.3"}) || cfg.tombstoneKeep != 2*time.Hour {
+		t.Errorf("want the command line's settings, have nickname %q, peers %v, tombstone-keep %v", cfg.nickname, cfg.peers.slice(), cfg.tombstoneKeep)
+	}
+
+	for _, testcase := range []struct {
+		file, err string
+	}{
+		{"peers: [10.0.0.1]", "line 1: no flag -peers (did you mean -peer?)"},
+		{"no-such-thing: 1", "line 1: no flag -no-such-thing"},
+		{"nickname: a\nnicknam: b", "line 2: no flag -nicknam (did you mean -nickname?)"},
+		{"config: other.yaml", "line 1: -config only works on the command line"},
+		{"root-ca-generation: one", "line 1: -root-ca-generation: "},
+	} {
+		if err := ioutil.WriteFile(path, []byte(testcase.file), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := parse("-config", path); err == nil || !strings.Contains(err.Error(), path+": "+testcase.err) {
+			t.Errorf("%q: want error %q, have %v", testcase.file, testcase.err, err)
+		}
+	}
+	if _, err := parse("-config", filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Error("missing file: want an error")
+	}
+}
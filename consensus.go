@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Consumers of apiserver URLs that can opt into consensus-healthy ones
+// only, with -consensus-healthy-only.
+const (
+	consensusOutputs = "outputs" // -kubeconfig-out, -discovery-file-out and the upstream file
+	consensusProxy   = "proxy"   // -local-proxy
+	consensusHook    = "hook"    // -on-apiserver-change
+)
+
+// consensusConfig is when the mesh as a whole, rather than any one peer,
+// finds an apiserver URL healthy: a single peer's probes can be wrong
+// for reasons of its own, say a local firewall or asymmetric routing.
+type consensusConfig struct {
+	// window is how recent a probe must be to vote. Peers that go
+	// silent, or stop probing, stop voting once theirs are older.
+	window time.Duration
+	// fraction is the share of voting peers that must have found a URL
+	// healthy for it to be consensus-healthy.
+	fraction float64
+	// only is the consumers that use consensus-healthy URLs only.
+	only map[string]bool
+}
+
+// validate checks cfg, as set from the command line.
+func (cfg consensusConfig) validate() error {
+	if cfg.window <= 0 || cfg.window > probeMaxAge {
+		return fmt.Errorf("-consensus-window must be more than 0 and at most %v", probeMaxAge)
+	}
+	if cfg.fraction <= 0 || cfg.fraction > 1 {
+		return fmt.Errorf("-consensus-fraction must be more than 0 and at most 1")
+	}
+	for consumer := range cfg.only {
+		switch consumer {
+		case consensusOutputs, consensusProxy, consensusHook:
+		default:
+			return fmt.Errorf("-consensus-healthy-only: %q is none of %s, %s or %s", consumer, consensusOutputs, consensusProxy, consensusHook)
+		}
+	}
+	return nil
+}
+
+// apiserverVotes is how many peers probed an apiserver URL within the
+// consensus window, and how many of them found it healthy.
+type apiserverVotes struct {
+	Voters  int
+	Healthy int
+}
+
+// healthy reports whether enough of the voters found the URL healthy.
+// A URL nobody has voted on is not.
+func (v apiserverVotes) healthy(fraction float64) bool {
+	return v.Voters > 0 && float64(v.Healthy) >= fraction*float64(v.Voters)
+}
+
+// apiserverConsensus counts the votes on each URL: every peer's latest
+// probe of it, if no older than window. Peers that never probe don't vote.
+func apiserverConsensus(probes []*APIServerProbe, window time.Duration, now time.Time) map[string]apiserverVotes {
+	votes := map[string]apiserverVotes{}
+	for _, pr := range probes {
+		if now.Sub(pr.Checked) > window {
+			continue
+		}
+		v := votes[pr.URL]
+		v.Voters++
+		if pr.Healthy {
+			v.Healthy++
+		}
+		votes[pr.URL] = v
+	}
+	return votes
+}
+
+// withConsensus fills in the consensus in views.
+func withConsensus(views []apiserverHealthView, probes []*APIServerProbe, cfg consensusConfig, now time.Time) []apiserverHealthView {
+	votes := apiserverConsensus(probes, cfg.window, now)
+	for i := range views {
+		v := votes[views[i].URL]
+		views[i].Voters, views[i].ConsensusHealthy = v.Voters, v.healthy(cfg.fraction)
+	}
+	return views
+}
+
+// consensusHealthyURLs keeps those of urls that are consensus-healthy,
+// in order. If none are, all of them stay: it's better to point at an
+// apiserver the mesh has doubts about than at none.
+func consensusHealthyURLs(urls []string, probes []*APIServerProbe, cfg consensusConfig, now time.Time) []string {
+	votes := apiserverConsensus(probes, cfg.window, now)
+	var healthy []string
+	for _, u := range urls {
+		if votes[u].healthy(cfg.fraction) {
+			healthy = append(healthy, u)
+		}
+	}
+	if len(healthy) == 0 {
+		return urls
+	}
+	return healthy
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+func TestAPIServerConsensus(t *testing.T) {
+	now := time.Now()
+	probes := []*APIServerProbe{
+		{URL: "https://a:6443", Peer: 1, Healthy: true, Checked: now},
+		{URL: "https://a:6443", Peer: 2, Healthy: true, Checked: now.Add(-time.Minute)},
+		{URL: "https://a:6443", Peer: 3, Healthy: false, Checked: now},
+		// Peer 4 has gone silent: its vote has decayed.
+		{URL: "https://a:6443", Peer: 4, Healthy: false, Checked: now.Add(-20 * time.Minute)},
+		{URL: "https://b:6443", Peer: 1, Healthy: false, Checked: now},
+		{URL: "https://b:6443", Peer: 2, Healthy: true, Checked: now},
+		{URL: "https://c:6443", Peer: 1, Healthy: true, Checked: now.Add(-30 * time.Minute)},
+	}
+	votes := apiserverConsensus(probes, 10*time.Minute, now)
+	want := map[string]apiserverVotes{
+		"https://a:6443": {Voters: 3, Healthy: 2},
+		"https://b:6443": {Voters: 2, Healthy: 1},
+	}
+	if !reflect.DeepEqual(want, votes) {
+		t.Fatalf("want %v, have %v", want, votes)
+	}
+	for _, testcase := range []struct {
+		url      string
+		fraction float64
+		want     bool
+	}{
+		{"https://a:6443", 0.5, true},
+		{"https://a:6443", 0.75, false},
+		{"https://b:6443", 0.5, true},
+		{"https://b:6443", 0.51, false},
+		// Nobody voted on c lately, and nobody ever on d.
+		{"https://c:6443", 0.5, false},
+		{"https://d:6443", 0.5, false},
+	} {
+		if have := votes[testcase.url].healthy(testcase.fraction); have != testcase.want {
+			t.Errorf("%s at %v: want %v, have %v", testcase.url, testcase.fraction, testcase.want, have)
+		}
+	}
+}
+
+func TestConsensusHealthyURLs(t *testing.T) {
+	now := time.Now()
+	cfg := consensusConfig{window: 10 * time.Minute, fraction: 0.5}
+	urls := []string{"https://a:6443", "https://b:6443", "https://c:6443"}
+	probes := []*APIServerProbe{
+		{URL: "https://a:6443", Peer: 1, Healthy: false, Checked: now},
+		{URL: "https://a:6443", Peer: 2, Healthy: false, Checked: now},
+		{URL: "https://c:6443", Peer: 1, Healthy: true, Checked: now},
+	}
+	if want, have := []string{"https://c:6443"}, consensusHealthyURLs(urls, probes, cfg, now); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	// If the mesh agrees on none, we keep them all.
+	if have := consensusHealthyURLs(urls, probes[:2], cfg, now); !reflect.DeepEqual(urls, have) {
+		t.Errorf("none healthy: want %v, have %v", urls, have)
+	}
+}
+
+func TestStateAPIServerURLsFor(t *testing.T) {
+	now := time.Now()
+	opts := peerOptions{consensus: consensusConfig{window: 10 * time.Minute, fraction: 0.5, only: map[string]bool{consensusProxy: true}}}
+	st := newState(mesh.PeerName(1), nil, []string{"https://a:6443", "https://b:6443"}, opts, newTextLogger(ioutil.Discard, "", 0))
+	st.mergeComplete(ClusterInfo{Probes: []*APIServerProbe{
+		{URL: "https://a:6443", Peer: 2, Healthy: false, Checked: now},
+		{URL: "https://b:6443", Peer: 2, Healthy: true, Checked: now},
+	}})
+	if want, have := []string{"https://b:6443"}, st.apiserverURLsFor(consensusProxy, now); !reflect.DeepEqual(want, have) {
+		t.Errorf("proxy: want %v, have %v", want, have)
+	}
+	if want, have := []string{"https://a:6443", "https://b:6443"}, st.apiserverURLsFor(consensusOutputs, now); !reflect.DeepEqual(want, have) {
+		t.Errorf("outputs: want %v, have %v", want, have)
+	}
+}
+
+func TestConsensusConfigValidate(t *testing.T) {
+	for _, testcase := range []struct {
+		cfg consensusConfig
+		ok  bool
+	}{
+		{consensusConfig{window: 10 * time.Minute, fraction: 0.5, only: map[string]bool{consensusOutputs: true, consensusHook: true}}, true},
+		{consensusConfig{window: 10 * time.Minute, fraction: 1}, true},
+		{consensusConfig{window: 0, fraction: 0.5}, false},
+		{consensusConfig{window: 2 * time.Hour, fraction: 0.5}, false},
+		{consensusConfig{window: 10 * time.Minute, fraction: 0}, false},
+		{consensusConfig{window: 10 * time.Minute, fraction: 1.5}, false},
+		{consensusConfig{window: 10 * time.Minute, fraction: 0.5, only: map[string]bool{"kubelet": true}}, false},
+	} {
+		if err := testcase.cfg.validate(); (err == nil) != testcase.ok {
+			t.Errorf("%+v: want ok %v, have %v", testcase.cfg, testcase.ok, err)
+		}
+	}
+}
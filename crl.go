@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// CRL is a certificate revocation list issued by one of the root CAs,
+// gossiped so that kubelets can learn about revoked certificates before
+// they can reach anything else.
+type CRL struct {
+	Bytes      []byte // DER
+	Issuer     []byte // raw subject of the issuer; we keep one CRL per issuer
+	Number     *big.Int
+	ThisUpdate time.Time
+	NextUpdate time.Time
+}
+
+func newCRL(rl *x509.RevocationList) *CRL {
+	return &CRL{
+		Bytes:      rl.Raw,
+		Issuer:     rl.RawIssuer,
+		Number:     rl.Number,
+		ThisUpdate: rl.ThisUpdate,
+		NextUpdate: rl.NextUpdate,
+	}
+}
+
+func (crl *CRL) String() string {
+	return fmt.Sprintf("CRL %v of %v", crl.Number, crl.ThisUpdate)
+}
+
+// expired reports whether the CRL is past its NextUpdate, if it has one.
+func (crl *CRL) expired(now time.Time) bool {
+	return !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate)
+}
+
+// loadCRL reads a PEM or DER CRL from path, and checks that one of roots
+// issued it.
+func loadCRL(path string, roots []*x509.Certificate) (*CRL, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(buf); block != nil {
+		if block.Type != "X509 CRL" {
+			return nil, fmt.Errorf("%s: %q is not an X509 CRL PEM block", path, block.Type)
+		}
+		buf = block.Bytes
+	}
+	crl, err := parseCRL(buf, roots)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return crl, nil
+}
+
+// parseCRL parses a DER CRL and checks that one of roots issued it.
+func parseCRL(der []byte, roots []*x509.Certificate) (*CRL, error) {
+	rl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range roots {
+		if bytes.Equal(root.RawSubject, rl.RawIssuer) && rl.CheckSignatureFrom(root) == nil {
+			return newCRL(rl), nil
+		}
+	}
+	return nil, errors.New("not signed by any of the root CAs")
+}
+
+// mergeCRLs keeps the newest CRL of each issuer.
+func mergeCRLs(ours, theirs []*CRL) (result, delta []*CRL) {
+	all := append(append([]*CRL(nil), ours...), theirs...)
+	keep, changed := mergeKeyed(len(ours), len(theirs),
+		func(i int) string { return string(all[i].Issuer) },
+		func(i, j int) bool { return preferCRL(all[i], all[j]) })
+	for _, i := range keep {
+		result = append(result, all[i])
+	}
+	for _, i := range changed {
+		delta = append(delta, all[i])
+	}
+	sortCRLs(result)
+	sortCRLs(delta)
+	return result, delta
+}
+
+// preferCRL prefers the highest CRL number, then the latest ThisUpdate.
+func preferCRL(a, b *CRL) bool {
+	an, bn := a.Number, b.Number
+	if an == nil {
+		an = new(big.Int)
+	}
+	if bn == nil {
+		bn = new(big.Int)
+	}
+	if c := an.Cmp(bn); c != 0 {
+		return c > 0
+	}
+	if !a.ThisUpdate.Equal(b.ThisUpdate) {
+		return a.ThisUpdate.After(b.ThisUpdate)
+	}
+	return bytes.Compare(a.Bytes, b.Bytes) > 0
+}
+
+func sortCRLs(crls []*CRL) {
+	sort.Slice(crls, func(i, j int) bool { return bytes.Compare(crls[i].Issuer, crls[j].Issuer) < 0 })
+}
+
+// encodeCRLs PEM-encodes crls.
+func encodeCRLs(crls []*CRL) []byte {
+	var buf bytes.Buffer
+	for _, crl := range crls {
+		pem.Encode(&buf, &pem.Block{Type: "X509 CRL", Bytes: crl.Bytes})
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCRL(t *testing.T, number int64, thisUpdate time.Time, issuer *x509.Certificate, key *ecdsa.PrivateKey) *CRL {
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(number),
+		ThisUpdate: thisUpdate,
+		NextUpdate: thisUpdate.Add(time.Hour),
+	}, issuer, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl, err := x509.ParseRevocationList(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newCRL(rl)
+}
+
+func TestLoadCRL(t *testing.T) {
+	ca, key := newTestCertSignedBy(t, testCATemplate, nil, nil)
+	other, otherKey := newTestCertSignedBy(t, testCATemplate, nil, nil)
+	now := time.Now()
+	crl := newTestCRL(t, 1, now, ca, key)
+	forged := newTestCRL(t, 1, now, other, otherKey) // same subject, other key
+
+	dir, err := ioutil.TempDir("", "crl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, testcase := range []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"pem", pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crl.Bytes}), ""},
+		{"der", crl.Bytes, ""},
+		{"cert", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw}), "not an X509 CRL"},
+		{"forged", forged.Bytes, "not signed by any of the root CAs"},
+		{"garbage", []byte("garbage"), "malformed"},
+	} {
+		path := filepath.Join(dir, testcase.name)
+		if err := ioutil.WriteFile(path, testcase.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		have, err := loadCRL(path, []*x509.Certificate{ca})
+		if testcase.err != "" {
+			if err == nil || !strings.Contains(err.Error(), testcase.err) {
+				t.Errorf("%s: want error containing %q, have %v", testcase.name, testcase.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", testcase.name, err)
+		} else if !reflect.DeepEqual(crl, have) {
+			t.Errorf("%s: want %v, have %v", testcase.name, crl, have)
+		}
+	}
+}
+
+func TestMergeCRLs(t *testing.T) {
+	ca, key := newTestCertSignedBy(t, testCATemplate, nil, nil)
+	other, otherKey := newTestCertSignedBy(t, x509.Certificate{
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		Subject:               pkix.Name{CommonName: "other-ca"},
+	}, nil, nil)
+	now := time.Now()
+	one := newTestCRL(t, 1, now, ca, key)
+	two := newTestCRL(t, 2, now.Add(-time.Hour), ca, key) // higher number wins over later ThisUpdate
+	twoLater := newTestCRL(t, 2, now, ca, key)
+	otherOne := newTestCRL(t, 1, now, other, otherKey)
+	both := []*CRL{otherOne, twoLater}
+	sortCRLs(both)
+
+	for _, testcase := range []struct {
+		name          string
+		ours, theirs  []*CRL
+		result, delta []*CRL
+	}{
+		{"empty", nil, nil, nil, nil},
+		{"new", nil, []*CRL{one}, []*CRL{one}, []*CRL{one}},
+		{"higher number", []*CRL{one}, []*CRL{two}, []*CRL{two}, []*CRL{two}},
+		{"lower number", []*CRL{two}, []*CRL{one}, []*CRL{two}, nil},
+		{"later update", []*CRL{two}, []*CRL{twoLater}, []*CRL{twoLater}, []*CRL{twoLater}},
+		{"earlier update", []*CRL{twoLater}, []*CRL{two}, []*CRL{twoLater}, nil},
+		{"other issuer", []*CRL{twoLater}, []*CRL{otherOne}, both, []*CRL{otherOne}},
+	} {
+		result, delta := mergeCRLs(testcase.ours, testcase.theirs)
+		if want, have := testcase.result, result; !reflect.DeepEqual(want, have) {
+			t.Errorf("%s: result: want %v, have %v", testcase.name, want, have)
+		}
+		if want, have := testcase.delta, delta; !reflect.DeepEqual(want, have) {
+			t.Errorf("%s: delta: want %v, have %v", testcase.name, want, have)
+		}
+	}
+}
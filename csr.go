@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// csrChannel is the gossip channel for kubelet serving certificate
+// requests, which only ever travel by unicast.
+const csrChannel = "kubelet-mesh-csr-v0"
+
+// csrMessage is a request, if CSR is set, or else the response to the
+// request with the same ID.
+type csrMessage struct {
+	ID          uint64
+	CSR         []byte // DER
+	Certificate []byte // DER
+	Error       string
+}
+
+// csrSigner is what a seed needs to sign serving certificates.
+type csrSigner struct {
+	key crypto.Signer
+	ca  *x509.Certificate
+	ttl time.Duration
+	// addresses is the nickname and IP addresses the mesh knows a peer by.
+	addresses func(mesh.PeerName) (nickname string, ips []net.IP)
+}
+
+// csrService implements mesh.Gossiper for csrChannel. Any peer can
+// request certificates from signers; only peers with a signer sign them.
+type csrService struct {
+	mtx     sync.Mutex
+	send    mesh.Gossip
+	signer  *csrSigner                 // nil unless we sign
+	signers map[mesh.PeerName]struct{} // whose responses we accept
+	pending map[uint64]chan<- csrMessage
+	signing map[mesh.PeerName]bool // whose request we're still handling
+	logger  *levelLogger
+}
+
+var _ mesh.Gossiper = &csrService{}
+
+func newCSRService(signer *csrSigner, signers []mesh.PeerName, logger *levelLogger) *csrService {
+	s := &csrService{
+		signer:  signer,
+		signers: map[mesh.PeerName]struct{}{},
+		pending: map[uint64]chan<- csrMessage{},
+		signing: map[mesh.PeerName]bool{},
+		logger:  logger,
+	}
+	for _, name := range signers {
+		s.signers[name] = struct{}{}
+	}
+	return s
+}
+
+// register the result of a mesh.Router.NewGossip.
+func (s *csrService) register(send mesh.Gossip) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.send = send
+}
+
+func (s *csrService) unicast(dst mesh.PeerName, msg csrMessage) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(msg); err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	send := s.send
+	s.mtx.Unlock()
+	if send == nil {
+		return errors.New("not registered")
+	}
+	return send.GossipUnicast(dst, buf.Bytes())
+}
+
+// There is no state to gossip on this channel.
+func (s *csrService) Gossip() mesh.GossipData                  { return nil }
+func (s *csrService) OnGossip([]byte) (mesh.GossipData, error) { return nil, nil }
+func (s *csrService) OnGossipBroadcast(mesh.PeerName, []byte) (mesh.GossipData, error) {
+	return nil, nil
+}
+
+func (s *csrService) OnGossipUnicast(src mesh.PeerName, buf []byte) error {
+	var msg csrMessage
+	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&msg); err != nil {
+		return err
+	}
+	if msg.CSR != nil {
+		// Signing is costly, so one request at a time from each peer,
+		// which waits for the answer anyway.
+		s.mtx.Lock()
+		busy := s.signing[src]
+		s.signing[src] = true
+		s.mtx.Unlock()
+		if busy {
+			s.logger.Debugf("Ignoring serving certificate request from %s, which we're still handling", src)
+			return nil
+		}
+		// Don't sign, or unicast, from inside the gossip callback.
+		go func() {
+			defer func() {
+				s.mtx.Lock()
+				delete(s.signing, src)
+				s.mtx.Unlock()
+			}()
+			s.handleRequest(src, msg)
+		}()
+		return nil
+	}
+	if _, ok := s.signers[src]; !ok {
+		s.logger.Warnf("Ignoring serving certificate from %s, which isn't in -csr-signers", src)
+		return nil
+	}
+	s.mtx.Lock()
+	ch, ok := s.pending[msg.ID]
+	delete(s.pending, msg.ID)
+	s.mtx.Unlock()
+	if ok {
+		ch <- msg // buffered
+	}
+	return nil
+}
+
+func (s *csrService) handleRequest(src mesh.PeerName, msg csrMessage) {
+	reply := csrMessage{ID: msg.ID}
+	if s.signer == nil {
+		reply.Error = "not a serving certificate signer"
+	} else if cert, err := s.signer.sign(src, msg.CSR, time.Now()); err != nil {
+		s.logger.Warnf("Refused to sign serving certificate for %s: %v", src, err)
+		reply.Error = err.Error()
+	} else {
+		s.logger.Infof("Signed serving certificate for %s", src)
+		reply.Certificate = cert
+	}
+	if err := s.unicast(src, reply); err != nil {
+		s.logger.Errorf("Replying to serving certificate request from %s: %v", src, err)
+	}
+}
+
+// sign signs a DER CSR from src, so long as it only asks for names
+// that the mesh knows src by. The subject is always a node's, whatever
+// else the CSR asks for.
+func (signer *csrSigner) sign(src mesh.PeerName, der []byte, now time.Time) ([]byte, error) {
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	nickname, ips := signer.addresses(src)
+	if err := validateCSR(csr, nickname, ips); err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	notAfter := now.Add(signer.ttl)
+	if notAfter.After(signer.ca.NotAfter) {
+		notAfter = signer.ca.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "system:node:" + nickname, Organization: []string{"system:nodes"}},
+		DNSNames:              csr.DNSNames,
+		IPAddresses:           csr.IPAddresses,
+		NotBefore:             now.Add(-5 * time.Minute), // for clock skew
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	return x509.CreateCertificate(rand.Reader, template, signer.ca, csr.PublicKey, signer.key)
+}
+
+// validateCSR checks that csr is for a kubelet serving certificate for
+// the peer with nickname and ips, and nothing else.
+func validateCSR(csr *x509.CertificateRequest, nickname string, ips []net.IP) error {
+	if nickname == "" {
+		return errors.New("peer not known to the mesh")
+	}
+	if want := "system:node:" + nickname; csr.Subject.CommonName != want {
+		return fmt.Errorf("common name %q is not %q", csr.Subject.CommonName, want)
+	}
+	if len(csr.EmailAddresses) > 0 || len(csr.URIs) > 0 {
+		return errors.New("only DNS and IP SANs may be requested")
+	}
+	if len(csr.DNSNames) == 0 && len(csr.IPAddresses) == 0 {
+		return errors.New("no SANs requested")
+	}
+	for _, name := range csr.DNSNames {
+		if !strings.EqualFold(name, nickname) {
+			return fmt.Errorf("DNS SAN %q is not the peer's nickname %q", name, nickname)
+		}
+	}
+next:
+	for _, ip := range csr.IPAddresses {
+		for _, known := range ips {
+			if ip.Equal(known) {
+				continue next
+			}
+		}
+		return fmt.Errorf("IP SAN %s is not one of the peer's addresses %v", ip, ips)
+	}
+	return nil
+}
+
+// meshPeerAddresses looks up the nickname of a peer and the IP addresses
+// that the peers it is connected to see it at.
+func meshPeerAddresses(router *mesh.Router) func(mesh.PeerName) (string, []net.IP) {
+	return func(name mesh.PeerName) (nickname string, ips []net.IP) {
+		for _, peer := range mesh.NewStatus(router).Peers {
+			if peer.Name == name.String() {
+				nickname = peer.NickName
+			}
+			for _, conn := range peer.Connections {
+				if conn.Name != name.String() {
+					continue
+				}
+				host, _, err := net.SplitHostPort(conn.Address)
+				if err != nil {
+					continue
+				}
+				if ip := net.ParseIP(host); ip != nil {
+					ips = append(ips, ip)
+				}
+			}
+		}
+		return nickname, ips
+	}
+}
+
+// request asks signer to sign csr, and waits up to timeout for the answer.
+func (s *csrService) request(signer mesh.PeerName, csr []byte, timeout time.Duration, quit <-chan struct{}) ([]byte, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint64(b[:])
+	ch := make(chan csrMessage, 1)
+	s.mtx.Lock()
+	s.pending[id] = ch
+	s.mtx.Unlock()
+	defer func() {
+		s.mtx.Lock()
+		delete(s.pending, id)
+		s.mtx.Unlock()
+	}()
+
+	if err := s.unicast(signer, csrMessage{ID: id, CSR: csr}); err != nil {
+		return nil, err
+	}
+	select {
+	case msg := <-ch:
+		if msg.Error != "" {
+			return nil, errors.New(msg.Error)
+		}
+		return msg.Certificate, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("no answer within %v", timeout)
+	case <-quit:
+		return nil, errors.New("stopped")
+	}
+}
+
+// servingCertRequest is what a peer asks the signers for.
+type servingCertRequest struct {
+	nickname string
+	ips      []net.IP
+	timeout  time.Duration
+	// roots returns the root CAs the certificate must chain to.
+	roots func() []*RootCAPublicKey
+}
+
+// requestServingCert generates a key and asks each of the signers in turn
+// to sign a serving certificate for it, backing off between rounds, until
+// one does or quit is closed.
+func (s *csrService) requestServingCert(req servingCertRequest, quit <-chan struct{}) (*ecdsa.PrivateKey, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: "system:node:" + req.nickname, Organization: []string{"system:nodes"}},
+		DNSNames:    []string{req.nickname},
+		IPAddresses: req.ips,
+	}, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var signers []mesh.PeerName
+	for name := range s.signers {
+		signers = append(signers, name)
+	}
+	sort.Slice(signers, func(i, j int) bool { return signers[i] < signers[j] })
+
+	backoff := time.Second
+	for {
+		for _, signer := range signers {
+			der, err := s.request(signer, csr, req.timeout, quit)
+			if err == nil {
+				err = verifyServingCert(der, key, req.roots())
+			}
+			if err == nil {
+				return key, der, nil
+			}
+			s.logger.Warnf("Serving certificate request to %s failed: %v", signer, err)
+		}
+		select {
+		case <-time.After(backoff):
+		case <-quit:
+			return nil, nil, errors.New("stopped")
+		}
+		if backoff *= 2; backoff > time.Minute {
+			backoff = time.Minute
+		}
+	}
+}
+
+// verifyServingCert checks that der is a serving certificate for key,
+// issued under one of roots.
+func verifyServingCert(der []byte, key *ecdsa.PrivateKey, roots []*RootCAPublicKey) error {
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+	if pub, ok := cert.PublicKey.(*ecdsa.PublicKey); !ok || !pub.Equal(&key.PublicKey) {
+		return errors.New("certificate is not for our key")
+	}
+	opts := x509.VerifyOptions{
+		Roots:         x509.NewCertPool(),
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, ca := range roots {
+		if root, err := x509.ParseCertificate(ca.Bytes); err == nil {
+			opts.Roots.AddCert(root)
+		}
+		for _, b := range ca.Chain {
+			if intermediate, err := x509.ParseCertificate(b); err == nil {
+				opts.Intermediates.AddCert(intermediate)
+			}
+		}
+	}
+	_, err = cert.Verify(opts)
+	return err
+}
+
+// writeServingCert writes cert and its key to certOut and keyOut.
+// The key goes first, so the certificate is never there without it.
+func writeServingCert(certOut, keyOut string, key *ecdsa.PrivateKey, cert []byte) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(keyOut, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return err
+	}
+	return writeFileAtomic(certOut, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert}), 0644)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/gob"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+func TestValidateCSR(t *testing.T) {
+	ips := []net.IP{net.ParseIP("10.0.0.1")}
+	for _, testcase := range []struct {
+		name string
+		csr  x509.CertificateRequest
+		ok   bool
+	}{
+		{"valid", x509.CertificateRequest{Subject: pkix.Name{CommonName: "system:node:node1"}, DNSNames: []string{"node1"}, IPAddresses: ips}, true},
+		{"wrong common name", x509.CertificateRequest{Subject: pkix.Name{CommonName: "system:node:node2"}, DNSNames: []string{"node1"}}, false},
+		{"other DNS name", x509.CertificateRequest{Subject: pkix.Name{CommonName: "system:node:node1"}, DNSNames: []string{"apiserver"}}, false},
+		{"other IP", x509.CertificateRequest{Subject: pkix.Name{CommonName: "system:node:node1"}, IPAddresses: []net.IP{net.ParseIP("10.0.0.2")}}, false},
+		{"no SANs", x509.CertificateRequest{Subject: pkix.Name{CommonName: "system:node:node1"}}, false},
+		{"email SAN", x509.CertificateRequest{Subject: pkix.Name{CommonName: "system:node:node1"}, DNSNames: []string{"node1"}, EmailAddresses: []string{"a@b"}}, false},
+	} {
+		if want, have := testcase.ok, validateCSR(&testcase.csr, "node1", ips); want != (have == nil) {
+			t.Errorf("%s: want ok=%v, have %v", testcase.name, want, have)
+		}
+	}
+}
+
+func TestCSRSignerSubject(t *testing.T) {
+	caCert, caKey := newTestCertSignedBy(t, testCATemplate, nil, nil)
+	signer := &csrSigner{key: caKey, ca: caCert, ttl: time.Hour, addresses: func(mesh.PeerName) (string, []net.IP) { return "node2", nil }}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "system:node:node2", Organization: []string{"system:masters"}, OrganizationalUnit: []string{"admins"}},
+		DNSNames: []string{"node2"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := signer.sign(2, csr, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := (pkix.Name{CommonName: "system:node:node2", Organization: []string{"system:nodes"}}).String(), cert.Subject.String(); want != have {
+		t.Errorf("want subject %s, have %s", want, have)
+	}
+}
+
+func TestCSRServiceOneRequestPerPeer(t *testing.T) {
+	caCert, caKey := newTestCertSignedBy(t, testCATemplate, nil, nil)
+	var calls int32
+	release := make(chan struct{})
+	signer := newCSRService(&csrSigner{key: caKey, ca: caCert, ttl: time.Hour, addresses: func(mesh.PeerName) (string, []net.IP) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return "", nil
+	}}, nil, newTextLogger(ioutil.Discard, "", 0))
+	g := &recordingGossip{}
+	signer.register(g)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{Subject: pkix.Name{CommonName: "system:node:node2"}}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(csrMessage{ID: 1, CSR: csr}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := signer.OnGossipUnicast(2, buf.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(release)
+	idle := func() bool {
+		signer.mtx.Lock()
+		defer signer.mtx.Unlock()
+		return len(signer.signing) == 0
+	}
+	for deadline := time.Now().Add(5 * time.Second); !idle() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, unicasts := g.sent(); len(unicasts[2]) != 1 || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("want one request handled, have %d, and %d answers", atomic.LoadInt32(&calls), len(unicasts[2]))
+	}
+	// Once answered, the next is handled.
+	if err := signer.OnGossipUnicast(2, buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&calls) < 2 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if have := atomic.LoadInt32(&calls); have != 2 {
+		t.Errorf("want the next request handled, have %d handled", have)
+	}
+}
+
+func TestRequestServingCert(t *testing.T) {
+	caCert, caKey := newTestCertSignedBy(t, testCATemplate, nil, nil)
+	roots := func() []*RootCAPublicKey { return []*RootCAPublicKey{newRootCAPublicKey(caCert, 0, 1)} }
+	var (
+		logger = newTextLogger(ioutil.Discard, "", 0)
+		signer = newCSRService(&csrSigner{key: caKey, ca: caCert, ttl: time.Hour, addresses: func(name mesh.PeerName) (string, []net.IP) {
+			if name != 2 {
+				return "", nil
+			}
+			return "node2", []net.IP{net.ParseIP("10.0.0.2")}
+		}}, nil, logger)
+		bystander = newCSRService(nil, nil, logger)
+		requester = newCSRService(nil, []mesh.PeerName{1, 3}, logger)
+		peers     = map[mesh.PeerName]mesh.Gossiper{1: signer, 2: requester, 3: bystander}
+	)
+	for name, s := range peers {
+		s.(*csrService).register(&unicastGossip{self: name, peers: peers})
+	}
+
+	quit := make(chan struct{})
+	defer close(quit)
+	key, der, err := requester.requestServingCert(servingCertRequest{
+		nickname: "node2",
+		ips:      []net.IP{net.ParseIP("10.0.0.2")},
+		timeout:  time.Second,
+		roots:    roots,
+	}, quit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyServingCert(der, key, roots()); err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "system:node:node2", cert.Subject.CommonName; want != have {
+		t.Errorf("want common name %q, have %q", want, have)
+	}
+
+	// A signer only signs for the names it knows the requester by.
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: "system:node:node1"},
+		DNSNames: []string{"node1"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := requester.request(1, csr, time.Second, quit); err == nil {
+		t.Errorf("want a request for another node's name refused")
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// dryRunSummary is the configuration main computed, for -dry-run.
+type dryRunSummary struct {
+	Listen        string
+	Name          string
+	Nickname      string
+	Peers         []string
+	RootCAs       []*RootCAPublicKey
+	ApiserverURLs []string
+	// Problems are what would only have been logged, but fail a dry run.
+	Problems []string
+}
+
+func (s dryRunSummary) write(w io.Writer, now time.Time) {
+	fmt.Fprintf(w, "mesh listen:   %s\n", s.Listen)
+	fmt.Fprintf(w, "peer name:     %s (%s)\n", s.Name, s.Nickname)
+	for _, peer := range s.Peers {
+		fmt.Fprintf(w, "initial peer:  %s\n", peer)
+	}
+	for _, ca := range s.RootCAs {
+		validity := "valid"
+		if now.Before(ca.NotBefore) {
+			validity = "NOT YET VALID"
+		} else if ca.expired(now) {
+			validity = "EXPIRED"
+		}
+		fmt.Fprintf(w, "root CA:       %s (%s), generation %d, %d intermediate(s), %s from %v to %v\n",
+			ca.fingerprint(), ca.subject(), ca.Generation, len(ca.Chain), validity, ca.NotBefore, ca.notAfter())
+	}
+	for _, u := range s.ApiserverURLs {
+		fmt.Fprintf(w, "apiserver:     %s\n", u)
+	}
+	for _, problem := range s.Problems {
+		fmt.Fprintf(w, "PROBLEM:       %s\n", problem)
+	}
+}
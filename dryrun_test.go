@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDryRunSummary(t *testing.T) {
+	now := time.Now()
+	valid := newRootCAPublicKey(newTestCert(t, testCATemplate), 3, 999)
+	expired := *valid
+	expired.NotAfter = now.Add(-time.Hour)
+
+	var buf bytes.Buffer
+	dryRunSummary{
+		Listen:        "0.0.0.0:6783",
+		Name:          "00:00:00:00:03:e7",
+		Nickname:      "node1",
+		Peers:         []string{"10.0.0.2"},
+		RootCAs:       []*RootCAPublicKey{valid, &expired},
+		ApiserverURLs: []string{"https://10.0.0.1:6443"},
+		Problems:      []string{`apiserver URL: "http://x": scheme must be https`},
+	}.write(&buf, now)
+	have := buf.String()
+	for _, want := range []string{
+		"mesh listen:   0.0.0.0:6783\n",
+		"peer name:     00:00:00:00:03:e7 (node1)\n",
+		"initial peer:  10.0.0.2\n",
+		"root CA:       " + valid.fingerprint() + " (CN=test-ca), generation 3, 0 intermediate(s), valid from",
+		"EXPIRED from",
+		"apiserver:     https://10.0.0.1:6443\n",
+		"PROBLEM:       apiserver URL",
+	} {
+		if !strings.Contains(have, want) {
+			t.Errorf("want %q in\n%s", want, have)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// fullSync unicasts our complete state every interval to the peers we
+// have connected to since the last time, so they needn't wait for the
+// next periodic gossip to learn the root CAs, and to one other connected
+// peer at random, to catch up anything either of us missed. Unicasts
+// are merged without being passed on, so this costs at most a handful
+// of messages per peer per interval, whatever the size of the mesh.
+func (p *peer) fullSync(connected func() []mesh.PeerName, interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	known := map[mesh.PeerName]bool{}
+	for {
+		select {
+		case <-ticker.C:
+			var targets []mesh.PeerName
+			known, targets = syncTargets(known, connected(), rng)
+			for _, dst := range targets {
+				p.unicastComplete(dst)
+			}
+		case <-quit:
+			return
+		}
+	}
+}
+
+// syncTargets returns the set of peers now connected, and which of them
+// to send our state to: the new ones, and one of the others at random.
+func syncTargets(known map[mesh.PeerName]bool, connected []mesh.PeerName, rng *rand.Rand) (map[mesh.PeerName]bool, []mesh.PeerName) {
+	now := map[mesh.PeerName]bool{}
+	var targets, others []mesh.PeerName
+	for _, name := range connected {
+		if now[name] {
+			continue
+		}
+		now[name] = true
+		if known[name] {
+			others = append(others, name)
+		} else {
+			targets = append(targets, name)
+		}
+	}
+	if len(others) > 0 {
+		targets = append(targets, others[rng.Intn(len(others))])
+	}
+	return now, targets
+}
+
+// unicastComplete sends our complete state to dst, from the peer's loop,
+// which owns our channels: on our first, and unless we have heard dst
+// there, on the others too, as it may be a peer from before it.
+func (p *peer) unicastComplete(dst mesh.PeerName) {
+	f := func() {
+		for i, ch := range p.channels {
+			if ch.send == nil || (i > 0 && p.channels[0].hasSeen(dst)) {
+				continue
+			}
+			if err := ch.send.GossipUnicast(dst, p.encoding(ch, p.st.copy()).Encode()[0]); err != nil {
+				p.logger.Debugf("Full sync to %s on %s: %v", dst, ch.name, err)
+				continue
+			}
+			p.logger.Debugf("Full sync to %s on %s", dst, ch.name)
+		}
+	}
+	select {
+	case p.actions <- f:
+	case <-p.quit:
+	}
+}
+
+// meshConnectedPeers lists the peers we have established connections to.
+func meshConnectedPeers(router *mesh.Router) func() []mesh.PeerName {
+	return func() (names []mesh.PeerName) {
+		status := mesh.NewStatus(router)
+		for _, peer := range status.Peers {
+			if peer.Name != status.Name {
+				continue
+			}
+			for _, conn := range peer.Connections {
+				if !conn.Established {
+					continue
+				}
+				if name, err := mesh.PeerNameFromString(conn.Name); err == nil {
+					names = append(names, name)
+				}
+			}
+		}
+		return names
+	}
+}
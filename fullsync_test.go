@@ -0,0 +1,48 @@
+package main
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"reflect"
+	"testing"
+
+	"github.com/weaveworks/mesh"
+)
+
+func TestSyncTargets(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	known := map[mesh.PeerName]bool{}
+	for _, testcase := range []struct {
+		connected []mesh.PeerName
+		new       []mesh.PeerName
+		others    int
+	}{
+		{nil, nil, 0},
+		{[]mesh.PeerName{1, 2}, []mesh.PeerName{1, 2}, 0},
+		{[]mesh.PeerName{1, 2, 2}, nil, 1},
+		{[]mesh.PeerName{2, 3}, []mesh.PeerName{3}, 1},
+		{[]mesh.PeerName{1, 2, 3}, []mesh.PeerName{1}, 1},
+	} {
+		var targets []mesh.PeerName
+		known, targets = syncTargets(known, testcase.connected, rng)
+		if want, have := len(testcase.new)+testcase.others, len(targets); want != have {
+			t.Errorf("%v: want %d targets, have %v", testcase.connected, want, targets)
+			continue
+		}
+		if have := targets[:len(testcase.new)]; len(testcase.new) > 0 && !reflect.DeepEqual(testcase.new, have) {
+			t.Errorf("%v: want new peers %v first, have %v", testcase.connected, testcase.new, targets)
+		}
+	}
+}
+
+func TestPeerUnicastComplete(t *testing.T) {
+	seed := newNodeBootstrapPeer(mesh.PeerName(1), "seed", []*RootCAPublicKey{caA}, []string{"https://a:6443"}, peerOptions{skipCAValidation: true}, newTextLogger(ioutil.Discard, "", 0))
+	newcomer := newNodeBootstrapPeer(mesh.PeerName(2), "newcomer", nil, nil, peerOptions{skipCAValidation: true}, newTextLogger(ioutil.Discard, "", 0))
+	seed.register(&unicastGossip{self: 1, peers: map[mesh.PeerName]mesh.Gossiper{2: newcomer}})
+
+	seed.unicastComplete(2)
+	seed.actions <- func() {} // wait for the unicast
+	if want, have := seed.st.copy().set, newcomer.st.copy().set; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// caHook runs a command, or POSTs to a webhook, when root CAs we
+// haven't trusted before turn up, once they stop turning up for a while.
+type caHook struct {
+	run      func(fingerprints []string) error
+	debounce time.Duration
+	logger   *levelLogger
+
+	mtx     sync.Mutex
+	seen    map[string]bool
+	pending []string
+	timer   *time.Timer
+}
+
+// newCAHook fires target, a webhook URL or a shell command, debounce
+// after the last of a burst of new root CAs. The root CAs in known,
+// which we loaded ourselves, don't count as new.
+func newCAHook(target string, debounce time.Duration, known []*RootCAPublicKey, logger *levelLogger) *caHook {
+	h := &caHook{debounce: debounce, logger: logger, seen: map[string]bool{}}
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		h.run = func(fingerprints []string) error { return postCAChange(target, fingerprints) }
+	} else {
+		h.run = func(fingerprints []string) error { return execCAChange(target, fingerprints) }
+	}
+	for _, ca := range known {
+		h.seen[ca.fingerprint()] = true
+	}
+	return h
+}
+
+// observe notes cas, and schedules the hook if any of them are new.
+func (h *caHook) observe(cas []*RootCAPublicKey) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	var added bool
+	for _, ca := range cas {
+		if fp := ca.fingerprint(); !h.seen[fp] {
+			h.seen[fp] = true
+			h.pending = append(h.pending, fp)
+			added = true
+		}
+	}
+	if !added {
+		return
+	}
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+	h.timer = time.AfterFunc(h.debounce, h.fire)
+}
+
+func (h *caHook) fire() {
+	h.mtx.Lock()
+	fingerprints := h.pending
+	h.pending, h.timer = nil, nil
+	h.mtx.Unlock()
+	if len(fingerprints) == 0 {
+		return
+	}
+	h.logger.Infof("New root CA(s) %s, running -on-ca-change", strings.Join(fingerprints, ", "))
+	if err := h.run(fingerprints); err != nil {
+		h.logger.Errorf("on-ca-change: %v", err)
+		return
+	}
+	h.logger.Infof("on-ca-change succeeded")
+}
+
+// execCAChange runs command with sh, with the new fingerprints in
+// KUBELET_MESH_CA_FINGERPRINTS, space-separated.
+func execCAChange(command string, fingerprints []string) error {
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), "KUBELET_MESH_CA_FINGERPRINTS="+strings.Join(fingerprints, " "))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", command, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// postCAChange POSTs {"fingerprints": [...]} to url.
+func postCAChange(url string, fingerprints []string) error {
+	body, err := json.Marshal(struct {
+		Fingerprints []string `json:"fingerprints"`
+	}{fingerprints})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("POST %s: %s", url, resp.Status)
+	}
+	return nil
+}
+
+// apiserverHook runs a command whenever the set of apiservers changes,
+// once it stops changing for a while. Runs never overlap, and each gets
+// only the latest set.
+type apiserverHook struct {
+	run      func(urls []string, labels map[string]map[string]string) error
+	debounce time.Duration
+	logger   *levelLogger
+
+	mtx     sync.Mutex
+	last    string
+	pending *apiserverChange
+	timer   *time.Timer
+
+	// running is held while the command runs.
+	running sync.Mutex
+}
+
+type apiserverChange struct {
+	urls   []string
+	labels map[string]map[string]string
+}
+
+// newAPIServerHook runs command with sh, debounce after the last of a
+// burst of changes, killing it after timeout.
+func newAPIServerHook(command string, debounce, timeout time.Duration, logger *levelLogger) *apiserverHook {
+	return &apiserverHook{
+		run: func(urls []string, labels map[string]map[string]string) error {
+			return execAPIServerChange(command, timeout, urls, labels)
+		},
+		debounce: debounce,
+		logger:   logger,
+	}
+}
+
+// observe notes urls, highest priority first, and schedules the hook if
+// they aren't the same set as last time. A change of order alone, as
+// apiservers come and go out of health, doesn't count.
+func (h *apiserverHook) observe(urls []string, labels map[string]map[string]string) {
+	sorted := append([]string{}, urls...)
+	sort.Strings(sorted)
+	key := strings.Join(sorted, " ")
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if key == h.last {
+		return
+	}
+	h.last = key
+	h.pending = &apiserverChange{urls: urls, labels: labels}
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+	h.timer = time.AfterFunc(h.debounce, h.fire)
+}
+
+func (h *apiserverHook) fire() {
+	h.running.Lock()
+	defer h.running.Unlock()
+	h.mtx.Lock()
+	change := h.pending
+	h.pending = nil
+	h.mtx.Unlock()
+	if change == nil {
+		// A run we waited for already took it.
+		return
+	}
+	h.logger.Infof("Apiservers changed to %s, running -on-apiserver-change", strings.Join(change.urls, ", "))
+	if err := h.run(change.urls, change.labels); err != nil {
+		h.logger.Errorf("on-apiserver-change: %v", err)
+		return
+	}
+	h.logger.Infof("on-apiserver-change succeeded")
+}
+
+// execAPIServerChange runs command with sh, with urls in
+// KUBELET_MESH_APISERVERS, comma-separated, and on stdin as
+// {"apiservers": [{"url": ..., "labels": {...}}, ...]}.
+func execAPIServerChange(command string, timeout time.Duration, urls []string, labels map[string]map[string]string) error {
+	type apiserver struct {
+		URL    string            `json:"url"`
+		Labels map[string]string `json:"labels,omitempty"`
+	}
+	apiservers := []apiserver{}
+	for _, u := range urls {
+		apiservers = append(apiservers, apiserver{URL: u, Labels: labels[u]})
+	}
+	stdin, err := json.Marshal(struct {
+		Apiservers []apiserver `json:"apiservers"`
+	}{apiservers})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Env = append(os.Environ(), "KUBELET_MESH_APISERVERS="+strings.Join(urls, ","))
+	cmd.Stdin = bytes.NewReader(stdin)
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s: killed after %v: %s", command, timeout, bytes.TrimSpace(out))
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v: %s", command, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCAHookDebounces(t *testing.T) {
+	fired := make(chan []string, 10)
+	h := newCAHook("true", 50*time.Millisecond, []*RootCAPublicKey{caA}, newTextLogger(ioutil.Discard, "", 0))
+	h.run = func(fingerprints []string) error {
+		fired <- fingerprints
+		return nil
+	}
+	// Our own root CA isn't news, and neither is one we've seen.
+	h.observe([]*RootCAPublicKey{caA})
+	h.observe([]*RootCAPublicKey{caA, caB})
+	h.observe([]*RootCAPublicKey{caA, caB})
+	h.observe([]*RootCAPublicKey{caB, caC})
+	select {
+	case have := <-fired:
+		if want := []string{caB.fingerprint(), caC.fingerprint()}; !reflect.DeepEqual(want, have) {
+			t.Errorf("want %v, have %v", want, have)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("hook didn't fire")
+	}
+	select {
+	case have := <-fired:
+		t.Errorf("want one firing, have another with %v", have)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestExecCAChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet-mesh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "out")
+	if err := execCAChange(`echo "$KUBELET_MESH_CA_FINGERPRINTS" > `+out, []string{"sha256:aa", "sha256:bb"}); err != nil {
+		t.Fatal(err)
+	}
+	if have, err := ioutil.ReadFile(out); err != nil || string(have) != "sha256:aa sha256:bb\n" {
+		t.Errorf("want the fingerprints passed on, have %q, %v", have, err)
+	}
+	err = execCAChange("echo oops; exit 3", nil)
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("want the exit status and output, have %v", err)
+	}
+}
+
+func TestPostCAChange(t *testing.T) {
+	var have []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct{ Fingerprints []string }
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		have = body.Fingerprints
+		if r.URL.Path == "/fail" {
+			http.Error(w, "nope", http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+	if err := postCAChange(server.URL+"/hook", []string{"sha256:aa"}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"sha256:aa"}; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	if err := postCAChange(server.URL+"/fail", []string{"sha256:aa"}); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("want the status, have %v", err)
+	}
+}
+
+func TestAPIServerHookSerializes(t *testing.T) {
+	h := newAPIServerHook("true", 10*time.Millisecond, time.Minute, newTextLogger(ioutil.Discard, "", 0))
+	fired := make(chan []string, 10)
+	release := make(chan struct{})
+	var running, overlapped int32
+	h.run = func(urls []string, labels map[string]map[string]string) error {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.StoreInt32(&overlapped, 1)
+		}
+		defer atomic.AddInt32(&running, -1)
+		fired <- urls
+		<-release
+		return nil
+	}
+	h.observe([]string{"https://a:6443"}, nil)
+	first := <-fired
+	// Changes while it runs wait for it, and only the latest counts.
+	h.observe([]string{"https://a:6443", "https://b:6443"}, nil)
+	time.Sleep(50 * time.Millisecond)
+	h.observe([]string{"https://c:6443", "https://a:6443"}, nil)
+	// A new order isn't a new set.
+	h.observe([]string{"https://a:6443", "https://c:6443"}, nil)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	if want := []string{"https://a:6443"}; !reflect.DeepEqual(want, first) {
+		t.Errorf("want %v, have %v", want, first)
+	}
+	var rest [][]string
+	timeout := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case urls := <-fired:
+			rest = append(rest, urls)
+		case <-timeout:
+			done = true
+		}
+	}
+	if want := [][]string{{"https://c:6443", "https://a:6443"}}; !reflect.DeepEqual(want, rest) {
+		t.Errorf("want %v, have %v", want, rest)
+	}
+	if atomic.LoadInt32(&overlapped) != 0 {
+		t.Error("want runs serialized, have them overlap")
+	}
+}
+
+func TestExecAPIServerChange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet-mesh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	env, stdin := filepath.Join(dir, "env"), filepath.Join(dir, "stdin")
+	urls := []string{"https://a:6443", "https://b:6443"}
+	labels := map[string]map[string]string{"https://a:6443": {"zone": "z1"}}
+	if err := execAPIServerChange(`echo "$KUBELET_MESH_APISERVERS" > `+env+`; cat > `+stdin, time.Minute, urls, labels); err != nil {
+		t.Fatal(err)
+	}
+	if have, err := ioutil.ReadFile(env); err != nil || string(have) != "https://a:6443,https://b:6443\n" {
+		t.Errorf("want the apiservers in the environment, have %q, %v", have, err)
+	}
+	have, err := ioutil.ReadFile(stdin)
+	if want := `{"apiservers":[{"url":"https://a:6443","labels":{"zone":"z1"}},{"url":"https://b:6443"}]}`; err != nil || string(have) != want {
+		t.Errorf("want %s on stdin, have %s, %v", want, have, err)
+	}
+	err = execAPIServerChange("echo oops; exit 3", time.Minute, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") || !strings.Contains(err.Error(), "oops") {
+		t.Errorf("want the exit status and output, have %v", err)
+	}
+	start := time.Now()
+	err = execAPIServerChange("exec sleep 10", 100*time.Millisecond, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "killed") || time.Since(start) > 5*time.Second {
+		t.Errorf("want it killed after the timeout, have %v after %v", err, time.Since(start))
+	}
+}
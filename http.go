@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// newStatusHandler returns the handler for the optional HTTP server,
+// which lets operators inspect what a peer currently knows, and, if
+// targets isn't nil, change which peers it connects to.
+func newStatusHandler(p *peer, targets meshTargets) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/state", handleState(p))
+	mux.HandleFunc("/ready", handleReady(p))
+	mux.Handle("/metrics", promhttp.Handler())
+	if targets != nil {
+		mux.HandleFunc("/peers/connect", handlePeers(p, targets, true))
+		mux.HandleFunc("/peers/forget", handlePeers(p, targets, false))
+	}
+	return mux
+}
+
+// httpListenAddr is where to serve listen: as given, unless it has no
+// host and we're not serving TLS, in which case on loopback only.
+func httpListenAddr(listen string, tls bool) (string, error) {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", err
+	}
+	if host == "" && !tls {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// basicAuth is the credentials every request to the HTTP server needs.
+type basicAuth struct {
+	user, password string
+}
+
+// parseBasicAuth parses <user>:<password>.
+func parseBasicAuth(s string) (basicAuth, error) {
+	i := strings.Index(s, ":")
+	if i < 1 || i == len(s)-1 {
+		return basicAuth{}, errors.New("want <user>:<password>")
+	}
+	return basicAuth{user: s[:i], password: s[i+1:]}, nil
+}
+
+// withBasicAuth responds 401 to requests without auth's credentials.
+func withBasicAuth(h http.Handler, auth basicAuth) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(auth.user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(auth.password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="kubelet-mesh"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// meshTargets is the part of mesh.ConnectionMaker that /peers drives.
+type meshTargets interface {
+	connectionMaker
+	Targets(activeOnly bool) []string
+}
+
+// handlePeers connects to, or forgets, the peer addresses in the "peer"
+// form values, and responds with the addresses we now connect to.
+func handlePeers(p *peer, targets meshTargets, connect bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		peers := r.Form["peer"]
+		if len(peers) == 0 {
+			http.Error(w, "no peer given", http.StatusBadRequest)
+			return
+		}
+		if connect {
+			p.logger.Infof("Connecting to %v, on request from %s", peers, r.RemoteAddr)
+			if errs := targets.InitiateConnections(peers, false); len(errs) > 0 {
+				var msgs []string
+				for _, err := range errs {
+					msgs = append(msgs, err.Error())
+				}
+				http.Error(w, strings.Join(msgs, "\n"), http.StatusBadRequest)
+				return
+			}
+		} else {
+			p.logger.Infof("Forgetting %v, on request from %s", peers, r.RemoteAddr)
+			targets.ForgetConnections(peers)
+		}
+		current := targets.Targets(false)
+		sort.Strings(current)
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(struct {
+			Targets []string `json:"targets"`
+		}{append([]string{}, current...)}); err != nil {
+			p.logger.Errorf("POST %s: %v", r.URL.Path, err)
+		}
+	}
+}
+
+func handleState(p *peer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(p.snapshot()); err != nil {
+			p.logger.Errorf("GET /state: %v", err)
+		}
+	}
+}
+
+func handleReady(p *peer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !p.ready() {
+			http.Error(w, "waiting for bootstrap data", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok\n"))
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestHandleReady(t *testing.T) {
+	p := newTestPeer()
+	p.st.opts.readyMinCAs, p.st.opts.readyMinAPIServers = 1, 1
+	handler := newStatusHandler(p, nil)
+
+	for _, testcase := range []struct {
+		merge ClusterInfo
+		want  int
+	}{
+		{ClusterInfo{}, http.StatusServiceUnavailable},
+		{ClusterInfo{RootCAs: []*RootCAPublicKey{caA}}, http.StatusServiceUnavailable},
+		{ClusterInfo{ApiserverURLs: []string{"https://a:6443"}}, http.StatusOK},
+	} {
+		p.st.mergeComplete(testcase.merge)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/ready", nil))
+		if want, have := testcase.want, rec.Code; want != have {
+			t.Errorf("after %v: want %d, have %d", testcase.merge, want, have)
+		}
+	}
+}
+
+// fakeTargets is a fakeConnectionMaker that keeps track of its targets.
+type fakeTargets struct {
+	fakeConnectionMaker
+	targets map[string]bool
+}
+
+func (cm *fakeTargets) InitiateConnections(peers []string, replace bool) []error {
+	for _, peer := range peers {
+		cm.targets[peer] = true
+	}
+	return cm.fakeConnectionMaker.InitiateConnections(peers, replace)
+}
+
+func (cm *fakeTargets) ForgetConnections(peers []string) {
+	for _, peer := range peers {
+		delete(cm.targets, peer)
+	}
+	cm.fakeConnectionMaker.ForgetConnections(peers)
+}
+
+func (cm *fakeTargets) Targets(activeOnly bool) []string {
+	var targets []string
+	for target := range cm.targets {
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+func TestHandlePeers(t *testing.T) {
+	cm := &fakeTargets{targets: map[string]bool{"10.0.0.1:6783": true}}
+	handler := newStatusHandler(newTestPeer(), cm)
+	for _, testcase := range []struct {
+		method, path string
+		peers        []string
+		code         int
+		body         string
+	}{
+		{"POST", "/peers/connect", []string{"10.0.0.2:6783", "10.0.0.3:6783"}, http.StatusOK, `{"targets":["10.0.0.1:6783","10.0.0.2:6783","10.0.0.3:6783"]}`},
+		{"POST", "/peers/forget", []string{"10.0.0.1:6783"}, http.StatusOK, `{"targets":["10.0.0.2:6783","10.0.0.3:6783"]}`},
+		{"POST", "/peers/forget", nil, http.StatusBadRequest, "no peer given"},
+		{"GET", "/peers/forget", []string{"10.0.0.2:6783"}, http.StatusMethodNotAllowed, "method not allowed"},
+	} {
+		form := url.Values{"peer": testcase.peers}
+		req := httptest.NewRequest(testcase.method, testcase.path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != testcase.code || strings.TrimSpace(rec.Body.String()) != testcase.body {
+			t.Errorf("%s %s %v: want %d %s, have %d %s", testcase.method, testcase.path, testcase.peers, testcase.code, testcase.body, rec.Code, rec.Body)
+		}
+	}
+	if want, have := 1, len(cm.forgotten); want != have {
+		t.Errorf("want %d forget, have %d", want, have)
+	}
+
+	// Without targets, there's no /peers.
+	rec := httptest.NewRecorder()
+	newStatusHandler(newTestPeer(), nil).ServeHTTP(rec, httptest.NewRequest("POST", "/peers/forget", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("without targets: want %d, have %d", http.StatusNotFound, rec.Code)
+	}
+}
+
+func TestHTTPListenAddr(t *testing.T) {
+	for _, testcase := range []struct {
+		listen string
+		tls    bool
+		want   string
+	}{
+		{":8080", false, "127.0.0.1:8080"},
+		{":8080", true, ":8080"},
+		{"0.0.0.0:8080", false, "0.0.0.0:8080"},
+		{"[::1]:8080", false, "[::1]:8080"},
+	} {
+		have, err := httpListenAddr(testcase.listen, testcase.tls)
+		if err != nil || have != testcase.want {
+			t.Errorf("%s (tls: %v): want %s, have %s, %v", testcase.listen, testcase.tls, testcase.want, have, err)
+		}
+	}
+	if _, err := httpListenAddr("8080", false); err == nil {
+		t.Error("want an error without a port")
+	}
+}
+
+func TestWithBasicAuth(t *testing.T) {
+	auth, err := parseBasicAuth("admin:s3cr:et")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"", "admin", "admin:", ":secret"} {
+		if _, err := parseBasicAuth(s); err == nil {
+			t.Errorf("%q: want an error", s)
+		}
+	}
+	handler := withBasicAuth(newStatusHandler(newTestPeer(), nil), auth)
+	for _, testcase := range []struct {
+		user, password string
+		want           int
+	}{
+		{"admin", "s3cr:et", http.StatusOK},
+		{"admin", "wrong", http.StatusUnauthorized},
+		{"other", "s3cr:et", http.StatusUnauthorized},
+		{"", "", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest("GET", "/state", nil)
+		if testcase.user != "" {
+			req.SetBasicAuth(testcase.user, testcase.password)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code != testcase.want {
+			t.Errorf("%s:%s: want %d, have %d", testcase.user, testcase.password, testcase.want, rec.Code)
+		}
+		if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s:%s: want a WWW-Authenticate challenge", testcase.user, testcase.password)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// virtualInterfacePrefixes are interfaces that often share a MAC address
+// across hosts, or get a random one, so make poor peer names.
+var virtualInterfacePrefixes = []string{"docker", "veth", "cni"}
+
+func virtualInterface(iface net.Interface) bool {
+	for _, prefix := range virtualInterfacePrefixes {
+		if strings.HasPrefix(iface.Name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// locallyAdministered reports whether addr has the U/L bit set, i.e. was
+// made up rather than burned in by the vendor.
+func locallyAdministered(addr net.HardwareAddr) bool {
+	return len(addr) > 0 && addr[0]&0x02 != 0
+}
+
+// selectInterface picks the interface whose MAC address names us: the
+// one called name, if given, or else the first that isn't loopback and
+// doesn't look virtual, falling back to the first virtual one.
+func selectInterface(ifaces []net.Interface, name string) (net.Interface, bool) {
+	var fallback *net.Interface
+	for i, iface := range ifaces {
+		if len(iface.HardwareAddr) == 0 {
+			continue
+		}
+		if name != "" {
+			if iface.Name == name {
+				return iface, true
+			}
+			continue
+		}
+		if iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if virtualInterface(iface) {
+			if fallback == nil {
+				fallback = &ifaces[i]
+			}
+			continue
+		}
+		return iface, true
+	}
+	if fallback != nil {
+		return *fallback, true
+	}
+	return net.Interface{}, false
+}
+
+// hardwareAddr picks the interface whose MAC address names us, as
+// selectInterface does, or says how to name us instead.
+func hardwareAddr(name string) (net.Interface, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return net.Interface{}, fmt.Errorf("listing network interfaces: %v; set -hwaddr", err)
+	}
+	iface, ok := selectInterface(ifaces, name)
+	if !ok {
+		if name != "" {
+			return net.Interface{}, fmt.Errorf("hwaddr-interface: no network interface %s with a MAC address", name)
+		}
+		return net.Interface{}, errors.New("no network interface has a MAC address to name this peer by; set -hwaddr")
+	}
+	return iface, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSelectInterface(t *testing.T) {
+	mac := func(s string) net.HardwareAddr {
+		addr, err := net.ParseMAC(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return addr
+	}
+	lo := net.Interface{Name: "lo", Flags: net.FlagLoopback, HardwareAddr: mac("00:00:00:00:00:01")}
+	docker := net.Interface{Name: "docker0", HardwareAddr: mac("02:42:ac:11:00:01")}
+	veth := net.Interface{Name: "veth1234", HardwareAddr: mac("02:42:ac:11:00:02")}
+	tun := net.Interface{Name: "tun0"}
+	eth := net.Interface{Name: "eth0", HardwareAddr: mac("00:16:3e:00:00:01")}
+	for _, testcase := range []struct {
+		ifaces []net.Interface
+		name   string
+		want   string // "" for none
+	}{
+		{[]net.Interface{lo, docker, veth, tun, eth}, "", "eth0"},
+		{[]net.Interface{lo, veth, docker}, "", "veth1234"},
+		{[]net.Interface{lo, tun}, "", ""},
+		{[]net.Interface{lo, docker, eth}, "docker0", "docker0"},
+		{[]net.Interface{lo, docker, eth}, "tun0", ""},
+		{[]net.Interface{lo, tun, eth}, "tun0", ""},
+	} {
+		iface, ok := selectInterface(testcase.ifaces, testcase.name)
+		switch {
+		case testcase.want == "" && ok:
+			t.Errorf("%q: want no interface, have %s", testcase.name, iface.Name)
+		case testcase.want != "" && (!ok || iface.Name != testcase.want):
+			t.Errorf("%q: want %s, have %s (%v)", testcase.name, testcase.want, iface.Name, ok)
+		}
+	}
+}
+
+func TestLocallyAdministered(t *testing.T) {
+	for _, testcase := range []struct {
+		addr string
+		want bool
+	}{
+		{"00:16:3e:00:00:01", false},
+		{"02:42:ac:11:00:01", true},
+		{"fe:ff:ff:ff:ff:ff", true},
+		{"01:00:5e:00:00:01", false},
+	} {
+		addr, err := net.ParseMAC(testcase.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := locallyAdministered(addr); have != testcase.want {
+			t.Errorf("%s: want %v, have %v", testcase.addr, testcase.want, have)
+		}
+	}
+}
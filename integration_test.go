@@ -0,0 +1,320 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// memMesh stands in for mesh's transport, in process: broadcasts are
+// delivered to a peer's neighbours, and every round each peer gossips
+// its complete state to them, as mesh does every gossip interval. Mesh
+// itself relays further; here, state only spreads a hop per round, which
+// is enough to converge and makes the topology matter.
+type memMesh struct {
+	mtx        sync.Mutex
+	peers      []*peer
+	neighbours map[mesh.PeerName][]*peer
+	broadcasts map[mesh.PeerName]int
+	wg         sync.WaitGroup
+}
+
+// memGossip is one peer's mesh.Gossip on a memMesh.
+type memGossip struct {
+	m   *memMesh
+	src mesh.PeerName
+}
+
+func (g memGossip) GossipUnicast(dst mesh.PeerName, msg []byte) error {
+	for _, p := range g.m.neighboursOf(g.src) {
+		if p.self == dst {
+			g.m.deliver(func() { p.OnGossipUnicast(g.src, msg) })
+			return nil
+		}
+	}
+	return fmt.Errorf("%s: no route to %s", g.src, dst)
+}
+
+func (g memGossip) GossipBroadcast(update mesh.GossipData) {
+	g.m.mtx.Lock()
+	g.m.broadcasts[g.src]++
+	g.m.mtx.Unlock()
+	for _, p := range g.m.neighboursOf(g.src) {
+		for _, buf := range update.Encode() {
+			p, buf := p, buf
+			g.m.deliver(func() { p.OnGossipBroadcast(g.src, buf) })
+		}
+	}
+}
+
+// deliver runs f asynchronously, as the network would: a peer
+// broadcasts from its actions loop, and must not wait on another's.
+func (m *memMesh) deliver(f func()) {
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		f()
+	}()
+}
+
+func (m *memMesh) neighboursOf(name mesh.PeerName) []*peer {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	return m.neighbours[name]
+}
+
+// link connects peers i and j, both ways.
+func (m *memMesh) link(i, j int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	a, b := m.peers[i], m.peers[j]
+	m.neighbours[a.self] = append(m.neighbours[a.self], b)
+	m.neighbours[b.self] = append(m.neighbours[b.self], a)
+}
+
+// round has every peer gossip its complete state to its neighbours.
+func (m *memMesh) round() {
+	for _, p := range m.peers {
+		for _, buf := range p.Gossip().Encode() {
+			for _, q := range m.neighboursOf(p.self) {
+				q, buf := q, buf
+				m.deliver(func() { q.OnGossip(buf) })
+			}
+		}
+	}
+	m.wg.Wait()
+}
+
+// testPeerSeed is what one peer in a harness starts out with.
+type testPeerSeed struct {
+	cas        int // how many root CAs to seed, of generation 0
+	apiservers []string
+}
+
+// newMemMesh builds a peer for each of seeds with newPeerRouter, and
+// wires them up over a memMesh, unlinked.
+func newMemMesh(t *testing.T, opts peerOptions, seeds []testPeerSeed) *memMesh {
+	m := &memMesh{neighbours: map[mesh.PeerName][]*peer{}, broadcasts: map[mesh.PeerName]int{}}
+	for i, seed := range seeds {
+		name := mesh.PeerName(i + 1)
+		var cas []*RootCAPublicKey
+		for j := 0; j < seed.cas; j++ {
+			// Root CAs with the same subject would conflict, and none
+			// be trusted.
+			template := testCATemplate
+			template.Subject.CommonName = fmt.Sprintf("peer-%d-ca-%d", i+1, j)
+			cas = append(cas, newRootCAPublicKey(newTestCert(t, template), 0, name))
+		}
+		_, p, err := newPeerRouter(peerConfig{
+			mesh:       mesh.Config{Host: "127.0.0.1", Port: 0},
+			name:       name,
+			nickname:   fmt.Sprintf("peer-%d", i+1),
+			certs:      cas,
+			apiservers: seed.apiservers,
+			opts:       opts,
+			logger:     newTextLogger(ioutil.Discard, "", 0),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Swap the router's gossip for ours.
+		p.register(memGossip{m: m, src: name})
+		m.peers = append(m.peers, p)
+	}
+	return m
+}
+
+func (m *memMesh) stop() {
+	m.wg.Wait()
+	for _, p := range m.peers {
+		p.stop()
+	}
+}
+
+// convergenceView is what must converge: every root CA and apiserver URL in a
+// peer's state, and which root CAs it trusts.
+type convergenceView struct {
+	RootCAs, Trusted, ApiserverURLs []string
+}
+
+func (p *peer) convergenceView() convergenceView {
+	p.st.mtx.RLock()
+	defer p.st.mtx.RUnlock()
+	var v convergenceView
+	for _, ca := range p.st.set.RootCAs {
+		v.RootCAs = append(v.RootCAs, ca.fingerprint())
+	}
+	for _, ca := range p.st.trustedRootCAs() {
+		v.Trusted = append(v.Trusted, ca.fingerprint())
+	}
+	v.ApiserverURLs = append(v.ApiserverURLs, p.st.set.ApiserverURLs...)
+	sort.Strings(v.RootCAs)
+	sort.Strings(v.Trusted)
+	return v
+}
+
+// converge runs rounds until every peer has the same view, and it is
+// want, or fails after timeout.
+func (m *memMesh) converge(t *testing.T, want func(convergenceView) bool, timeout time.Duration) convergenceView {
+	deadline := time.Now().Add(timeout)
+	for rounds := 1; ; rounds++ {
+		m.round()
+		views := make([]convergenceView, len(m.peers))
+		same := true
+		for i, p := range m.peers {
+			views[i] = p.convergenceView()
+			same = same && reflect.DeepEqual(views[0], views[i])
+		}
+		if same && want(views[0]) {
+			t.Logf("converged after %d round(s)", rounds)
+			return views[0]
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no convergence after %d rounds in %v: %+v", rounds, timeout, views)
+		}
+	}
+}
+
+func TestPeersConverge(t *testing.T) {
+	const n = 5
+	var seeds []testPeerSeed
+	var urls []string
+	for i := 0; i < n; i++ {
+		u := fmt.Sprintf("https://apiserver-%d:6443", i)
+		urls = append(urls, u)
+		seeds = append(seeds, testPeerSeed{cas: 1, apiservers: []string{u}})
+	}
+	// Peers that know nothing converge too.
+	seeds = append(seeds, testPeerSeed{}, testPeerSeed{})
+
+	for _, topology := range []struct {
+		name  string
+		links func(m *memMesh)
+	}{
+		{"full", func(m *memMesh) {
+			for i := range m.peers {
+				for j := i + 1; j < len(m.peers); j++ {
+					m.link(i, j)
+				}
+			}
+		}},
+		{"line", func(m *memMesh) {
+			for i := 1; i < len(m.peers); i++ {
+				m.link(i-1, i)
+			}
+		}},
+		{"star", func(m *memMesh) {
+			for i := 1; i < len(m.peers); i++ {
+				m.link(0, i)
+			}
+		}},
+	} {
+		t.Run(topology.name, func(t *testing.T) {
+			m := newMemMesh(t, peerOptions{}, seeds)
+			defer m.stop()
+			var cas []string
+			for _, p := range m.peers {
+				cas = append(cas, p.convergenceView().RootCAs...)
+			}
+			sort.Strings(cas)
+			topology.links(m)
+			v := m.converge(t, func(v convergenceView) bool {
+				return reflect.DeepEqual(v.RootCAs, cas) && reflect.DeepEqual(v.ApiserverURLs, urls)
+			}, 5*time.Second)
+			// Seeds of the same generation conflict, and everybody
+			// must pick the same winner.
+			if len(v.Trusted) != 1 {
+				t.Errorf("want one trusted root CA, have %v", v.Trusted)
+			}
+		})
+	}
+}
+
+func TestPeersConvergeOnRemoval(t *testing.T) {
+	m := newMemMesh(t, peerOptions{}, []testPeerSeed{
+		{cas: 1, apiservers: []string{"https://a:6443"}},
+		{apiservers: []string{"https://b:6443"}},
+		{},
+	})
+	defer m.stop()
+	m.link(0, 1)
+	m.link(1, 2)
+	m.converge(t, func(v convergenceView) bool { return len(v.ApiserverURLs) == 2 }, 5*time.Second)
+
+	m.peers[2].removeAPIServers([]string{"https://b:6443"}, time.Now(), time.Hour)
+	v := m.converge(t, func(v convergenceView) bool { return len(v.ApiserverURLs) == 1 }, 5*time.Second)
+	if want := []string{"https://a:6443"}; !reflect.DeepEqual(want, v.ApiserverURLs) {
+		t.Errorf("want %v, have %v", want, v.ApiserverURLs)
+	}
+}
+
+func TestLocalChangesBroadcastAtOnce(t *testing.T) {
+	m := newMemMesh(t, peerOptions{broadcastDelay: 20 * time.Millisecond}, []testPeerSeed{{cas: 1}, {}, {}})
+	defer m.stop()
+	for i := range m.peers {
+		for j := i + 1; j < len(m.peers); j++ {
+			m.link(i, j)
+		}
+	}
+	m.converge(t, func(v convergenceView) bool { return len(v.RootCAs) == 1 }, 5*time.Second)
+	m.wg.Wait()
+	m.mtx.Lock()
+	before := m.broadcasts[m.peers[0].self]
+	m.mtx.Unlock()
+
+	// Several changes in quick succession, and no more rounds: only the
+	// broadcast can carry them, well before periodic gossip would.
+	start := time.Now()
+	template := testCATemplate
+	template.Subject.CommonName = "reloaded"
+	m.peers[0].reloadRootCAs([]*x509.Certificate{newTestCert(t, template)})
+	m.peers[0].removeAPIServers([]string{"https://gone:6443"}, time.Now(), time.Hour)
+	want := m.peers[0].convergenceView()
+	for _, p := range m.peers {
+		for !reflect.DeepEqual(p.convergenceView(), want) {
+			if time.Since(start) > time.Second {
+				t.Fatalf("%s: want %+v, have %+v", p.self, want, p.convergenceView())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	t.Logf("reached every peer in %v", time.Since(start))
+
+	m.wg.Wait()
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	if have := m.broadcasts[m.peers[0].self] - before; have != 1 {
+		t.Errorf("want the changes coalesced into one broadcast, have %d", have)
+	}
+}
+
+func TestNewPeerRouter(t *testing.T) {
+	for _, testcase := range []struct {
+		name string
+		cfg  peerConfig
+		ok   bool
+	}{
+		{"ok", peerConfig{name: 1, mesh: mesh.Config{Host: "127.0.0.1", Port: mesh.Port}}, true},
+		{"no name", peerConfig{mesh: mesh.Config{Port: mesh.Port}}, false},
+		{"bad port", peerConfig{name: 1, mesh: mesh.Config{Port: 70000}}, false},
+	} {
+		router, p, err := newPeerRouter(testcase.cfg)
+		if testcase.ok != (err == nil) {
+			t.Errorf("%s: want ok %v, have %v", testcase.name, testcase.ok, err)
+			continue
+		}
+		if err == nil {
+			if router == nil || p == nil || p.self != testcase.cfg.name {
+				t.Errorf("%s: want a router and peer %s, have %v, %v", testcase.name, testcase.cfg.name, router, p)
+			}
+			p.stop()
+		}
+	}
+}
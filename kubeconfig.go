@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"text/template"
+)
+
+var kubeconfigTemplate = template.Must(template.New("kubeconfig").Parse(`apiVersion: v1
+kind: Config
+clusters:
+- name: kubernetes
+  cluster:
+    certificate-authority-data: {{.CAData}}
+    server: {{.Server}}
+{{- if .Token}}
+users:
+- name: kubelet-bootstrap
+  user:
+    token: {{.Token}}
+{{- end}}
+contexts:
+- name: kubelet-mesh
+  context:
+    cluster: kubernetes
+{{- if .Token}}
+    user: kubelet-bootstrap
+{{- end}}
+current-context: kubelet-mesh
+`))
+
+// renderKubeconfig renders a kubeconfig pointing at server,
+// trusting the PEM bundle caData, and authenticating with the
+// bootstrap token, if not empty.
+func renderKubeconfig(caData []byte, server, token string) []byte {
+	var buf bytes.Buffer
+	if err := kubeconfigTemplate.Execute(&buf, struct {
+		CAData, Server, Token string
+	}{
+		CAData: base64.StdEncoding.EncodeToString(caData),
+		Server: server,
+		Token:  token,
+	}); err != nil {
+		panic(err) // the template and its data are both ours
+	}
+	return buf.Bytes()
+}
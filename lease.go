@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// APIServerLease keeps an apiserver URL in the mesh for as long as the
+// peer advertising it keeps refreshing it. The TTL travels with it, so
+// every peer expires it at the same time, whatever its own -apiserver-ttl.
+// A zero TTL never expires.
+type APIServerLease struct {
+	URL       string
+	Peer      mesh.PeerName
+	Refreshed time.Time
+	TTL       time.Duration
+	// Since is when the peer started advertising the URL; only a lease
+	// since after the URL was removed brings it back.
+	Since time.Time
+	// Priority and Weight order the URL in what we write out; zero
+	// means the default.
+	Priority int
+	Weight   int
+	// Labels are the peer's key=value labels for the URL, such as its
+	// zone.
+	Labels map[string]string
+	// ServingCertHash is the spkiHash of the URL's serving certificate,
+	// as the peer last fetched it, if it did.
+	ServingCertHash string
+	// Nickname is the peer's, so operators can tell where a URL came
+	// from.
+	Nickname string
+	// Stamp is the peer's, from its latest refresh.
+	Stamp Stamp
+}
+
+func (l *APIServerLease) String() string {
+	return fmt.Sprintf("%s from %s refreshed at %v for %v", l.URL, l.Peer, l.Refreshed, l.TTL)
+}
+
+func (l *APIServerLease) key() string {
+	return l.Peer.String() + " " + l.URL
+}
+
+func (l *APIServerLease) expired(now time.Time) bool {
+	return l.TTL > 0 && now.Sub(l.Refreshed) > l.TTL
+}
+
+// forgotten reports whether we can drop the lease itself. We keep it for
+// another TTL after it expires, so that peers which don't track leases
+// can't gossip its URL straight back in.
+func (l *APIServerLease) forgotten(now time.Time) bool {
+	return l.TTL > 0 && now.Sub(l.Refreshed) > 2*l.TTL
+}
+
+// mergeAPIServerLeases keeps the latest refresh of each URL by each peer.
+func mergeAPIServerLeases(ours, theirs []*APIServerLease) (result, delta []*APIServerLease) {
+	all := append(append([]*APIServerLease(nil), ours...), theirs...)
+	keep, changed := mergeKeyed(len(ours), len(theirs),
+		func(i int) string { return all[i].key() },
+		func(i, j int) bool { return preferAPIServerLease(all[i], all[j]) })
+	for _, i := range keep {
+		result = append(result, all[i])
+	}
+	for _, i := range changed {
+		delta = append(delta, all[i])
+	}
+	sortAPIServerLeases(result)
+	sortAPIServerLeases(delta)
+	return result, delta
+}
+
+// preferAPIServerLease decides between two leases of the same URL by
+// the same peer: the latest stamp, then the latest refresh, then the
+// longest TTL, then the highest priority, then the lowest labels, then
+// the lowest hash, then the lowest nickname.
+func preferAPIServerLease(a, b *APIServerLease) bool {
+	if a.Stamp != b.Stamp {
+		return a.Stamp.after(b.Stamp)
+	}
+	if !a.Refreshed.Equal(b.Refreshed) {
+		return a.Refreshed.After(b.Refreshed)
+	}
+	if a.TTL != b.TTL {
+		return a.TTL > b.TTL
+	}
+	if pa, pb := leasePriority(a), leasePriority(b); pa != pb {
+		return pa.before(pb)
+	}
+	if la, lb := formatLabels(a.Labels), formatLabels(b.Labels); la != lb {
+		return la < lb
+	}
+	if a.ServingCertHash != b.ServingCertHash {
+		return a.ServingCertHash < b.ServingCertHash
+	}
+	return a.Nickname < b.Nickname
+}
+
+// formatLabels formats labels as sorted key=value pairs.
+func formatLabels(labels map[string]string) string {
+	var pairs []string
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func sortAPIServerLeases(leases []*APIServerLease) {
+	sort.Slice(leases, func(i, j int) bool {
+		if leases[i].URL != leases[j].URL {
+			return leases[i].URL < leases[j].URL
+		}
+		return leases[i].Peer < leases[j].Peer
+	})
+}
+
+// expiredAPIServerURLs is the URLs with leases, none of them unexpired.
+// URLs nobody ever leased, from peers that predate leases, never expire.
+func expiredAPIServerURLs(leases []*APIServerLease, now time.Time) map[string]bool {
+	expired := map[string]bool{}
+	for _, l := range leases {
+		u := normalizeAPIServerURL(l.URL)
+		if _, ok := expired[u]; !ok {
+			expired[u] = true
+		}
+		if !l.expired(now) {
+			expired[u] = false
+		}
+	}
+	return expired
+}
+
+// apiserverOrigin is a peer that advertises an apiserver URL.
+type apiserverOrigin struct {
+	Peer     string `json:"peer"`
+	Nickname string `json:"nickname,omitempty"`
+}
+
+func (o apiserverOrigin) String() string {
+	if o.Nickname == "" {
+		return o.Peer
+	}
+	return fmt.Sprintf("%s (%s)", o.Peer, o.Nickname)
+}
+
+// apiserverOrigins is the peers whose unexpired leases advertise each
+// URL, in order of peer, as the leases are sorted. URLs from peers that
+// predate leases have none.
+func apiserverOrigins(leases []*APIServerLease, now time.Time) map[string][]apiserverOrigin {
+	origins := map[string][]apiserverOrigin{}
+	for _, l := range leases {
+		if !l.expired(now) {
+			u := normalizeAPIServerURL(l.URL)
+			origins[u] = append(origins[u], apiserverOrigin{Peer: l.Peer.String(), Nickname: l.Nickname})
+		}
+	}
+	return origins
+}
+
+// formatOrigins is origins for the logs.
+func formatOrigins(origins []apiserverOrigin) string {
+	if len(origins) == 0 {
+		return "an unknown peer"
+	}
+	var s []string
+	for _, o := range origins {
+		s = append(s, o.String())
+	}
+	return strings.Join(s, ", ")
+}
+
+// refresh renews the leases of the apiserver URLs we advertise.
+func (st *state) refresh(now time.Time) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	if len(st.advertised) == 0 {
+		return
+	}
+	// Other peers only get the wall clock reading, in UTC.
+	now = now.UTC()
+	var (
+		leases  []*APIServerLease
+		sources []*APIServerSource
+		stamp   = st.clock.stamp(st.self, now)
+	)
+	for _, u := range st.advertised {
+		l := &APIServerLease{URL: u, Peer: st.self, Refreshed: now, TTL: st.opts.apiserverTTL, Since: st.advertisedSince[u], Stamp: stamp}
+		if pri, ok := st.opts.apiserverPriorities[u]; ok {
+			l.Priority, l.Weight = pri.Priority, pri.Weight
+		}
+		if labels, ok := st.opts.apiserverLabels[u]; ok {
+			l.Labels = labels
+		}
+		l.ServingCertHash = st.servingCertHashes[u]
+		l.Nickname = st.nickname
+		leases = append(leases, l)
+		// Only the earliest source of a URL sticks, so this is a no-op
+		// for those another peer introduced before us.
+		sources = append(sources, &APIServerSource{URL: u, Peer: st.self, FirstSeen: st.advertisedSince[u]})
+	}
+	// The URLs too, for those we only just started advertising.
+	st.merge(ClusterInfo{ApiserverURLs: st.advertised, APIServerLeases: leases, APIServerSources: sources}, now)
+}
+
+// advertise swaps the apiserver URLs we advertise for those in as, with
+// their priorities and labels. We stop refreshing the leases of those we
+// drop, so they expire everywhere after their TTL.
+func (st *state) advertise(as *apiserverset, now time.Time) (added, removed []string) {
+	st.mtx.Lock()
+	urls := normalizeAPIServerURLs(as.slice())
+	sort.Strings(urls)
+	since := map[string]time.Time{}
+	for _, u := range urls {
+		if t, ok := st.advertisedSince[u]; ok {
+			since[u] = t
+			continue
+		}
+		since[u] = st.clock.read(now)
+		added = append(added, u)
+	}
+	for _, u := range st.advertised {
+		if _, ok := since[u]; !ok {
+			removed = append(removed, u)
+		}
+	}
+	st.advertised, st.advertisedSince = urls, since
+	st.opts.apiserverPriorities, st.opts.apiserverLabels = as.priorities, as.labels
+	st.mtx.Unlock()
+	st.refresh(now)
+	return added, removed
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+func TestMergeAPIServerLeases(t *testing.T) {
+	t0 := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	a0 := &APIServerLease{URL: "https://a", Peer: 1, Refreshed: t0, TTL: time.Hour}
+	a1 := &APIServerLease{URL: "https://a", Peer: 1, Refreshed: t0.Add(time.Minute), TTL: time.Hour}
+	a0long := &APIServerLease{URL: "https://a", Peer: 1, Refreshed: t0, TTL: 2 * time.Hour}
+	b0 := &APIServerLease{URL: "https://a", Peer: 2, Refreshed: t0, TTL: time.Hour}
+	for _, testcase := range []struct {
+		ours, theirs  []*APIServerLease
+		result, delta []*APIServerLease
+	}{
+		{nil, []*APIServerLease{a0}, []*APIServerLease{a0}, []*APIServerLease{a0}},
+		{[]*APIServerLease{a0}, []*APIServerLease{a0}, []*APIServerLease{a0}, nil},
+		{[]*APIServerLease{a0}, []*APIServerLease{a1}, []*APIServerLease{a1}, []*APIServerLease{a1}},
+		{[]*APIServerLease{a1}, []*APIServerLease{a0}, []*APIServerLease{a1}, nil},
+		{[]*APIServerLease{a0}, []*APIServerLease{a0long}, []*APIServerLease{a0long}, []*APIServerLease{a0long}},
+		{[]*APIServerLease{b0}, []*APIServerLease{a0}, []*APIServerLease{a0, b0}, []*APIServerLease{a0}},
+	} {
+		result, delta := mergeAPIServerLeases(testcase.ours, testcase.theirs)
+		if !reflect.DeepEqual(testcase.result, result) {
+			t.Errorf("mergeAPIServerLeases(%v, %v): want result %v, have %v", testcase.ours, testcase.theirs, testcase.result, result)
+		}
+		if !reflect.DeepEqual(testcase.delta, delta) {
+			t.Errorf("mergeAPIServerLeases(%v, %v): want delta %v, have %v", testcase.ours, testcase.theirs, testcase.delta, delta)
+		}
+	}
+}
+
+func TestExpiredAPIServerURLs(t *testing.T) {
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	leases := []*APIServerLease{
+		{URL: "https://a", Peer: 1, Refreshed: now.Add(-2 * time.Hour), TTL: time.Hour},
+		{URL: "https://a", Peer: 2, Refreshed: now.Add(-time.Minute), TTL: time.Hour},
+		{URL: "https://B:443", Peer: 1, Refreshed: now.Add(-2 * time.Hour), TTL: time.Hour},
+	}
+	want := map[string]bool{"https://a": false, "https://b": true}
+	if have := expiredAPIServerURLs(leases, now); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestStateExpiresAPIServerURLs(t *testing.T) {
+	logger := newTextLogger(ioutil.Discard, "", 0)
+	seed := newNodeBootstrapPeer(mesh.PeerName(1), "seed", nil, []string{"https://a:6443"}, peerOptions{skipCAValidation: true, apiserverTTL: time.Hour}, logger)
+	// The receiver's own TTL doesn't matter; the lease's does.
+	p := newNodeBootstrapPeer(mesh.PeerName(2), "test", nil, nil, peerOptions{skipCAValidation: true, apiserverTTL: time.Minute}, logger)
+	legacy := ClusterInfo{ApiserverURLs: []string{"https://legacy:6443"}}
+	p.st.mergeComplete(legacy)
+	p.st.mergeComplete(seed.st.copy().set)
+	if want, have := []string{"https://a:6443", "https://legacy:6443"}, p.st.set.ApiserverURLs; !reflect.DeepEqual(want, have) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+	refreshed := seed.st.set.APIServerLeases[0].Refreshed
+
+	// A partition shorter than the TTL keeps the URL.
+	p.st.expire(refreshed.Add(59 * time.Minute))
+	if want, have := []string{"https://a:6443", "https://legacy:6443"}, p.st.set.ApiserverURLs; !reflect.DeepEqual(want, have) {
+		t.Errorf("before the TTL: want %v, have %v", want, have)
+	}
+
+	p.st.expire(refreshed.Add(61 * time.Minute))
+	if want, have := []string{"https://legacy:6443"}, p.st.set.ApiserverURLs; !reflect.DeepEqual(want, have) {
+		t.Errorf("after the TTL: want %v, have %v", want, have)
+	}
+	// Peers that don't know about leases can't gossip it back.
+	if d := p.st.merge(ClusterInfo{ApiserverURLs: []string{"https://a:6443"}}, refreshed.Add(62*time.Minute)); len(d.ApiserverURLs) != 0 {
+		t.Errorf("want the expired URL ignored, have delta %v", d.ApiserverURLs)
+	}
+	if want, have := []string{"https://legacy:6443"}, p.st.set.ApiserverURLs; !reflect.DeepEqual(want, have) {
+		t.Errorf("after re-gossip: want %v, have %v", want, have)
+	}
+
+	// Once the seed is back, so is its URL.
+	seed.st.refresh(refreshed.Add(63 * time.Minute))
+	p.st.merge(seed.st.copy().set, refreshed.Add(63*time.Minute))
+	if want, have := []string{"https://a:6443", "https://legacy:6443"}, p.st.set.ApiserverURLs; !reflect.DeepEqual(want, have) {
+		t.Errorf("after a refresh: want %v, have %v", want, have)
+	}
+}
+
+func TestAPIServerLabelsGossip(t *testing.T) {
+	logger := newTextLogger(ioutil.Discard, "", 0)
+	labels := map[string]map[string]string{"https://api-z1:6443": {"zone": "eu-west-1a"}}
+	seed := newNodeBootstrapPeer(mesh.PeerName(1), "seed", nil, []string{"https://api-z1:6443", "https://api-z2:6443"}, peerOptions{skipCAValidation: true, apiserverLabels: labels}, logger)
+	set, err := decodeClusterInfo(encodeGossip(seed.st.copy().set, nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newNodeBootstrapPeer(mesh.PeerName(2), "test", nil, nil, peerOptions{skipCAValidation: true}, logger)
+	p.st.mergeComplete(set)
+	if want, have := labels, p.snapshot().ApiserverLabels; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestAPIServerOrigins(t *testing.T) {
+	var logs bytes.Buffer
+	discard := newTextLogger(ioutil.Discard, "", 0)
+	seed1 := newNodeBootstrapPeer(mesh.PeerName(1), "master-1", nil, []string{"https://a:6443", "https://b:6443"}, peerOptions{skipCAValidation: true}, discard)
+	seed2 := newNodeBootstrapPeer(mesh.PeerName(2), "master-2", nil, []string{"https://a:6443"}, peerOptions{skipCAValidation: true}, discard)
+	p := newNodeBootstrapPeer(mesh.PeerName(3), "test", nil, nil, peerOptions{skipCAValidation: true}, newTextLogger(&logs, "", 0))
+	legacy := ClusterInfo{ApiserverURLs: []string{"https://legacy:6443"}}
+	for _, set := range []ClusterInfo{seed1.st.copy().set, seed2.st.copy().set, legacy} {
+		set, err := decodeClusterInfo(encodeGossip(set, nil), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.st.mergeComplete(set)
+	}
+	want := map[string][]apiserverOrigin{
+		"https://a:6443": {{Peer: mesh.PeerName(1).String(), Nickname: "master-1"}, {Peer: mesh.PeerName(2).String(), Nickname: "master-2"}},
+		"https://b:6443": {{Peer: mesh.PeerName(1).String(), Nickname: "master-1"}},
+	}
+	if have := p.snapshot().ApiserverOrigins; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	for _, line := range []string{
+		"Learned apiserver URL https://a:6443, advertised by " + mesh.PeerName(1).String() + " (master-1)",
+		"Learned apiserver URL https://legacy:6443, advertised by an unknown peer",
+	} {
+		if !strings.Contains(logs.String(), line) {
+			t.Errorf("want %q logged, have\n%s", line, logs.String())
+		}
+	}
+}
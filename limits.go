@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var gossipRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "kubelet_mesh",
+	Name:      "gossip_messages_rejected_total",
+	Help:      "Gossip messages dropped for exceeding the payload limits, by the limit.",
+}, []string{"limit"})
+
+func init() {
+	prometheus.MustRegister(gossipRejected)
+}
+
+// payloadLimits bound the gossip we decode, so that a hostile or buggy
+// peer can't inflate every node's memory. Zero is no limit.
+type payloadLimits struct {
+	// maxBytes is the largest payload we decode at all. It is checked
+	// first, so it also bounds what decoding allocates, which for either
+	// wire version grows with the payload, not with what it claims; and
+	// again for what a compressed payload inflates to.
+	maxBytes int
+	// maxAPIServers is the most entries of each kind about apiservers,
+	// from URLs to probes.
+	maxAPIServers int
+	// maxURLLength is the longest apiserver URL.
+	maxURLLength int
+	// maxCertBytes is the largest DER certificate, of a CA or its chain.
+	maxCertBytes int
+}
+
+// payloadLimitError is a payload over payloadLimits; limit labels
+// gossipRejected.
+type payloadLimitError struct {
+	limit, msg string
+}
+
+func (e *payloadLimitError) Error() string {
+	return e.msg
+}
+
+func overLimit(limit, format string, args ...interface{}) error {
+	return &payloadLimitError{limit: limit, msg: fmt.Sprintf(format, args...)}
+}
+
+// checkSize checks a raw payload, before we decrypt or decode it.
+func (l payloadLimits) checkSize(buf []byte) error {
+	if l.maxBytes > 0 && len(buf) > l.maxBytes {
+		return overLimit("bytes", "payload of %d bytes, over the limit of %d", len(buf), l.maxBytes)
+	}
+	return nil
+}
+
+// check checks the shape of a decoded payload.
+func (l payloadLimits) check(set ClusterInfo) error {
+	if l.maxAPIServers > 0 {
+		for _, list := range []struct {
+			what string
+			n    int
+		}{
+			{"apiserver URLs", len(set.ApiserverURLs)},
+			{"apiserver leases", len(set.APIServerLeases)},
+			{"apiserver tombstones", len(set.APIServerTombstones)},
+			{"resolved apiservers", len(set.ResolvedAPIServers)},
+			{"apiserver probes", len(set.Probes)},
+			{"apiserver sources", len(set.APIServerSources)},
+		} {
+			if list.n > l.maxAPIServers {
+				return overLimit("apiservers", "%d %s, over the limit of %d", list.n, list.what, l.maxAPIServers)
+			}
+		}
+		for _, a := range set.Attestations {
+			if len(a.ApiserverURLs) > l.maxAPIServers {
+				return overLimit("apiservers", "an attestation of %d apiserver URLs, over the limit of %d", len(a.ApiserverURLs), l.maxAPIServers)
+			}
+		}
+	}
+	if l.maxURLLength > 0 {
+		var urls []string
+		urls = append(urls, set.ApiserverURLs...)
+		for _, x := range set.APIServerLeases {
+			urls = append(urls, x.URL)
+		}
+		for _, x := range set.APIServerTombstones {
+			urls = append(urls, x.URL)
+		}
+		for _, x := range set.ResolvedAPIServers {
+			urls = append(urls, x.URL)
+		}
+		for _, x := range set.Probes {
+			urls = append(urls, x.URL)
+		}
+		for _, x := range set.APIServerSources {
+			urls = append(urls, x.URL)
+		}
+		for _, a := range set.Attestations {
+			urls = append(urls, a.ApiserverURLs...)
+		}
+		for _, u := range urls {
+			if len(u) > l.maxURLLength {
+				return overLimit("url", "an apiserver URL of %d bytes, over the limit of %d", len(u), l.maxURLLength)
+			}
+		}
+	}
+	if l.maxCertBytes > 0 {
+		cas := set.RootCAs
+		for _, slot := range set.CASlots {
+			cas = append(cas[:len(cas):len(cas)], slot...)
+		}
+		for _, ca := range cas {
+			for _, der := range append([][]byte{ca.Bytes}, ca.Chain...) {
+				if len(der) > l.maxCertBytes {
+					return overLimit("cert", "a certificate of %d bytes, over the limit of %d", len(der), l.maxCertBytes)
+				}
+			}
+		}
+		for _, a := range set.Attestations {
+			if len(a.RootCA) > l.maxCertBytes {
+				return overLimit("cert", "an attestation naming a root CA of %d bytes, over the limit of %d", len(a.RootCA), l.maxCertBytes)
+			}
+		}
+	}
+	return nil
+}
+
+// rejectLogInterval is how often we log payloads rejected from the same
+// source, which may well resend them with every gossip.
+const rejectLogInterval = time.Minute
+
+// rejectLog rate-limits the logging of rejected payloads, by source.
+type rejectLog struct {
+	n      uint64 // payloads rejected; atomic, and first, to be 64-bit aligned
+	mtx    sync.Mutex
+	logged map[string]time.Time
+}
+
+// reject counts a payload rejected from source, and reports whether to
+// log it: the first time, and then once every rejectLogInterval.
+func (r *rejectLog) reject(source string, now time.Time) bool {
+	atomic.AddUint64(&r.n, 1)
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.logged == nil {
+		r.logged = map[string]time.Time{}
+	}
+	if last, ok := r.logged[source]; ok && now.Sub(last) < rejectLogInterval {
+		return false
+	}
+	for s, last := range r.logged {
+		if now.Sub(last) >= rejectLogInterval {
+			delete(r.logged, s)
+		}
+	}
+	r.logged[source] = now
+	return true
+}
+
+func (r *rejectLog) count() uint64 {
+	return atomic.LoadUint64(&r.n)
+}
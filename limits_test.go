@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+func TestPayloadLimits(t *testing.T) {
+	limits := payloadLimits{maxBytes: 100, maxAPIServers: 2, maxURLLength: 30, maxCertBytes: 10}
+	urls := func(n int) []string {
+		var us []string
+		for i := 0; i < n; i++ {
+			us = append(us, fmt.Sprintf("https://a-%d:6443", i))
+		}
+		return us
+	}
+	for _, testcase := range []struct {
+		name  string
+		set   ClusterInfo
+		limit string // "" if within the limits
+	}{
+		{"empty", ClusterInfo{}, ""},
+		{"at the limits", ClusterInfo{
+			ApiserverURLs: urls(2),
+			RootCAs:       []*RootCAPublicKey{{Bytes: make([]byte, 10), Chain: [][]byte{make([]byte, 10)}}},
+		}, ""},
+		{"too many URLs", ClusterInfo{ApiserverURLs: urls(3)}, "apiservers"},
+		{"too many probes", ClusterInfo{Probes: []*APIServerProbe{{URL: "a"}, {URL: "b"}, {URL: "c"}}}, "apiservers"},
+		{"attestation of too many URLs", ClusterInfo{Attestations: []*Attestation{{ApiserverURLs: urls(3)}}}, "apiservers"},
+		{"long URL", ClusterInfo{ApiserverURLs: []string{"https://" + strings.Repeat("a", 30)}}, "url"},
+		{"long lease URL", ClusterInfo{APIServerLeases: []*APIServerLease{{URL: "https://" + strings.Repeat("a", 30)}}}, "url"},
+		{"big root CA", ClusterInfo{RootCAs: []*RootCAPublicKey{{Bytes: make([]byte, 11)}}}, "cert"},
+		{"big intermediate", ClusterInfo{RootCAs: []*RootCAPublicKey{{Chain: [][]byte{make([]byte, 11)}}}}, "cert"},
+		{"big slot CA", ClusterInfo{CASlots: map[string][]*RootCAPublicKey{"front-proxy": {{Bytes: make([]byte, 11)}}}}, "cert"},
+	} {
+		err := limits.check(testcase.set)
+		if testcase.limit == "" {
+			if err != nil {
+				t.Errorf("%s: %v", testcase.name, err)
+			}
+			continue
+		}
+		if e, ok := err.(*payloadLimitError); !ok || e.limit != testcase.limit {
+			t.Errorf("%s: want over the %s limit, have %v", testcase.name, testcase.limit, err)
+		}
+	}
+	if err := limits.checkSize(make([]byte, 100)); err != nil {
+		t.Error(err)
+	}
+	if err := limits.checkSize(make([]byte, 101)); err == nil {
+		t.Error("101 bytes: want an error")
+	}
+	if err := (payloadLimits{}).check(ClusterInfo{ApiserverURLs: urls(1000)}); err != nil {
+		t.Errorf("no limits: %v", err)
+	}
+}
+
+func TestPeerDropsPayloadsOverLimits(t *testing.T) {
+	var logs bytes.Buffer
+	p := newNodeBootstrapPeer(mesh.PeerName(1), "test", nil, nil, peerOptions{
+		skipCAValidation: true,
+		limits:           payloadLimits{maxBytes: 1 << 10, maxAPIServers: 4},
+	}, newTextLogger(&logs, "", 0))
+	defer p.stop()
+
+	var urls []string
+	for i := 0; i < 5; i++ {
+		urls = append(urls, fmt.Sprintf("https://a-%d:6443", i))
+	}
+	tooMany := encodeGossip(ClusterInfo{ApiserverURLs: urls}, nil)
+	tooBig := encodeGossip(ClusterInfo{ApiserverURLs: []string{"https://" + strings.Repeat("a", 2<<10) + ":6443"}}, nil)
+	for i := 0; i < 3; i++ {
+		for _, buf := range [][]byte{tooMany, tooBig} {
+			if _, err := p.OnGossipBroadcast(mesh.PeerName(2), buf); err != nil {
+				t.Fatalf("want the payload dropped, not the connection: %v", err)
+			}
+		}
+		if _, err := p.OnGossip(tooMany); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot := p.snapshot()
+	if len(snapshot.ApiserverURLs) != 0 {
+		t.Errorf("want nothing merged, have %v", snapshot.ApiserverURLs)
+	}
+	if snapshot.RejectedPayloads != 9 {
+		t.Errorf("want 9 rejected payloads, have %d", snapshot.RejectedPayloads)
+	}
+	// Once per source, however often it sends.
+	if n := strings.Count(logs.String(), "Dropping gossip from peer "+mesh.PeerName(2).String()); n != 1 {
+		t.Errorf("want one log line for peer 2, have %d:\n%s", n, logs.String())
+	}
+	if n := strings.Count(logs.String(), "Dropping gossip from gossip"); n != 1 {
+		t.Errorf("want one log line for gossip, have %d:\n%s", n, logs.String())
+	}
+
+	// The limit holds for what a compressed payload inflates to, too.
+	bomb := encodeClusterInfoVersion(ClusterInfo{ApiserverURLs: []string{"https://" + strings.Repeat("a", 4<<10) + ":6443"}}, nil, wireVersion, 1)
+	if len(bomb) > 1<<10 {
+		t.Fatalf("want the compressed payload under the limit, have %d bytes", len(bomb))
+	}
+	if _, err := p.OnGossipBroadcast(mesh.PeerName(2), bomb); err != nil {
+		t.Fatal(err)
+	}
+	if have := p.snapshot().RejectedPayloads; have != 10 {
+		t.Errorf("compressed: want 10 rejected payloads, have %d", have)
+	}
+
+	// Within the limits, the same peer is heard again.
+	if _, err := p.OnGossipBroadcast(mesh.PeerName(2), encodeGossip(ClusterInfo{ApiserverURLs: urls[:1]}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if have := p.snapshot().ApiserverURLs; len(have) != 1 {
+		t.Errorf("want %v merged, have %v", urls[:1], have)
+	}
+}
+
+func TestRejectLog(t *testing.T) {
+	var r rejectLog
+	now := time.Now()
+	for _, testcase := range []struct {
+		source string
+		at     time.Duration
+		want   bool
+	}{
+		{"peer a", 0, true},
+		{"peer a", time.Second, false},
+		{"peer b", time.Second, true},
+		{"peer a", rejectLogInterval - time.Second, false},
+		{"peer a", rejectLogInterval, true},
+		{"peer b", rejectLogInterval, false},
+	} {
+		if have := r.reject(testcase.source, now.Add(testcase.at)); have != testcase.want {
+			t.Errorf("%s at %v: want %v, have %v", testcase.source, testcase.at, testcase.want, have)
+		}
+	}
+	if r.count() != 6 {
+		t.Errorf("want 6 rejected, have %d", r.count())
+	}
+}
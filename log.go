@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "debug"
+	case levelInfo:
+		return "info"
+	case levelWarn:
+		return "warn"
+	case levelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// parseLogLevel parses -log-level.
+func parseLogLevel(s string) (logLevel, error) {
+	for l := levelDebug; l <= levelError; l++ {
+		if s == l.String() {
+			return l, nil
+		}
+	}
+	return 0, fmt.Errorf("-log-level %q: must be debug, info, warn or error", s)
+}
+
+// textPrefix marks warnings and errors in text mode, as we always have.
+var textPrefix = map[logLevel]string{levelWarn: "WARNING: ", levelError: "ERROR: "}
+
+// levelLogger writes leveled log messages, either as text like the
+// standard logger, or as one JSON object per line.
+type levelLogger struct {
+	level logLevel    // the least severe level we log; debug by default
+	text  *log.Logger // nil in JSON mode
+
+	mtx  sync.Mutex
+	out  io.Writer
+	peer string
+	now  func() time.Time
+}
+
+// newTextLogger logs like log.New(out, prefix, flag).
+func newTextLogger(out io.Writer, prefix string, flag int) *levelLogger {
+	return &levelLogger{text: log.New(out, prefix, flag)}
+}
+
+// newJSONLogger logs objects with ts, level, peer and msg fields.
+func newJSONLogger(out io.Writer, peer string) *levelLogger {
+	return &levelLogger{out: out, peer: peer, now: time.Now}
+}
+
+// newLogger returns a logger for -log-format and -log-level.
+func newLogger(format, level string, out io.Writer, peer string) (*levelLogger, error) {
+	min, err := parseLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	var l *levelLogger
+	switch format {
+	case "text":
+		l = newTextLogger(out, peer+"> ", log.LstdFlags)
+	case "json":
+		l = newJSONLogger(out, peer)
+	default:
+		return nil, fmt.Errorf("-log-format %q: must be text or json", format)
+	}
+	l.level = min
+	return l, nil
+}
+
+func (l *levelLogger) logf(level logLevel, format string, args ...interface{}) {
+	if level < l.level {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if l.text != nil {
+		l.text.Output(3, textPrefix[level]+msg)
+		return
+	}
+	line, err := json.Marshal(struct {
+		TS    string `json:"ts"`
+		Level string `json:"level"`
+		Peer  string `json:"peer"`
+		Msg   string `json:"msg"`
+	}{l.now().UTC().Format(time.RFC3339Nano), level.String(), l.peer, msg})
+	if err != nil {
+		return // can't happen with only strings
+	}
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.out.Write(append(line, '\n'))
+}
+
+func (l *levelLogger) Debugf(format string, args ...interface{}) { l.logf(levelDebug, format, args...) }
+func (l *levelLogger) Infof(format string, args ...interface{})  { l.logf(levelInfo, format, args...) }
+func (l *levelLogger) Warnf(format string, args ...interface{})  { l.logf(levelWarn, format, args...) }
+func (l *levelLogger) Errorf(format string, args ...interface{}) { l.logf(levelError, format, args...) }
+
+// Fatalf and Fatal log at error level, and exit.
+func (l *levelLogger) Fatalf(format string, args ...interface{}) {
+	l.logf(levelError, format, args...)
+	os.Exit(1)
+}
+
+func (l *levelLogger) Fatal(args ...interface{}) {
+	l.logf(levelError, "%s", fmt.Sprint(args...))
+	os.Exit(1)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := newJSONLogger(&buf, "node1")
+	logger.now = func() time.Time { return time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC) }
+	logger.Infof("hello %s", "world")
+	logger.Warnf("careful")
+
+	var have []map[string]string
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var entry map[string]string
+		if err := dec.Decode(&entry); err != nil {
+			t.Fatal(err)
+		}
+		have = append(have, entry)
+	}
+	want := []map[string]string{
+		{"ts": "2017-01-02T03:04:05Z", "level": "info", "peer": "node1", "msg": "hello world"},
+		{"ts": "2017-01-02T03:04:05Z", "level": "warn", "peer": "node1", "msg": "careful"},
+	}
+	if len(want) != len(have) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+	for i := range want {
+		for k, v := range want[i] {
+			if have[i][k] != v {
+				t.Errorf("line %d: want %s=%q, have %q", i, k, v, have[i][k])
+			}
+		}
+	}
+}
+
+func TestTextLogger(t *testing.T) {
+	var buf bytes.Buffer
+	newTextLogger(&buf, "node1> ", 0).Infof("hello %s", "world")
+	if want, have := "node1> hello world\n", buf.String(); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+	if _, err := newLogger("yaml", "info", &buf, "node1"); err == nil {
+		t.Errorf("want error for an unknown format")
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := newLogger("text", "warn", &buf, "node1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.text.SetFlags(0)
+	logger.Debugf("gossip")
+	logger.Infof("hello")
+	logger.Warnf("careful")
+	logger.Errorf("broken")
+	if want, have := "node1> WARNING: careful\nnode1> ERROR: broken\n", buf.String(); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+	if _, err := newLogger("text", "verbose", &buf, "node1"); err == nil {
+		t.Errorf("want error for an unknown level")
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// Stamp versions an entry that one peer owns, such as the root CAs it
+// seeds, its apiserver leases and its bootstrap token, so that merges
+// are last-writer-wins: the version with the highest Clock wins, and
+// on a tie that of the lowest Peer, so that every peer picks the same
+// one whatever the order of merges. The owner stamps an entry from its
+// lamportClock whenever it changes it, so a peer that rejoins with a
+// version from months ago can't bring it back over the current one.
+//
+// The zero Stamp is older than any other, as are the entries of peers
+// from before stamps, which then fall back to the other tie-breakers.
+type Stamp struct {
+	Clock uint64
+	Peer  mesh.PeerName
+}
+
+// after reports whether s is a later version than t.
+func (s Stamp) after(t Stamp) bool {
+	if s.Clock != t.Clock {
+		return s.Clock > t.Clock
+	}
+	return s.Peer < t.Peer
+}
+
+func (s Stamp) IsZero() bool {
+	return s == Stamp{}
+}
+
+// mergeKeyed merges ours and theirs, entries of one kind that key and
+// prefer index as one list, ours first, keeping one entry per key: the
+// one prefer(i, j) picks over the rest, even among ours. It returns the
+// indices of the entries to keep, and of those from theirs that we
+// didn't already have, each in the order its key first comes.
+func mergeKeyed(ours, theirs int, key func(i int) string, prefer func(i, j int) bool) (result, delta []int) {
+	existing := map[string]int{} // the index into result
+	changed := map[int]bool{}    // of result
+	for i := 0; i < ours+theirs; i++ {
+		k := key(i)
+		if r, ok := existing[k]; ok {
+			if prefer(i, result[r]) {
+				result[r] = i
+				if i >= ours {
+					changed[r] = true
+				}
+			}
+			continue
+		}
+		existing[k] = len(result)
+		result = append(result, i)
+		if i >= ours {
+			changed[len(result)-1] = true
+		}
+	}
+	for r, i := range result {
+		if changed[r] {
+			delta = append(delta, i)
+		}
+	}
+	return result, delta
+}
+
+// lamportClock is a hybrid logical clock, in nanoseconds since the
+// epoch: each tick is later than both the wall clock and every tick it
+// has witnessed, from us or other peers. Taking the wall clock, rather
+// than counting from zero, means our stamps after a restart beat those
+// from before it, which other peers still have; witnessing means they
+// also beat those of peers whose own clocks are ahead of ours.
+type lamportClock struct {
+	mtx  sync.Mutex
+	last uint64
+}
+
+// tick returns a clock reading later than any before.
+func (c *lamportClock) tick(now time.Time) uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.last++
+	if wall := uint64(now.UnixNano()); wall > c.last {
+		c.last = wall
+	}
+	return c.last
+}
+
+// maxClockSkew is how far ahead of our wall clock another peer's may be.
+// Clock readings beyond it are of a misconfigured or hostile peer, and we
+// neither witness them nor admit what they stamp: one peer with its clock
+// in 2099, or sending the largest clock there is, would otherwise push
+// every peer's clock after it for good, or wrap it round to zero.
+const maxClockSkew = time.Hour
+
+// aheadOf reports whether clock is more than maxClockSkew ahead of now.
+func aheadOf(clock uint64, now time.Time) bool {
+	return clock > clockOf(now.Add(maxClockSkew))
+}
+
+// witness makes sure our next tick is later than clock, unless that is
+// more than maxClockSkew ahead of now.
+func (c *lamportClock) witness(clock uint64, now time.Time) {
+	if aheadOf(clock, now) {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if clock > c.last {
+		c.last = clock
+	}
+}
+
+// read is a tick as a time, for the entries that are ordered by when
+// rather than by Stamp: tombstones, and what they delete.
+func (c *lamportClock) read(now time.Time) time.Time {
+	return time.Unix(0, int64(c.tick(now))).UTC()
+}
+
+// clockOf is the clock reading t is, as from lamportClock.read.
+func clockOf(t time.Time) uint64 {
+	if t.IsZero() || t.Before(time.Unix(0, 0)) {
+		return 0
+	}
+	return uint64(t.UnixNano())
+}
+
+// stamp is a fresh Stamp of self's.
+func (c *lamportClock) stamp(self mesh.PeerName, now time.Time) Stamp {
+	return Stamp{Clock: c.tick(now), Peer: self}
+}
+
+// maxClock is the latest clock among the stamps in info, and the
+// times that are clock readings.
+func (info ClusterInfo) maxClock() (clock uint64) {
+	see := func(s Stamp) {
+		if s.Clock > clock {
+			clock = s.Clock
+		}
+	}
+	seeTime := func(t time.Time) {
+		see(Stamp{Clock: clockOf(t)})
+	}
+	for _, ca := range info.RootCAs {
+		see(ca.Stamp)
+	}
+	for _, cas := range info.CASlots {
+		for _, ca := range cas {
+			see(ca.Stamp)
+		}
+	}
+	for _, l := range info.APIServerLeases {
+		see(l.Stamp)
+		seeTime(l.Since)
+	}
+	for _, t := range info.APIServerTombstones {
+		seeTime(t.Removed)
+	}
+	for _, t := range info.BootstrapTokens {
+		see(t.Stamp)
+	}
+	for _, t := range info.BootstrapTokenTombstones {
+		seeTime(t.Removed)
+	}
+	return clock
+}
+
+// withoutClocksAhead drops the entries of info stamped, or otherwise
+// timed by a clock reading, more than maxClockSkew ahead of now, and
+// reports how many it dropped.
+func (info ClusterInfo) withoutClocksAhead(now time.Time) (ClusterInfo, int) {
+	dropped := 0
+	ahead := func(clock uint64) bool {
+		if aheadOf(clock, now) {
+			dropped++
+			return true
+		}
+		return false
+	}
+	var cas []*RootCAPublicKey
+	for _, ca := range info.RootCAs {
+		if !ahead(ca.Stamp.Clock) {
+			cas = append(cas, ca)
+		}
+	}
+	info.RootCAs = cas
+	info.CASlots = filterCASlots(info.CASlots, func(_ string, ca *RootCAPublicKey) bool { return !ahead(ca.Stamp.Clock) })
+	var leases []*APIServerLease
+	for _, l := range info.APIServerLeases {
+		if !ahead(l.Stamp.Clock) && !ahead(clockOf(l.Since)) {
+			leases = append(leases, l)
+		}
+	}
+	info.APIServerLeases = leases
+	var tombstones []*APIServerTombstone
+	for _, t := range info.APIServerTombstones {
+		if !ahead(clockOf(t.Removed)) {
+			tombstones = append(tombstones, t)
+		}
+	}
+	info.APIServerTombstones = tombstones
+	var tokens []*BootstrapToken
+	for _, t := range info.BootstrapTokens {
+		if !ahead(t.Stamp.Clock) {
+			tokens = append(tokens, t)
+		}
+	}
+	info.BootstrapTokens = tokens
+	var revocations []*BootstrapTokenTombstone
+	for _, t := range info.BootstrapTokenTombstones {
+		if !ahead(clockOf(t.Removed)) {
+			revocations = append(revocations, t)
+		}
+	}
+	info.BootstrapTokenTombstones = revocations
+	return info, dropped
+}
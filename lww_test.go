@@ -0,0 +1,164 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStampAfter(t *testing.T) {
+	for _, testcase := range []struct {
+		s, t Stamp
+		want bool
+	}{
+		{Stamp{2, 1}, Stamp{1, 1}, true},
+		{Stamp{1, 1}, Stamp{2, 1}, false},
+		{Stamp{1, 1}, Stamp{1, 2}, true},
+		{Stamp{1, 2}, Stamp{1, 1}, false},
+		{Stamp{1, 1}, Stamp{1, 1}, false},
+		{Stamp{1, 9}, Stamp{}, true},
+		{Stamp{}, Stamp{1, 9}, false},
+	} {
+		if have := testcase.s.after(testcase.t); testcase.want != have {
+			t.Errorf("%v after %v: want %v, have %v", testcase.s, testcase.t, testcase.want, have)
+		}
+	}
+}
+
+func TestLamportClock(t *testing.T) {
+	now := time.Unix(1e9, 0)
+	var c lamportClock
+	first := c.tick(now)
+	if want := uint64(now.UnixNano()); want != first {
+		t.Errorf("want the wall clock, %d, have %d", want, first)
+	}
+	// The wall clock going backwards doesn't.
+	if second := c.tick(now.Add(-time.Hour)); second <= first {
+		t.Errorf("want a tick after %d, have %d", first, second)
+	}
+	// Nor does a peer whose clock is ahead of ours.
+	ahead := uint64(now.Add(time.Hour).UnixNano())
+	c.witness(ahead, now)
+	if third := c.tick(now); third <= ahead {
+		t.Errorf("want a tick after the witnessed %d, have %d", ahead, third)
+	}
+	c.witness(1, now)
+	if s := c.stamp(7, now); s.Clock <= ahead+1 || s.Peer != 7 {
+		t.Errorf("want a stamp of peer 7 after %d, have %v", ahead+1, s)
+	}
+}
+
+func TestLamportClockBoundsSkew(t *testing.T) {
+	now := time.Unix(1e9, 0)
+	var c lamportClock
+	for _, clock := range []uint64{uint64(now.Add(2 * maxClockSkew).UnixNano()), math.MaxUint64} {
+		c.witness(clock, now)
+		if have := c.tick(now); have >= clock || have > uint64(now.UnixNano())+1<<20 {
+			t.Errorf("witnessing %d: want a tick at the wall clock, have %d", clock, have)
+		}
+	}
+	within := uint64(now.Add(maxClockSkew / 2).UnixNano())
+	c.witness(within, now)
+	if have := c.tick(now); have <= within {
+		t.Errorf("want a tick after the witnessed %d, have %d", within, have)
+	}
+}
+
+func TestStateMergeWitnessesOnlyAdmitted(t *testing.T) {
+	now := time.Now()
+	st := newState(999, nil, nil, peerOptions{}, newTextLogger(ioutil.Discard, "", 0))
+	soon := Stamp{Clock: uint64(now.Add(maxClockSkew / 2).UnixNano()), Peer: 1}
+	far := Stamp{Clock: math.MaxUint64, Peer: 2}
+	for _, set := range []ClusterInfo{
+		// Within the skew, but expired, so not admitted.
+		{RootCAs: []*RootCAPublicKey{{Bytes: []byte("expired"), NotAfter: now.Add(-time.Minute), Stamp: soon}}},
+		// Admitted but for being far too far ahead.
+		{BootstrapTokens: []*BootstrapToken{{Token: "abcdef.0123456789abcdef", Expires: now.Add(time.Hour), Origin: 2, Stamp: far}}},
+	} {
+		st.Merge(&state{set: set})
+		if len(st.set.RootCAs) != 0 || len(st.set.BootstrapTokens) != 0 {
+			t.Errorf("%v: want nothing merged, have %v", set, st.set)
+		}
+		if have := st.clock.tick(time.Now()); have >= soon.Clock {
+			t.Errorf("%v: want our clock unmoved by what we didn't admit, have %d, at or after %d", set, have, soon.Clock)
+		}
+	}
+}
+
+func TestMergeKeyed(t *testing.T) {
+	// Ours, then theirs, each a key and how much prefer likes it.
+	type entry struct {
+		key  string
+		rank int
+	}
+	for _, testcase := range []struct {
+		name          string
+		ours, theirs  []entry
+		result, delta []int
+	}{
+		{"empty", nil, nil, nil, nil},
+		{"only ours", []entry{{"a", 1}, {"b", 1}}, nil, []int{0, 1}, nil},
+		{"only theirs", nil, []entry{{"a", 1}, {"b", 1}}, []int{0, 1}, []int{0, 1}},
+		{"new key", []entry{{"a", 1}}, []entry{{"b", 1}}, []int{0, 1}, []int{1}},
+		{"theirs wins", []entry{{"a", 1}, {"b", 1}}, []entry{{"b", 2}}, []int{0, 2}, []int{2}},
+		{"ours wins", []entry{{"a", 2}}, []entry{{"a", 1}}, []int{0}, nil},
+		{"a tie is ours", []entry{{"a", 1}}, []entry{{"a", 1}}, []int{0}, nil},
+		{"duplicates of ours", []entry{{"a", 1}, {"a", 2}}, nil, []int{1}, nil},
+		{"duplicates of theirs", []entry{{"a", 1}}, []entry{{"a", 3}, {"a", 2}}, []int{1}, []int{1}},
+	} {
+		all := append(append([]entry(nil), testcase.ours...), testcase.theirs...)
+		result, delta := mergeKeyed(len(testcase.ours), len(testcase.theirs),
+			func(i int) string { return all[i].key },
+			func(i, j int) bool { return all[i].rank > all[j].rank })
+		if !reflect.DeepEqual(testcase.result, result) || !reflect.DeepEqual(testcase.delta, delta) {
+			t.Errorf("%s: want %v, delta %v, have %v, delta %v", testcase.name, testcase.result, testcase.delta, result, delta)
+		}
+	}
+}
+
+func TestMergeLastWriterWins(t *testing.T) {
+	var (
+		stale, current = Stamp{Clock: 1, Peer: 1}, Stamp{Clock: 2, Peer: 1}
+		old            = time.Unix(1e9, 0).UTC()
+	)
+	// The stale versions would win on everything but their stamps.
+	ours := ClusterInfo{
+		RootCAs:         []*RootCAPublicKey{{Bytes: []byte("a"), Generation: 1, Origin: 1, Stamp: current}},
+		APIServerLeases: []*APIServerLease{{URL: "https://a:6443", Peer: 1, Refreshed: old, Stamp: current}},
+		BootstrapTokens: []*BootstrapToken{{Token: "abcdef.0123456789abcdef", Expires: old, Origin: 1, Stamp: current}},
+	}
+	theirs := ClusterInfo{
+		RootCAs:         []*RootCAPublicKey{{Bytes: []byte("a"), Generation: 5, Origin: 1, Stamp: stale}},
+		APIServerLeases: []*APIServerLease{{URL: "https://a:6443", Peer: 1, Refreshed: old.Add(time.Hour), Stamp: stale}},
+		BootstrapTokens: []*BootstrapToken{{Token: "abcdef.0123456789abcdef", Expires: old.Add(time.Hour), Origin: 1, Stamp: stale}},
+	}
+	result, delta := mergeClusterInfo(ours, theirs)
+	if !reflect.DeepEqual(ours, result) {
+		t.Errorf("want the current versions %v, have %v", ours, result)
+	}
+	if !delta.empty() {
+		t.Errorf("want no delta, have %v", delta)
+	}
+	// Whichever side they're on.
+	if result, _ := mergeClusterInfo(theirs, ours); !reflect.DeepEqual(ours, result) {
+		t.Errorf("want the current versions %v, have %v", ours, result)
+	}
+}
+
+func TestStateStampsAfterWitnessing(t *testing.T) {
+	st := newState(1, nil, []string{"https://a:6443"}, peerOptions{}, newTextLogger(ioutil.Discard, "", 0))
+	// Another peer, its clock an hour ahead, has a version of our lease.
+	ahead := Stamp{Clock: uint64(time.Now().Add(time.Hour).UnixNano()), Peer: 1}
+	st.mergeComplete(ClusterInfo{APIServerLeases: []*APIServerLease{{URL: "https://a:6443", Peer: 1, Refreshed: time.Now().UTC(), Stamp: ahead}}})
+	st.refresh(time.Now())
+	st.mtx.RLock()
+	defer st.mtx.RUnlock()
+	if len(st.set.APIServerLeases) != 1 {
+		t.Fatalf("want one lease, have %v", st.set.APIServerLeases)
+	}
+	if have := st.set.APIServerLeases[0].Stamp; !have.after(ahead) {
+		t.Errorf("want our refresh to win, stamped after %v, have %v", ahead, have)
+	}
+}
@@ -1,125 +1,1024 @@
 package main
 
 import (
+	"context"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"net"
-	"net/url"
+	"net/http"
 	"os"
 	"os/signal"
 	"sort"
 	"strconv"
 	"strings"
 	"syscall"
+	"text/template"
 	"time"
 
-	"crypto/x509"
-	"encoding/pem"
-
 	"github.com/weaveworks/mesh"
 )
 
-func main() {
-	peers := &stringset{}
-	apiservers := &stringset{}
-	var (
-		meshListen = flag.String("mesh", net.JoinHostPort("0.0.0.0", strconv.Itoa(mesh.Port)), "mesh listen address")
-		hwaddr     = flag.String("hwaddr", mustHardwareAddr(), "MAC address, i.e. mesh peer ID")
-		nickname   = flag.String("nickname", mustHostname(), "peer nickname")
-		password   = flag.String("password", "", "password (optional)")
-		rootCA     = flag.String("root-ca", "", "root CA certificate")
-	)
-	flag.Var(peers, "peer", "initial peer (may be repeated)")
-	flag.Var(apiservers, "apiserver", "the URL of the apiserver (may be repeated)")
-	flag.Parse()
+// Config is everything run needs, as set by the command-line flags, and
+// the -config file.
+type Config struct {
+	peers                        stringset
+	apiservers                   *apiserverset
+	removals                     *apiserverset
+	revokes                      stringset
+	rootCAs                      stringset
+	caHashes                     stringset
+	csrSigners                   stringset
+	caSlots                      slotPaths
+	subnets                      stringset
+	caSlotOut                    slotPaths
+	servingCertIPs               stringset
+	consensusHealthyOnly         stringset
+	caOutMode                    fileMode
+	kubeconfigMode               fileMode
+	meshListen                   string
+	hwaddr                       string
+	hwaddrInterface              string
+	nickname                     string
+	password                     string
+	passwordFile                 string
+	passwordSalt                 string
+	rootCAGeneration             uint64
+	watchRootCA                  bool
+	rootCAOverlap                time.Duration
+	skipCAValidation             bool
+	allowExpiredCA               bool
+	caExpiryWarning              time.Duration
+	caFromSecret                 string
+	kubeconfig                   string
+	caOut                        string
+	crlPath                      string
+	crlOut                       string
+	kubeconfigOut                string
+	discoveryFileOut             string
+	onCAChange                   string
+	onCAChangeDebounce           time.Duration
+	onAPIServerChange            string
+	onAPIServerChangeDebounce    time.Duration
+	onAPIServerChangeTimeout     time.Duration
+	localProxy                   string
+	localProxyDialTimeout        time.Duration
+	upstreamOut                  string
+	upstreamTemplate             string
+	upstreamReloadPidfile        string
+	upstreamReloadSignal         string
+	upstreamDebounce             time.Duration
+	discoveryServer              string
+	tofuFile                     string
+	tofuReset                    bool
+	rootCAKey                    string
+	signCSRs                     bool
+	servingCertOut               string
+	servingKeyOut                string
+	servingCertTTL               time.Duration
+	csrTimeout                   time.Duration
+	requireSigned                bool
+	caQuorum                     int
+	bootstrapToken               string
+	bootstrapTokenFile           string
+	bootstrapTokenTTL            time.Duration
+	bootstrapTokenOut            string
+	showSecrets                  bool
+	protocolMinVersion           int
+	peerDiscovery                bool
+	peerRefreshInterval          time.Duration
+	peerCheckTimeout             time.Duration
+	requireInitialPeer           bool
+	connLimit                    int
+	apiserverTTL                 time.Duration
+	tombstoneKeep                time.Duration
+	maxCAs                       int
+	apiserverFile                string
+	maxAPIServerURLs             int
+	maxPayloadBytes              int
+	maxPayloadAPIServers         int
+	maxPayloadURLLength          int
+	maxPayloadCertBytes          int
+	allowInsecureAPIServer       bool
+	shutdownGrace                time.Duration
+	statusInterval               time.Duration
+	connectionLogInterval        time.Duration
+	fullSyncInterval             time.Duration
+	stateRequestTimeout          time.Duration
+	broadcastDelay               time.Duration
+	apiserverProbeInterval       time.Duration
+	apiserverProbeTimeout        time.Duration
+	apiserverCertRefreshInterval time.Duration
+	consensusWindow              time.Duration
+	consensusFraction            float64
+	apiserverProbeMax            int
+	apiserverResolveInterval     time.Duration
+	readyMinCAs                  int
+	readyMinAPIServers           int
+	waitForCA                    bool
+	waitForCATimeout             time.Duration
+	readyFile                    string
+	logFormat                    string
+	logLevel                     string
+	httpListen                   string
+	httpTLSCert                  string
+	httpTLSKey                   string
+	httpBasicAuth                string
+	httpAdmin                    bool
+	wireVersion                  int
+	compressOver                 int
+	channelCompat                bool
+	dryRun                       bool
+	showVersion                  bool
+	configFile                   string
 
-	logger := log.New(os.Stderr, *nickname+"> ", log.LstdFlags)
+	// For tests: stop, if set, shuts run down when closed, as a signal
+	// would; the rest, if set, stand in for the real thing.
+	stop          <-chan struct{}
+	stdout        io.Writer
+	lookupHost    func(host string) ([]string, error)
+	dial          dialer
+	probe         func(rawurl string, roots []*RootCAPublicKey, timeout time.Duration) (certHash string, err error)
+	fetchCertHash func(rawurl string, roots []*RootCAPublicKey, timeout time.Duration) (certHash string, err error)
+}
 
-	host, portStr, err := net.SplitHostPort(*meshListen)
+// newConfig is a Config with nothing set but what the flags need.
+func newConfig() Config {
+	return Config{
+		peers:                stringset{},
+		apiservers:           &apiserverset{stringset: stringset{}},
+		removals:             &apiserverset{stringset: stringset{}},
+		revokes:              stringset{},
+		rootCAs:              stringset{},
+		caHashes:             stringset{},
+		csrSigners:           stringset{},
+		caSlots:              slotPaths{},
+		subnets:              stringset{},
+		caSlotOut:            slotPaths{},
+		servingCertIPs:       stringset{},
+		consensusHealthyOnly: stringset{},
+		caOutMode:            fileMode(0644),
+		kubeconfigMode:       fileMode(0600),
+	}
+}
+
+// register defines a flag for each field of cfg in fs, with its default.
+func (cfg *Config) register(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.configFile, "config", "", "YAML file of flags, by name without the dash, e.g. peer: [10.0.0.1, 10.0.0.2]; flags on the command line win (optional)")
+	fs.StringVar(&cfg.configFile, "config-file", "", "same as -config")
+	fs.StringVar(&cfg.meshListen, "mesh", net.JoinHostPort("0.0.0.0", strconv.Itoa(mesh.Port)), "mesh listen address; one only, IPv6 in brackets, as in [::]:6783")
+	fs.StringVar(&cfg.hwaddr, "hwaddr", "", "MAC address, i.e. mesh peer ID (default that of -hwaddr-interface, or of the first physical-looking interface)")
+	fs.StringVar(&cfg.hwaddrInterface, "hwaddr-interface", "", "network interface whose MAC address to use as the mesh peer ID")
+	fs.StringVar(&cfg.nickname, "nickname", "", "peer nickname (default the hostname)")
+	fs.StringVar(&cfg.password, "password", "", "password (optional)")
+	fs.StringVar(&cfg.passwordFile, "password-file", "", "read the password from this file instead (optional)")
+	fs.StringVar(&cfg.passwordSalt, "password-salt", "kubelet-mesh", "salt for the payload key derived from -password, the same on every peer of a cluster; give each cluster its own")
+	fs.Uint64Var(&cfg.rootCAGeneration, "root-ca-generation", 0, "root CA generation; bump on every CA rotation")
+	fs.BoolVar(&cfg.watchRootCA, "watch-root-ca", false, "load -root-ca when the file appears or changes, without a restart")
+	fs.DurationVar(&cfg.rootCAOverlap, "root-ca-overlap", 24*time.Hour, "how long to keep trusting the previous root CA generation after a rotation")
+	fs.BoolVar(&cfg.skipCAValidation, "skip-ca-validation", false, "distribute root CAs even if they are not valid CA certificates")
+	fs.BoolVar(&cfg.allowExpiredCA, "allow-expired-ca", false, "distribute root CAs even if they have expired")
+	fs.DurationVar(&cfg.caExpiryWarning, "ca-expiry-warning", 30*24*time.Hour, "warn about root CAs that expire within this long")
+	fs.StringVar(&cfg.caFromSecret, "ca-from-secret", "", "also seed the root CAs in the ca.crt of this Kubernetes Secret, as namespace/name (optional)")
+	fs.StringVar(&cfg.kubeconfig, "kubeconfig", "", "JSON kubeconfig to read -ca-from-secret with (default the in-cluster service account)")
+	fs.StringVar(&cfg.caOut, "ca-out", "", "write the root CA bundle to this file, e.g. /etc/kubernetes/pki/ca.crt (optional)")
+	fs.StringVar(&cfg.crlPath, "crl", "", "CRL issued by the root CA, to gossip along with it (optional)")
+	fs.StringVar(&cfg.crlOut, "crl-out", "", "write the gossiped CRLs to this file (optional)")
+	fs.StringVar(&cfg.kubeconfigOut, "kubeconfig-out", "", "write a kubeconfig to this file once a root CA and apiserver are known (optional)")
+	fs.Var(&cfg.kubeconfigMode, "kubeconfig-mode", "file mode for -kubeconfig-out, which may hold the bootstrap token")
+	fs.StringVar(&cfg.discoveryFileOut, "discovery-file-out", "", "write a kubeadm join --discovery-file to this file once a root CA and apiserver are known (optional)")
+	fs.StringVar(&cfg.onCAChange, "on-ca-change", "", "shell command to run, or webhook URL to POST to, when new root CAs are trusted; the command gets their fingerprints in $KUBELET_MESH_CA_FINGERPRINTS (optional)")
+	fs.DurationVar(&cfg.onCAChangeDebounce, "on-ca-change-debounce", 5*time.Second, "how long to wait for more root CAs before running -on-ca-change")
+	fs.StringVar(&cfg.onAPIServerChange, "on-apiserver-change", "", "shell command to run when the set of apiservers changes; it gets them in $KUBELET_MESH_APISERVERS, comma-separated, and as JSON on stdin (optional)")
+	fs.DurationVar(&cfg.onAPIServerChangeDebounce, "on-apiserver-change-debounce", 5*time.Second, "how long to wait for the apiservers to settle before running -on-apiserver-change")
+	fs.DurationVar(&cfg.onAPIServerChangeTimeout, "on-apiserver-change-timeout", time.Minute, "how long -on-apiserver-change may run before it is killed")
+	fs.StringVar(&cfg.localProxy, "local-proxy", "", "listen on this address, e.g. 127.0.0.1:6443, and forward connections to the gossiped apiservers (optional)")
+	fs.DurationVar(&cfg.localProxyDialTimeout, "local-proxy-dial-timeout", 5*time.Second, "how long -local-proxy waits to connect to an apiserver before trying the next")
+	fs.StringVar(&cfg.upstreamOut, "upstream-out", "", "write the apiservers, one host:port per line, to this file for a local load balancer (optional)")
+	fs.StringVar(&cfg.upstreamTemplate, "upstream-template", "", "render -upstream-out with this text/template instead, given .Servers with .URL, .Host and .Port (optional)")
+	fs.StringVar(&cfg.upstreamReloadPidfile, "upstream-reload-pidfile", "", "signal the process whose PID is in this file whenever -upstream-out changes (optional)")
+	fs.StringVar(&cfg.upstreamReloadSignal, "upstream-reload-signal", "HUP", "signal to send to the process in -upstream-reload-pidfile: HUP, USR1 or USR2")
+	fs.DurationVar(&cfg.upstreamDebounce, "upstream-debounce", 2*time.Second, "how long to let gossip settle before rewriting -upstream-out")
+	fs.StringVar(&cfg.discoveryServer, "discovery-server", "", "apiserver URL to put in -discovery-file-out, if gossiped; the first one otherwise")
+	fs.StringVar(&cfg.tofuFile, "tofu-file", "", "pin the first gossiped root CA accepted, in this file, and refuse any other (optional)")
+	fs.BoolVar(&cfg.tofuReset, "tofu-reset", false, "forget the root CA pinned in -tofu-file, and pin the next one accepted")
+	fs.StringVar(&cfg.rootCAKey, "root-ca-key", "", "sign our apiserver URLs, and with -csr-signer serving certificates, with this root CA private key (optional)")
+	fs.BoolVar(&cfg.signCSRs, "csr-signer", false, "sign kubelet serving certificates for peers, with -root-ca-key")
+	fs.StringVar(&cfg.servingCertOut, "serving-cert-out", "", "get a kubelet serving certificate signed by one of -csr-signers, and write it to this file (optional)")
+	fs.StringVar(&cfg.servingKeyOut, "serving-key-out", "", "write the key for -serving-cert-out to this file")
+	fs.DurationVar(&cfg.servingCertTTL, "serving-cert-ttl", 365*24*time.Hour, "how long the serving certificates we sign are valid for")
+	fs.DurationVar(&cfg.csrTimeout, "csr-timeout", 10*time.Second, "how long to wait for a signer to answer a serving certificate request")
+	fs.BoolVar(&cfg.requireSigned, "require-signed", false, "reject gossiped apiserver URLs not signed by a root CA pinned with -ca-hash or -tofu-file")
+	fs.IntVar(&cfg.caQuorum, "ca-quorum", 1, "only trust a gossiped root CA once this many distinct peers have broadcast it")
+	fs.StringVar(&cfg.bootstrapToken, "bootstrap-token", "", "kubelet bootstrap token to gossip, as <id>.<secret> (optional)")
+	fs.StringVar(&cfg.bootstrapTokenFile, "bootstrap-token-file", "", "read the bootstrap token from this file instead (optional)")
+	fs.DurationVar(&cfg.bootstrapTokenTTL, "bootstrap-token-ttl", 24*time.Hour, "how long peers keep gossiping our bootstrap token")
+	fs.StringVar(&cfg.bootstrapTokenOut, "bootstrap-token-out", "", "write the bootstrap token to this file, once known (optional)")
+	fs.BoolVar(&cfg.showSecrets, "show-secrets", false, "include bootstrap tokens in /state")
+	fs.IntVar(&cfg.protocolMinVersion, "protocol-min-version", mesh.ProtocolMinVersion, fmt.Sprintf("minimum mesh protocol version to negotiate (%d-%d)", mesh.ProtocolMinVersion, mesh.ProtocolMaxVersion))
+	fs.BoolVar(&cfg.peerDiscovery, "peer-discovery", true, "connect to peers learned from other peers, not just -peer")
+	fs.DurationVar(&cfg.peerRefreshInterval, "peer-refresh-interval", 0, "how often to re-resolve -peer hostnames, connecting to new addresses and forgetting old ones (0 to resolve only when connecting)")
+	fs.DurationVar(&cfg.peerCheckTimeout, "peer-check-timeout", 2*time.Second, "at startup, how long to wait for each -peer to answer a TCP dial, to log which are reachable (0 to skip)")
+	fs.BoolVar(&cfg.requireInitialPeer, "require-initial-peer", false, "exit with an error if no -peer is reachable at startup")
+	fs.IntVar(&cfg.connLimit, "conn-limit", 64, "maximum number of mesh connections")
+	fs.DurationVar(&cfg.apiserverTTL, "apiserver-ttl", 6*time.Hour, "how long other peers keep our -apiserver URLs after we stop advertising them (0 for forever)")
+	fs.DurationVar(&cfg.tombstoneKeep, "tombstone-keep", 7*24*time.Hour, "how long peers remember a -remove-apiserver or -revoke-bootstrap-token; longer than any peer stays offline")
+	fs.IntVar(&cfg.maxCAs, "max-cas", 32, "most root CAs to keep, the newest; 0 for no limit")
+	fs.StringVar(&cfg.apiserverFile, "apiserver-file", "", "file of apiserver URLs, one per line as for -apiserver, with # comments; re-read on SIGHUP (optional)")
+	fs.IntVar(&cfg.maxPayloadBytes, "max-payload-bytes", 4<<20, "drop gossip payloads bigger than this, before decoding them; 0 for no limit")
+	fs.IntVar(&cfg.maxPayloadAPIServers, "max-payload-apiservers", 4096, "drop gossip payloads with more entries than this of any kind about apiservers, such as URLs, leases or probes; 0 for no limit")
+	fs.IntVar(&cfg.maxPayloadURLLength, "max-payload-url-length", 2048, "drop gossip payloads with an apiserver URL longer than this; 0 for no limit")
+	fs.IntVar(&cfg.maxPayloadCertBytes, "max-payload-cert-bytes", 64<<10, "drop gossip payloads with a certificate bigger than this, in DER; 0 for no limit")
+	fs.IntVar(&cfg.maxAPIServerURLs, "max-apiserver-urls", 32, "most apiserver URLs to keep, from -apiserver and from other peers, evicting the least recently refreshed gossiped ones; 0 for no limit")
+	fs.BoolVar(&cfg.allowInsecureAPIServer, "allow-insecure-apiserver", false, "accept http:// apiserver URLs, from -apiserver and from other peers (for local testing)")
+	fs.DurationVar(&cfg.shutdownGrace, "shutdown-grace", 5*time.Second, "how long to let the final gossip drain on shutdown")
+	fs.DurationVar(&cfg.statusInterval, "status-interval", 60*time.Second, "how often to log a status summary (0 to disable)")
+	fs.DurationVar(&cfg.connectionLogInterval, "connection-log-interval", 5*time.Second, "how often to check for mesh connections that came, went or changed state, to log them, and count failed connection attempts (0 to disable)")
+	fs.DurationVar(&cfg.broadcastDelay, "broadcast-delay", 200*time.Millisecond, "how long to gather local changes, such as a reloaded root CA or a removed apiserver, before broadcasting them together, rather than waiting for periodic gossip (0 to broadcast each at once)")
+	fs.DurationVar(&cfg.fullSyncInterval, "full-sync-interval", 30*time.Second, "how often to unicast our complete state to newly connected peers, and one other (0 to disable)")
+	fs.DurationVar(&cfg.stateRequestTimeout, "state-request-timeout", 2*time.Second, "on joining, ask our first connected peer for its complete state, and another if it doesn't answer within this, waiting twice as long each time (0 not to ask)")
+	fs.DurationVar(&cfg.apiserverProbeInterval, "apiserver-probe-interval", time.Minute, "how often, give or take half, to probe the gossiped apiserver URLs (0 to disable)")
+	fs.DurationVar(&cfg.apiserverProbeTimeout, "apiserver-probe-timeout", 5*time.Second, "timeout for each apiserver probe")
+	fs.DurationVar(&cfg.apiserverCertRefreshInterval, "apiserver-cert-refresh-interval", 10*time.Minute, "how often to fetch the serving certificate of each -apiserver, to gossip its public key hash; 0 to disable")
+	fs.DurationVar(&cfg.consensusWindow, "consensus-window", 10*time.Minute, "how recent a peer's probe of an apiserver must be to count towards the consensus on its health")
+	fs.Float64Var(&cfg.consensusFraction, "consensus-fraction", 0.5, "share of the peers that recently probed an apiserver that must have found it healthy for it to be consensus-healthy")
+	fs.IntVar(&cfg.apiserverProbeMax, "apiserver-probe-max", 10, "most apiserver URLs to probe in each round (0 for all)")
+	fs.DurationVar(&cfg.apiserverResolveInterval, "apiserver-resolve-interval", 5*time.Minute, "how often to resolve the gossiped apiserver hostnames, and gossip their IP addresses for peers without DNS (0 to disable)")
+	fs.IntVar(&cfg.readyMinCAs, "ready-min-cas", 1, "root CAs needed before /ready succeeds")
+	fs.IntVar(&cfg.readyMinAPIServers, "ready-min-apiservers", 1, "apiserver URLs needed before /ready succeeds")
+	fs.BoolVar(&cfg.waitForCA, "wait-for-ca", false, "only notify systemd and write -ready-file once a root CA and apiserver URL are known")
+	fs.DurationVar(&cfg.waitForCATimeout, "wait-for-ca-timeout", 0, "with -wait-for-ca, exit with an error if they aren't known within this long (0 to wait forever)")
+	fs.StringVar(&cfg.readyFile, "ready-file", "", "create this file once ready (optional)")
+	fs.StringVar(&cfg.logFormat, "log-format", "text", "log format, text or json")
+	fs.StringVar(&cfg.logLevel, "log-level", "info", "least severe messages to log: debug, info, warn or error")
+	fs.StringVar(&cfg.httpListen, "http-listen", "", "HTTP listen address for the status endpoint; without a host, loopback unless serving TLS (optional)")
+	fs.StringVar(&cfg.httpTLSCert, "http-tls-cert", "", "serve -http-listen over HTTPS with this certificate (optional)")
+	fs.StringVar(&cfg.httpTLSKey, "http-tls-key", "", "private key for -http-tls-cert")
+	fs.StringVar(&cfg.httpBasicAuth, "http-basic-auth", "", "require HTTP basic auth on -http-listen, with the <user>:<password> in this file (optional)")
+	fs.BoolVar(&cfg.httpAdmin, "http-admin", false, "serve POST /peers/connect and /peers/forget on -http-listen, to change which peers we connect to")
+	fs.IntVar(&cfg.wireVersion, "wire-version", wireVersion, "wire version to gossip in: 2, protobuf, or 1, gob, while upgrading a mesh of peers that only understand 1")
+	fs.IntVar(&cfg.compressOver, "compress-over", 0, "gzip gossip payloads on "+nodeBootstrapChannelV1+" bigger than this many bytes; 0 never to")
+	fs.BoolVar(&cfg.channelCompat, "channel-compat", true, "also gossip on "+nodeBootstrapChannel+", in -wire-version and uncompressed, for peers from before "+nodeBootstrapChannelV1+"; turn off once /state shows no peers only there")
+	fs.BoolVar(&cfg.dryRun, "dry-run", false, "print the configuration this would run with, and exit; non-zero if any of it is invalid")
+	fs.BoolVar(&cfg.showVersion, "version", false, "print the version, git commit and build date, and exit")
+	fs.Var(cfg.peers, "peer", "initial peer (may be repeated)")
+	fs.DurationVar(&cfg.apiserverProbeInterval, "apiserver-healthcheck-interval", cfg.apiserverProbeInterval, "same as -apiserver-probe-interval")
+	fs.DurationVar(&cfg.tombstoneKeep, "remove-apiserver-keep", cfg.tombstoneKeep, "same as -tombstone-keep")
+	fs.Var(cfg.apiservers, "apiserver", "the URL of the apiserver, optionally followed by ,priority=<n>,weight=<n> and ,<label>=<value> (may be repeated)")
+	fs.Var(cfg.consensusHealthyOnly, "consensus-healthy-only", "use only consensus-healthy apiservers, if any, for outputs (the kubeconfig, discovery and upstream files), proxy (-local-proxy) or hook (-on-apiserver-change) (may be repeated)")
+	fs.Var(cfg.removals, "remove-apiserver", "remove this apiserver URL across the mesh, even if other peers still advertise it (may be repeated)")
+	fs.Var(cfg.revokes, "revoke-bootstrap-token", "revoke the bootstrap token with this ID across the mesh, even if other peers still gossip it (may be repeated)")
+	fs.Var(cfg.rootCAs, "root-ca", "root CA certificate bundle (may be repeated)")
+	fs.Var(cfg.caSlots, "ca", "CA certificate bundle for a named slot, as name=path, e.g. front-proxy=/etc/kubernetes/pki/front-proxy-ca.crt; cluster is -root-ca (may be repeated)")
+	fs.Var(cfg.caSlotOut, "ca-slot-out", "write the CA bundle of a named slot to a file, as name=path; cluster is -ca-out (may be repeated)")
+	fs.Var(&cfg.caOutMode, "ca-out-mode", "file mode for -ca-out")
+	fs.Var(cfg.csrSigners, "csr-signers", "peer allowed to sign our serving certificate, by MAC address (may be repeated)")
+	fs.Var(cfg.servingCertIPs, "serving-cert-ip", "IP address to request in our serving certificate, as the signers see us (may be repeated)")
+	fs.Var(cfg.subnets, "trusted-subnet", "CIDR of a subnet whose peers are trusted by the mesh (may be repeated)")
+	fs.Var(cfg.caHashes, "ca-hash", "only accept gossiped root CAs with this public key hash, as sha256:<hex> (may be repeated)")
+}
+
+func main() {
+	mode, args, err := command(os.Args[1:])
 	if err != nil {
-		logger.Fatalf("mesh address: %s: %v", *meshListen, err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	port, err := strconv.Atoi(portStr)
+	if mode == "status" {
+		switch err := statusCommand(args, os.Stdout, os.Stderr); err {
+		case nil, flag.ErrHelp:
+		default:
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	cfg := newConfig()
+	cfg.register(flag.CommandLine)
+	if err := cfg.parse(flag.CommandLine, args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if cfg.showVersion {
+		fmt.Println(versionString())
+		os.Exit(0)
+	}
+	if cfg.nickname == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "hostname: %v; set -nickname\n", err)
+			os.Exit(2)
+		}
+		cfg.nickname = hostname
+	}
+	logger, err := newLogger(cfg.logFormat, cfg.logLevel, os.Stderr, cfg.nickname)
 	if err != nil {
-		logger.Fatalf("mesh address: %s: %v", *meshListen, err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := run(cfg, logger); err != nil {
+		logger.Fatalf("%v", err)
+	}
+}
+
+// run runs a peer with cfg until it's signalled or cfg.stop is closed,
+// then leaves the mesh gracefully. It returns an error if cfg is invalid,
+// or if anything else stopped it.
+func run(cfg Config, logger *levelLogger) error {
+	stdout, lookupHost, probe, fetchCertHash := cfg.stdout, cfg.lookupHost, cfg.probe, cfg.fetchCertHash
+	if stdout == nil {
+		stdout = os.Stdout
+	}
+	if lookupHost == nil {
+		lookupHost = net.LookupHost
 	}
+	dial := cfg.dial
+	if dial == nil {
+		dial = net.DialTimeout
+	}
+	if probe == nil {
+		probe = probeAPIServer
+	}
+	if fetchCertHash == nil {
+		fetchCertHash = fetchServingCertHash
+	}
+	logger.Infof("Starting %s", versionString())
 
-	name, err := mesh.PeerNameFromString(*hwaddr)
+	if cfg.nickname == "" {
+		return errors.New("no nickname")
+	}
+	// The cluster slot is -root-ca, but don't change the caller's flags.
+	rootCAs, caSlots := stringset{}, slotPaths{}
+	for path := range cfg.rootCAs {
+		rootCAs.Set(path)
+	}
+	for slot, paths := range cfg.caSlots {
+		if slot == clusterSlot {
+			for _, path := range paths {
+				rootCAs.Set(path)
+			}
+			continue
+		}
+		caSlots[slot] = paths
+	}
+	slotOut := map[string]string{}
+	for _, name := range cfg.caSlotOut.names() {
+		if paths := cfg.caSlotOut[name]; len(paths) > 1 {
+			return fmt.Errorf("-ca-slot-out: more than one path for %s", name)
+		}
+		slotOut[name] = cfg.caSlotOut[name][0]
+	}
+	if path, ok := slotOut[clusterSlot]; ok {
+		if cfg.caOut != "" && cfg.caOut != path {
+			return errors.New("-ca-out and -ca-slot-out cluster=... disagree")
+		}
+		cfg.caOut = path
+		delete(slotOut, clusterSlot)
+	}
+
+	host, port, err := parseMeshListen(cfg.meshListen)
 	if err != nil {
-		logger.Fatalf("%s: %v", *hwaddr, err)
+		return fmt.Errorf("mesh address: %v", err)
+	}
+
+	if cfg.protocolMinVersion < mesh.ProtocolMinVersion || cfg.protocolMinVersion > mesh.ProtocolMaxVersion {
+		return fmt.Errorf("-protocol-min-version %d: must be between %d and %d", cfg.protocolMinVersion, mesh.ProtocolMinVersion, mesh.ProtocolMaxVersion)
 	}
+	logger.Infof("Negotiating mesh protocol version %d or later, up to %d", cfg.protocolMinVersion, mesh.ProtocolMaxVersion)
 
-	certInfo := &RootCAPublicKey{}
+	if cfg.connLimit <= 0 {
+		return fmt.Errorf("-conn-limit %d: must be positive", cfg.connLimit)
+	}
+	if cfg.requireInitialPeer && (len(cfg.peers) == 0 || cfg.peerCheckTimeout <= 0) {
+		return errors.New("-require-initial-peer needs -peer and -peer-check-timeout")
+	}
+	// Each peer only needs a few connections for gossip to reach everyone,
+	// so a limit far beyond what the seed set suggests is probably a typo.
+	if seeds := len(cfg.peers); cfg.connLimit > 256 && cfg.connLimit > 16*seeds {
+		logger.Warnf("-conn-limit %d is very high for %d seed peer(s)", cfg.connLimit, seeds)
+	}
 
-	if *rootCA != "" {
-		logger.Print("Found a certificate...")
-		ca, err := ioutil.ReadFile(*rootCA)
+	trusted := []*net.IPNet{}
+	for _, s := range cfg.subnets.slice() {
+		_, subnet, err := net.ParseCIDR(s)
 		if err != nil {
-			logger.Print(err)
+			return fmt.Errorf("trusted-subnet: %v", err)
 		}
+		trusted = append(trusted, subnet)
+	}
 
-		certBlock, _ := pem.Decode(ca)
-		cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if cfg.passwordFile != "" {
+		if cfg.password != "" {
+			return errors.New("-password and -password-file are mutually exclusive")
+		}
+		cfg.password, err = readPassword(cfg.passwordFile)
 		if err != nil {
-			logger.Print(err)
+			return fmt.Errorf("password file: %v", err)
 		}
+	}
 
-		logger.Printf("Picked up root CA certificate which is not valid before %v", cert.NotBefore)
-		certInfo.NotBefore = cert.NotBefore
-		certInfo.Signature = cert.Signature
-		certInfo.Bytes = certBlock.Bytes
+	if cfg.bootstrapTokenFile != "" {
+		if cfg.bootstrapToken != "" {
+			return errors.New("-bootstrap-token and -bootstrap-token-file are mutually exclusive")
+		}
+		cfg.bootstrapToken, err = readPassword(cfg.bootstrapTokenFile)
+		if err != nil {
+			return fmt.Errorf("bootstrap token file: %v", err)
+		}
+	}
+	if cfg.bootstrapToken != "" {
+		if err := validateBootstrapToken(cfg.bootstrapToken); err != nil {
+			return err
+		}
+	}
+	for _, id := range cfg.revokes.slice() {
+		if err := validateBootstrapTokenID(id); err != nil {
+			return fmt.Errorf("revoke-bootstrap-token: %s: %v", id, err)
+		}
+		if cfg.bootstrapToken != "" && bootstrapTokenID(cfg.bootstrapToken) == id {
+			return fmt.Errorf("revoke-bootstrap-token: %s is also the -bootstrap-token", id)
+		}
 	}
 
-	router := mesh.NewRouter(mesh.Config{
-		Host:               host,
-		Port:               port,
-		ProtocolMinVersion: mesh.ProtocolMinVersion,
-		Password:           []byte(*password),
-		ConnLimit:          64,
-		PeerDiscovery:      true,
-		TrustedSubnets:     []*net.IPNet{},
-	}, name, *nickname, mesh.NullOverlay{}, log.New(ioutil.Discard, "", 0))
+	if cfg.hwaddr != "" && cfg.hwaddrInterface != "" {
+		return errors.New("-hwaddr and -hwaddr-interface are mutually exclusive")
+	}
+	if cfg.hwaddr == "" {
+		iface, err := hardwareAddr(cfg.hwaddrInterface)
+		if err != nil {
+			return err
+		}
+		cfg.hwaddr = iface.HardwareAddr.String()
+		logger.Infof("Using MAC address %s of interface %s as peer name", cfg.hwaddr, iface.Name)
+		if locallyAdministered(iface.HardwareAddr) {
+			logger.Warnf("MAC address %s of interface %s is locally administered, so may not be unique; if peer names collide, set -hwaddr or -hwaddr-interface", cfg.hwaddr, iface.Name)
+		}
+	}
+	name, err := mesh.PeerNameFromString(cfg.hwaddr)
+	if err != nil {
+		return fmt.Errorf("%s: %v", cfg.hwaddr, err)
+	}
 
-	// XXX change "node" to something else, "kubelet"?
-	apiserverURLs := make([]string, 0)
-	for _, apiserver := range apiservers.slice() {
-		if apiserverURL, err := url.Parse(apiserver); err == nil {
-			apiserverURLs = append(apiserverURLs, apiserverURL.String())
+	pins := map[string]struct{}{}
+	for _, s := range cfg.caHashes.slice() {
+		hash, err := parseCAHash(s)
+		if err != nil {
+			return fmt.Errorf("ca-hash: %v", err)
+		}
+		pins[hash] = struct{}{}
+	}
+
+	var tofu *tofuPin
+	if cfg.tofuFile != "" {
+		if cfg.tofuReset && !cfg.dryRun {
+			if err := os.Remove(cfg.tofuFile); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("tofu-reset: %v", err)
+			}
+			logger.Infof("Forgot the root CA pinned in %s", cfg.tofuFile)
+		}
+		if tofu, err = loadTOFUPin(cfg.tofuFile); err != nil {
+			return fmt.Errorf("tofu-file: %v", err)
+		}
+	} else if cfg.tofuReset {
+		return errors.New("-tofu-reset needs -tofu-file")
+	}
+
+	if cfg.requireSigned && len(pins) == 0 && tofu == nil {
+		return errors.New("-require-signed needs -ca-hash or -tofu-file")
+	}
+
+	var httpAddr string
+	var httpAuthCreds *basicAuth
+	if cfg.httpListen != "" {
+		if (cfg.httpTLSCert == "") != (cfg.httpTLSKey == "") {
+			return errors.New("-http-tls-cert and -http-tls-key go together")
+		}
+		if httpAddr, err = httpListenAddr(cfg.httpListen, cfg.httpTLSCert != ""); err != nil {
+			return fmt.Errorf("http-listen: %v", err)
+		}
+		if cfg.httpBasicAuth != "" {
+			s, err := readPassword(cfg.httpBasicAuth)
+			if err != nil {
+				return fmt.Errorf("http-basic-auth: %v", err)
+			}
+			auth, err := parseBasicAuth(s)
+			if err != nil {
+				return fmt.Errorf("http-basic-auth: %s: %v", cfg.httpBasicAuth, err)
+			}
+			httpAuthCreds = &auth
+		}
+	}
+
+	upstreamOpts := upstreamOptions{out: cfg.upstreamOut, pidFile: cfg.upstreamReloadPidfile, debounce: cfg.upstreamDebounce}
+	if upstreamOpts.signal, err = parseSignal(cfg.upstreamReloadSignal); err != nil {
+		return fmt.Errorf("upstream-reload-signal: %v", err)
+	}
+	if cfg.upstreamTemplate != "" {
+		if upstreamOpts.template, err = template.ParseFiles(cfg.upstreamTemplate); err != nil {
+			return fmt.Errorf("upstream-template: %v", err)
+		}
+	}
+
+	apiserverFlags := cfg.apiservers
+	if cfg.apiservers, err = loadAPIServers(apiserverFlags, cfg.apiserverFile, cfg.allowInsecureAPIServer, cfg.maxAPIServerURLs); err != nil {
+		return fmt.Errorf("apiserver: %v", err)
+	}
+
+	opts := peerOptions{
+		caGeneration:           cfg.rootCAGeneration,
+		caOverlap:              cfg.rootCAOverlap,
+		skipCAValidation:       cfg.skipCAValidation,
+		allowExpiredCA:         cfg.allowExpiredCA,
+		caExpiryWarning:        cfg.caExpiryWarning,
+		caHashes:               pins,
+		tofu:                   tofu,
+		requireSigned:          cfg.requireSigned,
+		caQuorum:               cfg.caQuorum,
+		caOut:                  cfg.caOut,
+		caOutMode:              os.FileMode(cfg.caOutMode),
+		caSlotOut:              slotOut,
+		crlOut:                 cfg.crlOut,
+		apiserverTTL:           cfg.apiserverTTL,
+		apiserverPriorities:    cfg.apiservers.priorities,
+		apiserverLabels:        cfg.apiservers.labels,
+		maxCAs:                 cfg.maxCAs,
+		maxAPIServerURLs:       cfg.maxAPIServerURLs,
+		allowInsecureAPIServer: cfg.allowInsecureAPIServer,
+		kubeconfigOut:          cfg.kubeconfigOut,
+		kubeconfigMode:         os.FileMode(cfg.kubeconfigMode),
+		discoveryFileOut:       cfg.discoveryFileOut,
+		discoveryServer:        cfg.discoveryServer,
+		bootstrapTokenOut:      cfg.bootstrapTokenOut,
+		showSecrets:            cfg.showSecrets,
+		readyMinCAs:            cfg.readyMinCAs,
+		readyMinAPIServers:     cfg.readyMinAPIServers,
+		upstream:               upstreamOpts,
+		wireVersion:            byte(cfg.wireVersion),
+		compressOver:           cfg.compressOver,
+		channelCompat:          cfg.channelCompat,
+		consensus:              consensusConfig{window: cfg.consensusWindow, fraction: cfg.consensusFraction, only: map[string]bool{}},
+		broadcastDelay:         cfg.broadcastDelay,
+		limits:                 payloadLimits{maxBytes: cfg.maxPayloadBytes, maxAPIServers: cfg.maxPayloadAPIServers, maxURLLength: cfg.maxPayloadURLLength, maxCertBytes: cfg.maxPayloadCertBytes},
+	}
+	if cfg.compressOver < 0 {
+		return fmt.Errorf("compress-over: %d is negative", cfg.compressOver)
+	}
+	if cfg.wireVersion != wireVersion && cfg.wireVersion != legacyWireVersion {
+		return fmt.Errorf("wire-version: %d is neither %d nor %d", cfg.wireVersion, wireVersion, legacyWireVersion)
+	}
+	if cfg.wireVersion != wireVersion && !cfg.channelCompat {
+		return fmt.Errorf("wire-version: %d is only for %s, which -channel-compat=false turns off", cfg.wireVersion, nodeBootstrapChannel)
+	}
+	for _, consumer := range cfg.consensusHealthyOnly.slice() {
+		opts.consensus.only[consumer] = true
+	}
+	if err := opts.consensus.validate(); err != nil {
+		return fmt.Errorf("consensus: %v", err)
+	}
+	if cfg.password != "" {
+		if opts.sealer, err = newSealer([]byte(cfg.password), []byte(cfg.passwordSalt)); err != nil {
+			return fmt.Errorf("payload encryption: %v", err)
+		}
+	}
+
+	// readSecretCAs reads -ca-from-secret, if given. The Secret is only
+	// one more seed, so we go on without it if it can't be read.
+	readSecretCAs := func() ([]*x509.Certificate, error) { return nil, nil }
+	if cfg.caFromSecret != "" {
+		namespace, name, err := parseSecretRef(cfg.caFromSecret)
+		if err != nil {
+			return fmt.Errorf("ca-from-secret: %v", err)
+		}
+		var client *kubeClient
+		if cfg.kubeconfig != "" {
+			client, err = kubeconfigKubeClient(cfg.kubeconfig)
 		} else {
-			logger.Printf("Could not parse %q as ULR - %s", apiserver, err)
+			client, err = inClusterKubeClient()
+		}
+		if err != nil {
+			return fmt.Errorf("ca-from-secret: %v", err)
+		}
+		readSecretCAs = func() ([]*x509.Certificate, error) {
+			return readRootCASecret(client, namespace, name, opts, logger)
+		}
+	}
+
+	var problems []string
+	cas, err := readRootCAs(rootCAs.slice(), opts, logger)
+	if err != nil && cfg.watchRootCA {
+		logger.Warnf("root CA: %v; waiting for it to change", err)
+		problems = append(problems, fmt.Sprintf("root CA: %v", err))
+	} else if err != nil {
+		return fmt.Errorf("root CA: %v", err)
+	}
+	if secretCAs, err := readSecretCAs(); err != nil {
+		logger.Warnf("ca-from-secret: %s: %v; going on without it", cfg.caFromSecret, err)
+		problems = append(problems, fmt.Sprintf("ca-from-secret: %s: %v", cfg.caFromSecret, err))
+	} else {
+		cas = append(cas, secretCAs...)
+	}
+	var crl *CRL
+	if cfg.crlPath != "" {
+		if crl, err = loadCRL(cfg.crlPath, cas); err != nil {
+			return fmt.Errorf("CRL: %v", err)
+		}
+		if crl.expired(time.Now()) {
+			logger.Warnf("%s expired at %v; distributing it anyway", crl, crl.NextUpdate)
 		}
 	}
+	slotCerts := map[string][]*x509.Certificate{}
+	for _, slot := range caSlots.names() {
+		if slotCerts[slot], err = readRootCAs(caSlots[slot], opts, logger); err != nil {
+			return fmt.Errorf("%s CA: %v", slot, err)
+		}
+	}
+	certs := newRootCAPublicKeys(cas, cfg.rootCAGeneration, name)
+	if cfg.maxCAs > 0 && len(certs) > cfg.maxCAs {
+		return fmt.Errorf("root-ca: %d root CA certificates given, but -max-cas is %d", len(certs), cfg.maxCAs)
+	}
+	introduce(certs, cfg.nickname, time.Now(), nil)
+	for _, ca := range certs {
+		logger.Infof("Picked up root CA certificate %s, with %d intermediate(s), which is not valid before %v", ca.fingerprint(), len(ca.Chain), ca.NotBefore)
+	}
+
+	// XXX change "node" to something else, "kubelet"?
+	apiserverURLs := append([]string{}, cfg.apiservers.slice()...)
+	for _, apiserver := range cfg.removals.slice() {
+		if _, ok := cfg.apiservers.stringset[apiserver]; ok {
+			return fmt.Errorf("remove-apiserver: %s is also an -apiserver", apiserver)
+		}
+	}
+
+	var (
+		attestation *Attestation
+		signer      *csrSigner
+	)
+	if cfg.rootCAKey != "" {
+		key, err := loadRootCAKey(cfg.rootCAKey)
+		if err != nil {
+			return fmt.Errorf("root CA key: %v", err)
+		}
+		cert, err := certForKey(cas, key)
+		if err != nil {
+			return fmt.Errorf("root CA key: %s: %v", cfg.rootCAKey, err)
+		}
+		if attestation, err = signAttestation(key, cert, name, apiserverURLs, time.Now()); err != nil {
+			return fmt.Errorf("root CA key: %v", err)
+		}
+		logger.Infof("Signed %d apiserver URL(s) with the key of root CA %s", len(attestation.ApiserverURLs), spkiHash(cert))
+		if cfg.signCSRs {
+			signer = &csrSigner{key: key, ca: cert, ttl: cfg.servingCertTTL}
+		}
+	} else if cfg.signCSRs {
+		return errors.New("-csr-signer needs -root-ca-key")
+	}
+
+	var signerNames []mesh.PeerName
+	for _, s := range cfg.csrSigners.slice() {
+		name, err := mesh.PeerNameFromString(s)
+		if err != nil {
+			return fmt.Errorf("csr-signers: %s: %v", s, err)
+		}
+		signerNames = append(signerNames, name)
+	}
+	if cfg.servingCertOut != "" && (cfg.servingKeyOut == "" || len(signerNames) == 0) {
+		return errors.New("-serving-cert-out needs -serving-key-out and -csr-signers")
+	}
+	var ips []net.IP
+	for _, s := range cfg.servingCertIPs.slice() {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("serving-cert-ip: %q is not an IP address", s)
+		}
+		ips = append(ips, ip)
+	}
+	if cfg.dryRun {
+		// Nothing is built, let alone started.
+		dryRunSummary{
+			Listen:        net.JoinHostPort(host, strconv.Itoa(port)),
+			Name:          name.String(),
+			Nickname:      cfg.nickname,
+			Peers:         cfg.peers.slice(),
+			RootCAs:       certs,
+			ApiserverURLs: apiserverURLs,
+			Problems:      problems,
+		}.write(stdout, time.Now())
+		if len(problems) > 0 {
+			return fmt.Errorf("dry run: %d problem(s)", len(problems))
+		}
+		return nil
+	}
+	if cfg.onCAChange != "" {
+		opts.caHook = newCAHook(cfg.onCAChange, cfg.onCAChangeDebounce, certs, logger)
+	}
+	if cfg.onAPIServerChange != "" {
+		opts.apiserverHook = newAPIServerHook(cfg.onAPIServerChange, cfg.onAPIServerChangeDebounce, cfg.onAPIServerChangeTimeout, logger)
+	}
+	csrs := newCSRService(signer, signerNames, logger)
 
-	nodeBootstrapPeer := newNodeBootstrapPeer(name, certInfo, apiserverURLs, logger)
-	nodeBootstrap := router.NewGossip("kubernetes-node-bootstrap-v0", nodeBootstrapPeer)
-	nodeBootstrapPeer.register(nodeBootstrap)
+	if cfg.peerCheckTimeout > 0 && len(cfg.peers) > 0 {
+		reachable := logReachability(checkPeers(cfg.peers.slice(), cfg.peerCheckTimeout, dial), logger)
+		if reachable == 0 && cfg.requireInitialPeer {
+			return fmt.Errorf("none of the %d -peer(s) is reachable, and -require-initial-peer is set", len(cfg.peers))
+		}
+	}
+
+	// Before anything starts, so that if we can't, there's nothing to stop.
+	var proxyListener net.Listener
+	if cfg.localProxy != "" {
+		if proxyListener, err = net.Listen("tcp", cfg.localProxy); err != nil {
+			return fmt.Errorf("local-proxy: %v", err)
+		}
+	}
+
+	router, nodeBootstrapPeer, err := newPeerRouter(peerConfig{
+		mesh: mesh.Config{
+			Host:               host,
+			Port:               port,
+			ProtocolMinVersion: byte(cfg.protocolMinVersion),
+			Password:           []byte(cfg.password),
+			ConnLimit:          cfg.connLimit,
+			PeerDiscovery:      cfg.peerDiscovery,
+			TrustedSubnets:     trusted,
+		},
+		name:       name,
+		nickname:   cfg.nickname,
+		certs:      certs,
+		apiservers: apiserverURLs,
+		opts:       opts,
+		logger:     logger,
+	})
+	if err != nil {
+		if proxyListener != nil {
+			proxyListener.Close()
+		}
+		return fmt.Errorf("mesh: %v", err)
+	}
+	if signer != nil {
+		signer.addresses = meshPeerAddresses(router)
+	}
+	for slot, certs := range slotCerts {
+		nodeBootstrapPeer.addCASlot(slot, certs)
+	}
+	if crl != nil {
+		nodeBootstrapPeer.addCRL(crl)
+	}
+	if attestation != nil {
+		nodeBootstrapPeer.addAttestation(attestation)
+	}
+	if cfg.bootstrapToken != "" {
+		nodeBootstrapPeer.addBootstrapToken(cfg.bootstrapToken, time.Now().Add(cfg.bootstrapTokenTTL))
+	}
+	if removed := cfg.removals.slice(); len(removed) > 0 {
+		nodeBootstrapPeer.removeAPIServers(removed, time.Now(), cfg.tombstoneKeep)
+	}
+	if revoked := cfg.revokes.slice(); len(revoked) > 0 {
+		nodeBootstrapPeer.revokeBootstrapTokens(revoked, time.Now(), cfg.tombstoneKeep)
+	}
+	nodeBootstrapPeer.onChange()
+	csrs.register(router.NewGossip(csrChannel, csrs))
 
 	func() {
-		logger.Printf("mesh router starting (%s)", *meshListen)
+		logger.Infof("mesh router starting (%s)", cfg.meshListen)
 		router.Start()
 	}()
-	defer func() {
-		logger.Printf("mesh router stopping")
-		router.Stop()
-	}()
 
-	router.ConnectionMaker.InitiateConnections(peers.slice(), true)
+	// The -peer list is connected to, and retried, with or without discovery.
+	if !cfg.peerDiscovery {
+		logger.Warnf("peer discovery is off; the mesh won't grow beyond %s", cfg.peers)
+	}
+	if cfg.peerRefreshInterval > 0 {
+		resolver := newPeerResolver(cfg.peers.slice(), router.ConnectionMaker, logger)
+		resolver.refresh()
+		go resolver.loop(cfg.peerRefreshInterval, nodeBootstrapPeer.quit)
+	} else {
+		for _, err := range router.ConnectionMaker.InitiateConnections(cfg.peers.slice(), true) {
+			logger.Warnf("peer: %v", err)
+		}
+	}
+
+	if cfg.servingCertOut != "" {
+		go func() {
+			key, cert, err := csrs.requestServingCert(servingCertRequest{
+				nickname: cfg.nickname,
+				ips:      ips,
+				timeout:  cfg.csrTimeout,
+				roots:    nodeBootstrapPeer.trustedRootCAs,
+			}, nodeBootstrapPeer.quit)
+			if err != nil {
+				logger.Errorf("Serving certificate: %v", err)
+				return
+			}
+			if err := writeServingCert(cfg.servingCertOut, cfg.servingKeyOut, key, cert); err != nil {
+				logger.Errorf("Serving certificate: %v", err)
+				return
+			}
+			logger.Infof("Wrote serving certificate to %s", cfg.servingCertOut)
+		}()
+	}
 
-	errs := make(chan error)
+	// Room for a reason from each of the signals, cfg.stop, waitReady, the
+	// HTTP server and the local proxy, so that none blocks once we have
+	// the first.
+	errs := make(chan error, 5)
+	stopping, done := make(chan struct{}), make(chan struct{})
+	defer close(done)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
 	go func() {
-		c := make(chan os.Signal)
-		signal.Notify(c, syscall.SIGINT)
-		errs <- fmt.Errorf("%s", <-c)
+		// The first signal is why we shut down, unless something else
+		// is; any after that means the operator can't wait for it.
+		select {
+		case s := <-signals:
+			errs <- receivedSignal{s}
+		case <-stopping:
+		}
+		select {
+		case s := <-signals:
+			logger.Infof("%s while shutting down, exiting immediately", s)
+			os.Exit(1)
+		case <-done:
+		}
 	}()
+	if cfg.stop != nil {
+		go func() {
+			select {
+			case <-cfg.stop:
+				errs <- errStopped
+			case <-done:
+			}
+		}()
+	}
+
+	go func() {
+		if cfg.waitForCA {
+			logger.Infof("Waiting for a root CA and apiserver URL")
+			if err := waitReady(nodeBootstrapPeer, time.Second, cfg.waitForCATimeout, nodeBootstrapPeer.quit); err != nil {
+				errs <- err
+				return
+			}
+		}
+		logger.Infof("Ready")
+		if cfg.readyFile != "" {
+			if err := writeFileAtomic(cfg.readyFile, nil, 0644); err != nil {
+				logger.Errorf("Writing ready file: %v", err)
+			}
+		}
+		if err := sdNotify("READY=1"); err != nil {
+			logger.Errorf("Notifying systemd: %v", err)
+		}
+	}()
+
+	// reloadRootCAs is all or nothing: if any file is missing or invalid,
+	// including one removed since startup, we keep what we have. So too
+	// if -ca-from-secret can't be read, unless the Secret is gone.
+	reloadRootCAs := func() {
+		cas, err := readRootCAs(rootCAs.slice(), opts, logger)
+		if err != nil {
+			logger.Errorf("root CA reload failed, keeping the current one: %v", err)
+			return
+		}
+		secretCAs, err := readSecretCAs()
+		if err == errSecretNotFound {
+			logger.Warnf("ca-from-secret: %s: %v; going on without it", cfg.caFromSecret, err)
+		} else if err != nil {
+			logger.Errorf("root CA reload failed, keeping the current one: ca-from-secret: %s: %v", cfg.caFromSecret, err)
+			return
+		}
+		nodeBootstrapPeer.reloadRootCAs(append(cas, secretCAs...))
+	}
 
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer func() {
+		signal.Stop(hup)
+		close(hup)
+	}()
 	go func() {
-		time.Sleep(5 * time.Second)
-		logger.Print(mesh.NewStatus(router).Connections)
+		for range hup {
+			logger.Infof("SIGHUP, reloading root CA from %s", rootCAs)
+			reloadRootCAs()
+			if cfg.apiserverFile == "" {
+				continue
+			}
+			logger.Infof("SIGHUP, reloading apiservers from %s", cfg.apiserverFile)
+			as, err := loadAPIServers(apiserverFlags, cfg.apiserverFile, cfg.allowInsecureAPIServer, cfg.maxAPIServerURLs)
+			if err != nil {
+				logger.Errorf("apiserver reload failed, keeping the current ones: %v", err)
+				continue
+			}
+			nodeBootstrapPeer.reloadAPIServers(as)
+		}
 	}()
 
-	logger.Print(<-errs)
+	if cfg.watchRootCA {
+		watchFiles(rootCAs.slice(), time.Second, nodeBootstrapPeer.quit, logger, func() {
+			logger.Infof("%s changed, reloading root CA", rootCAs)
+			reloadRootCAs()
+		})
+	}
+
+	if cfg.httpListen != "" {
+		registerMetrics(router, nodeBootstrapPeer)
+		var targets meshTargets
+		if cfg.httpAdmin {
+			targets = router.ConnectionMaker
+		}
+		handler := newStatusHandler(nodeBootstrapPeer, targets)
+		if httpAuthCreds != nil {
+			handler = withBasicAuth(handler, *httpAuthCreds)
+		}
+		go func() {
+			if cfg.httpTLSCert != "" {
+				logger.Infof("HTTPS server starting (%s)", httpAddr)
+				errs <- http.ListenAndServeTLS(httpAddr, cfg.httpTLSCert, cfg.httpTLSKey, handler)
+				return
+			}
+			logger.Infof("HTTP server starting (%s)", httpAddr)
+			errs <- http.ListenAndServe(httpAddr, handler)
+		}()
+	}
+
+	if cfg.statusInterval > 0 {
+		go logStatus(router, nodeBootstrapPeer, cfg.statusInterval, nodeBootstrapPeer.quit, logger)
+	}
+	if cfg.connectionLogInterval > 0 {
+		go logConnections(router, cfg.connectionLogInterval, nodeBootstrapPeer.retries, nodeBootstrapPeer.quit, logger)
+	}
+	if cfg.fullSyncInterval > 0 {
+		go nodeBootstrapPeer.fullSync(meshConnectedPeers(router), cfg.fullSyncInterval, nodeBootstrapPeer.quit)
+	}
+	if cfg.stateRequestTimeout > 0 {
+		go nodeBootstrapPeer.requestState(meshConnectedPeers(router), cfg.stateRequestTimeout, nodeBootstrapPeer.quit)
+	}
+	if proxyListener != nil {
+		logger.Infof("Local apiserver proxy starting (%s)", cfg.localProxy)
+		go func() {
+			errs <- newLocalProxy(nodeBootstrapPeer.proxyTiers, cfg.localProxyDialTimeout, logger).serve(proxyListener)
+		}()
+	}
+	if cfg.apiserverResolveInterval > 0 {
+		go nodeBootstrapPeer.resolveAPIServerHosts(cfg.apiserverResolveInterval, lookupHost, nodeBootstrapPeer.quit)
+	}
+	if cfg.apiserverCertRefreshInterval > 0 && len(apiserverURLs) > 0 {
+		go nodeBootstrapPeer.fetchServingCerts(cfg.apiserverCertRefreshInterval, cfg.apiserverProbeTimeout, fetchCertHash, nodeBootstrapPeer.quit)
+	}
+	if cfg.apiserverProbeInterval > 0 {
+		probes := probeConfig{interval: cfg.apiserverProbeInterval, timeout: cfg.apiserverProbeTimeout, max: cfg.apiserverProbeMax, probe: probe}
+		go nodeBootstrapPeer.probeAPIServers(probes, nodeBootstrapPeer.quit)
+	}
+
+	reason := <-errs
+	close(stopping)
+	logger.Infof("%v", reason)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.shutdownGrace)
+	defer cancel()
+	shutdown(ctx, router, nodeBootstrapPeer, logger)
+	if _, ok := reason.(receivedSignal); !ok && reason != errStopped {
+		return fmt.Errorf("exiting: %v", reason)
+	}
+	logger.Infof("exiting: %v", reason)
+	return nil
+}
+
+// errStopped is the reason run exits when cfg.stop is closed.
+var errStopped = errors.New("stopped")
+
+// receivedSignal is the reason we exit when asked to.
+type receivedSignal struct{ os.Signal }
+
+func (s receivedSignal) Error() string {
+	return fmt.Sprintf("received %s", s.Signal)
+}
+
+// shutdown leaves the mesh gracefully: it stops connecting to new peers,
+// broadcasts our state one last time, and gives that broadcast until ctx
+// is done to drain before stopping the router. Mesh gossip isn't
+// acknowledged, so draining ends early only once no connections are left.
+func shutdown(ctx context.Context, router *mesh.Router, p *peer, logger *levelLogger) {
+	logger.Infof("mesh router draining")
+	router.ConnectionMaker.ForgetConnections(router.ConnectionMaker.Targets(false))
+	p.broadcastNow()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+drain:
+	for len(mesh.NewStatus(router).Connections) > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			break drain
+		}
+	}
+	logger.Infof("mesh router stopping")
+	router.Stop()
+	p.stop()
 }
 
 type stringset map[string]struct{}
@@ -142,23 +1041,31 @@ func (ss stringset) slice() []string {
 	return slice
 }
 
-func mustHardwareAddr() string {
-	ifaces, err := net.Interfaces()
+// readPassword reads a password from path, without the trailing newline
+// that editors and echo leave behind.
+func readPassword(path string) (string, error) {
+	buf, err := ioutil.ReadFile(path)
 	if err != nil {
-		panic(err)
-	}
-	for _, iface := range ifaces {
-		if s := iface.HardwareAddr.String(); s != "" {
-			return s
-		}
+		return "", err
 	}
-	panic("no valid network interfaces")
+	return strings.TrimSuffix(string(buf), "\n"), nil
 }
 
-func mustHostname() string {
-	hostname, err := os.Hostname()
+// fileMode is a flag.Value for octal file modes.
+type fileMode os.FileMode
+
+func (m *fileMode) Set(value string) error {
+	mode, err := strconv.ParseUint(value, 8, 32)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if mode&^0777 != 0 {
+		return fmt.Errorf("%s: not a file permission mode", value)
 	}
-	return hostname
+	*m = fileMode(mode)
+	return nil
+}
+
+func (m *fileMode) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
 }
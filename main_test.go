@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testConfig parses args as main would, with the fakes tests need.
+func testConfig(t *testing.T, args ...string) Config {
+	cfg := newConfig()
+	fs := flag.NewFlagSet("kubelet-mesh", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	cfg.register(fs)
+	base := []string{
+		"-hwaddr", "00:00:00:00:00:01",
+		"-nickname", "test",
+		"-status-interval", "0",
+		"-connection-log-interval", "0",
+		"-full-sync-interval", "0",
+		"-state-request-timeout", "0",
+		"-apiserver-probe-interval", "0",
+		"-apiserver-resolve-interval", "0",
+		"-apiserver-cert-refresh-interval", "0",
+		"-shutdown-grace", "10ms",
+	}
+	if err := cfg.parse(fs, append(base, args...)); err != nil {
+		t.Fatal(err)
+	}
+	cfg.lookupHost = func(string) ([]string, error) { return nil, nil }
+	cfg.dial = func(string, string, time.Duration) (net.Conn, error) { return nil, errors.New("unreachable") }
+	cfg.probe = func(string, []*RootCAPublicKey, time.Duration) (string, error) { return "", nil }
+	return cfg
+}
+
+func TestRunStops(t *testing.T) {
+	cfg := testConfig(t, "-apiserver", "https://10.0.0.1:6443")
+	stop := make(chan struct{})
+	cfg.stop = stop
+	done := make(chan error)
+	go func() { done <- run(cfg, newTextLogger(ioutil.Discard, "", 0)) }()
+	close(stop)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("want a clean stop, have %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run didn't stop")
+	}
+}
+
+func TestRunDryRun(t *testing.T) {
+	for _, testcase := range []struct {
+		name string
+		args []string
+		want string
+		ok   bool
+	}{
+		{"ok", []string{"-apiserver", "https://10.0.0.1:6443"}, "apiserver:     https://10.0.0.1:6443\n", true},
+		{"problem", []string{"-watch-root-ca", "-root-ca", "/nonexistent/ca.crt"}, "PROBLEM:", false},
+	} {
+		cfg := testConfig(t, append([]string{"-dry-run"}, testcase.args...)...)
+		var buf bytes.Buffer
+		cfg.stdout = &buf
+		err := run(cfg, newTextLogger(ioutil.Discard, "", 0))
+		if testcase.ok != (err == nil) {
+			t.Errorf("%s: want ok %v, have %v", testcase.name, testcase.ok, err)
+		}
+		if have := buf.String(); !strings.Contains(have, testcase.want) {
+			t.Errorf("%s: want %q in\n%s", testcase.name, testcase.want, have)
+		}
+	}
+}
+
+func TestRunInvalidConfig(t *testing.T) {
+	bound, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bound.Close()
+	for _, testcase := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"-conn-limit", "0"}, "-conn-limit 0: must be positive"},
+		{[]string{"-password", "x", "-password-file", "y"}, "mutually exclusive"},
+		{[]string{"-csr-signer"}, "-csr-signer needs -root-ca-key"},
+		{[]string{"-wire-version", "3"}, "wire-version: 3"},
+		{[]string{"-wire-version", "1", "-channel-compat=false"}, "wire-version: 1 is only for kubernetes-node-bootstrap-v0"},
+		{[]string{"-compress-over", "-1"}, "compress-over: -1 is negative"},
+		{[]string{"-require-initial-peer"}, "-require-initial-peer needs -peer"},
+		{[]string{"-require-initial-peer", "-peer", "10.0.0.2"}, "none of the 1 -peer(s) is reachable"},
+		{[]string{"-local-proxy", bound.Addr().String()}, "local-proxy:"},
+	} {
+		cfg := testConfig(t, testcase.args...)
+		err := run(cfg, newTextLogger(ioutil.Discard, "", 0))
+		if err == nil || !strings.Contains(err.Error(), testcase.want) {
+			t.Errorf("%v: want an error with %q, have %v", testcase.args, testcase.want, err)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// parseMeshListen splits -mesh into the host and port for mesh.Config.
+// The router binds a single address, so we only take one; IPv6 hosts
+// go in brackets, as in [::]:6783.
+func parseMeshListen(listen string) (host string, port int, err error) {
+	if strings.Contains(listen, ",") {
+		return "", 0, fmt.Errorf("%q: the mesh router binds a single address", listen)
+	}
+	host, portStr, err := net.SplitHostPort(listen)
+	if err != nil {
+		if strings.Count(listen, ":") > 1 && !strings.HasPrefix(listen, "[") {
+			return "", 0, fmt.Errorf("%q: put IPv6 addresses in brackets, as in [::]:6783", listen)
+		}
+		return "", 0, err
+	}
+	port, err = strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return "", 0, fmt.Errorf("%q: bad port %q", listen, portStr)
+	}
+	if ip := strings.SplitN(host, "%", 2)[0]; strings.Contains(ip, ":") && net.ParseIP(ip) == nil {
+		return "", 0, fmt.Errorf("%q: bad IPv6 address %q", listen, host)
+	}
+	return host, port, nil
+}
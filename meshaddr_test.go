@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestParseMeshListen(t *testing.T) {
+	for _, testcase := range []struct {
+		listen string
+		host   string
+		port   int
+		ok     bool
+	}{
+		{"0.0.0.0:6783", "0.0.0.0", 6783, true},
+		{":6783", "", 6783, true},
+		{"[::]:6783", "::", 6783, true},
+		{"[fd00::1]:7000", "fd00::1", 7000, true},
+		{"[fe80::1%eth0]:6783", "fe80::1%eth0", 6783, true},
+		{"node-1:6783", "node-1", 6783, true},
+		{"::6783", "", 0, false},
+		{"fd00::1:6783", "", 0, false},
+		{"[fd00::zz]:6783", "", 0, false},
+		{"0.0.0.0:6783,[::]:6783", "", 0, false},
+		{"0.0.0.0", "", 0, false},
+		{"0.0.0.0:mesh", "", 0, false},
+		{"0.0.0.0:65536", "", 0, false},
+	} {
+		host, port, err := parseMeshListen(testcase.listen)
+		if want, have := testcase.ok, err == nil; want != have {
+			t.Errorf("%q: want ok=%v, have %v", testcase.listen, want, err)
+			continue
+		}
+		if testcase.ok && (host != testcase.host || port != testcase.port) {
+			t.Errorf("%q: want %q %d, have %q %d", testcase.listen, testcase.host, testcase.port, host, port)
+		}
+	}
+}
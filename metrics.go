@@ -0,0 +1,59 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/weaveworks/mesh"
+)
+
+var gossipReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "kubelet_mesh",
+	Name:      "gossip_messages_received_total",
+	Help:      "Gossip messages received, by the callback that handled them.",
+}, []string{"callback"})
+
+var gossipUndecryptable = prometheus.NewCounter(prometheus.CounterOpts{
+	Namespace: "kubelet_mesh",
+	Name:      "gossip_messages_undecryptable_total",
+	Help:      "Gossip messages dropped because they didn't decrypt with our password.",
+})
+
+func init() {
+	prometheus.MustRegister(gossipReceived, gossipUndecryptable)
+}
+
+// registerMetrics exposes gauges that are read from router and p
+// whenever they are scraped.
+func registerMetrics(router *mesh.Router, p *peer) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "kubelet_mesh",
+		Name:      "connections",
+		Help:      "Current mesh connections.",
+	}, func() float64 {
+		return float64(len(mesh.NewStatus(router).Connections))
+	}))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "kubelet_mesh",
+		Name:      "root_cas",
+		Help:      "Root CA certificates known to this peer.",
+	}, func() float64 {
+		return float64(len(p.snapshot().RootCAs))
+	}))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "kubelet_mesh",
+		Name:      "apiserver_urls",
+		Help:      "Apiserver URLs known to this peer.",
+	}, func() float64 {
+		return float64(len(p.snapshot().ApiserverURLs))
+	}))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: "kubelet_mesh",
+		Name:      "root_ca_expiry_timestamp_seconds",
+		Help:      "When the first of the trusted root CAs expires, in seconds since the epoch, or 0 if there are none.",
+	}, func() float64 {
+		t := p.firstExpiry()
+		if t.IsZero() {
+			return 0
+		}
+		return float64(t.Unix())
+	}))
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// waitReady polls p every interval until it is ready, or until timeout,
+// if not zero, or quit.
+func waitReady(p *peer, interval, timeout time.Duration, quit <-chan struct{}) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		deadline = time.After(timeout)
+	}
+	for !p.ready() {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return fmt.Errorf("no root CA and apiserver URL after %v", timeout)
+		case <-quit:
+			return fmt.Errorf("stopped")
+		}
+	}
+	return nil
+}
+
+// sdNotify sends state to systemd, if it started us as Type=notify.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWaitReady(t *testing.T) {
+	p := newTestPeer()
+	p.st.opts.readyMinCAs, p.st.opts.readyMinAPIServers = 1, 1
+	quit := make(chan struct{})
+	defer close(quit)
+
+	if err := waitReady(p, time.Millisecond, 20*time.Millisecond, quit); err == nil {
+		t.Errorf("want timeout with nothing known")
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- waitReady(p, time.Millisecond, 0, quit) }()
+	p.st.mergeComplete(ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443"}})
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("still waiting once ready")
+	}
+}
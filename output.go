@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"encoding/pem"
+)
+
+// writeFileAtomic writes data to path via a temporary file in the same
+// directory and a rename, so that readers only ever see the old or the
+// new contents, and a crash never leaves a partial file behind. The
+// temporary file has mode before anything is written to it, so secrets
+// are never readable by more than mode allows, even for a moment.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // no-op once renamed
+
+	if err := f.Chmod(mode); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// writeFileIfChanged is writeFileAtomic, but leaves path alone if it
+// already holds data, with mode. It reports whether it wrote anything.
+func writeFileIfChanged(path string, data []byte, mode os.FileMode) (bool, error) {
+	if existing, err := ioutil.ReadFile(path); err == nil && bytes.Equal(existing, data) {
+		if fi, err := os.Stat(path); err == nil && fi.Mode().Perm() == mode.Perm() {
+			return false, nil
+		}
+	}
+	return true, writeFileAtomic(path, data, mode)
+}
+
+// encodeRootCAs PEM-encodes cas into a bundle suitable for ca.crt,
+// each root followed by its chain in order.
+func encodeRootCAs(cas []*RootCAPublicKey) []byte {
+	var buf bytes.Buffer
+	for _, ca := range cas {
+		pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: ca.Bytes})
+		for _, der := range ca.Chain {
+			pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+		}
+	}
+	return buf.Bytes()
+}
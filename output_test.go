@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileIfChanged(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet-mesh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ca.crt")
+
+	for _, testcase := range []struct {
+		data  string
+		mode  os.FileMode
+		wrote bool
+	}{
+		{"one", 0640, true},
+		{"one", 0640, false},
+		{"two", 0640, true},
+		{"two", 0644, true}, // the mode alone changed
+		{"two", 0640, true},
+	} {
+		wrote, err := writeFileIfChanged(path, []byte(testcase.data), testcase.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, have := testcase.wrote, wrote; want != have {
+			t.Errorf("%q: want wrote=%v, have %v", testcase.data, want, have)
+		}
+		if have, err := ioutil.ReadFile(path); err != nil || string(have) != testcase.data {
+			t.Errorf("%q: have %q, %v", testcase.data, have, err)
+		}
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := os.FileMode(0640), fi.Mode().Perm(); want != have {
+		t.Errorf("mode: want %v, have %v", want, have)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("want only %s left behind, have %d files", path, len(files))
+	}
+}
@@ -1,24 +1,148 @@
 package main
 
 import (
-	"log"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"bytes"
-	"encoding/gob"
+	"crypto/x509"
 
 	"github.com/weaveworks/mesh"
 )
 
+// nodeBootstrapChannel is the gossip channel for ClusterInfo from before
+// nodeBootstrapChannelV1.
+const nodeBootstrapChannel = "kubernetes-node-bootstrap-v0"
+
+// peerOptions tune how a peer treats the data it holds.
+type peerOptions struct {
+	// sealer encrypts the payload, if we have a mesh password; for each
+	// channel, with forChannel.
+	sealer *sealer
+	// wireVersion, if set, is the wire version we send on
+	// nodeBootstrapChannel, for upgrades from peers that only understand
+	// legacyWireVersion.
+	wireVersion byte
+	// compressOver, if set, is the payload size over which we gzip it,
+	// on nodeBootstrapChannelV1.
+	compressOver int
+	// channelCompat also gossips on nodeBootstrapChannel, for peers from
+	// before nodeBootstrapChannelV1.
+	channelCompat bool
+	// caGeneration is the generation of the root CAs we load ourselves.
+	caGeneration uint64
+	// caOverlap is how long a superseded root CA generation
+	// stays trusted after a newer one is seen.
+	caOverlap time.Duration
+	// skipCAValidation accepts gossiped root CAs without checking them.
+	skipCAValidation bool
+	// allowExpiredCA keeps root CAs that are past their NotAfter.
+	allowExpiredCA bool
+	// caExpiryWarning is how long before a root CA expires to warn about it.
+	caExpiryWarning time.Duration
+	// caHashes, if not empty, are the only public key hashes
+	// we accept gossiped root CAs for.
+	caHashes map[string]struct{}
+	// tofu, if not nil, pins the first gossiped root CA we accept.
+	tofu *tofuPin
+	// requireSigned drops gossiped apiserver URLs that aren't covered by
+	// an attestation signed by a root CA pinned by caHashes or tofu.
+	requireSigned bool
+	// caQuorum is how many distinct peers must advertise a gossiped
+	// root CA before we trust it.
+	caQuorum int
+	// caOut is where to write our root CA bundle, if anywhere.
+	caOut     string
+	caOutMode os.FileMode
+	// crlOut is where to write our CRLs, if anywhere.
+	crlOut string
+	// caSlotOut is where to write the CA bundle of each slot but the cluster's.
+	caSlotOut map[string]string
+	// apiserverTTL is how long the apiserver URLs we advertise outlive us,
+	// or zero for forever.
+	apiserverTTL time.Duration
+	// apiserverPriorities are those of the apiserver URLs we advertise,
+	// where not the default.
+	apiserverPriorities map[string]apiserverPriority
+	// apiserverLabels are the labels of the apiserver URLs we advertise.
+	apiserverLabels map[string]map[string]string
+	// maxCAs, if set, is how many root CAs we keep, the newest.
+	maxCAs int
+	// maxAPIServerURLs, if set, is how many apiserver URLs we keep,
+	// evicting gossiped ones.
+	maxAPIServerURLs int
+	// allowInsecureAPIServer accepts http apiserver URLs.
+	allowInsecureAPIServer bool
+	// kubeconfigOut is where to write a kubeconfig, once we can, with
+	// kubeconfigMode, or 0600 if that is zero.
+	kubeconfigOut  string
+	kubeconfigMode os.FileMode
+	// discoveryFileOut is where to write a kubeadm discovery file, once
+	// we can, pointing at discoveryServer if we know of it.
+	discoveryFileOut string
+	discoveryServer  string
+	// bootstrapTokenOut is where to write the current bootstrap token.
+	bootstrapTokenOut string
+	// showSecrets includes bootstrap tokens in /state.
+	showSecrets bool
+	// readyMinCAs and readyMinAPIServers are how many trusted root CAs
+	// and apiserver URLs we need before we report ready.
+	readyMinCAs        int
+	readyMinAPIServers int
+	// upstream is where and how to write a load balancer upstream file.
+	upstream upstreamOptions
+	// caHook, if set, is told about every root CA we trust.
+	caHook *caHook
+	// apiserverHook, if set, is told about every set of apiservers.
+	apiserverHook *apiserverHook
+	// consensus is when the mesh agrees an apiserver is healthy, and
+	// what uses only those it does.
+	consensus consensusConfig
+	// broadcastDelay is how long to wait for more local changes before
+	// broadcasting them all at once, or zero not to.
+	broadcastDelay time.Duration
+	// limits bound the gossip payloads we accept.
+	limits payloadLimits
+}
+
 // Peer encapsulates state and implements mesh.Gossiper.
 // It should be passed to mesh.Router.NewGossip,
 // and the resulting Gossip registered in turn,
 // before calling mesh.Router.Start.
 type peer struct {
-	st      *state
-	send    mesh.Gossip
-	actions chan<- func()
-	quit    chan struct{}
-	logger  *log.Logger
+	st       *state
+	self     mesh.PeerName
+	nickname string
+	rejected uint64    // root CAs rejected from gossip; atomic
+	pinFails uint64    // root CAs rejected for not matching caHashes or tofu; atomic
+	unsigned uint64    // attestations and apiserver URLs rejected under requireSigned; atomic
+	quorum   *caQuorum // nil unless caQuorum > 1
+	retries  *connRetries
+	rejects  rejectLog // payloads over opts.limits
+	answers  stateAnswers
+	outMtx   sync.Mutex
+	channels []*gossipChannel // nodeBootstrapChannelV1 first
+	actions  chan<- func()
+	quit     chan struct{}
+	logger   *levelLogger
+
+	// kubeconfigServer is the apiserver we last wrote to kubeconfigOut.
+	kubeconfigServer string
+
+	// upstreamTimer, if set, is the pending write of the upstream file.
+	upstreamMtx   sync.Mutex
+	upstreamTimer *time.Timer
+
+	// broadcastTimer, if set, is the pending broadcast of local changes.
+	broadcastMtx   sync.Mutex
+	broadcastTimer *time.Timer
+
+	// synced is closed once we merge a unicast of a peer's complete
+	// state, which is all requestState waits for.
+	synced     chan struct{}
+	syncedOnce sync.Once
 }
 
 // peer implements mesh.Gossiper.
@@ -27,88 +151,920 @@ var _ mesh.Gossiper = &peer{}
 // Construct a peer with empty state.
 // Be sure to register a channel, later,
 // so we can make outbound communication.
-func newNodeBootstrapPeer(self mesh.PeerName, certInfo *RootCAPublicKey, apiservers []string, logger *log.Logger) *peer {
+func newNodeBootstrapPeer(self mesh.PeerName, nickname string, certs []*RootCAPublicKey, apiservers []string, opts peerOptions, logger *levelLogger) *peer {
 	actions := make(chan func())
 	p := &peer{
-		st:      newState(self, certInfo, apiservers, logger),
-		send:    nil, // must .register() later
-		actions: actions,
-		quit:    make(chan struct{}),
-		logger:  logger,
+		st:       newState(self, certs, apiservers, opts, logger),
+		self:     self,
+		nickname: nickname,
+		actions:  actions,
+		quit:     make(chan struct{}),
+		logger:   logger,
+		retries:  newConnRetries(),
+		synced:   make(chan struct{}),
+	}
+	p.st.nickname = nickname
+	// Each must .register() later.
+	p.channels = []*gossipChannel{newGossipChannel(nodeBootstrapChannelV1, wireVersion, opts.compressOver)}
+	if opts.channelCompat {
+		p.channels = append(p.channels, newGossipChannel(nodeBootstrapChannel, opts.wireVersion, 0))
+	}
+	// Our leases carry our nickname too.
+	p.st.refresh(time.Now())
+	if opts.caQuorum > 1 {
+		p.quorum = newCAQuorum(opts.caQuorum)
 	}
 	go p.loop(actions)
 	return p
 }
 
+// caExpiryCheckInterval is how often we warn about root CAs that expire
+// within -ca-expiry-warning, on top of when we first learn about them.
+const caExpiryCheckInterval = time.Hour
+
 func (p *peer) loop(actions <-chan func()) {
+	sweep := time.NewTicker(time.Minute)
+	defer sweep.Stop()
+	// Every peer checks, so we hear about it even once the seed is gone.
+	expiryCheck := time.NewTicker(caExpiryCheckInterval)
+	defer expiryCheck.Stop()
 	for {
 		select {
 		case f := <-actions:
 			f()
+		case now := <-expiryCheck.C:
+			p.st.mtx.RLock()
+			p.st.warnExpiry(p.st.trustedRootCAs(), now)
+			p.st.mtx.RUnlock()
+		case now := <-sweep.C:
+			// Let peers know straight away when we drop root CAs,
+			// rather than at the next periodic gossip.
+			broadcast := p.st.expire(now)
+			p.onChange()
+			if p.quorum != nil {
+				// Periodic gossip doesn't say who it's from, so vouch
+				// for our root CAs where other peers can count us.
+				p.quorum.prune(now)
+				broadcast = true
+			}
+			if broadcast {
+				p.broadcastAll()
+			}
 		case <-p.quit:
 			return
 		}
 	}
 }
 
-// register the result of a mesh.Router.NewGossip.
+// register the result of a mesh.Router.NewGossip for our first channel.
 func (p *peer) register(send mesh.Gossip) {
-	p.actions <- func() { p.send = send }
+	p.registerOn(p.channels[0], send)
+}
+
+// registerOn registers the result of a mesh.Router.NewGossip for ch.
+func (p *peer) registerOn(ch *gossipChannel, send mesh.Gossip) {
+	p.actions <- func() { ch.send = send }
 }
 
 func (p *peer) stop() {
 	close(p.quit)
 }
 
+// reloadRootCAs swaps the root CAs we seed the mesh with,
+// and lets our peers know straight away.
+func (p *peer) reloadRootCAs(certs []*x509.Certificate) {
+	if !p.st.swapRootCAs(certs) {
+		p.logger.Infof("Root CA unchanged")
+		return
+	}
+	p.logger.Infof("Root CA reloaded as generation %d", p.snapshot().TrustedGeneration)
+	p.onChange()
+	p.broadcast()
+}
+
+// onChange is called whenever our state may have changed,
+// to bring whatever we write out of it up to date.
+func (p *peer) onChange() {
+	p.outMtx.Lock()
+	defer p.outMtx.Unlock()
+	if p.st.opts.caHook != nil {
+		p.st.opts.caHook.observe(p.trustedRootCAs())
+	}
+	if h := p.st.opts.apiserverHook; h != nil {
+		now := time.Now()
+		p.st.mtx.RLock()
+		urls := p.st.apiserverURLsFor(consensusHook, now)
+		labels := apiserverLabels(p.st.set.APIServerLeases, now)
+		p.st.mtx.RUnlock()
+		h.observe(urls, labels)
+	}
+	p.writeCA()
+	p.writeCASlots()
+	p.writeCRLs()
+	p.writeBootstrapToken()
+	p.maybeWriteKubeconfig()
+	p.maybeWriteDiscoveryFile()
+	p.scheduleUpstream()
+}
+
+// writeCA writes our trusted root CA bundle to caOut,
+// unless it's already there.
+func (p *peer) writeCA() {
+	if p.st.opts.caOut == "" {
+		return
+	}
+	p.st.mtx.RLock()
+	cas := p.st.trustedRootCAs()
+	p.st.mtx.RUnlock()
+	if len(cas) == 0 {
+		return
+	}
+	wrote, err := writeFileIfChanged(p.st.opts.caOut, encodeRootCAs(cas), p.st.opts.caOutMode)
+	if err != nil {
+		p.logger.Errorf("Writing root CA bundle: %v", err)
+	} else if wrote {
+		p.logger.Infof("Wrote %d root CA certificate(s) to %s", len(cas), p.st.opts.caOut)
+	}
+}
+
+// addCRL seeds the mesh with a CRL of our own.
+func (p *peer) addCRL(crl *CRL) {
+	p.st.mergeComplete(ClusterInfo{CRLs: []*CRL{crl}})
+}
+
+// writeCRLs writes our CRLs to crlOut, unless they're already there.
+func (p *peer) writeCRLs() {
+	if p.st.opts.crlOut == "" {
+		return
+	}
+	p.st.mtx.RLock()
+	crls := p.st.set.CRLs
+	p.st.mtx.RUnlock()
+	if len(crls) == 0 {
+		return
+	}
+	wrote, err := writeFileIfChanged(p.st.opts.crlOut, encodeCRLs(crls), p.st.opts.caOutMode)
+	if err != nil {
+		p.logger.Errorf("Writing CRLs: %v", err)
+	} else if wrote {
+		p.logger.Infof("Wrote %d CRL(s) to %s", len(crls), p.st.opts.crlOut)
+	}
+}
+
+// admitCRLs drops gossiped CRLs that none of roots issued, and warns
+// about expired ones, which we pass on anyway so clients have something.
+func (p *peer) admitCRLs(src string, crls []*CRL, roots []*RootCAPublicKey, now time.Time) []*CRL {
+	var certs []*x509.Certificate
+	for _, ca := range roots {
+		if cert, err := x509.ParseCertificate(ca.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+	var kept []*CRL
+	for _, crl := range crls {
+		checked, err := parseCRL(crl.Bytes, certs)
+		if err != nil {
+			atomic.AddUint64(&p.rejected, 1)
+			p.logger.Warnf("Rejected %s from %s: %v", crl, src, err)
+			continue
+		}
+		if checked.expired(now) {
+			p.logger.Warnf("%s from %s expired at %v; passing it on anyway", checked, src, checked.NextUpdate)
+		}
+		kept = append(kept, checked)
+	}
+	return kept
+}
+
+// addCASlot seeds the mesh with CAs of our own for the named slot.
+func (p *peer) addCASlot(name string, certs []*x509.Certificate) {
+	var cas []*RootCAPublicKey
+	for _, cert := range certs {
+		cas = append(cas, newRootCAPublicKey(cert, 0, p.self))
+	}
+	now := time.Now()
+	introduce(cas, p.nickname, now, nil)
+	stamp := p.st.clock.stamp(p.self, now)
+	for _, ca := range cas {
+		ca.Stamp = stamp
+	}
+	p.st.mergeComplete(ClusterInfo{CASlots: map[string][]*RootCAPublicKey{name: cas}})
+	p.broadcast()
+}
+
+// writeCASlots writes the CA bundle of each slot in caSlotOut,
+// unless it's already there.
+func (p *peer) writeCASlots() {
+	for name, path := range p.st.opts.caSlotOut {
+		p.st.mtx.RLock()
+		cas := p.st.set.CASlots[name]
+		p.st.mtx.RUnlock()
+		if len(cas) == 0 {
+			continue
+		}
+		wrote, err := writeFileIfChanged(path, encodeRootCAs(cas), p.st.opts.caOutMode)
+		if err != nil {
+			p.logger.Errorf("Writing %s CA bundle: %v", name, err)
+		} else if wrote {
+			p.logger.Infof("Wrote %d %s CA certificate(s) to %s", len(cas), name, path)
+		}
+	}
+}
+
+// addBootstrapToken seeds the mesh with a bootstrap token of our own.
+func (p *peer) addBootstrapToken(token string, expires time.Time) {
+	stamp := p.st.clock.stamp(p.self, time.Now())
+	p.st.mergeComplete(ClusterInfo{BootstrapTokens: []*BootstrapToken{{Token: token, Expires: expires, Origin: p.self, Stamp: stamp}}})
+	p.broadcast()
+}
+
+// writeBootstrapToken writes the current bootstrap token to
+// bootstrapTokenOut, unless it's already there.
+func (p *peer) writeBootstrapToken() {
+	if p.st.opts.bootstrapTokenOut == "" {
+		return
+	}
+	p.st.mtx.RLock()
+	token := currentBootstrapToken(p.st.set.BootstrapTokens, time.Now())
+	p.st.mtx.RUnlock()
+	if token == nil {
+		return
+	}
+	wrote, err := writeFileIfChanged(p.st.opts.bootstrapTokenOut, []byte(token.Token+"\n"), 0600)
+	if err != nil {
+		p.logger.Errorf("Writing bootstrap token: %v", err)
+	} else if wrote {
+		p.logger.Infof("Wrote bootstrap token %s to %s", token, p.st.opts.bootstrapTokenOut)
+	}
+}
+
+// broadcast our complete state to the mesh, rather than waiting
+// for it to be picked up by periodic gossip, once opts.broadcastDelay
+// has passed, so that changes landing together go out together.
+func (p *peer) broadcast() {
+	delay := p.st.opts.broadcastDelay
+	if delay <= 0 {
+		p.broadcastNow()
+		return
+	}
+	p.broadcastMtx.Lock()
+	defer p.broadcastMtx.Unlock()
+	if p.broadcastTimer != nil {
+		return
+	}
+	p.broadcastTimer = time.AfterFunc(delay, func() {
+		p.broadcastMtx.Lock()
+		p.broadcastTimer = nil
+		p.broadcastMtx.Unlock()
+		p.broadcastNow()
+	})
+}
+
+// broadcastNow broadcasts our complete state straight away.
+func (p *peer) broadcastNow() {
+	select {
+	case p.actions <- p.broadcastAll:
+	case <-p.quit:
+	}
+}
+
+// stateSnapshot is a point-in-time view of our state, suitable for
+// serializing to operators.
+type stateSnapshot struct {
+	PeerName            string                         `json:"peerName"`
+	Nickname            string                         `json:"nickname"`
+	RootCAs             []*RootCAPublicKey             `json:"rootCAs"`
+	Provenance          []string                       `json:"provenance"`
+	CASlots             map[string][]*RootCAPublicKey  `json:"caSlots,omitempty"`
+	TrustedGeneration   uint64                         `json:"trustedGeneration"`
+	RejectedRootCAs     uint64                         `json:"rejectedRootCAs"`
+	CAHashMismatches    uint64                         `json:"caHashMismatches"`
+	Unsigned            uint64                         `json:"unsigned"`
+	RejectedPayloads    uint64                         `json:"rejectedPayloads"`
+	RootCAConflict      []rootCAConflict               `json:"rootCAConflict,omitempty"`
+	Conflicts           []subjectConflict              `json:"conflicts,omitempty"`
+	Rotation            *rotationView                  `json:"rotation,omitempty"`
+	PendingRootCAs      []pendingRootCAView            `json:"pendingRootCAs,omitempty"`
+	ConnectionRetries   []connRetryView                `json:"connectionRetries,omitempty"`
+	Channels            []channelView                  `json:"channels"`
+	ApiserverURLs       []string                       `json:"apiserverURLs"`
+	ApiserverHealth     []apiserverHealthView          `json:"apiserverHealth,omitempty"`
+	RemovedAPIServers   []string                       `json:"removedApiservers,omitempty"`
+	RevokedTokens       []string                       `json:"revokedBootstrapTokens,omitempty"`
+	ResolvedAPIServers  []resolvedAPIServerView        `json:"resolvedApiservers,omitempty"`
+	ApiserverLabels     map[string]map[string]string   `json:"apiserverLabels,omitempty"`
+	ApiserverCertHashes map[string][]string            `json:"apiserverCertHashes,omitempty"`
+	ApiserverOrigins    map[string][]apiserverOrigin   `json:"apiserverOrigins,omitempty"`
+	ApiserverSources    map[string]apiserverSourceView `json:"apiserverSources,omitempty"`
+	BootstrapTokens     []bootstrapTokenView           `json:"bootstrapTokens"`
+}
+
+// bootstrapTokenView is a bootstrap token, redacted unless showSecrets is set.
+type bootstrapTokenView struct {
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+	Origin  string    `json:"origin"`
+}
+
+// resolvedAPIServerView is what an apiserver URL's host last resolved to.
+type resolvedAPIServerView struct {
+	URL      string    `json:"url"`
+	IPs      []string  `json:"ips"`
+	Resolved time.Time `json:"resolved"`
+	Peer     string    `json:"peer"`
+}
+
+// rootCAConflict is one of the root CAs in a conflict.
+type rootCAConflict struct {
+	Fingerprint string    `json:"fingerprint"`
+	Origin      string    `json:"origin"`
+	NotBefore   time.Time `json:"notBefore"`
+	Trusted     bool      `json:"trusted"`
+}
+
+// snapshot takes the state lock, like the gossip callbacks do,
+// so the returned view is consistent.
+func (p *peer) snapshot() stateSnapshot {
+	p.st.mtx.RLock()
+	defer p.st.mtx.RUnlock()
+	var conflict []rootCAConflict
+	subjects := findSubjectConflicts(p.st.set.RootCAs)
+	winner, conflicting := findConflict(withoutSubjectConflicts(p.st.set.RootCAs, subjects), p.st.generation)
+	for _, ca := range conflicting {
+		conflict = append(conflict, rootCAConflict{
+			Fingerprint: ca.fingerprint(),
+			Origin:      ca.Origin.String(),
+			NotBefore:   ca.NotBefore,
+			Trusted:     ca.Origin == winner.Origin,
+		})
+	}
+	tokens := []bootstrapTokenView{}
+	for _, t := range p.st.set.BootstrapTokens {
+		token := redactToken(t.Token)
+		if p.st.opts.showSecrets {
+			token = t.Token
+		}
+		tokens = append(tokens, bootstrapTokenView{Token: token, Expires: t.Expires, Origin: t.Origin.String()})
+	}
+	provenance := []string{}
+	for _, ca := range p.st.set.RootCAs {
+		provenance = append(provenance, ca.provenance())
+	}
+	var removed []string
+	for _, t := range p.st.set.APIServerTombstones {
+		removed = append(removed, t.String())
+	}
+	var revoked []string
+	for _, t := range p.st.set.BootstrapTokenTombstones {
+		revoked = append(revoked, t.String())
+	}
+	var resolved []resolvedAPIServerView
+	for _, r := range p.st.set.ResolvedAPIServers {
+		resolved = append(resolved, resolvedAPIServerView{URL: r.URL, IPs: r.IPs, Resolved: r.Resolved, Peer: r.Peer.String()})
+	}
+	var pending []pendingRootCAView
+	if p.quorum != nil {
+		pending = p.quorum.view()
+	}
+	var retries []connRetryView
+	if p.retries != nil {
+		retries = p.retries.view()
+	}
+	return stateSnapshot{
+		PeerName:            p.self.String(),
+		Nickname:            p.nickname,
+		RootCAs:             append([]*RootCAPublicKey{}, p.st.set.RootCAs...),
+		Provenance:          provenance,
+		CASlots:             filterCASlots(p.st.set.CASlots, func(string, *RootCAPublicKey) bool { return true }),
+		TrustedGeneration:   p.st.generation,
+		RejectedRootCAs:     atomic.LoadUint64(&p.rejected),
+		CAHashMismatches:    atomic.LoadUint64(&p.pinFails),
+		Unsigned:            atomic.LoadUint64(&p.unsigned),
+		RejectedPayloads:    p.rejects.count(),
+		Channels:            channelViews(p.channels),
+		RootCAConflict:      conflict,
+		Conflicts:           subjects,
+		Rotation:            p.st.rotation(),
+		PendingRootCAs:      pending,
+		ConnectionRetries:   retries,
+		ApiserverURLs:       append([]string{}, p.st.set.ApiserverURLs...),
+		ApiserverHealth:     withConsensus(apiserverHealth(p.st.set.Probes, p.self, time.Now()), p.st.set.Probes, p.st.opts.consensus, time.Now()),
+		RemovedAPIServers:   removed,
+		RevokedTokens:       revoked,
+		ResolvedAPIServers:  resolved,
+		ApiserverLabels:     apiserverLabels(p.st.set.APIServerLeases, time.Now()),
+		ApiserverCertHashes: servingCertHashes(p.st.set.APIServerLeases, time.Now()),
+		ApiserverOrigins:    apiserverOrigins(p.st.set.APIServerLeases, time.Now()),
+		ApiserverSources:    apiserverSources(p.st.set.APIServerSources),
+		BootstrapTokens:     tokens,
+	}
+}
+
+// admit drops gossiped root CAs that fail validation, or aren't pinned,
+// and apiserver URLs we wouldn't accept from -apiserver, so that a
+// misconfigured or compromised peer can't poison everyone else.
+func (p *peer) admit(src string, set ClusterInfo) ClusterInfo {
+	opts := p.st.opts
+	set.ApiserverURLs = p.admitAPIServerURLs(src, set.ApiserverURLs)
+	if opts.requireSigned {
+		set = p.admitSigned(src, set)
+	}
+	if opts.skipCAValidation && len(opts.caHashes) == 0 && opts.tofu == nil {
+		return set
+	}
+	var (
+		cas []*RootCAPublicKey
+		now = time.Now()
+	)
+	for _, ca := range set.RootCAs {
+		if len(opts.caHashes) > 0 {
+			if err := checkCAHash(ca, opts.caHashes); err != nil {
+				atomic.AddUint64(&p.pinFails, 1)
+				p.logger.Warnf("Rejected root CA %s (%s) from %s: %v", ca.fingerprint(), ca.subject(), src, err)
+				continue
+			}
+		}
+		if !opts.skipCAValidation {
+			if err := validateRootCAPublicKey(ca, now, opts.allowExpiredCA); err != nil {
+				atomic.AddUint64(&p.rejected, 1)
+				p.logger.Warnf("Rejected root CA %s (%s) from %s: %v", ca.fingerprint(), ca.subject(), src, err)
+				continue
+			}
+		}
+		if opts.tofu != nil {
+			if err := opts.tofu.allows(ca); err != nil {
+				atomic.AddUint64(&p.pinFails, 1)
+				p.logger.Warnf("Rejected root CA %s (%s) from %s, refusing to substitute it: %v", ca.fingerprint(), ca.subject(), src, err)
+				continue
+			}
+		}
+		cas = append(cas, ca)
+	}
+	set.RootCAs = cas
+	if !opts.skipCAValidation {
+		set.CASlots = filterCASlots(set.CASlots, func(slot string, ca *RootCAPublicKey) bool {
+			if err := validateRootCAPublicKey(ca, now, opts.allowExpiredCA); err != nil {
+				atomic.AddUint64(&p.rejected, 1)
+				p.logger.Warnf("Rejected %s CA %s (%s) from %s: %v", slot, ca.fingerprint(), ca.subject(), src, err)
+				return false
+			}
+			return true
+		})
+		if len(set.CRLs) > 0 {
+			p.st.mtx.RLock()
+			roots := append(append([]*RootCAPublicKey{}, p.st.set.RootCAs...), cas...)
+			p.st.mtx.RUnlock()
+			set.CRLs = p.admitCRLs(src, set.CRLs, roots, now)
+		}
+	}
+	return set
+}
+
+// admitAPIServerURLs drops gossiped apiserver URLs that we wouldn't
+// accept from -apiserver, so one misconfigured peer can't point the
+// whole fleet at a plaintext endpoint.
+func (p *peer) admitAPIServerURLs(src string, urls []string) []string {
+	var kept []string
+	for _, u := range normalizeAPIServerURLs(urls) {
+		if err := validateAPIServerURL(u, p.st.opts.allowInsecureAPIServer); err != nil {
+			p.logger.Warnf("Rejected apiserver URL from %s: %v", src, err)
+			continue
+		}
+		kept = append(kept, u)
+	}
+	return kept
+}
+
+// admitSigned drops attestations that don't verify, and then apiserver URLs
+// that no verified attestation, in set or already in our state, covers.
+func (p *peer) admitSigned(src string, set ClusterInfo) ClusterInfo {
+	pinned := func(hash string) bool {
+		if _, ok := p.st.opts.caHashes[hash]; ok {
+			return true
+		}
+		return p.st.opts.tofu != nil && p.st.opts.tofu.matches(hash)
+	}
+	attested := map[string]bool{}
+	p.st.mtx.RLock()
+	for _, a := range p.st.set.Attestations {
+		for _, u := range normalizeAPIServerURLs(a.ApiserverURLs) {
+			attested[u] = true
+		}
+	}
+	p.st.mtx.RUnlock()
+
+	var atts []*Attestation
+	for _, a := range set.Attestations {
+		if err := verifyAttestation(a, pinned); err != nil {
+			atomic.AddUint64(&p.unsigned, 1)
+			p.logger.Warnf("Rejected %s from %s: %v", a, src, err)
+			continue
+		}
+		for _, u := range normalizeAPIServerURLs(a.ApiserverURLs) {
+			attested[u] = true
+		}
+		atts = append(atts, a)
+	}
+	var urls []string
+	for _, u := range normalizeAPIServerURLs(set.ApiserverURLs) {
+		if !attested[u] {
+			atomic.AddUint64(&p.unsigned, 1)
+			p.logger.Warnf("Rejected apiserver URL %s from %s: not signed by a pinned root CA", u, src)
+			continue
+		}
+		urls = append(urls, u)
+	}
+	set.Attestations, set.ApiserverURLs = atts, urls
+	return set
+}
+
+// addAttestation seeds the mesh with an attestation of our own.
+func (p *peer) addAttestation(a *Attestation) {
+	p.st.mergeComplete(ClusterInfo{Attestations: []*Attestation{a}})
+}
+
+// accept admits set from src, which is name if known, holds back its
+// root CAs until enough peers advertise them, and only then pins them on
+// first use, so that one the quorum never accepts can't take the pin.
+func (p *peer) accept(name mesh.PeerName, src string, set ClusterInfo) ClusterInfo {
+	return p.pinOnFirstUse(src, p.awaitQuorum(name, p.admit(src, set)))
+}
+
+// pinOnFirstUse pins, with -tofu-file, the first of the admitted root
+// CAs of set, if nothing is pinned yet, and drops the rest that don't
+// match the pin, which admit may have let through before there was one.
+func (p *peer) pinOnFirstUse(src string, set ClusterInfo) ClusterInfo {
+	t := p.st.opts.tofu
+	if t == nil {
+		return set
+	}
+	var cas []*RootCAPublicKey
+	for _, ca := range set.RootCAs {
+		pinned, err := t.check(ca)
+		if err != nil {
+			atomic.AddUint64(&p.pinFails, 1)
+			p.logger.Warnf("Rejected root CA %s (%s) from %s, refusing to substitute it: %v", ca.fingerprint(), ca.subject(), src, err)
+			continue
+		} else if pinned {
+			p.logger.Infof("Pinned root CA %s from %s on first use, in %s", ca.fingerprint(), src, t.path)
+		}
+		cas = append(cas, ca)
+	}
+	set.RootCAs = cas
+	return set
+}
+
+// awaitQuorum holds back gossiped root CAs, from src if known, that we
+// don't already trust until enough peers have advertised them.
+func (p *peer) awaitQuorum(src mesh.PeerName, set ClusterInfo) ClusterInfo {
+	if p.quorum == nil {
+		return set
+	}
+	p.st.mtx.RLock()
+	have := map[string]bool{}
+	for _, ca := range p.st.set.RootCAs {
+		have[ca.fingerprint()] = true
+	}
+	p.st.mtx.RUnlock()
+
+	var cas []*RootCAPublicKey
+	for _, ca := range set.RootCAs {
+		if have[ca.fingerprint()] {
+			cas = append(cas, ca)
+			continue
+		}
+		seen, ok := p.quorum.see(ca, src)
+		if !ok {
+			p.logger.Debugf("Holding root CA %s until %d peers advertise it, seen from %d", ca.fingerprint(), p.quorum.n, seen)
+			continue
+		}
+		p.logger.Infof("Accepting root CA %s, advertised by %d peers", ca.fingerprint(), seen)
+		cas = append(cas, ca)
+	}
+	set.RootCAs = cas
+	return set
+}
+
+// decode decodes a payload on ch from source. It logs and reports false,
+// rather than return an error and drop the connection, so that a peer
+// with the wrong password, or a newer wire version, can't sever the mesh
+// for everyone. Nor can one over opts.limits, which it logs only now and
+// then, since the same peer likely sends it again with every gossip.
+func (p *peer) decode(ch *gossipChannel, source string, buf []byte) (set ClusterInfo, ok bool) {
+	err := p.st.opts.limits.checkSize(buf)
+	if err == nil {
+		maxInflated := p.st.opts.limits.maxBytes
+		if maxInflated == 0 {
+			maxInflated = defaultMaxInflatedBytes
+		}
+		set, err = decodeClusterInfoLimited(buf, p.st.opts.sealer.forChannel(ch.name), maxInflated)
+	}
+	if err == nil {
+		err = p.st.opts.limits.check(set)
+	}
+	if e, ok := err.(*payloadLimitError); ok {
+		gossipRejected.WithLabelValues(e.limit).Inc()
+		if p.rejects.reject(source, time.Now()) {
+			p.logger.Warnf("Dropping gossip from %s: %v", source, err)
+		}
+		return ClusterInfo{}, false
+	}
+	if err != nil {
+		if err == errUndecryptable {
+			gossipUndecryptable.Inc()
+		}
+		p.logger.Warnf("Dropping gossip: %v", err)
+		return set, false
+	}
+	return set, true
+}
+
 // Return a copy of our complete state.
 func (p *peer) Gossip() (complete mesh.GossipData) {
-	complete = p.st.copy()
-	p.logger.Printf("Gossip => complete %v", complete.(*state).set)
-	return complete
+	return p.gossip(p.channels[0])
 }
 
 // Merge the gossiped data represented by buf into our state.
 // Return the state information that was modified.
 func (p *peer) OnGossip(buf []byte) (delta mesh.GossipData, err error) {
-	var set ClusterInfo
-	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&set); err != nil {
-		return nil, err
+	return p.onGossip(p.channels[0], buf)
+}
+
+// Merge the gossiped data represented by buf into our state.
+// Return the state information that was modified.
+func (p *peer) OnGossipBroadcast(src mesh.PeerName, buf []byte) (received mesh.GossipData, err error) {
+	return p.onGossipBroadcast(p.channels[0], src, buf)
+}
+
+// Merge the gossiped data represented by buf into our state.
+func (p *peer) OnGossipUnicast(src mesh.PeerName, buf []byte) error {
+	return p.onGossipUnicast(p.channels[0], src, buf)
+}
+
+// The mesh.Gossiper methods, for channel ch.
+
+func (p *peer) gossip(ch *gossipChannel) (complete mesh.GossipData) {
+	p.st.refresh(time.Now())
+	complete = p.encoding(ch, p.st.copy())
+	p.logger.Debugf("Gossip %s => complete %v", ch.name, complete.(*state).set)
+	return complete
+}
+
+func (p *peer) onGossip(ch *gossipChannel, buf []byte) (delta mesh.GossipData, err error) {
+	gossipReceived.WithLabelValues("OnGossip").Inc()
+	set, ok := p.decode(ch, "gossip", buf)
+	if !ok {
+		return nil, nil
 	}
 
-	delta = p.st.mergeDelta(set)
+	delta = p.st.mergeDelta(p.accept(mesh.UnknownPeerName, "gossip", set))
+	if delta != nil {
+		p.onChange()
+	}
 	if delta == nil {
-		p.logger.Printf("OnGossip %v => delta %v", set, delta)
+		p.logger.Debugf("OnGossip %s %v => delta %v", ch.name, set, delta)
 	} else {
-		p.logger.Printf("OnGossip %v => delta %v", set, delta.(*state).set)
+		p.logger.Debugf("OnGossip %s %v => delta %v", ch.name, set, delta.(*state).set)
 	}
-	return delta, nil
+	return p.encoding(ch, delta), nil
 }
 
-// Merge the gossiped data represented by buf into our state.
-// Return the state information that was modified.
-func (p *peer) OnGossipBroadcast(src mesh.PeerName, buf []byte) (received mesh.GossipData, err error) {
-	var set ClusterInfo
-	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&set); err != nil {
-		return nil, err
+func (p *peer) onGossipBroadcast(ch *gossipChannel, src mesh.PeerName, buf []byte) (received mesh.GossipData, err error) {
+	gossipReceived.WithLabelValues("OnGossipBroadcast").Inc()
+	set, ok := p.decode(ch, "peer "+src.String(), buf)
+	if !ok {
+		return nil, nil
+	}
+	ch.saw(src)
+	if p.preferred(ch, src) {
+		// Still pass it on, for the peers that only hear this channel.
+		p.logger.Debugf("OnGossipBroadcast %s %s %v => relayed only, as it is on %s too", ch.name, src, set, p.channels[0].name)
+		return p.encoding(ch, &state{set: set}), nil
 	}
 
-	received = p.st.mergeReceived(set)
+	received = p.st.mergeReceived(p.accept(src, "peer "+src.String(), set))
+	p.onChange()
 	if received == nil {
-		p.logger.Printf("OnGossipBroadcast %s %v => delta %v", src, set, received)
+		p.logger.Debugf("OnGossipBroadcast %s %s %v => delta %v", ch.name, src, set, received)
 	} else {
-		p.logger.Printf("OnGossipBroadcast %s %v => delta %v", src, set, received.(*state).set)
+		p.logger.Debugf("OnGossipBroadcast %s %s %v => delta %v", ch.name, src, set, received.(*state).set)
 	}
-	return received, nil
+	return p.encoding(ch, received), nil
 }
 
-// Merge the gossiped data represented by buf into our state.
-func (p *peer) OnGossipUnicast(src mesh.PeerName, buf []byte) error {
-	var set ClusterInfo
-	if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&set); err != nil {
-		return err
+func (p *peer) onGossipUnicast(ch *gossipChannel, src mesh.PeerName, buf []byte) error {
+	gossipReceived.WithLabelValues("OnGossipUnicast").Inc()
+	if p.isStateRequest(ch, buf) {
+		ch.saw(src)
+		p.logger.Debugf("OnGossipUnicast %s %s => state request", ch.name, src)
+		p.answerStateRequest(src)
+		return nil
+	}
+	set, ok := p.decode(ch, "peer "+src.String(), buf)
+	if !ok {
+		return nil
+	}
+	ch.saw(src)
+	if p.preferred(ch, src) {
+		p.logger.Debugf("OnGossipUnicast %s %s %v => ignored, as it is on %s too", ch.name, src, set, p.channels[0].name)
+		return nil
 	}
 
-	complete := p.st.mergeComplete(set)
-	p.logger.Printf("OnGossipUnicast %s %v => complete %v", src, set, complete)
+	complete := p.st.mergeComplete(p.accept(src, "peer "+src.String(), set))
+	p.onChange()
+	if len(set.RootCAs) > 0 || len(set.ApiserverURLs) > 0 {
+		p.markSynced()
+	}
+	p.logger.Debugf("OnGossipUnicast %s %s %v => complete %v", ch.name, src, set, complete)
 	return nil
 }
+
+// preferred reports whether to not merge what src sent on ch, because
+// it gossips on our first channel too: what it sent there is the same
+// or newer, in a format that needn't be one older peers understand.
+func (p *peer) preferred(ch *gossipChannel, src mesh.PeerName) bool {
+	return ch != p.channels[0] && p.channels[0].hasSeen(src)
+}
+
+// encoding makes d encode for ch.
+func (p *peer) encoding(ch *gossipChannel, d mesh.GossipData) mesh.GossipData {
+	return ch.encoding(d, p.st.opts.sealer)
+}
+
+// broadcastAll broadcasts our complete state on every channel we have
+// registered, from the peer's loop, which owns them.
+func (p *peer) broadcastAll() {
+	for _, ch := range p.channels {
+		if ch.send != nil {
+			ch.send.GossipBroadcast(p.encoding(ch, p.st.copy()))
+		}
+	}
+}
+
+// trustedRootCAs takes the state lock, and returns the root CAs we trust.
+func (p *peer) trustedRootCAs() []*RootCAPublicKey {
+	p.st.mtx.RLock()
+	defer p.st.mtx.RUnlock()
+	return p.st.trustedRootCAs()
+}
+
+// caBundle takes the state lock, and returns the PEM bundle of every
+// root CA we trust that hasn't expired, sorted by fingerprint so that it
+// only changes when they do, or nil if there are none. Mid-rotation
+// that is both the old and the new, until the old retire or expire and
+// the sweep drops them, so kubelets trust either throughout.
+func (p *peer) caBundle() []byte {
+	now := time.Now()
+	p.st.mtx.RLock()
+	trusted, allowExpired := p.st.trustedRootCAs(), p.st.opts.allowExpiredCA
+	p.st.mtx.RUnlock()
+	var cas []*RootCAPublicKey
+	for _, ca := range trusted {
+		if !ca.expired(now) || allowExpired {
+			cas = append(cas, ca)
+		}
+	}
+	if len(cas) == 0 {
+		return nil
+	}
+	sort.Slice(cas, func(i, j int) bool { return cas[i].fingerprint() < cas[j].fingerprint() })
+	return encodeRootCAs(cas)
+}
+
+// firstExpiry takes the state lock, and returns when the first of the
+// root CAs we trust expires, or zero if we don't know of any.
+func (p *peer) firstExpiry() time.Time {
+	p.st.mtx.RLock()
+	defer p.st.mtx.RUnlock()
+	return p.st.firstExpiry()
+}
+
+// ready reports whether we have learned enough bootstrap data
+// for a kubelet to use.
+func (p *peer) ready() bool {
+	p.st.mtx.RLock()
+	defer p.st.mtx.RUnlock()
+	return len(p.st.trustedRootCAs()) >= p.st.opts.readyMinCAs &&
+		len(p.st.set.ApiserverURLs) >= p.st.opts.readyMinAPIServers
+}
+
+// maybeWriteKubeconfig writes a kubeconfig to kubeconfigOut once we know at
+// least one root CA and one apiserver, unless it's already there.
+func (p *peer) maybeWriteKubeconfig() {
+	if p.st.opts.kubeconfigOut == "" {
+		return
+	}
+	server, healthy := p.bestAPIServer()
+	bundle := p.caBundle()
+	p.st.mtx.RLock()
+	var token string
+	if t := currentBootstrapToken(p.st.set.BootstrapTokens, time.Now()); t != nil {
+		token = t.Token
+	}
+	p.st.mtx.RUnlock()
+	if bundle == nil || server == "" {
+		return
+	}
+	mode := p.st.opts.kubeconfigMode
+	if mode == 0 {
+		mode = 0600
+	}
+	wrote, err := writeFileIfChanged(p.st.opts.kubeconfigOut, renderKubeconfig(bundle, server, token), mode)
+	if err != nil {
+		p.logger.Errorf("Writing kubeconfig: %v", err)
+		return
+	}
+	if wrote {
+		if previous := p.kubeconfigServer; previous != "" && previous != server {
+			p.logger.Infof("Failed kubeconfig over from %s to %s (healthy: %v)", previous, server, healthy)
+		}
+		p.logger.Infof("Wrote kubeconfig for %s to %s", server, p.st.opts.kubeconfigOut)
+	}
+	p.kubeconfigServer = server
+}
+
+// bestAPIServer picks the apiserver to point the kubeconfig at, and
+// reports whether it's known to be healthy. It's the first, in order of
+// priority, of those we last found healthy, or if we haven't probed
+// them, that most peers last found healthy; failing that, the first of
+// those nobody has probed, and failing that, of the rest. The same state
+// always gives the same choice.
+func (p *peer) bestAPIServer() (string, bool) {
+	now := time.Now()
+	p.st.mtx.RLock()
+	urls := p.st.apiserverURLsFor(consensusOutputs, now)
+	health := apiserverHealth(p.st.set.Probes, p.self, now)
+	p.st.mtx.RUnlock()
+	if len(urls) == 0 {
+		return "", false
+	}
+	const (
+		healthy = iota
+		unknown
+		unhealthy
+	)
+	rank := map[string]int{}
+	for _, h := range health {
+		switch {
+		case h.Local != nil && h.Local.Healthy:
+			rank[h.URL] = healthy
+		case h.Local != nil:
+			rank[h.URL] = unhealthy
+		case h.Healthy > h.Unhealthy:
+			rank[h.URL] = healthy
+		case h.Unhealthy > h.Healthy:
+			rank[h.URL] = unhealthy
+		}
+	}
+	rankOf := func(u string) int {
+		if r, ok := rank[u]; ok {
+			return r
+		}
+		return unknown
+	}
+	best := urls[0]
+	for _, u := range urls[1:] {
+		if rankOf(u) < rankOf(best) {
+			best = u
+		}
+	}
+	return best, rankOf(best) == healthy
+}
+
+// maybeWriteDiscoveryFile writes a kubeconfig with only the cluster,
+// for kubeadm join --discovery-file, to discoveryFileOut once we know
+// a root CA and an apiserver.
+func (p *peer) maybeWriteDiscoveryFile() {
+	if p.st.opts.discoveryFileOut == "" {
+		return
+	}
+	bundle := p.caBundle()
+	p.st.mtx.RLock()
+	apiservers := p.st.apiserverURLsFor(consensusOutputs, time.Now())
+	p.st.mtx.RUnlock()
+	if bundle == nil || len(apiservers) == 0 {
+		return
+	}
+	server := pickAPIServer(apiservers, p.st.opts.discoveryServer)
+	wrote, err := writeFileIfChanged(p.st.opts.discoveryFileOut, renderKubeconfig(bundle, server, ""), 0644)
+	if err != nil {
+		p.logger.Errorf("Writing discovery file: %v", err)
+	} else if wrote {
+		p.logger.Infof("Wrote discovery file for %s to %s", server, p.st.opts.discoveryFileOut)
+	}
+}
+
+// pickAPIServer picks preferred, if it's one of apiservers, or else the
+// first of them, which are sorted by priority, so the choice only
+// changes when the set of apiservers or their priorities do.
+func pickAPIServer(apiservers []string, preferred string) string {
+	if preferred != "" {
+		preferred = normalizeAPIServerURL(preferred)
+		for _, u := range apiservers {
+			if u == preferred {
+				return u
+			}
+		}
+	}
+	return apiservers[0]
+}
@@ -2,44 +2,47 @@ package main
 
 import (
 	"bytes"
-	"encoding/gob"
+	"crypto/x509"
 	"io/ioutil"
-	"log"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/weaveworks/mesh"
 )
 
+func newTestPeer() *peer {
+	return newNodeBootstrapPeer(mesh.PeerName(999), "test", nil, nil, peerOptions{skipCAValidation: true}, newTextLogger(ioutil.Discard, "", 0))
+}
+
 func TestPeerOnGossip(t *testing.T) {
 	for _, testcase := range []struct {
-		initial map[mesh.PeerName]int
-		msg     map[mesh.PeerName]int
-		want    map[mesh.PeerName]int
+		initial ClusterInfo
+		msg     ClusterInfo
+		want    *ClusterInfo
 	}{
 		{
-			map[mesh.PeerName]int{},
-			map[mesh.PeerName]int{123: 1, 456: 2},
-			map[mesh.PeerName]int{123: 1, 456: 2},
+			ClusterInfo{},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443"}},
+			&ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443"}},
 		},
 		{
-			map[mesh.PeerName]int{123: 1},
-			map[mesh.PeerName]int{123: 0, 456: 2},
-			map[mesh.PeerName]int{456: 2},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA, caB}},
+			&ClusterInfo{RootCAs: []*RootCAPublicKey{caB}},
 		},
 		{
-			map[mesh.PeerName]int{123: 9},
-			map[mesh.PeerName]int{123: 8},
+			ClusterInfo{ApiserverURLs: []string{"https://a:6443"}},
+			ClusterInfo{ApiserverURLs: []string{"https://a:6443"}},
 			nil,
 		},
 	} {
-		p := newPeer(mesh.PeerName(999), log.New(ioutil.Discard, "", 0))
+		p := newTestPeer()
 		p.st.mergeComplete(testcase.initial)
-		var buf bytes.Buffer
-		if err := gob.NewEncoder(&buf).Encode(testcase.msg); err != nil {
-			t.Fatal(err)
-		}
-		delta, err := p.OnGossip(buf.Bytes())
+		buf := encodeGossip(testcase.msg, nil)
+		delta, err := p.OnGossip(buf)
 		if err != nil {
 			t.Errorf("%v OnGossip %v: %v", testcase.initial, testcase.msg, err)
 			continue
@@ -49,8 +52,8 @@ func TestPeerOnGossip(t *testing.T) {
 				t.Errorf("%v OnGossip %v: want nil, have non-nil", testcase.initial, testcase.msg)
 			}
 		} else {
-			if have := delta.(*state).set; !reflect.DeepEqual(want, have) {
-				t.Errorf("%v OnGossip %v: want %v, have %v", testcase.initial, testcase.msg, want, have)
+			if have := delta.(*state).set; !reflect.DeepEqual(*want, have) {
+				t.Errorf("%v OnGossip %v: want %v, have %v", testcase.initial, testcase.msg, *want, have)
 			}
 		}
 	}
@@ -58,33 +61,30 @@ func TestPeerOnGossip(t *testing.T) {
 
 func TestPeerOnGossipBroadcast(t *testing.T) {
 	for _, testcase := range []struct {
-		initial map[mesh.PeerName]int
-		msg     map[mesh.PeerName]int
-		want    map[mesh.PeerName]int
+		initial ClusterInfo
+		msg     ClusterInfo
+		want    ClusterInfo
 	}{
 		{
-			map[mesh.PeerName]int{},
-			map[mesh.PeerName]int{123: 1, 456: 2},
-			map[mesh.PeerName]int{123: 1, 456: 2},
+			ClusterInfo{},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443"}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443"}},
 		},
 		{
-			map[mesh.PeerName]int{123: 1},
-			map[mesh.PeerName]int{123: 0, 456: 2},
-			map[mesh.PeerName]int{456: 2},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA, caB}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caB}},
 		},
 		{
-			map[mesh.PeerName]int{123: 9},
-			map[mesh.PeerName]int{123: 8},
-			map[mesh.PeerName]int{}, // OnGossipBroadcast returns received, which should never be nil
+			ClusterInfo{ApiserverURLs: []string{"https://a:6443"}},
+			ClusterInfo{ApiserverURLs: []string{"https://a:6443"}},
+			ClusterInfo{}, // OnGossipBroadcast returns received, which should never be nil
 		},
 	} {
-		p := newPeer(999, log.New(ioutil.Discard, "", 0))
+		p := newTestPeer()
 		p.st.mergeComplete(testcase.initial)
-		var buf bytes.Buffer
-		if err := gob.NewEncoder(&buf).Encode(testcase.msg); err != nil {
-			t.Fatal(err)
-		}
-		delta, err := p.OnGossipBroadcast(mesh.UnknownPeerName, buf.Bytes())
+		buf := encodeGossip(testcase.msg, nil)
+		delta, err := p.OnGossipBroadcast(mesh.UnknownPeerName, buf)
 		if err != nil {
 			t.Errorf("%v OnGossipBroadcast %v: %v", testcase.initial, testcase.msg, err)
 			continue
@@ -97,38 +97,616 @@ func TestPeerOnGossipBroadcast(t *testing.T) {
 
 func TestPeerOnGossipUnicast(t *testing.T) {
 	for _, testcase := range []struct {
-		initial map[mesh.PeerName]int
-		msg     map[mesh.PeerName]int
-		want    map[mesh.PeerName]int
+		initial ClusterInfo
+		msg     ClusterInfo
+		want    ClusterInfo
 	}{
 		{
-			map[mesh.PeerName]int{},
-			map[mesh.PeerName]int{123: 1, 456: 2},
-			map[mesh.PeerName]int{123: 1, 456: 2},
+			ClusterInfo{},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443"}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443"}},
 		},
 		{
-			map[mesh.PeerName]int{123: 1},
-			map[mesh.PeerName]int{123: 0, 456: 2},
-			map[mesh.PeerName]int{123: 1, 456: 2},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caB}, ApiserverURLs: []string{"https://a:6443"}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA, caB}, ApiserverURLs: []string{"https://a:6443"}},
 		},
 		{
-			map[mesh.PeerName]int{123: 9},
-			map[mesh.PeerName]int{123: 8},
-			map[mesh.PeerName]int{123: 9},
+			ClusterInfo{ApiserverURLs: []string{"https://b:6443"}},
+			ClusterInfo{ApiserverURLs: []string{"https://a:6443"}},
+			ClusterInfo{ApiserverURLs: []string{"https://a:6443", "https://b:6443"}},
 		},
 	} {
-		p := newPeer(999, log.New(ioutil.Discard, "", 0))
+		p := newTestPeer()
 		p.st.mergeComplete(testcase.initial)
-		var buf bytes.Buffer
-		if err := gob.NewEncoder(&buf).Encode(testcase.msg); err != nil {
-			t.Fatal(err)
-		}
-		if err := p.OnGossipUnicast(mesh.UnknownPeerName, buf.Bytes()); err != nil {
-			t.Errorf("%v OnGossipBroadcast %v: %v", testcase.initial, testcase.msg, err)
+		buf := encodeGossip(testcase.msg, nil)
+		if err := p.OnGossipUnicast(mesh.UnknownPeerName, buf); err != nil {
+			t.Errorf("%v OnGossipUnicast %v: %v", testcase.initial, testcase.msg, err)
 			continue
 		}
 		if want, have := testcase.want, p.st.set; !reflect.DeepEqual(want, have) {
-			t.Errorf("%v OnGossipBroadcast %v: want %v, have %v", testcase.initial, testcase.msg, want, have)
+			t.Errorf("%v OnGossipUnicast %v: want %v, have %v", testcase.initial, testcase.msg, want, have)
+		}
+	}
+}
+
+func TestPeerAdvertisesRootCAsFromAllNeighbours(t *testing.T) {
+	p := newTestPeer()
+	for src, ca := range map[mesh.PeerName]*RootCAPublicKey{1: caA, 2: caB} {
+		buf := encodeGossip(ClusterInfo{RootCAs: []*RootCAPublicKey{ca}}, nil)
+		if _, err := p.OnGossipBroadcast(src, buf); err != nil {
+			t.Fatalf("OnGossipBroadcast from %s: %v", src, err)
+		}
+	}
+	if want, have := []*RootCAPublicKey{caA, caB}, p.Gossip().(*state).set.RootCAs; !reflect.DeepEqual(want, have) {
+		t.Errorf("Gossip: want %v, have %v", want, have)
+	}
+}
+
+func TestPeerRejectsInvalidRootCA(t *testing.T) {
+	leaf := testCATemplate
+	leaf.IsCA = false
+	var (
+		good = newRootCAPublicKey(newTestCert(t, testCATemplate), 0, 999)
+		bad  = newRootCAPublicKey(newTestCert(t, leaf), 0, 999)
+	)
+	p := newNodeBootstrapPeer(mesh.PeerName(999), "test", nil, nil, peerOptions{}, newTextLogger(ioutil.Discard, "", 0))
+	buf := encodeGossip(ClusterInfo{RootCAs: []*RootCAPublicKey{good, bad, caA}}, nil)
+	if _, err := p.OnGossipBroadcast(mesh.PeerName(123), buf); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []*RootCAPublicKey{good}, p.st.set.RootCAs; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	if want, have := uint64(2), p.snapshot().RejectedRootCAs; want != have {
+		t.Errorf("rejected: want %d, have %d", want, have)
+	}
+}
+
+func TestPeerReloadRootCAs(t *testing.T) {
+	var (
+		oldCert = newTestCert(t, testCATemplate)
+		newCert = newTestCert(t, testCATemplate)
+		oldCA   = newRootCAPublicKey(oldCert, 0, 999)
+	)
+	p := newNodeBootstrapPeer(mesh.PeerName(999), "test", []*RootCAPublicKey{oldCA}, nil, peerOptions{caOverlap: time.Hour}, newTextLogger(ioutil.Discard, "", 0))
+
+	p.reloadRootCAs([]*x509.Certificate{oldCert})
+	if want, have := uint64(0), p.snapshot().TrustedGeneration; want != have {
+		t.Errorf("unchanged reload: want generation %d, have %d", want, have)
+	}
+
+	p.reloadRootCAs([]*x509.Certificate{newCert})
+	snapshot := p.snapshot()
+	if want, have := uint64(1), snapshot.TrustedGeneration; want != have {
+		t.Errorf("reload: want generation %d, have %d", want, have)
+	}
+	if want, have := 2, len(snapshot.RootCAs); want != have {
+		t.Errorf("reload: want %d root CAs during the overlap, have %d", want, have)
+	}
+}
+
+func TestPeerWritesCAOut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet-mesh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caOut := filepath.Join(dir, "ca.crt")
+
+	p := newNodeBootstrapPeer(mesh.PeerName(999), "test", nil, nil, peerOptions{
+		skipCAValidation: true,
+		caOut:            caOut,
+		caOutMode:        0644,
+	}, newTextLogger(ioutil.Discard, "", 0))
+	for _, cas := range [][]*RootCAPublicKey{{caA}, {caB}} {
+		buf := encodeGossip(ClusterInfo{RootCAs: cas}, nil)
+		if _, err := p.OnGossip(buf); err != nil {
+			t.Fatal(err)
+		}
+		have, err := ioutil.ReadFile(caOut)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := encodeRootCAs(p.st.set.RootCAs); !bytes.Equal(want, have) {
+			t.Errorf("after %v: want\n%s\nhave\n%s", cas, want, have)
+		}
+	}
+}
+
+func TestPeerRejectsUnpinnedRootCA(t *testing.T) {
+	var (
+		pinnedCert = newTestCert(t, testCATemplate)
+		pinned     = newRootCAPublicKey(pinnedCert, 0, 999)
+		other      = newRootCAPublicKey(newTestCert(t, testCATemplate), 0, 999)
+	)
+	p := newNodeBootstrapPeer(mesh.PeerName(999), "test", nil, nil, peerOptions{
+		caHashes: map[string]struct{}{spkiHash(pinnedCert): {}},
+	}, newTextLogger(ioutil.Discard, "", 0))
+	buf := encodeGossip(ClusterInfo{RootCAs: []*RootCAPublicKey{pinned, other}}, nil)
+	if err := p.OnGossipUnicast(mesh.PeerName(123), buf); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []*RootCAPublicKey{pinned}, p.st.set.RootCAs; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	if want, have := uint64(1), p.snapshot().CAHashMismatches; want != have {
+		t.Errorf("mismatches: want %d, have %d", want, have)
+	}
+}
+
+func TestPeerMaybeWriteKubeconfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet-mesh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kubeconfig := filepath.Join(dir, "kubeconfig")
+
+	p := newNodeBootstrapPeer(mesh.PeerName(999), "test", []*RootCAPublicKey{caA}, nil, peerOptions{
+		skipCAValidation: true,
+		kubeconfigOut:    kubeconfig,
+	}, newTextLogger(ioutil.Discard, "", 0))
+	p.maybeWriteKubeconfig()
+	if _, err := os.Stat(kubeconfig); !os.IsNotExist(err) {
+		t.Fatalf("without an apiserver: want no kubeconfig, have %v", err)
+	}
+
+	p.st.mergeComplete(ClusterInfo{ApiserverURLs: []string{"https://a:6443"}})
+	p.maybeWriteKubeconfig()
+	have, err := ioutil.ReadFile(kubeconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := renderKubeconfig(encodeRootCAs([]*RootCAPublicKey{caA}), "https://a:6443", ""); !bytes.Equal(want, have) {
+		t.Errorf("want\n%s\nhave\n%s", want, have)
+	}
+	if !bytes.Contains(have, []byte("server: https://a:6443\n")) {
+		t.Errorf("kubeconfig doesn't point at the apiserver:\n%s", have)
+	}
+	fi, err := os.Stat(kubeconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := os.FileMode(0600), fi.Mode().Perm(); want != have {
+		t.Errorf("mode: want %v, have %v", want, have)
+	}
+
+	// -kubeconfig-mode overrides that, and fixes a file with the right
+	// contents but the wrong mode.
+	if err := os.Chmod(kubeconfig, 0644); err != nil {
+		t.Fatal(err)
+	}
+	p.st.opts.kubeconfigMode = 0640
+	p.maybeWriteKubeconfig()
+	if fi, err = os.Stat(kubeconfig); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := os.FileMode(0640), fi.Mode().Perm(); want != have {
+		t.Errorf("-kubeconfig-mode: want %v, have %v", want, have)
+	}
+}
+
+func TestPeerCABundle(t *testing.T) {
+	now := time.Now()
+	var (
+		old     = &RootCAPublicKey{Bytes: []byte("old"), Generation: 1, NotAfter: now.Add(time.Second)}
+		current = &RootCAPublicKey{Bytes: []byte("current"), Generation: 2, NotAfter: now.Add(time.Hour)}
+	)
+	p := newNodeBootstrapPeer(mesh.PeerName(999), "test", nil, nil, peerOptions{
+		skipCAValidation: true,
+		caOverlap:        time.Hour,
+	}, newTextLogger(ioutil.Discard, "", 0))
+	defer p.stop()
+	if have := p.caBundle(); have != nil {
+		t.Errorf("without root CAs: want no bundle, have\n%s", have)
+	}
+
+	// Both, mid-rotation, in the order of their fingerprints whatever
+	// the order we learn them in.
+	sorted := []*RootCAPublicKey{old, current}
+	if sorted[1].fingerprint() < sorted[0].fingerprint() {
+		sorted[0], sorted[1] = sorted[1], sorted[0]
+	}
+	p.st.mergeComplete(ClusterInfo{RootCAs: []*RootCAPublicKey{sorted[1], sorted[0]}})
+	if want, have := encodeRootCAs(sorted), p.caBundle(); !bytes.Equal(want, have) {
+		t.Errorf("want\n%s\nhave\n%s", want, have)
+	}
+
+	// Once the old one expires, it's out of the bundle at once, and out
+	// of our state at the next sweep.
+	later := now.Add(time.Minute)
+	old.NotAfter = now.Add(-time.Second)
+	if want, have := encodeRootCAs([]*RootCAPublicKey{current}), p.caBundle(); !bytes.Equal(want, have) {
+		t.Errorf("after expiry: want\n%s\nhave\n%s", want, have)
+	}
+	if !p.st.expire(later) {
+		t.Error("want the sweep to drop the expired root CA")
+	}
+	if want, have := []*RootCAPublicKey{current}, p.trustedRootCAs(); !reflect.DeepEqual(want, have) {
+		t.Errorf("after the sweep: want %v, have %v", want, have)
+	}
+}
+
+func TestPeerKubeconfigPrefersHighestPriority(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet-mesh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kubeconfig := filepath.Join(dir, "kubeconfig")
+
+	seed := newNodeBootstrapPeer(mesh.PeerName(1), "seed", nil, []string{"https://a:6443", "https://b:6443"}, peerOptions{
+		skipCAValidation:    true,
+		apiserverPriorities: map[string]apiserverPriority{"https://b:6443": {Priority: 10, Weight: 100}},
+	}, newTextLogger(ioutil.Discard, "", 0))
+	p := newNodeBootstrapPeer(mesh.PeerName(999), "test", []*RootCAPublicKey{caA}, nil, peerOptions{
+		skipCAValidation: true,
+		kubeconfigOut:    kubeconfig,
+	}, newTextLogger(ioutil.Discard, "", 0))
+	if _, err := p.OnGossip(encodeGossip(seed.st.copy().set, nil)); err != nil {
+		t.Fatal(err)
+	}
+	p.maybeWriteKubeconfig()
+	have, err := ioutil.ReadFile(kubeconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(have, []byte("server: https://b:6443\n")) {
+		t.Errorf("kubeconfig doesn't point at the highest priority apiserver:\n%s", have)
+	}
+}
+
+func TestPeerMaybeWriteDiscoveryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet-mesh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	discovery := filepath.Join(dir, "discovery.yaml")
+
+	p := newNodeBootstrapPeer(mesh.PeerName(999), "test", []*RootCAPublicKey{caA}, []string{"https://b:6443"}, peerOptions{
+		skipCAValidation: true,
+		discoveryFileOut: discovery,
+		discoveryServer:  "https://c:6443",
+	}, newTextLogger(ioutil.Discard, "", 0))
+	p.st.mergeComplete(ClusterInfo{
+		ApiserverURLs:   []string{"https://a:6443"},
+		BootstrapTokens: []*BootstrapToken{{Token: "abcdef.0123456789abcdef", Expires: time.Now().Add(time.Hour)}},
+	})
+	for _, testcase := range []struct {
+		name   string
+		update ClusterInfo
+		server string
+	}{
+		{"first", ClusterInfo{}, "https://a:6443"},
+		{"preferred", ClusterInfo{ApiserverURLs: []string{"https://c:6443"}}, "https://c:6443"},
+		{"new root CA", ClusterInfo{RootCAs: []*RootCAPublicKey{caB}}, "https://c:6443"},
+	} {
+		p.st.mergeComplete(testcase.update)
+		p.maybeWriteDiscoveryFile()
+		have, err := ioutil.ReadFile(discovery)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := renderKubeconfig(p.caBundle(), testcase.server, ""); !bytes.Equal(want, have) {
+			t.Errorf("%s: want\n%s\nhave\n%s", testcase.name, want, have)
+		}
+		if bytes.Contains(have, []byte("users:")) {
+			t.Errorf("%s: discovery file has credentials:\n%s", testcase.name, have)
+		}
+	}
+}
+
+func TestPeerAwaitsCAQuorum(t *testing.T) {
+	p := newNodeBootstrapPeer(mesh.PeerName(999), "test", nil, nil, peerOptions{skipCAValidation: true, caQuorum: 2}, newTextLogger(ioutil.Discard, "", 0))
+	buf := encodeGossip(ClusterInfo{RootCAs: []*RootCAPublicKey{caA}}, nil)
+	for _, step := range []struct {
+		name string
+		send func() error
+		want int
+	}{
+		{"broadcast from 1", func() error { _, err := p.OnGossipBroadcast(1, buf); return err }, 0},
+		{"gossip", func() error { _, err := p.OnGossip(buf); return err }, 0},
+		{"unicast from 1", func() error { return p.OnGossipUnicast(1, buf) }, 0},
+		{"broadcast from 2", func() error { _, err := p.OnGossipBroadcast(2, buf); return err }, 1},
+	} {
+		if err := step.send(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if want, have := step.want, len(p.st.set.RootCAs); want != have {
+			t.Errorf("after %s: want %d root CAs, have %d", step.name, want, have)
+		}
+	}
+	if pending := p.snapshot().PendingRootCAs; len(pending) != 0 {
+		t.Errorf("want nothing pending, have %v", pending)
+	}
+}
+
+func TestPeerPinsOnlyAfterQuorum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet-mesh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ca-fingerprint")
+	pin, err := loadTOFUPin(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		hostile     = newRootCAPublicKey(newTestCert(t, testCATemplate), 0, 1)
+		genuineCert = newTestCert(t, testCATemplate)
+		genuine     = newRootCAPublicKey(genuineCert, 0, 2)
+	)
+	p := newNodeBootstrapPeer(mesh.PeerName(999), "test", nil, nil, peerOptions{
+		skipCAValidation: true,
+		caQuorum:         2,
+		tofu:             pin,
+	}, newTextLogger(ioutil.Discard, "", 0))
+	defer p.stop()
+
+	// One peer alone advertises hostile, so it must not take the pin.
+	if _, err := p.OnGossipBroadcast(1, encodeGossip(ClusterInfo{RootCAs: []*RootCAPublicKey{hostile}}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("want no pin file for a root CA short of quorum, have %v", err)
+	}
+
+	// Two do genuine, which takes it.
+	buf := encodeGossip(ClusterInfo{RootCAs: []*RootCAPublicKey{genuine}}, nil)
+	for _, src := range []mesh.PeerName{2, 3} {
+		if _, err := p.OnGossipBroadcast(src, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want, have := []*RootCAPublicKey{genuine}, p.trustedRootCAs(); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	if !pin.matches(spkiHash(genuineCert)) {
+		t.Error("want the genuine root CA pinned")
+	}
+}
+
+func TestPeerBootstrapToken(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet-mesh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kubeconfig := filepath.Join(dir, "kubeconfig")
+
+	const token = "abcdef.0123456789abcdef"
+	p := newNodeBootstrapPeer(mesh.PeerName(999), "test", []*RootCAPublicKey{caA}, []string{"https://a:6443"}, peerOptions{
+		kubeconfigOut: kubeconfig,
+	}, newTextLogger(ioutil.Discard, "", 0))
+	p.addBootstrapToken(token, time.Now().Add(time.Hour))
+	p.onChange()
+
+	have, err := ioutil.ReadFile(kubeconfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := renderKubeconfig(encodeRootCAs([]*RootCAPublicKey{caA}), "https://a:6443", token); !bytes.Equal(want, have) {
+		t.Errorf("want\n%s\nhave\n%s", want, have)
+	}
+	if !bytes.Contains(have, []byte("token: "+token)) {
+		t.Errorf("token missing from\n%s", have)
+	}
+
+	for _, showSecrets := range []bool{false, true} {
+		p.st.opts.showSecrets = showSecrets
+		want := "abcdef.<redacted>"
+		if showSecrets {
+			want = token
+		}
+		if have := p.snapshot().BootstrapTokens[0].Token; want != have {
+			t.Errorf("showSecrets=%v: want %q, have %q", showSecrets, want, have)
+		}
+	}
+}
+
+func TestPeerRequireSigned(t *testing.T) {
+	cert, key := newTestCertSignedBy(t, testCATemplate, nil, nil)
+	a, err := signAttestation(key, cert, 1, []string{"https://a:6443"}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newNodeBootstrapPeer(mesh.PeerName(999), "test", nil, nil, peerOptions{
+		skipCAValidation: true,
+		caHashes:         map[string]struct{}{spkiHash(cert): {}},
+		requireSigned:    true,
+	}, newTextLogger(ioutil.Discard, "", 0))
+
+	for _, testcase := range []struct {
+		msg  ClusterInfo
+		want []string
+	}{
+		{ClusterInfo{ApiserverURLs: []string{"https://a:6443"}}, nil},
+		{ClusterInfo{ApiserverURLs: []string{"https://a:6443", "https://evil:6443"}, Attestations: []*Attestation{a}}, []string{"https://a:6443"}},
+		{ClusterInfo{ApiserverURLs: []string{"https://a:6443/"}}, []string{"https://a:6443"}},
+		{ClusterInfo{ApiserverURLs: []string{"https://evil:6443"}}, []string{"https://a:6443"}},
+	} {
+		buf := encodeGossip(testcase.msg, nil)
+		if err := p.OnGossipUnicast(mesh.PeerName(123), buf); err != nil {
+			t.Fatal(err)
+		}
+		if want, have := testcase.want, p.st.set.ApiserverURLs; !reflect.DeepEqual(want, have) {
+			t.Errorf("after %v: want %v, have %v", testcase.msg, want, have)
+		}
+	}
+	if want, have := uint64(3), p.snapshot().Unsigned; want != have {
+		t.Errorf("unsigned: want %d, have %d", want, have)
+	}
+}
+
+func TestPeerForwardsCASlots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet-mesh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "front-proxy-ca.crt")
+
+	p := newNodeBootstrapPeer(mesh.PeerName(999), "test", nil, nil, peerOptions{
+		skipCAValidation: true,
+		caSlotOut:        map[string]string{"front-proxy": out},
+		caOutMode:        0644,
+	}, newTextLogger(ioutil.Discard, "", 0))
+	msg := ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, CASlots: map[string][]*RootCAPublicKey{
+		"front-proxy":      {caB},
+		"some-future-slot": {caC},
+	}}
+	buf := encodeGossip(msg, nil)
+	if _, err := p.OnGossip(buf); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := msg, p.Gossip().(*state).set; !reflect.DeepEqual(want, have) {
+		t.Errorf("Gossip: want %v, have %v", want, have)
+	}
+	have, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := encodeRootCAs([]*RootCAPublicKey{caB}); !bytes.Equal(want, have) {
+		t.Errorf("want\n%s\nhave\n%s", want, have)
+	}
+}
+
+func TestPeerRejectsBadSelfSignature(t *testing.T) {
+	cert := newTestCert(t, testCATemplate)
+	forged := newRootCAPublicKey(cert, 0, 999)
+	forged.Bytes = append([]byte{}, cert.Raw...)
+	// Flip a bit of the signature, at the very end of the DER.
+	forged.Bytes[len(forged.Bytes)-1] ^= 1
+	if c, err := x509.ParseCertificate(forged.Bytes); err == nil {
+		forged.Signature = c.Signature
+	}
+
+	var logs bytes.Buffer
+	p := newNodeBootstrapPeer(mesh.PeerName(999), "test", nil, nil, peerOptions{}, newTextLogger(&logs, "", 0))
+	buf := encodeGossip(ClusterInfo{RootCAs: []*RootCAPublicKey{forged}}, nil)
+	if _, err := p.OnGossip(buf); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(p.st.set.RootCAs); n != 0 {
+		t.Errorf("want the forged root CA rejected, have %d root CAs", n)
+	}
+	if want := "CN=test-ca"; !bytes.Contains(logs.Bytes(), []byte(want)) {
+		t.Errorf("want %q in the logs, have\n%s", want, logs.Bytes())
+	}
+}
+
+func TestPeerForwardsCRLs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet-mesh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out := filepath.Join(dir, "ca.crl")
+
+	cert, key := newTestCertSignedBy(t, testCATemplate, nil, nil)
+	other, otherKey := newTestCertSignedBy(t, testCATemplate, nil, nil)
+	expired := newTestCRL(t, 1, time.Now().Add(-2*time.Hour), cert, key)
+	forged := newTestCRL(t, 2, time.Now(), other, otherKey)
+
+	var logs bytes.Buffer
+	p := newNodeBootstrapPeer(mesh.PeerName(999), "test", nil, nil, peerOptions{crlOut: out, caOutMode: 0644}, newTextLogger(&logs, "", 0))
+	buf := encodeGossip(ClusterInfo{
+		RootCAs: []*RootCAPublicKey{newRootCAPublicKey(cert, 0, 999)},
+		CRLs:    []*CRL{expired, forged},
+	}, nil)
+	if _, err := p.OnGossip(buf); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []*CRL{expired}, p.st.set.CRLs; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	if want := "expired at"; !bytes.Contains(logs.Bytes(), []byte(want)) {
+		t.Errorf("want %q in the logs, have\n%s", want, logs.Bytes())
+	}
+	have, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := encodeCRLs([]*CRL{expired}); !bytes.Equal(want, have) {
+		t.Errorf("want\n%s\nhave\n%s", want, have)
+	}
+}
+
+func TestPeerEncryptedGossip(t *testing.T) {
+	sender, err := newSealer([]byte("secret"), []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong, err := newSealer([]byte("guess"), []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := newNodeBootstrapPeer(mesh.PeerName(1), "src", []*RootCAPublicKey{caA}, []string{"https://a:6443"}, peerOptions{skipCAValidation: true, sealer: sender}, newTextLogger(ioutil.Discard, "", 0))
+	buf := src.Gossip().Encode()[0]
+
+	for _, testcase := range []struct {
+		name   string
+		sealer *sealer
+		merged bool
+	}{
+		{"same password", sender, true},
+		{"wrong password", wrong, false},
+	} {
+		var logs bytes.Buffer
+		p := newNodeBootstrapPeer(mesh.PeerName(999), "test", nil, nil, peerOptions{skipCAValidation: true, sealer: testcase.sealer}, newTextLogger(&logs, "", 0))
+		if _, err := p.OnGossip(buf); err != nil {
+			t.Errorf("%s: %v", testcase.name, err)
+		}
+		if have := len(p.st.set.RootCAs) > 0; testcase.merged != have {
+			t.Errorf("%s: want merged=%v, have %v", testcase.name, testcase.merged, have)
+		}
+		if !testcase.merged && !bytes.Contains(logs.Bytes(), []byte("Dropping gossip")) {
+			t.Errorf("%s: want the drop logged, have\n%s", testcase.name, logs.Bytes())
+		}
+	}
+}
+
+func TestPeerPreservesProvenance(t *testing.T) {
+	seeded := *caA
+	seeded.Origin, seeded.OriginNickname, seeded.Introduced = 1, "master-1", time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// The seed's root CA goes through an intermediate peer to a third.
+	intermediate := newNodeBootstrapPeer(mesh.PeerName(2), "relay", nil, nil, peerOptions{skipCAValidation: true}, newTextLogger(ioutil.Discard, "", 0))
+	buf := encodeGossip(ClusterInfo{RootCAs: []*RootCAPublicKey{&seeded}}, nil)
+	if _, err := intermediate.OnGossip(buf); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestPeer()
+	if _, err := p.OnGossip(intermediate.Gossip().Encode()[0]); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{seeded.provenance()}, p.snapshot().Provenance; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestPeerRejectsInsecureAPIServerURLs(t *testing.T) {
+	msg := ClusterInfo{ApiserverURLs: []string{"http://a:8080", "https://b:6443", "ftp://c", "d:6443"}}
+	for _, testcase := range []struct {
+		allowInsecure bool
+		want          []string
+	}{
+		{false, []string{"https://b:6443", "https://d:6443"}},
+		{true, []string{"http://a:8080", "https://b:6443", "https://d:6443"}},
+	} {
+		var logs bytes.Buffer
+		p := newNodeBootstrapPeer(mesh.PeerName(999), "test", nil, nil, peerOptions{skipCAValidation: true, allowInsecureAPIServer: testcase.allowInsecure}, newTextLogger(&logs, "", 0))
+		if _, err := p.OnGossip(encodeGossip(msg, nil)); err != nil {
+			t.Fatal(err)
+		}
+		if have := p.st.set.ApiserverURLs; !reflect.DeepEqual(testcase.want, have) {
+			t.Errorf("allowInsecure=%v: want %v, have %v", testcase.allowInsecure, testcase.want, have)
+		}
+		if !bytes.Contains(logs.Bytes(), []byte(`Rejected apiserver URL from gossip: "ftp://c"`)) {
+			t.Errorf("allowInsecure=%v: want the rejection logged, have\n%s", testcase.allowInsecure, logs.Bytes())
 		}
 	}
 }
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// probeMaxAge is how long a probe result is gossiped for. Peers that
+// stop probing, or leave, stop counting once theirs age out.
+const probeMaxAge = time.Hour
+
+// APIServerProbe is what one peer last saw of one apiserver URL.
+type APIServerProbe struct {
+	URL     string
+	Peer    mesh.PeerName
+	Healthy bool
+	Checked time.Time
+	Error   string // why it wasn't healthy
+}
+
+func (pr *APIServerProbe) key() string {
+	return pr.Peer.String() + " " + pr.URL
+}
+
+func (pr *APIServerProbe) stale(now time.Time) bool {
+	return now.Sub(pr.Checked) > probeMaxAge
+}
+
+// mergeProbes keeps the latest probe each peer made of each URL.
+func mergeProbes(ours, theirs []*APIServerProbe) (result, delta []*APIServerProbe) {
+	all := append(append([]*APIServerProbe(nil), ours...), theirs...)
+	keep, changed := mergeKeyed(len(ours), len(theirs),
+		func(i int) string { return all[i].key() },
+		func(i, j int) bool { return preferProbe(all[i], all[j]) })
+	for _, i := range keep {
+		result = append(result, all[i])
+	}
+	for _, i := range changed {
+		delta = append(delta, all[i])
+	}
+	sortProbes(result)
+	sortProbes(delta)
+	return result, delta
+}
+
+// preferProbe decides between two probes by the same peer of the same
+// URL: the latest, then the unhealthy one, then the lowest error.
+func preferProbe(a, b *APIServerProbe) bool {
+	if !a.Checked.Equal(b.Checked) {
+		return a.Checked.After(b.Checked)
+	}
+	if a.Healthy != b.Healthy {
+		return !a.Healthy
+	}
+	return a.Error < b.Error
+}
+
+func sortProbes(probes []*APIServerProbe) {
+	sort.Slice(probes, func(i, j int) bool {
+		if probes[i].URL != probes[j].URL {
+			return probes[i].URL < probes[j].URL
+		}
+		return probes[i].Peer < probes[j].Peer
+	})
+}
+
+// apiserverHealthView is how many peers recently found an apiserver
+// URL healthy, and how many didn't, and what we found ourselves.
+type apiserverHealthView struct {
+	URL         string          `json:"url"`
+	Healthy     int             `json:"healthy"`
+	Unhealthy   int             `json:"unhealthy"`
+	LastChecked time.Time       `json:"lastChecked"`
+	Local       *localProbeView `json:"local,omitempty"`
+	// Voters and ConsensusHealthy are as of the -consensus-window.
+	Voters           int  `json:"voters"`
+	ConsensusHealthy bool `json:"consensusHealthy"`
+}
+
+// localProbeView is our own latest probe of an apiserver URL.
+type localProbeView struct {
+	Healthy bool      `json:"healthy"`
+	Checked time.Time `json:"checked"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// apiserverHealth counts the unexpired probes of each URL.
+func apiserverHealth(probes []*APIServerProbe, self mesh.PeerName, now time.Time) []apiserverHealthView {
+	var views []apiserverHealthView
+	index := map[string]int{}
+	for _, pr := range probes {
+		if pr.stale(now) {
+			continue
+		}
+		i, ok := index[pr.URL]
+		if !ok {
+			i = len(views)
+			index[pr.URL] = i
+			views = append(views, apiserverHealthView{URL: pr.URL})
+		}
+		if pr.Healthy {
+			views[i].Healthy++
+		} else {
+			views[i].Unhealthy++
+		}
+		if pr.Checked.After(views[i].LastChecked) {
+			views[i].LastChecked = pr.Checked
+		}
+		if pr.Peer == self {
+			views[i].Local = &localProbeView{Healthy: pr.Healthy, Checked: pr.Checked, Error: pr.Error}
+		}
+	}
+	return views
+}
+
+// demoteUnhealthy moves the URLs that our own unexpired probes found
+// unhealthy after the others, keeping the order within each.
+func demoteUnhealthy(urls []string, probes []*APIServerProbe, self mesh.PeerName, now time.Time) []string {
+	unhealthy := map[string]bool{}
+	for _, pr := range probes {
+		if pr.Peer == self && !pr.Healthy && !pr.stale(now) {
+			unhealthy[pr.URL] = true
+		}
+	}
+	var healthy, demoted []string
+	for _, u := range urls {
+		if unhealthy[u] {
+			demoted = append(demoted, u)
+		} else {
+			healthy = append(healthy, u)
+		}
+	}
+	return append(healthy, demoted...)
+}
+
+// probeAPIServer GETs /healthz from rawurl, trusting roots, or if we
+// don't know any root CAs yet, just checks that it accepts connections.
+// It returns the spkiHash of the serving certificate, if it saw one.
+func probeAPIServer(rawurl string, roots []*RootCAPublicKey, timeout time.Duration) (certHash string, err error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	if len(roots) == 0 {
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), defaultPorts[u.Scheme])
+		}
+		conn, err := net.DialTimeout("tcp", host, timeout)
+		if err != nil {
+			return "", err
+		}
+		return "", conn.Close()
+	}
+	pool := x509.NewCertPool()
+	for _, ca := range roots {
+		if cert, err := x509.ParseCertificate(ca.Bytes); err == nil {
+			pool.AddCert(cert)
+		}
+	}
+	// A transport of its own each time, so it mustn't keep its connection
+	// open after, for every URL, every interval.
+	client := &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}, DisableKeepAlives: true},
+	}
+	resp, err := client.Get(rawurl + "/healthz")
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 {
+		certHash = spkiHash(resp.TLS.PeerCertificates[0])
+	}
+	if resp.StatusCode != http.StatusOK {
+		return certHash, fmt.Errorf("/healthz: %s", resp.Status)
+	}
+	return certHash, nil
+}
+
+// probeConfig is how often, and how much, each peer probes.
+type probeConfig struct {
+	interval time.Duration
+	timeout  time.Duration
+	// max caps the URLs probed per round; the rest wait for later rounds.
+	max   int
+	probe func(rawurl string, roots []*RootCAPublicKey, timeout time.Duration) (certHash string, err error)
+}
+
+// probeAPIServers probes the gossiped apiserver URLs until quit is
+// closed. Rounds are spread over anywhere from half to one and a half
+// intervals, so that peers started together don't probe together.
+func (p *peer) probeAPIServers(cfg probeConfig, quit <-chan struct{}) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	offset := 0
+	for {
+		jitter := time.Duration(rng.Int63n(int64(cfg.interval)))
+		select {
+		case <-time.After(cfg.interval/2 + jitter):
+		case <-quit:
+			return
+		}
+		offset = p.probeRound(cfg, offset, time.Now())
+	}
+}
+
+// probeRound probes up to cfg.max URLs, starting from offset, records the
+// results in our state for the next gossip, rewrites what depends on
+// them, and returns where to carry on.
+func (p *peer) probeRound(cfg probeConfig, offset int, now time.Time) int {
+	p.st.mtx.RLock()
+	urls, roots := p.st.set.ApiserverURLs, p.st.trustedRootCAs()
+	gossiped := servingCertHashes(p.st.set.APIServerLeases, now)
+	p.st.mtx.RUnlock()
+	if len(urls) == 0 {
+		return 0
+	}
+	n := len(urls)
+	if cfg.max > 0 && n > cfg.max {
+		n = cfg.max
+	}
+	var probes []*APIServerProbe
+	for i := 0; i < n; i++ {
+		u := urls[(offset+i)%len(urls)]
+		pr := &APIServerProbe{URL: u, Peer: p.self, Healthy: true, Checked: now}
+		certHash, err := cfg.probe(u, roots, cfg.timeout)
+		if err != nil {
+			pr.Healthy, pr.Error = false, err.Error()
+			p.logger.Debugf("Apiserver %s is unhealthy: %v", u, err)
+		}
+		if hashes := gossiped[u]; certHash != "" && len(hashes) > 0 && !containsString(hashes, certHash) {
+			p.logger.Warnf("Apiserver %s served a certificate with public key %s, but its seeds gossip %s: a man in the middle, or a stale entry?", u, certHash, strings.Join(hashes, ", "))
+		}
+		probes = append(probes, pr)
+	}
+	p.st.mergeComplete(ClusterInfo{Probes: probes})
+	// Fail the kubeconfig over as soon as we notice.
+	p.onChange()
+	return (offset + n) % len(urls)
+}
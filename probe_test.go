@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+func TestMergeProbes(t *testing.T) {
+	t0 := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(time.Minute)
+	a0 := &APIServerProbe{URL: "https://a", Peer: 1, Healthy: true, Checked: t0}
+	a1 := &APIServerProbe{URL: "https://a", Peer: 1, Healthy: false, Checked: t1, Error: "refused"}
+	a1healthy := &APIServerProbe{URL: "https://a", Peer: 1, Healthy: true, Checked: t1}
+	b := &APIServerProbe{URL: "https://a", Peer: 2, Healthy: true, Checked: t0}
+	for _, testcase := range []struct {
+		ours, theirs  []*APIServerProbe
+		result, delta []*APIServerProbe
+	}{
+		{nil, []*APIServerProbe{a0}, []*APIServerProbe{a0}, []*APIServerProbe{a0}},
+		{[]*APIServerProbe{a0}, []*APIServerProbe{a0}, []*APIServerProbe{a0}, nil},
+		// The latest probe by the same peer wins.
+		{[]*APIServerProbe{a0}, []*APIServerProbe{a1}, []*APIServerProbe{a1}, []*APIServerProbe{a1}},
+		{[]*APIServerProbe{a1}, []*APIServerProbe{a0}, []*APIServerProbe{a1}, nil},
+		// At the same time, unhealthy wins.
+		{[]*APIServerProbe{a1healthy}, []*APIServerProbe{a1}, []*APIServerProbe{a1}, []*APIServerProbe{a1}},
+		{[]*APIServerProbe{a1}, []*APIServerProbe{a1healthy}, []*APIServerProbe{a1}, nil},
+		// Probes by different peers are kept side by side.
+		{[]*APIServerProbe{b}, []*APIServerProbe{a0}, []*APIServerProbe{a0, b}, []*APIServerProbe{a0}},
+	} {
+		result, delta := mergeProbes(testcase.ours, testcase.theirs)
+		if !reflect.DeepEqual(testcase.result, result) {
+			t.Errorf("mergeProbes(%v, %v): want result %v, have %v", testcase.ours, testcase.theirs, testcase.result, result)
+		}
+		if !reflect.DeepEqual(testcase.delta, delta) {
+			t.Errorf("mergeProbes(%v, %v): want delta %v, have %v", testcase.ours, testcase.theirs, testcase.delta, delta)
+		}
+	}
+}
+
+func TestAPIServerHealth(t *testing.T) {
+	now := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	probes := []*APIServerProbe{
+		{URL: "https://a", Peer: 1, Healthy: true, Checked: now.Add(-time.Minute)},
+		{URL: "https://a", Peer: 2, Healthy: true, Checked: now.Add(-2 * time.Minute)},
+		{URL: "https://a", Peer: 3, Healthy: false, Checked: now.Add(-3 * time.Minute)},
+		{URL: "https://b", Peer: 1, Healthy: false, Checked: now.Add(-probeMaxAge - time.Second)},
+	}
+	want := []apiserverHealthView{{URL: "https://a", Healthy: 2, Unhealthy: 1, LastChecked: now.Add(-time.Minute), Local: &localProbeView{Healthy: false, Checked: now.Add(-3 * time.Minute)}}}
+	if have := apiserverHealth(probes, 3, now); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestStateDropsStaleProbes(t *testing.T) {
+	now := time.Now()
+	fresh := &APIServerProbe{URL: "https://a", Peer: 1, Healthy: true, Checked: now}
+	stale := &APIServerProbe{URL: "https://a", Peer: 2, Healthy: true, Checked: now.Add(-probeMaxAge - time.Minute)}
+	p := newTestPeer()
+	p.st.mergeComplete(ClusterInfo{Probes: []*APIServerProbe{fresh, stale}})
+	if want, have := []*APIServerProbe{fresh}, p.st.set.Probes; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestProbeAPIServer(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	healthy := httptest.NewTLSServer(mux)
+	defer healthy.Close()
+	unhealthy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "etcd is down", http.StatusInternalServerError)
+	}))
+	defer unhealthy.Close()
+	roots := []*RootCAPublicKey{newRootCAPublicKey(healthy.Certificate(), 0, 0), newRootCAPublicKey(unhealthy.Certificate(), 0, 0)}
+	untrusted := []*RootCAPublicKey{newRootCAPublicKey(newTestCert(t, testCATemplate), 0, 0)}
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closedURL := "https://" + closed.Addr().String()
+	closed.Close()
+
+	for _, testcase := range []struct {
+		url   string
+		roots []*RootCAPublicKey
+		want  string // substring of the error, or "" for healthy
+	}{
+		{healthy.URL, roots, ""},
+		{unhealthy.URL, roots, "500"},
+		{healthy.URL, untrusted, "certificate"},
+		// Without a root CA we can only check that it's listening.
+		{unhealthy.URL, nil, ""},
+		{closedURL, nil, "refused"},
+	} {
+		_, err := probeAPIServer(testcase.url, testcase.roots, time.Second)
+		switch {
+		case testcase.want == "" && err != nil:
+			t.Errorf("%s: want healthy, have %v", testcase.url, err)
+		case testcase.want != "" && (err == nil || !strings.Contains(err.Error(), testcase.want)):
+			t.Errorf("%s: want error containing %q, have %v", testcase.url, testcase.want, err)
+		}
+	}
+	if have, err := probeAPIServer(healthy.URL, roots, time.Second); err != nil || have != spkiHash(healthy.Certificate()) {
+		t.Errorf("want the serving certificate's hash, have %q, %v", have, err)
+	}
+}
+
+func TestProbeAPIServerClosesConnections(t *testing.T) {
+	var open int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt64(&open, 1)
+		case http.StateClosed, http.StateHijacked:
+			atomic.AddInt64(&open, -1)
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+	roots := []*RootCAPublicKey{newRootCAPublicKey(server.Certificate(), 0, 0)}
+	for i := 0; i < 10; i++ {
+		if _, err := probeAPIServer(server.URL, roots, time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt64(&open) > 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if have := atomic.LoadInt64(&open); have > 0 {
+		t.Errorf("want no connections left open, have %d", have)
+	}
+}
+
+func TestPeerProbeRound(t *testing.T) {
+	now := time.Now()
+	p := newTestPeer()
+	p.st.mergeComplete(ClusterInfo{ApiserverURLs: []string{"https://a", "https://b", "https://c"}})
+	var probed []string
+	cfg := probeConfig{max: 2, probe: func(rawurl string, _ []*RootCAPublicKey, _ time.Duration) (string, error) {
+		probed = append(probed, rawurl)
+		if rawurl == "https://b" {
+			return "", errors.New("refused")
+		}
+		return "", nil
+	}}
+	offset := p.probeRound(cfg, 0, now)
+	offset = p.probeRound(cfg, offset, now.Add(time.Second))
+	if want := []string{"https://a", "https://b", "https://c", "https://a"}; !reflect.DeepEqual(want, probed) {
+		t.Errorf("want probes of %v, have %v", want, probed)
+	}
+	if offset != 1 {
+		t.Errorf("want offset 1, have %d", offset)
+	}
+	self := mesh.PeerName(999)
+	want := []*APIServerProbe{
+		{URL: "https://a", Peer: self, Healthy: true, Checked: now.Add(time.Second)},
+		{URL: "https://b", Peer: self, Healthy: false, Checked: now, Error: "refused"},
+		{URL: "https://c", Peer: self, Healthy: true, Checked: now.Add(time.Second)},
+	}
+	if have := p.st.set.Probes; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestDemoteUnhealthy(t *testing.T) {
+	now := time.Now()
+	probes := []*APIServerProbe{
+		{URL: "https://a", Peer: 1, Healthy: false, Checked: now},
+		{URL: "https://b", Peer: 2, Healthy: false, Checked: now},
+		{URL: "https://c", Peer: 1, Healthy: true, Checked: now},
+		{URL: "https://d", Peer: 1, Healthy: false, Checked: now.Add(-probeMaxAge - time.Minute)},
+		{URL: "https://e", Peer: 1, Healthy: false, Checked: now},
+	}
+	urls := []string{"https://e", "https://a", "https://b", "https://c", "https://d"}
+	// Only our own probes count; b was unhealthy to another peer.
+	want := []string{"https://b", "https://c", "https://d", "https://e", "https://a"}
+	if have := demoteUnhealthy(urls, probes, 1, now); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestPeerDemotesUnhealthyAPIServers(t *testing.T) {
+	p := newTestPeer()
+	p.st.mergeComplete(ClusterInfo{ApiserverURLs: []string{"https://a:6443", "https://b:6443"}})
+	cfg := probeConfig{probe: func(rawurl string, _ []*RootCAPublicKey, _ time.Duration) (string, error) {
+		if rawurl == "https://a:6443" {
+			return "", errors.New("refused")
+		}
+		return "", nil
+	}}
+	now := time.Now()
+	p.probeRound(cfg, 0, now)
+	if want, have := []string{"https://b:6443", "https://a:6443"}, p.st.prioritizedAPIServerURLs(now); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	// Demoted, but still gossiped.
+	if want, have := []string{"https://a:6443", "https://b:6443"}, p.st.copy().set.ApiserverURLs; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v gossiped, have %v", want, have)
+	}
+	if local := p.snapshot().ApiserverHealth[0].Local; local == nil || local.Healthy || local.Error != "refused" {
+		t.Errorf("want our failed probe in /state, have %+v", local)
+	}
+}
+
+func TestPeerBestAPIServer(t *testing.T) {
+	now := time.Now()
+	urls := []string{"https://a:6443", "https://b:6443", "https://c:6443"}
+	self, other := mesh.PeerName(999), mesh.PeerName(1)
+	probe := func(u string, peer mesh.PeerName, healthy bool) *APIServerProbe {
+		return &APIServerProbe{URL: u, Peer: peer, Healthy: healthy, Checked: now}
+	}
+	for _, testcase := range []struct {
+		name    string
+		probes  []*APIServerProbe
+		want    string
+		healthy bool
+	}{
+		{"no probes", nil, "https://a:6443", false},
+		{"all healthy", []*APIServerProbe{probe("https://a:6443", self, true), probe("https://b:6443", self, true)}, "https://a:6443", true},
+		{"first unhealthy", []*APIServerProbe{probe("https://a:6443", self, false), probe("https://b:6443", self, true)}, "https://b:6443", true},
+		{"healthy beats unprobed", []*APIServerProbe{probe("https://c:6443", self, true)}, "https://c:6443", true},
+		{"unprobed beats unhealthy", []*APIServerProbe{probe("https://a:6443", self, false)}, "https://b:6443", false},
+		{"peers count if we haven't probed", []*APIServerProbe{probe("https://a:6443", other, false), probe("https://b:6443", other, true)}, "https://b:6443", true},
+		{"our probes beat peers'", []*APIServerProbe{probe("https://a:6443", other, false), probe("https://a:6443", self, true)}, "https://a:6443", true},
+		{"all unhealthy", []*APIServerProbe{probe("https://a:6443", self, false), probe("https://b:6443", self, false), probe("https://c:6443", self, false)}, "https://a:6443", false},
+	} {
+		p := newTestPeer()
+		p.st.mergeComplete(ClusterInfo{ApiserverURLs: urls, Probes: testcase.probes})
+		have, healthy := p.bestAPIServer()
+		if have != testcase.want || healthy != testcase.healthy {
+			t.Errorf("%s: want %s (healthy: %v), have %s (healthy: %v)", testcase.name, testcase.want, testcase.healthy, have, healthy)
+		}
+	}
+}
+
+func TestPeerKubeconfigFailsOver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet-mesh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	kubeconfig := filepath.Join(dir, "kubeconfig")
+	var logs bytes.Buffer
+	p := newNodeBootstrapPeer(mesh.PeerName(999), "test", []*RootCAPublicKey{caA}, []string{"https://a:6443", "https://b:6443"}, peerOptions{
+		skipCAValidation: true,
+		kubeconfigOut:    kubeconfig,
+	}, newTextLogger(&logs, "", 0))
+	down := map[string]bool{}
+	cfg := probeConfig{probe: func(rawurl string, _ []*RootCAPublicKey, _ time.Duration) (string, error) {
+		if down[rawurl] {
+			return "", errors.New("refused")
+		}
+		return "", nil
+	}}
+	now := time.Now()
+	for _, testcase := range []struct {
+		down bool
+		want string
+	}{
+		{false, "https://a:6443"},
+		{true, "https://b:6443"},
+		{false, "https://a:6443"},
+	} {
+		down["https://a:6443"] = testcase.down
+		now = now.Add(time.Second)
+		p.probeRound(cfg, 0, now)
+		have, err := ioutil.ReadFile(kubeconfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(have, []byte("server: "+testcase.want+"\n")) {
+			t.Errorf("a down: %v: want kubeconfig for %s, have\n%s", testcase.down, testcase.want, have)
+		}
+	}
+	if !bytes.Contains(logs.Bytes(), []byte("Failed kubeconfig over from https://a:6443 to https://b:6443")) {
+		t.Errorf("want the failover logged, have\n%s", logs.Bytes())
+	}
+}
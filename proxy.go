@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var proxyConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "kubelet_mesh",
+	Name:      "proxy_connections_total",
+	Help:      "Connections the local proxy forwarded, by backend.",
+}, []string{"backend"})
+
+var proxyDialFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "kubelet_mesh",
+	Name:      "proxy_dial_failures_total",
+	Help:      "Connections the local proxy failed to make, by backend.",
+}, []string{"backend"})
+
+func init() {
+	prometheus.MustRegister(proxyConnections, proxyDialFailures)
+}
+
+// localProxy forwards TCP connections to the gossiped apiservers.
+type localProxy struct {
+	// tiers returns the backends to try, as host:port, in tiers
+	// that are each tried round-robin before the next.
+	tiers  func() [][]string
+	dial   func(network, addr string) (net.Conn, error)
+	logger *levelLogger
+	next   uint64 // atomic
+}
+
+func newLocalProxy(tiers func() [][]string, timeout time.Duration, logger *levelLogger) *localProxy {
+	dialer := &net.Dialer{Timeout: timeout}
+	return &localProxy{tiers: tiers, dial: dialer.Dial, logger: logger}
+}
+
+// backends is the order to try the backends in for one connection:
+// each tier in turn, starting from the next in the round-robin.
+func (lp *localProxy) backends() []string {
+	n := int(atomic.AddUint64(&lp.next, 1) - 1)
+	var order []string
+	for _, tier := range lp.tiers() {
+		for i := range tier {
+			order = append(order, tier[(n+i)%len(tier)])
+		}
+	}
+	return order
+}
+
+// serve accepts connections on l until it's closed. Each connection is
+// forwarded to the apiservers we know of when it arrives; later gossip
+// doesn't disturb it.
+func (lp *localProxy) serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go lp.forward(conn)
+	}
+}
+
+func (lp *localProxy) forward(conn net.Conn) {
+	defer conn.Close()
+	backends := lp.backends()
+	if len(backends) == 0 {
+		lp.logger.Warnf("Proxy: no apiservers to forward %s to", conn.RemoteAddr())
+		return
+	}
+	for _, backend := range backends {
+		upstream, err := lp.dial("tcp", backend)
+		if err != nil {
+			proxyDialFailures.WithLabelValues(backend).Inc()
+			lp.logger.Warnf("Proxy: %v", err)
+			continue
+		}
+		proxyConnections.WithLabelValues(backend).Inc()
+		lp.logger.Debugf("Proxy: forwarding %s to %s", conn.RemoteAddr(), backend)
+		pipe(conn, upstream)
+		return
+	}
+	lp.logger.Errorf("Proxy: couldn't reach any of %v for %s", backends, conn.RemoteAddr())
+}
+
+// pipe copies between a and b until both directions are done, then
+// closes b.
+func pipe(a, b net.Conn) {
+	defer b.Close()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	copyHalf := func(dst, src net.Conn) {
+		defer wg.Done()
+		io.Copy(dst, src)
+		if tcp, ok := dst.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		} else {
+			dst.Close()
+		}
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	wg.Wait()
+}
+
+// proxyTiers is the host:port of each of our apiservers, in tiers of
+// equal priority, with those we last found unhealthy in the last tiers.
+func (p *peer) proxyTiers() [][]string {
+	now := time.Now()
+	p.st.mtx.RLock()
+	urls := p.st.apiserverURLsFor(consensusProxy, now)
+	priority := apiserverPriorities(p.st.set.APIServerLeases, now)
+	health := apiserverHealth(p.st.set.Probes, p.self, now)
+	p.st.mtx.RUnlock()
+	unhealthy := map[string]bool{}
+	for _, h := range health {
+		if h.Local != nil && !h.Local.Healthy {
+			unhealthy[h.URL] = true
+		}
+	}
+	type tierKey struct {
+		unhealthy bool
+		priority  int
+	}
+	var tiers [][]string
+	var last tierKey
+	for _, u := range urls {
+		host, port, err := apiserverHostPort(u)
+		if err != nil {
+			continue
+		}
+		key := tierKey{unhealthy[u], priority(u).Priority}
+		if len(tiers) == 0 || key != last {
+			tiers = append(tiers, nil)
+			last = key
+		}
+		tiers[len(tiers)-1] = append(tiers[len(tiers)-1], net.JoinHostPort(host, port))
+	}
+	return tiers
+}
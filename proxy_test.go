@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+func TestLocalProxyBackends(t *testing.T) {
+	lp := newLocalProxy(func() [][]string {
+		return [][]string{{"a:6443", "b:6443"}, {"c:6443"}}
+	}, time.Second, newTextLogger(ioutil.Discard, "", 0))
+	for _, want := range [][]string{
+		{"a:6443", "b:6443", "c:6443"},
+		{"b:6443", "a:6443", "c:6443"},
+		{"a:6443", "b:6443", "c:6443"},
+	} {
+		if have := lp.backends(); !reflect.DeepEqual(want, have) {
+			t.Errorf("want %v, have %v", want, have)
+		}
+	}
+}
+
+func TestLocalProxyForwards(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead.Close()
+
+	backends := [][]string{{dead.Addr().String(), echo.Addr().String()}}
+	lp := newLocalProxy(func() [][]string { return backends }, time.Second, newTextLogger(ioutil.Discard, "", 0))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go lp.serve(l)
+
+	// Whichever backend the round-robin starts from, we get through.
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("hello\n")); err != nil {
+			t.Fatal(err)
+		}
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || line != "hello\n" {
+			t.Errorf("connection %d: want hello back, have %q, %v", i, line, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestPeerProxyTiers(t *testing.T) {
+	now := time.Now()
+	p := newNodeBootstrapPeer(mesh.PeerName(999), "test", nil, []string{"https://local-1:6443", "https://local-2:6443", "https://remote"}, peerOptions{
+		skipCAValidation: true,
+		apiserverPriorities: map[string]apiserverPriority{
+			"https://local-1:6443": {Priority: 10, Weight: 100},
+			"https://local-2:6443": {Priority: 10, Weight: 100},
+		},
+	}, newTextLogger(ioutil.Discard, "", 0))
+	p.st.mergeComplete(ClusterInfo{Probes: []*APIServerProbe{{URL: "https://local-2:6443", Peer: p.self, Healthy: false, Checked: now}}})
+	want := [][]string{{"local-1:6443"}, {"remote:443"}, {"local-2:6443"}}
+	if have := p.proxyTiers(); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	// One we can't parse, first, is skipped without costing a tier.
+	p = newNodeBootstrapPeer(mesh.PeerName(999), "test", nil, []string{"https://a b", "https://remote"}, peerOptions{skipCAValidation: true}, newTextLogger(ioutil.Discard, "", 0))
+	if want, have := [][]string{{"remote:443"}}, p.proxyTiers(); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// caQuorum holds gossiped root CAs back until enough distinct peers have
+// advertised them, so a single misconfigured or compromised peer can't
+// inject one. Only broadcast and unicast gossip tell us who the sender
+// is; root CAs in periodic gossip are held, but not counted.
+type caQuorum struct {
+	mtx     sync.Mutex
+	n       int
+	pending map[string]*pendingRootCA // by fingerprint
+}
+
+type pendingRootCA struct {
+	ca     *RootCAPublicKey
+	seenBy map[mesh.PeerName]struct{}
+}
+
+// pendingRootCAView is a pending root CA, for operators.
+type pendingRootCAView struct {
+	Fingerprint string   `json:"fingerprint"`
+	SeenBy      []string `json:"seenBy"`
+}
+
+func newCAQuorum(n int) *caQuorum {
+	return &caQuorum{n: n, pending: map[string]*pendingRootCA{}}
+}
+
+// see records that src advertised ca, and reports how many distinct peers
+// have, and whether that is a quorum. Once it is, ca is no longer pending.
+func (q *caQuorum) see(ca *RootCAPublicKey, src mesh.PeerName) (seen int, ok bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	fp := ca.fingerprint()
+	p, found := q.pending[fp]
+	if !found {
+		p = &pendingRootCA{seenBy: map[mesh.PeerName]struct{}{}}
+		q.pending[fp] = p
+	}
+	p.ca = ca
+	if src != mesh.UnknownPeerName {
+		p.seenBy[src] = struct{}{}
+	}
+	if len(p.seenBy) < q.n {
+		return len(p.seenBy), false
+	}
+	delete(q.pending, fp)
+	return len(p.seenBy), true
+}
+
+// prune forgets pending root CAs that have expired.
+func (q *caQuorum) prune(now time.Time) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	for fp, p := range q.pending {
+		if p.ca.expired(now) {
+			delete(q.pending, fp)
+		}
+	}
+}
+
+func (q *caQuorum) view() []pendingRootCAView {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+	var view []pendingRootCAView
+	for fp, p := range q.pending {
+		v := pendingRootCAView{Fingerprint: fp, SeenBy: []string{}}
+		for name := range p.seenBy {
+			v.SeenBy = append(v.SeenBy, name.String())
+		}
+		sort.Strings(v.SeenBy)
+		view = append(view, v)
+	}
+	sort.Slice(view, func(i, j int) bool { return view[i].Fingerprint < view[j].Fingerprint })
+	return view
+}
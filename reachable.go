@@ -0,0 +1,61 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// dialer is net.DialTimeout, or a stand-in for it.
+type dialer func(network, address string, timeout time.Duration) (net.Conn, error)
+
+// peerReachability is whether a -peer answered a TCP dial.
+type peerReachability struct {
+	Peer string
+	Err  error
+}
+
+// checkPeers dials each of peers, at the mesh port unless they give one,
+// all at once, and reports which answered within timeout, in the order
+// of peers. Mesh retries the rest forever, without a word, so this is
+// the place to find a typo.
+func checkPeers(peers []string, timeout time.Duration, dial dialer) []peerReachability {
+	results := make([]peerReachability, len(peers))
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		addr := peer
+		if _, _, err := net.SplitHostPort(peer); err != nil {
+			addr = net.JoinHostPort(peer, strconv.Itoa(mesh.Port))
+		}
+		wg.Add(1)
+		go func(i int, peer, addr string) {
+			defer wg.Done()
+			results[i].Peer = peer
+			conn, err := dial("tcp", addr, timeout)
+			if err != nil {
+				results[i].Err = err
+				return
+			}
+			conn.Close()
+		}(i, peer, addr)
+	}
+	wg.Wait()
+	return results
+}
+
+// logReachability logs which peers answered, and how many did.
+func logReachability(results []peerReachability, logger *levelLogger) (reachable int) {
+	for _, r := range results {
+		if r.Err != nil {
+			logger.Warnf("Peer %s is not reachable, yet: %v", r.Peer, r.Err)
+			continue
+		}
+		logger.Infof("Peer %s is reachable", r.Peer)
+		reachable++
+	}
+	logger.Infof("%d of %d -peer(s) reachable", reachable, len(results))
+	return reachable
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCheckPeers(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	peers := []string{l.Addr().String(), closed.Addr().String()}
+	results := checkPeers(peers, time.Second, net.DialTimeout)
+	if len(results) != 2 || results[0].Peer != peers[0] || results[0].Err != nil {
+		t.Errorf("want %s reachable, have %+v", peers[0], results)
+	}
+	if len(results) != 2 || results[1].Peer != peers[1] || results[1].Err == nil {
+		t.Errorf("want %s unreachable, have %+v", peers[1], results)
+	}
+	if want, have := 1, logReachability(results, newTextLogger(ioutil.Discard, "", 0)); want != have {
+		t.Errorf("want %d reachable, have %d", want, have)
+	}
+}
+
+func TestCheckPeersDefaultPort(t *testing.T) {
+	var dialed []string
+	results := checkPeers([]string{"seed.example"}, time.Second, func(network, address string, timeout time.Duration) (net.Conn, error) {
+		dialed = append(dialed, address)
+		return nil, errors.New("no route to host")
+	})
+	if want := []string{"seed.example:6783"}; !reflect.DeepEqual(want, dialed) {
+		t.Errorf("want to dial %v, have %v", want, dialed)
+	}
+	if len(results) != 1 || results[0].Peer != "seed.example" || results[0].Err == nil {
+		t.Errorf("want seed.example unreachable, have %+v", results)
+	}
+}
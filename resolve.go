@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// connectionMaker is the part of mesh.ConnectionMaker that peerResolver
+// drives.
+type connectionMaker interface {
+	InitiateConnections(peers []string, replace bool) []error
+	ForgetConnections(peers []string)
+}
+
+// peerResolver keeps us connecting to whatever addresses the -peer
+// hostnames currently resolve to.
+type peerResolver struct {
+	peers  []string
+	lookup func(host string) ([]string, error)
+	cm     connectionMaker
+	logger *levelLogger
+	// addrs is what each of peers last resolved to.
+	addrs map[string][]string
+}
+
+func newPeerResolver(peers []string, cm connectionMaker, logger *levelLogger) *peerResolver {
+	return &peerResolver{
+		peers:  peers,
+		lookup: net.LookupHost,
+		cm:     cm,
+		logger: logger,
+		addrs:  map[string][]string{},
+	}
+}
+
+// resolve looks up each peer, keeping what it last resolved to if the
+// lookup fails, so that a DNS outage doesn't cost us our connections.
+// IP addresses resolve to themselves.
+func (r *peerResolver) resolve() map[string][]string {
+	addrs := map[string][]string{}
+	for _, peer := range r.peers {
+		host, port, err := net.SplitHostPort(peer)
+		if err != nil {
+			host, port = peer, strconv.Itoa(mesh.Port)
+		}
+		if net.ParseIP(host) != nil {
+			addrs[peer] = []string{net.JoinHostPort(host, port)}
+			continue
+		}
+		ips, err := r.lookup(host)
+		if err != nil {
+			r.logger.Warnf("Resolving peer %s: %v", peer, err)
+			addrs[peer] = r.addrs[peer]
+			continue
+		}
+		for _, ip := range ips {
+			addrs[peer] = append(addrs[peer], net.JoinHostPort(ip, port))
+		}
+	}
+	return addrs
+}
+
+// refresh re-resolves the peers, connects to the addresses that are
+// new, and forgets those that are gone. Addresses that haven't changed
+// are left alone, connected or not.
+func (r *peerResolver) refresh() {
+	addrs := r.resolve()
+	added, removed := diffAddrs(flattenAddrs(r.addrs), flattenAddrs(addrs))
+	r.addrs = addrs
+	if len(removed) > 0 {
+		r.logger.Infof("Forgetting peer address(es) %v", removed)
+		r.cm.ForgetConnections(removed)
+	}
+	if len(added) > 0 {
+		r.logger.Infof("Connecting to peer address(es) %v", added)
+		r.cm.InitiateConnections(added, false)
+	}
+}
+
+// loop refreshes every interval until quit is closed.
+func (r *peerResolver) loop(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			r.refresh()
+		case <-quit:
+			return
+		}
+	}
+}
+
+func flattenAddrs(addrs map[string][]string) map[string]bool {
+	flat := map[string]bool{}
+	for _, as := range addrs {
+		for _, a := range as {
+			flat[a] = true
+		}
+	}
+	return flat
+}
+
+// diffAddrs returns the addresses in now but not before, and vice versa.
+func diffAddrs(before, now map[string]bool) (added, removed []string) {
+	for a := range now {
+		if !before[a] {
+			added = append(added, a)
+		}
+	}
+	for a := range before {
+		if !now[a] {
+			removed = append(removed, a)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
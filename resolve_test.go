@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+type fakeConnectionMaker struct {
+	initiated, forgotten [][]string
+}
+
+func (cm *fakeConnectionMaker) InitiateConnections(peers []string, replace bool) []error {
+	cm.initiated = append(cm.initiated, peers)
+	return nil
+}
+
+func (cm *fakeConnectionMaker) ForgetConnections(peers []string) {
+	cm.forgotten = append(cm.forgotten, peers)
+}
+
+func TestPeerResolverRefresh(t *testing.T) {
+	cm := &fakeConnectionMaker{}
+	r := newPeerResolver([]string{"seeds.example:6783", "10.0.0.9:6783", "other.example"}, cm, newTextLogger(ioutil.Discard, "", 0))
+	answers := map[string][]string{
+		"seeds.example": {"10.0.0.1", "10.0.0.2"},
+		"other.example": {"10.0.0.3"},
+	}
+	r.lookup = func(host string) ([]string, error) {
+		if ips, ok := answers[host]; ok {
+			return ips, nil
+		}
+		return nil, errors.New("no such host")
+	}
+
+	r.refresh()
+	want := [][]string{{"10.0.0.1:6783", "10.0.0.2:6783", "10.0.0.3:6783", "10.0.0.9:6783"}}
+	if !reflect.DeepEqual(want, cm.initiated) || cm.forgotten != nil {
+		t.Fatalf("want %v initiated, have %v initiated and %v forgotten", want, cm.initiated, cm.forgotten)
+	}
+
+	// Nothing changed, so nothing's reconnected.
+	r.refresh()
+	if len(cm.initiated) != 1 || cm.forgotten != nil {
+		t.Errorf("unchanged: have %v initiated and %v forgotten", cm.initiated, cm.forgotten)
+	}
+
+	// A failed lookup keeps the addresses we had.
+	delete(answers, "other.example")
+	r.refresh()
+	if len(cm.initiated) != 1 || cm.forgotten != nil {
+		t.Errorf("failed lookup: have %v initiated and %v forgotten", cm.initiated, cm.forgotten)
+	}
+
+	answers["seeds.example"] = []string{"10.0.0.2", "10.0.0.4"}
+	r.refresh()
+	if want := [][]string{{"10.0.0.1:6783"}}; !reflect.DeepEqual(want, cm.forgotten) {
+		t.Errorf("want %v forgotten, have %v", want, cm.forgotten)
+	}
+	if want := []string{"10.0.0.4:6783"}; len(cm.initiated) != 2 || !reflect.DeepEqual(want, cm.initiated[1]) {
+		t.Errorf("want %v initiated, have %v", want, cm.initiated)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/weaveworks/mesh"
+)
+
+var connectionFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "kubelet_mesh",
+	Name:      "connection_failures_total",
+	Help:      "Failed attempts to connect to mesh targets, as polled from mesh.",
+}, []string{"target"})
+
+func init() {
+	prometheus.MustRegister(connectionFailures)
+}
+
+// connRetries counts the failed attempts to connect to each target,
+// since we were last connected to it. Mesh backs off and retries
+// failed targets forever, but only shows the last error, and when it
+// will retry; so we count each failure that polls of its status turn up.
+type connRetries struct {
+	mtx     sync.Mutex
+	targets map[string]*connRetry // by address
+}
+
+type connRetry struct {
+	failures int
+	lastErr  string
+	failedAt time.Time
+	retry    string
+	// info is that of the failure we last counted, as mesh only
+	// changes it on the next one.
+	info string
+}
+
+// connRetryView is a target we're failing to connect to, for operators.
+type connRetryView struct {
+	Target    string    `json:"target"`
+	Failures  int       `json:"failedAttempts"`
+	LastError string    `json:"lastError"`
+	FailedAt  time.Time `json:"lastFailure"`
+	NextRetry string    `json:"nextRetry,omitempty"`
+}
+
+func (v connRetryView) String() string {
+	return fmt.Sprintf("%s: %d failed attempt(s), last error %s", v.Target, v.Failures, v.LastError)
+}
+
+func newConnRetries() *connRetries {
+	return &connRetries{targets: map[string]*connRetry{}}
+}
+
+// observe takes in a poll of our mesh connections at now. A target
+// that mesh shows as failed, with an error and retry time we haven't
+// seen, failed again; one that's established starts again from none,
+// and one that's gone, connected under another address or forgotten,
+// is forgotten here too.
+func (r *connRetries) observe(conns []mesh.LocalConnectionStatus, now time.Time) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	seen := map[string]bool{}
+	for _, c := range conns {
+		if !c.Outbound {
+			continue
+		}
+		seen[c.Address] = true
+		t, ok := r.targets[c.Address]
+		switch {
+		case c.State == "established":
+			delete(r.targets, c.Address)
+		case c.State != "failed":
+		case !ok:
+			t = &connRetry{}
+			r.targets[c.Address] = t
+			fallthrough
+		case t.info != c.Info:
+			t.failures++
+			t.info, t.failedAt = c.Info, now
+			t.lastErr, t.retry = c.Info, ""
+			if i := strings.LastIndex(c.Info, ", retry: "); i >= 0 {
+				t.lastErr, t.retry = c.Info[:i], c.Info[i+len(", retry: "):]
+			}
+			connectionFailures.WithLabelValues(c.Address).Inc()
+		}
+	}
+	for addr := range r.targets {
+		if !seen[addr] {
+			delete(r.targets, addr)
+		}
+	}
+}
+
+// view is the targets with failures, by address.
+func (r *connRetries) view() []connRetryView {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	var views []connRetryView
+	for addr, t := range r.targets {
+		views = append(views, connRetryView{Target: addr, Failures: t.failures, LastError: t.lastErr, FailedAt: t.failedAt, NextRetry: t.retry})
+	}
+	sort.Slice(views, func(i, j int) bool { return views[i].Target < views[j].Target })
+	return views
+}
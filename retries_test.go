@@ -0,0 +1,60 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+func TestConnRetries(t *testing.T) {
+	t0 := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	failed := func(addr, info string) mesh.LocalConnectionStatus {
+		return mesh.LocalConnectionStatus{Address: addr, Outbound: true, State: "failed", Info: info}
+	}
+	connecting := mesh.LocalConnectionStatus{Address: "10.0.0.2:6783", Outbound: true, State: "retrying", Info: "dial tcp 10.0.0.2:6783: connection refused"}
+	established := mesh.LocalConnectionStatus{Address: "10.0.0.2:6783", Outbound: true, State: "established"}
+	inbound := mesh.LocalConnectionStatus{Address: "10.0.0.3:41234", State: "failed", Info: "whatever"}
+	refused := func(retry string) mesh.LocalConnectionStatus {
+		return failed("10.0.0.2:6783", "dial tcp 10.0.0.2:6783: connection refused, retry: "+retry)
+	}
+
+	r := newConnRetries()
+	for i, step := range []struct {
+		conns []mesh.LocalConnectionStatus
+		want  []connRetryView
+	}{
+		{[]mesh.LocalConnectionStatus{refused("t1"), inbound}, []connRetryView{
+			{Target: "10.0.0.2:6783", Failures: 1, LastError: "dial tcp 10.0.0.2:6783: connection refused", FailedAt: t0, NextRetry: "t1"},
+		}},
+		// Polled again before the retry: the same failure.
+		{[]mesh.LocalConnectionStatus{refused("t1")}, []connRetryView{
+			{Target: "10.0.0.2:6783", Failures: 1, LastError: "dial tcp 10.0.0.2:6783: connection refused", FailedAt: t0, NextRetry: "t1"},
+		}},
+		{[]mesh.LocalConnectionStatus{connecting}, []connRetryView{
+			{Target: "10.0.0.2:6783", Failures: 1, LastError: "dial tcp 10.0.0.2:6783: connection refused", FailedAt: t0, NextRetry: "t1"},
+		}},
+		{[]mesh.LocalConnectionStatus{refused("t3"), failed("10.0.0.4:6783", "no route to host")}, []connRetryView{
+			{Target: "10.0.0.2:6783", Failures: 2, LastError: "dial tcp 10.0.0.2:6783: connection refused", FailedAt: t0.Add(3 * time.Second), NextRetry: "t3"},
+			{Target: "10.0.0.4:6783", Failures: 1, LastError: "no route to host", FailedAt: t0.Add(3 * time.Second)},
+		}},
+		// Connected, and forgotten.
+		{[]mesh.LocalConnectionStatus{established}, nil},
+		{[]mesh.LocalConnectionStatus{refused("t5")}, []connRetryView{
+			{Target: "10.0.0.2:6783", Failures: 1, LastError: "dial tcp 10.0.0.2:6783: connection refused", FailedAt: t0.Add(5 * time.Second), NextRetry: "t5"},
+		}},
+	} {
+		r.observe(step.conns, t0.Add(time.Duration(i)*time.Second))
+		if have := r.view(); !reflect.DeepEqual(step.want, have) {
+			t.Errorf("step %d: want %+v, have %+v", i, step.want, have)
+		}
+	}
+}
+
+func TestConnRetryViewString(t *testing.T) {
+	v := connRetryView{Target: "10.0.0.2:6783", Failures: 12, LastError: "connection refused"}
+	if want, have := "10.0.0.2:6783: 12 failed attempt(s), last error connection refused", v.String(); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
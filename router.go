@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+
+	"github.com/weaveworks/mesh"
+)
+
+// peerConfig is what newPeerRouter needs to build a mesh router and our
+// peer on it.
+type peerConfig struct {
+	mesh       mesh.Config
+	name       mesh.PeerName
+	nickname   string
+	certs      []*RootCAPublicKey
+	apiservers []string
+	opts       peerOptions
+	logger     *levelLogger
+}
+
+// newPeerRouter builds a mesh router, and our peer gossiping its
+// channels on it. Neither is started: the caller seeds the peer,
+// registers any other channels, and starts the router.
+func newPeerRouter(cfg peerConfig) (*mesh.Router, *peer, error) {
+	if cfg.name == mesh.UnknownPeerName {
+		return nil, nil, errors.New("no peer name")
+	}
+	if cfg.mesh.Port < 0 || cfg.mesh.Port > 65535 {
+		return nil, nil, fmt.Errorf("mesh port %d out of range", cfg.mesh.Port)
+	}
+	if cfg.logger == nil {
+		cfg.logger = newTextLogger(ioutil.Discard, "", 0)
+	}
+	router := mesh.NewRouter(cfg.mesh, cfg.name, cfg.nickname, mesh.NullOverlay{}, log.New(ioutil.Discard, "", 0))
+	p := newNodeBootstrapPeer(cfg.name, cfg.nickname, cfg.certs, cfg.apiservers, cfg.opts, cfg.logger)
+	p.register(router.NewGossip(p.channels[0].name, p))
+	for _, ch := range p.channels[1:] {
+		p.registerOn(ch, router.NewGossip(ch.name, channelGossiper{p: p, ch: ch}))
+	}
+	return router, p, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	sealSaltSize = 16
+	// sealIterations makes guessing the password from captured gossip
+	// expensive. We derive the key just once, at startup.
+	sealIterations = 100000
+)
+
+// errUndecryptable is what open returns for a payload sealed with
+// another password or salt, or tampered with.
+var errUndecryptable = errors.New("decrypting payload failed; is the sender's -password or -password-salt different?")
+
+// sealer encrypts and authenticates the gossip payload of one channel
+// with AES-GCM, under the cluster's key: derived with PBKDF2 from the
+// mesh password and the cluster's salt, which every peer shares, and
+// sends in the clear with every message. So each peer derives one key,
+// and none can make another derive more.
+type sealer struct {
+	channel string // authenticated with every payload
+	*sealKeys
+}
+
+// sealKeys is the key of a sealer, which it shares with those for the
+// other channels.
+type sealKeys struct {
+	salt []byte
+	aead cipher.AEAD
+}
+
+// newSealer is a sealer for nodeBootstrapChannel, with the key from
+// password and clusterSalt; forChannel makes one for the others.
+func newSealer(password, clusterSalt []byte) (*sealer, error) {
+	sum := sha256.Sum256(clusterSalt)
+	salt := sum[:sealSaltSize]
+	aead, err := deriveAEAD(password, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &sealer{channel: nodeBootstrapChannel, sealKeys: &sealKeys{salt: salt, aead: aead}}, nil
+}
+
+// forChannel is s for the channel name, with the same keys; nil if s is.
+func (s *sealer) forChannel(name string) *sealer {
+	if s == nil {
+		return nil
+	}
+	return &sealer{channel: name, sealKeys: s.sealKeys}
+}
+
+func deriveAEAD(password, salt []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(pbkdf2.Key(password, salt, sealIterations, 32, sha256.New))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal returns salt || nonce || ciphertext. The channel name is
+// authenticated too, so a payload can't be replayed on another channel.
+func (s *sealer) seal(plaintext []byte) []byte {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err) // as Encode panics when it can't encode
+	}
+	out := append(append([]byte{}, s.salt...), nonce...)
+	return s.aead.Seal(out, nonce, plaintext, []byte(s.channel))
+}
+
+// open reverses seal, failing unless the sender had our password and salt.
+func (s *sealer) open(buf []byte) ([]byte, error) {
+	if len(buf) < sealSaltSize+s.aead.NonceSize() {
+		return nil, errors.New("encrypted payload too short")
+	}
+	salt, buf := buf[:sealSaltSize], buf[sealSaltSize:]
+	if !bytes.Equal(salt, s.salt) {
+		return nil, errUndecryptable
+	}
+	nonce, buf := buf[:s.aead.NonceSize()], buf[s.aead.NonceSize():]
+	plaintext, err := s.aead.Open(nil, nonce, buf, []byte(s.channel))
+	if err != nil {
+		return nil, errUndecryptable
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealer(t *testing.T) {
+	alice, err := newSealer([]byte("secret"), []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := newSealer([]byte("secret"), []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mallory, err := newSealer([]byte("guess"), []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCluster, err := newSealer([]byte("secret"), []byte("other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte("bootstrap state")
+	sealed := alice.seal(plaintext)
+	if bytes.Contains(sealed, plaintext) {
+		t.Errorf("plaintext visible in %q", sealed)
+	}
+	tampered := append([]byte{}, sealed...)
+	tampered[len(tampered)-1] ^= 1
+
+	for _, testcase := range []struct {
+		name string
+		s    *sealer
+		buf  []byte
+		ok   bool
+	}{
+		{"self", alice, sealed, true},
+		{"same password", bob, sealed, true},
+		{"wrong password", mallory, sealed, false},
+		{"another cluster's salt", otherCluster, sealed, false},
+		{"tampered", bob, tampered, false},
+		{"truncated", bob, sealed[:sealSaltSize+1], false},
+		{"plaintext", bob, plaintext, false},
+		{"another channel", bob.forChannel(nodeBootstrapChannelV1), sealed, false},
+	} {
+		have, err := testcase.s.open(testcase.buf)
+		if testcase.ok != (err == nil) {
+			t.Errorf("%s: want ok=%v, have %v", testcase.name, testcase.ok, err)
+		} else if testcase.ok && !bytes.Equal(plaintext, have) {
+			t.Errorf("%s: want %q, have %q", testcase.name, plaintext, have)
+		}
+	}
+
+	// The same keys, for v1.
+	v1 := alice.forChannel(nodeBootstrapChannelV1)
+	if have, err := bob.forChannel(nodeBootstrapChannelV1).open(v1.seal(plaintext)); err != nil || !bytes.Equal(plaintext, have) {
+		t.Errorf("v1: want %q, have %q, %v", plaintext, have, err)
+	}
+	if _, err := bob.open(v1.seal(plaintext)); err == nil {
+		t.Error("v1 on v0: want an error")
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir is where Kubernetes mounts a pod's service account
+// token and the cluster CA.
+var serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// errSecretNotFound is returned by kubeClient.secret for a Secret, or
+// Secret key, that does not exist.
+var errSecretNotFound = errors.New("not found")
+
+// kubeClient is just enough of a Kubernetes API client to read a Secret,
+// so that -ca-from-secret doesn't need client-go.
+type kubeClient struct {
+	server string
+	token  string
+	client *http.Client
+}
+
+// inClusterKubeClient talks to the apiserver of the cluster we are
+// running in, as the pod's service account.
+func inClusterKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a cluster (no $KUBERNETES_SERVICE_HOST); use -kubeconfig")
+	}
+	token, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("%s: no PEM certificates found", filepath.Join(serviceAccountDir, "ca.crt"))
+	}
+	return &kubeClient{
+		server: "https://" + net.JoinHostPort(host, port),
+		token:  strings.TrimSpace(string(token)),
+		client: newKubeHTTPClient(&tls.Config{RootCAs: pool}),
+	}, nil
+}
+
+// kubeconfigFile is the part of a kubeconfig we understand.
+type kubeconfigFile struct {
+	CurrentContext string `json:"current-context"`
+	Contexts       []struct {
+		Name    string `json:"name"`
+		Context struct {
+			Cluster string `json:"cluster"`
+			User    string `json:"user"`
+		} `json:"context"`
+	} `json:"contexts"`
+	Clusters []struct {
+		Name    string `json:"name"`
+		Cluster struct {
+			Server    string `json:"server"`
+			CAData    []byte `json:"certificate-authority-data"`
+			CAFile    string `json:"certificate-authority"`
+			SkipCheck bool   `json:"insecure-skip-tls-verify"`
+		} `json:"cluster"`
+	} `json:"clusters"`
+	Users []struct {
+		Name string `json:"name"`
+		User struct {
+			Token     string `json:"token"`
+			TokenFile string `json:"tokenFile"`
+			CertData  []byte `json:"client-certificate-data"`
+			CertFile  string `json:"client-certificate"`
+			KeyData   []byte `json:"client-key-data"`
+			KeyFile   string `json:"client-key"`
+		} `json:"user"`
+	} `json:"users"`
+}
+
+// kubeconfigKubeClient talks to the apiserver of the current context of
+// the kubeconfig at path. Only JSON kubeconfigs are read, as we have no
+// YAML parser; kubectl config view --raw --minify -o json converts one.
+// Relative file names in it are relative to path, as for kubectl.
+func kubeconfigKubeClient(path string) (*kubeClient, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config kubeconfigFile
+	if err := json.Unmarshal(buf, &config); err != nil {
+		return nil, fmt.Errorf("%s: %v (only JSON kubeconfigs are supported: convert with kubectl config view --raw --minify -o json)", path, err)
+	}
+	var clusterName, userName string
+	found := false
+	for _, c := range config.Contexts {
+		if c.Name == config.CurrentContext {
+			clusterName, userName, found = c.Context.Cluster, c.Context.User, true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("%s: no context %q", path, config.CurrentContext)
+	}
+	resolve := func(name string) string {
+		if name == "" || filepath.IsAbs(name) {
+			return name
+		}
+		return filepath.Join(filepath.Dir(path), name)
+	}
+	readFile := func(data []byte, name string) ([]byte, error) {
+		if len(data) > 0 || name == "" {
+			return data, nil
+		}
+		return ioutil.ReadFile(resolve(name))
+	}
+
+	c := &kubeClient{}
+	tlsConfig := &tls.Config{}
+	found = false
+	for _, cluster := range config.Clusters {
+		if cluster.Name != clusterName {
+			continue
+		}
+		found = true
+		c.server = strings.TrimSuffix(cluster.Cluster.Server, "/")
+		tlsConfig.InsecureSkipVerify = cluster.Cluster.SkipCheck
+		ca, err := readFile(cluster.Cluster.CAData, cluster.Cluster.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: cluster %s: %v", path, clusterName, err)
+		}
+		if len(ca) > 0 {
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+				return nil, fmt.Errorf("%s: cluster %s: no PEM certificates found", path, clusterName)
+			}
+		}
+	}
+	if !found || c.server == "" {
+		return nil, fmt.Errorf("%s: no server for cluster %q", path, clusterName)
+	}
+	for _, user := range config.Users {
+		if user.Name != userName {
+			continue
+		}
+		c.token = user.User.Token
+		if c.token == "" && user.User.TokenFile != "" {
+			token, err := ioutil.ReadFile(resolve(user.User.TokenFile))
+			if err != nil {
+				return nil, fmt.Errorf("%s: user %s: %v", path, userName, err)
+			}
+			c.token = strings.TrimSpace(string(token))
+		}
+		cert, err := readFile(user.User.CertData, user.User.CertFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: user %s: %v", path, userName, err)
+		}
+		key, err := readFile(user.User.KeyData, user.User.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: user %s: %v", path, userName, err)
+		}
+		if len(cert) > 0 || len(key) > 0 {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, fmt.Errorf("%s: user %s: %v", path, userName, err)
+			}
+			tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+	}
+	c.client = newKubeHTTPClient(tlsConfig)
+	return c, nil
+}
+
+func newKubeHTTPClient(tlsConfig *tls.Config) *http.Client {
+	return &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig},
+	}
+}
+
+// secret reads the data of the Secret namespace/name.
+func (c *kubeClient) secret(namespace, name string) (map[string][]byte, error) {
+	req, err := http.NewRequest("GET", c.server+"/api/v1/namespaces/"+url.PathEscape(namespace)+"/secrets/"+url.PathEscape(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errSecretNotFound
+	default:
+		return nil, fmt.Errorf("GET %s: %s", req.URL.Path, resp.Status)
+	}
+	var secret struct {
+		Data map[string][]byte `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return nil, fmt.Errorf("GET %s: %v", req.URL.Path, err)
+	}
+	return secret.Data, nil
+}
+
+// parseSecretRef splits a -ca-from-secret namespace/name.
+func parseSecretRef(ref string) (namespace, name string, err error) {
+	i := strings.Index(ref, "/")
+	if i <= 0 || i == len(ref)-1 || strings.Count(ref, "/") != 1 {
+		return "", "", fmt.Errorf("%q: want namespace/name", ref)
+	}
+	return ref[:i], ref[i+1:], nil
+}
+
+// readRootCASecret reads the root CAs from the ca.crt key of the Secret
+// namespace/name, and checks them as readRootCAs does. A missing Secret,
+// or one without a ca.crt, is errSecretNotFound.
+func readRootCASecret(c *kubeClient, namespace, name string, opts peerOptions, logger *levelLogger) ([]*x509.Certificate, error) {
+	data, err := c.secret(namespace, name)
+	if err != nil {
+		return nil, err
+	}
+	buf, ok := data["ca.crt"]
+	if !ok {
+		return nil, errSecretNotFound
+	}
+	source := "secret " + namespace + "/" + name
+	cas, err := parseRootCAs(buf, source, logger)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkRootCAs(cas, source, time.Now(), opts); err != nil {
+		return nil, err
+	}
+	return cas, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSecretRef(t *testing.T) {
+	for _, testcase := range []struct {
+		ref             string
+		namespace, name string
+		ok              bool
+	}{
+		{"kube-system/cluster-ca", "kube-system", "cluster-ca", true},
+		{"cluster-ca", "", "", false},
+		{"/cluster-ca", "", "", false},
+		{"kube-system/", "", "", false},
+		{"a/b/c", "", "", false},
+	} {
+		namespace, name, err := parseSecretRef(testcase.ref)
+		if testcase.ok != (err == nil) || namespace != testcase.namespace || name != testcase.name {
+			t.Errorf("%q: want %q, %q (ok %v), have %q, %q, %v", testcase.ref, testcase.namespace, testcase.name, testcase.ok, namespace, name, err)
+		}
+	}
+}
+
+func TestReadRootCASecret(t *testing.T) {
+	ca := newTestCert(t, testCATemplate)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		data := map[string][]byte{}
+		switch r.URL.Path {
+		case "/api/v1/namespaces/kube-system/secrets/cluster-ca":
+			data["ca.crt"] = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+		case "/api/v1/namespaces/kube-system/secrets/no-ca":
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"kind": "Secret", "data": data})
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "kubelet-mesh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "token"), []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	kubeconfig := map[string]interface{}{
+		"current-context": "test",
+		"contexts": []interface{}{map[string]interface{}{
+			"name": "test", "context": map[string]string{"cluster": "c", "user": "u"},
+		}},
+		"clusters": []interface{}{map[string]interface{}{
+			"name": "c", "cluster": map[string]interface{}{
+				"server":                     server.URL,
+				"certificate-authority-data": pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}),
+			},
+		}},
+		"users": []interface{}{map[string]interface{}{
+			"name": "u", "user": map[string]string{"tokenFile": "token"},
+		}},
+	}
+	buf, _ := json.Marshal(kubeconfig)
+	path := filepath.Join(dir, "kubeconfig")
+	if err := ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatal(err)
+	}
+	client, err := kubeconfigKubeClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := newTextLogger(ioutil.Discard, "", 0)
+	opts := peerOptions{skipCAValidation: true}
+	cas, err := readRootCASecret(client, "kube-system", "cluster-ca", opts, logger)
+	if err != nil || len(cas) != 1 || !cas[0].Equal(ca) {
+		t.Errorf("cluster-ca: want %s, have %v, %v", ca.Subject.CommonName, cas, err)
+	}
+	for _, name := range []string{"missing", "no-ca"} {
+		if _, err := readRootCASecret(client, "kube-system", name, opts, logger); err != errSecretNotFound {
+			t.Errorf("%s: want %v, have %v", name, errSecretNotFound, err)
+		}
+	}
+	client.token = "wrong"
+	if _, err := readRootCASecret(client, "kube-system", "cluster-ca", opts, logger); err == nil || err == errSecretNotFound {
+		t.Errorf("wrong token: want an error, have %v", err)
+	}
+}
+
+func TestKubeconfigKubeClientWantsJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet-mesh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "kubeconfig")
+	if err := ioutil.WriteFile(path, []byte("apiVersion: v1\nkind: Config\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := kubeconfigKubeClient(path); err == nil {
+		t.Error("YAML kubeconfig: want an error")
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// Attestation is a seed's signed statement of the apiserver URLs it
+// gossips, made with the private key of one of its root CAs. Receivers
+// that pin that root CA can then tell the URLs weren't made up by some
+// other peer that managed to join the mesh.
+type Attestation struct {
+	Origin        mesh.PeerName
+	RootCA        []byte // DER of the root CA whose key signed
+	ApiserverURLs []string
+	Signed        time.Time
+	Signature     []byte
+}
+
+func (a *Attestation) String() string {
+	return fmt.Sprintf("attestation by %s of %v at %v", a.Origin, a.ApiserverURLs, a.Signed)
+}
+
+// payload is what gets signed: everything but the signature,
+// in a form that doesn't depend on how it was encoded on the way.
+func (a *Attestation) payload() []byte {
+	var buf bytes.Buffer
+	sum := sha256.Sum256(a.RootCA)
+	fmt.Fprintf(&buf, "kubelet-mesh attestation v1\n%s\n%x\n%d\n", a.Origin, sum, a.Signed.UnixNano())
+	urls := append([]string{}, a.ApiserverURLs...)
+	sort.Strings(urls)
+	buf.WriteString(strings.Join(urls, "\n"))
+	return buf.Bytes()
+}
+
+// loadRootCAKey reads a PEM private key, in PKCS#1, SEC 1 or PKCS#8 form.
+func loadRootCAKey(path string) (crypto.Signer, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, buf = pem.Decode(buf)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM private key found", path)
+		}
+		var key interface{}
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key, err = x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("%s: unsupported private key type %T", path, key)
+		}
+		return signer, nil
+	}
+}
+
+// certForKey finds the certificate in certs for key.
+func certForKey(certs []*x509.Certificate, key crypto.Signer) (*x509.Certificate, error) {
+	for _, cert := range certs {
+		if pub, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); ok && pub.Equal(key.Public()) {
+			return cert, nil
+		}
+	}
+	return nil, errors.New("the key doesn't belong to any of the root CAs")
+}
+
+// signatureAlgorithm is how we sign with, and verify against, pub.
+func signatureAlgorithm(pub crypto.PublicKey) (x509.SignatureAlgorithm, crypto.Hash, error) {
+	switch pub.(type) {
+	case *ecdsa.PublicKey:
+		return x509.ECDSAWithSHA256, crypto.SHA256, nil
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA, crypto.SHA256, nil
+	case ed25519.PublicKey:
+		return x509.PureEd25519, crypto.Hash(0), nil
+	}
+	return x509.UnknownSignatureAlgorithm, 0, fmt.Errorf("unsupported public key type %T", pub)
+}
+
+// signAttestation attests to urls as origin, with the key of ca.
+func signAttestation(key crypto.Signer, ca *x509.Certificate, origin mesh.PeerName, urls []string, now time.Time) (*Attestation, error) {
+	_, hash, err := signatureAlgorithm(key.Public())
+	if err != nil {
+		return nil, err
+	}
+	a := &Attestation{
+		Origin:        origin,
+		RootCA:        ca.Raw,
+		ApiserverURLs: normalizeAPIServerURLs(urls),
+		Signed:        now,
+	}
+	digest := a.payload()
+	if hash != 0 {
+		h := hash.New()
+		h.Write(digest)
+		digest = h.Sum(nil)
+	}
+	if a.Signature, err = key.Sign(rand.Reader, digest, hash); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// verifyAttestation checks that a was signed by the key of its root CA,
+// and that pinned accepts that root CA's public key hash.
+func verifyAttestation(a *Attestation, pinned func(hash string) bool) error {
+	cert, err := x509.ParseCertificate(a.RootCA)
+	if err != nil {
+		return err
+	}
+	if hash := spkiHash(cert); !pinned(hash) {
+		return fmt.Errorf("signed by root CA with public key hash %s, which isn't pinned", hash)
+	}
+	algo, _, err := signatureAlgorithm(cert.PublicKey)
+	if err != nil {
+		return err
+	}
+	if err := cert.CheckSignature(algo, a.payload(), a.Signature); err != nil {
+		return fmt.Errorf("bad signature: %v", err)
+	}
+	return nil
+}
+
+// mergeAttestations keeps the latest attestation from each origin.
+func mergeAttestations(ours, theirs []*Attestation) (result, delta []*Attestation) {
+	all := append(append([]*Attestation(nil), ours...), theirs...)
+	keep, changed := mergeKeyed(len(ours), len(theirs),
+		func(i int) string { return all[i].Origin.String() },
+		func(i, j int) bool { return preferAttestation(all[i], all[j]) })
+	for _, i := range keep {
+		result = append(result, all[i])
+	}
+	for _, i := range changed {
+		delta = append(delta, all[i])
+	}
+	sortAttestations(result)
+	sortAttestations(delta)
+	return result, delta
+}
+
+func preferAttestation(a, b *Attestation) bool {
+	if !a.Signed.Equal(b.Signed) {
+		return a.Signed.After(b.Signed)
+	}
+	return bytes.Compare(a.Signature, b.Signature) > 0
+}
+
+func sortAttestations(as []*Attestation) {
+	sort.Slice(as, func(i, j int) bool { return as[i].Origin < as[j].Origin })
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifyAttestation(t *testing.T) {
+	cert, key := newTestCertSignedBy(t, testCATemplate, nil, nil)
+	other, _ := newTestCertSignedBy(t, testCATemplate, nil, nil)
+	pinned := func(hash string) bool { return hash == spkiHash(cert) }
+
+	sign := func() *Attestation {
+		a, err := signAttestation(key, cert, 1, []string{"https://b:6443/", "https://a:6443"}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return a
+	}
+	for _, testcase := range []struct {
+		name   string
+		tamper func(*Attestation)
+		ok     bool
+	}{
+		{"valid", func(*Attestation) {}, true},
+		{"URL added", func(a *Attestation) { a.ApiserverURLs = append(a.ApiserverURLs, "https://evil:6443") }, false},
+		{"origin changed", func(a *Attestation) { a.Origin = 2 }, false},
+		{"replayed later", func(a *Attestation) { a.Signed = a.Signed.Add(time.Hour) }, false},
+		{"unpinned root CA", func(a *Attestation) { a.RootCA = other.Raw }, false},
+		{"unsigned", func(a *Attestation) { a.Signature = nil }, false},
+	} {
+		a := sign()
+		testcase.tamper(a)
+		if want, have := testcase.ok, verifyAttestation(a, pinned); want != (have == nil) {
+			t.Errorf("%s: want ok=%v, have %v", testcase.name, want, have)
+		}
+	}
+}
+
+func TestLoadRootCAKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet-mesh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert, key := newTestCertSignedBy(t, testCATemplate, nil, nil)
+	sec1, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range map[string][]byte{
+		"sec1":  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}),
+		"pkcs8": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}),
+		"none":  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+		signer, err := loadRootCAKey(path)
+		if name == "none" {
+			if err == nil {
+				t.Errorf("%s: want error", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if have, err := certForKey([]*x509.Certificate{cert}, signer); err != nil || have != cert {
+			t.Errorf("%s: want %v, have %v (%v)", name, cert.Subject, have, err)
+		}
+	}
+}
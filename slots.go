@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// clusterSlot is the name of the cluster CA in -ca and -ca-slot-out.
+// Its certificates are ClusterInfo.RootCAs, with rotation, conflict
+// resolution and pinning; the CAs of other slots, such as front-proxy
+// or etcd, are ClusterInfo.CASlots, and simply merge by fingerprint.
+const clusterSlot = "cluster"
+
+var slotNameRE = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// slotPaths is a flag.Value for repeated name=path flags.
+type slotPaths map[string][]string
+
+func (sp slotPaths) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i < 0 {
+		return fmt.Errorf("%q: must be of the form name=path", value)
+	}
+	name, path := value[:i], value[i+1:]
+	if !slotNameRE.MatchString(name) {
+		return fmt.Errorf("%q: slot names are lower case letters, digits and dashes", name)
+	}
+	if path == "" {
+		return fmt.Errorf("%q: no path", value)
+	}
+	sp[name] = append(sp[name], path)
+	return nil
+}
+
+func (sp slotPaths) String() string {
+	var s []string
+	for _, name := range sp.names() {
+		for _, path := range sp[name] {
+			s = append(s, name+"="+path)
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+func (sp slotPaths) names() []string {
+	names := make([]string, 0, len(sp))
+	for name := range sp {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mergeCASlots merges each slot independently. Slots we don't know
+// anything about are kept like any other, so we pass them on.
+func mergeCASlots(ours, theirs map[string][]*RootCAPublicKey) (result, delta map[string][]*RootCAPublicKey) {
+	for name, cas := range ours {
+		r, _ := mergeRootCAs(nil, cas)
+		result = setCASlot(result, name, r)
+	}
+	for name, cas := range theirs {
+		r, d := mergeRootCAs(result[name], cas)
+		result = setCASlot(result, name, r)
+		delta = setCASlot(delta, name, d)
+	}
+	return result, delta
+}
+
+// setCASlot sets slot name of slots to cas, allocating slots if need be,
+// and leaving empty slots out.
+func setCASlot(slots map[string][]*RootCAPublicKey, name string, cas []*RootCAPublicKey) map[string][]*RootCAPublicKey {
+	if len(cas) == 0 {
+		return slots
+	}
+	if slots == nil {
+		slots = map[string][]*RootCAPublicKey{}
+	}
+	slots[name] = cas
+	return slots
+}
+
+// filterCASlots returns a copy of slots with just the CAs keep accepts.
+func filterCASlots(slots map[string][]*RootCAPublicKey, keep func(slot string, ca *RootCAPublicKey) bool) (result map[string][]*RootCAPublicKey) {
+	for name, cas := range slots {
+		var kept []*RootCAPublicKey
+		for _, ca := range cas {
+			if keep(name, ca) {
+				kept = append(kept, ca)
+			}
+		}
+		result = setCASlot(result, name, kept)
+	}
+	return result
+}
+
+// caSlotsUnexpired keeps, for filterCASlots, CAs that haven't expired,
+// or all of them if allowExpired.
+func caSlotsUnexpired(now time.Time, allowExpired bool) func(string, *RootCAPublicKey) bool {
+	return func(slot string, ca *RootCAPublicKey) bool {
+		if ca.expired(now) && !allowExpired {
+			logger.Infof("Discarding %s CA %s which expired at %v", slot, ca.fingerprint(), ca.NotAfter)
+			return false
+		}
+		return true
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSlotPathsSet(t *testing.T) {
+	for _, testcase := range []struct {
+		value string
+		ok    bool
+	}{
+		{"cluster=/etc/kubernetes/pki/ca.crt", true},
+		{"front-proxy=/etc/kubernetes/pki/front-proxy-ca.crt", true},
+		{"etcd=a=b", true},
+		{"/etc/kubernetes/pki/ca.crt", false},
+		{"Front-Proxy=/x", false},
+		{"-etcd=/x", false},
+		{"etcd=", false},
+	} {
+		if want, have := testcase.ok, (slotPaths{}).Set(testcase.value); want != (have == nil) {
+			t.Errorf("%q: want ok=%v, have %v", testcase.value, want, have)
+		}
+	}
+	sp := slotPaths{}
+	sp.Set("etcd=a=b")
+	sp.Set("etcd=c")
+	if want, have := []string{"a=b", "c"}, sp["etcd"]; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestMergeCASlots(t *testing.T) {
+	type slots = map[string][]*RootCAPublicKey
+	for _, testcase := range []struct {
+		ours, theirs  slots
+		result, delta slots
+	}{
+		{nil, nil, nil, nil},
+		{
+			slots{"front-proxy": {caA}},
+			slots{"etcd": {caA}},
+			slots{"front-proxy": {caA}, "etcd": {caA}},
+			slots{"etcd": {caA}},
+		},
+		{
+			slots{"front-proxy": {caA}},
+			slots{"front-proxy": {caB, caA}},
+			slots{"front-proxy": {caA, caB}},
+			slots{"front-proxy": {caB}},
+		},
+		{
+			slots{"front-proxy": {caA}},
+			slots{"front-proxy": {caA}, "some-future-slot": {caC}},
+			slots{"front-proxy": {caA}, "some-future-slot": {caC}},
+			slots{"some-future-slot": {caC}},
+		},
+	} {
+		result, delta := mergeCASlots(testcase.ours, testcase.theirs)
+		if want, have := testcase.result, result; !reflect.DeepEqual(want, have) {
+			t.Errorf("%v + %v: want result %v, have %v", testcase.ours, testcase.theirs, want, have)
+		}
+		if want, have := testcase.delta, delta; !reflect.DeepEqual(want, have) {
+			t.Errorf("%v + %v: want delta %v, have %v", testcase.ours, testcase.theirs, want, have)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// APIServerSource is which peer first introduced an apiserver URL into
+// the mesh, and when, so that a rogue URL can be traced back. Unlike a
+// lease, it outlives the peer advertising the URL, for as long as the
+// URL stays in the mesh.
+type APIServerSource struct {
+	URL       string
+	Peer      mesh.PeerName
+	FirstSeen time.Time
+}
+
+// mergeAPIServerSources keeps the earliest source of each URL.
+func mergeAPIServerSources(ours, theirs []*APIServerSource) (result, delta []*APIServerSource) {
+	all := append(append([]*APIServerSource(nil), ours...), theirs...)
+	keep, changed := mergeKeyed(len(ours), len(theirs),
+		func(i int) string { return normalizeAPIServerURL(all[i].URL) },
+		func(i, j int) bool { return preferAPIServerSource(all[i], all[j]) })
+	for _, i := range keep {
+		result = append(result, all[i])
+	}
+	for _, i := range changed {
+		delta = append(delta, all[i])
+	}
+	sortAPIServerSources(result)
+	sortAPIServerSources(delta)
+	return result, delta
+}
+
+// preferAPIServerSource decides between two sources of the same URL:
+// the first seen, then the lowest peer.
+func preferAPIServerSource(a, b *APIServerSource) bool {
+	if !a.FirstSeen.Equal(b.FirstSeen) {
+		return a.FirstSeen.Before(b.FirstSeen)
+	}
+	return a.Peer < b.Peer
+}
+
+func sortAPIServerSources(sources []*APIServerSource) {
+	sort.Slice(sources, func(i, j int) bool { return sources[i].URL < sources[j].URL })
+}
+
+// keepAPIServerSources is those of sources whose URL is in urls.
+func keepAPIServerSources(sources []*APIServerSource, urls []string) []*APIServerSource {
+	in := map[string]bool{}
+	for _, u := range urls {
+		in[normalizeAPIServerURL(u)] = true
+	}
+	var kept []*APIServerSource
+	for _, s := range sources {
+		if in[normalizeAPIServerURL(s.URL)] {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// apiserverSourceView is an APIServerSource in /state.
+type apiserverSourceView struct {
+	Peer      string    `json:"peer"`
+	FirstSeen time.Time `json:"firstSeen"`
+}
+
+// apiserverSources is the source of each URL, by URL.
+func apiserverSources(sources []*APIServerSource) map[string]apiserverSourceView {
+	if len(sources) == 0 {
+		return nil
+	}
+	views := map[string]apiserverSourceView{}
+	for _, s := range sources {
+		views[s.URL] = apiserverSourceView{Peer: s.Peer.String(), FirstSeen: s.FirstSeen}
+	}
+	return views
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+func TestMergeAPIServerSources(t *testing.T) {
+	t0 := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	a1 := &APIServerSource{URL: "https://a:6443", Peer: 1, FirstSeen: t0}
+	a2 := &APIServerSource{URL: "https://a:6443", Peer: 2, FirstSeen: t0.Add(time.Hour)}
+	a3 := &APIServerSource{URL: "https://a:6443", Peer: 3, FirstSeen: t0}
+	b2 := &APIServerSource{URL: "https://b:6443", Peer: 2, FirstSeen: t0}
+	for _, testcase := range []struct {
+		name          string
+		ours, theirs  []*APIServerSource
+		result, delta []*APIServerSource
+	}{
+		{"new", []*APIServerSource{a1}, []*APIServerSource{b2}, []*APIServerSource{a1, b2}, []*APIServerSource{b2}},
+		{"earlier wins", []*APIServerSource{a2}, []*APIServerSource{a1}, []*APIServerSource{a1}, []*APIServerSource{a1}},
+		{"later loses", []*APIServerSource{a1}, []*APIServerSource{a2}, []*APIServerSource{a1}, nil},
+		{"then the lowest peer", []*APIServerSource{a3}, []*APIServerSource{a1}, []*APIServerSource{a1}, []*APIServerSource{a1}},
+	} {
+		result, delta := mergeAPIServerSources(testcase.ours, testcase.theirs)
+		if !reflect.DeepEqual(testcase.result, result) || !reflect.DeepEqual(testcase.delta, delta) {
+			t.Errorf("%s: want %v, %v, have %v, %v", testcase.name, testcase.result, testcase.delta, result, delta)
+		}
+	}
+}
+
+func TestStateKeepsEarliestAPIServerSource(t *testing.T) {
+	logger := newTextLogger(ioutil.Discard, "", 0)
+	first := newState(mesh.PeerName(2), nil, []string{"https://a:6443"}, peerOptions{}, logger)
+	time.Sleep(time.Millisecond)
+	second := newState(mesh.PeerName(1), nil, []string{"https://a:6443", "https://b:6443"}, peerOptions{}, logger)
+	second.mergeComplete(first.copy().set)
+	first.mergeComplete(second.copy().set)
+	for _, st := range []*state{first, second} {
+		sources := apiserverSources(st.set.APIServerSources)
+		if have := sources["https://a:6443"].Peer; have != mesh.PeerName(2).String() {
+			t.Errorf("%s: want a from %s, have %s", st.self, mesh.PeerName(2), have)
+		}
+		if have := sources["https://b:6443"].Peer; have != mesh.PeerName(1).String() {
+			t.Errorf("%s: want b from %s, have %s", st.self, mesh.PeerName(1), have)
+		}
+	}
+	if want, have := first.set.APIServerSources, second.set.APIServerSources; !reflect.DeepEqual(want, have) {
+		t.Errorf("want the same sources, have %v and %v", want, have)
+	}
+}
+
+func TestKeepAPIServerSources(t *testing.T) {
+	a := &APIServerSource{URL: "https://a:6443", Peer: 1}
+	b := &APIServerSource{URL: "https://b:6443", Peer: 1}
+	if want, have := []*APIServerSource{b}, keepAPIServerSources([]*APIServerSource{a, b}, []string{"https://B:6443/"}); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
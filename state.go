@@ -2,11 +2,15 @@ package main
 
 import (
 	"bytes"
-	"log"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
-	"encoding/gob"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
 
 	"github.com/weaveworks/mesh"
 )
@@ -14,23 +18,180 @@ import (
 type RootCAPublicKey struct {
 	Bytes     []byte
 	NotBefore time.Time
+	NotAfter  time.Time
 	Signature []byte
+	// Generation is bumped by the operator on every CA rotation.
+	// Peers trust the highest generation they have seen, and keep
+	// older ones only for the overlap window.
+	Generation uint64
+	// Origin is the peer that loaded the certificate and seeded it.
+	Origin mesh.PeerName
+	// Chain is the intermediates issued under this root, parents before
+	// children. It travels with the root as one unit, so we never mix
+	// intermediates from one bundle with a root from another.
+	Chain [][]byte
+	// RetireAt, if set, is when the seed that rotated away from this
+	// certificate wants it dropped everywhere. It only counts for a
+	// generation older than the current one.
+	RetireAt time.Time
+	// OriginNickname and Introduced are the nickname of Origin, and when
+	// it first loaded the certificate, so operators can trace where a
+	// root CA came from. Nobody but the origin ever sets them.
+	OriginNickname string
+	Introduced     time.Time
+	// Stamp is Origin's, from when it last changed the entry.
+	Stamp Stamp
+}
+
+func newRootCAPublicKey(cert *x509.Certificate, generation uint64, origin mesh.PeerName) *RootCAPublicKey {
+	return &RootCAPublicKey{
+		Bytes:      cert.Raw,
+		NotBefore:  cert.NotBefore,
+		NotAfter:   cert.NotAfter,
+		Signature:  cert.Signature,
+		Generation: generation,
+		Origin:     origin,
+	}
+}
+
+// introduce records that nickname loaded cas at now, unless it loaded
+// the same certificate before, among previous.
+func introduce(cas []*RootCAPublicKey, nickname string, now time.Time, previous []*RootCAPublicKey) {
+	first := map[string]time.Time{}
+	for _, ca := range previous {
+		first[ca.fingerprint()] = ca.Introduced
+	}
+	for _, ca := range cas {
+		ca.OriginNickname = nickname
+		ca.Introduced = now
+		if t, ok := first[ca.fingerprint()]; ok && !t.IsZero() {
+			ca.Introduced = t
+		}
+	}
+}
+
+// provenance says which peer introduced the certificate, and when.
+func (ca *RootCAPublicKey) provenance() string {
+	at := "an unknown time"
+	if !ca.Introduced.IsZero() {
+		at = ca.Introduced.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprintf("CA %s introduced by peer %s (%s) at %s", ca.fingerprint(), ca.Origin, ca.OriginNickname, at)
+}
+
+// fingerprint identifies a certificate by the SHA-256 of its raw DER.
+func (ca *RootCAPublicKey) fingerprint() string {
+	sum := sha256.Sum256(ca.Bytes)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// subject is the certificate's subject, for logging.
+func (ca *RootCAPublicKey) subject() string {
+	cert, err := x509.ParseCertificate(ca.Bytes)
+	if err != nil {
+		return "unparseable certificate"
+	}
+	return cert.Subject.String()
+}
+
+// notAfter is NotAfter, or, from peers that predate it, what the
+// certificate says. It is zero if even that can't be parsed.
+func (ca *RootCAPublicKey) notAfter() time.Time {
+	if !ca.NotAfter.IsZero() {
+		return ca.NotAfter
+	}
+	cert, err := x509.ParseCertificate(ca.Bytes)
+	if err != nil {
+		return time.Time{}
+	}
+	return cert.NotAfter
+}
+
+// expired reports whether the certificate is past its NotAfter.
+// Peers that predate NotAfter don't send it, so a zero value never expires.
+func (ca *RootCAPublicKey) expired(now time.Time) bool {
+	return !ca.NotAfter.IsZero() && now.After(ca.NotAfter)
 }
 
 type ClusterInfo struct {
-	RootCA *RootCAPublicKey
+	// RootCAs is the set of trusted CAs, deduplicated by fingerprint.
+	RootCAs []*RootCAPublicKey
 	// TODO ApiserverURLs []url.URL
 	ApiserverURLs []string
+	// APIServerLeases is the latest refresh of each apiserver URL by
+	// each peer that advertises it.
+	APIServerLeases []*APIServerLease
+	// APIServerTombstones is the latest removal of each apiserver URL.
+	APIServerTombstones []*APIServerTombstone
+	// APIServerSources is the peer that first introduced each apiserver
+	// URL, and when.
+	APIServerSources []*APIServerSource
+	// ResolvedAPIServers is the latest IP addresses of each apiserver
+	// URL's host, for peers that can't resolve it themselves.
+	ResolvedAPIServers []*ResolvedAPIServer
+	// BootstrapTokens is deduplicated by token, and ages out on expiry.
+	BootstrapTokens []*BootstrapToken
+	// BootstrapTokenTombstones is the latest revocation of each token ID.
+	BootstrapTokenTombstones []*BootstrapTokenTombstone
+	// CASlots is the CAs other than the cluster CA, by slot name.
+	CASlots map[string][]*RootCAPublicKey
+	// CRLs is the newest CRL of each root CA that issues one.
+	CRLs []*CRL
+	// Probes is the latest probe of each apiserver URL by each peer.
+	Probes []*APIServerProbe
+	// Attestations is the latest signed statement from each seed
+	// of the apiserver URLs it seeded.
+	Attestations []*Attestation
 }
 
 type state struct {
 	mtx  sync.RWMutex
 	self mesh.PeerName
+	opts peerOptions
 	// TODO rename 'set' to 'info'
 	set ClusterInfo
+
+	// generation is the root CA generation we currently trust,
+	// and rotated is when we first saw it.
+	generation uint64
+	rotated    time.Time
+
+	// local is the root CAs we loaded ourselves, rather than learned.
+	local []*RootCAPublicKey
+
+	// conflict identifies the root CA conflict we last warned about.
+	conflict string
+
+	// evicted is the apiserver URLs we last warned about evicting, over
+	// opts.maxAPIServerURLs.
+	evicted string
+
+	// nickname is our own, for the root CAs we introduce.
+	nickname string
+
+	// sealer, if set, encrypts what Encode returns.
+	sealer *sealer
+	// wireVersion, if set, is what Encode encodes in, rather than the
+	// current wireVersion.
+	wireVersion byte
+	// compressOver, if set, is the size over which Encode compresses.
+	compressOver int
+
+	// advertised is the apiserver URLs we lease, with opts.apiserverTTL,
+	// each since advertisedSince.
+	advertised      []string
+	advertisedSince map[string]time.Time
+
+	// servingCertHashes is the serving certificate hash we last fetched
+	// of each URL we advertise.
+	servingCertHashes map[string]string
+
+	// clock stamps the entries we own, having witnessed every stamp
+	// merged in.
+	clock lamportClock
 }
 
-var logger *log.Logger
+var logger *levelLogger
 
 // state implements GossipData.
 var _ mesh.GossipData = &state{}
@@ -38,16 +199,34 @@ var _ mesh.GossipData = &state{}
 // Construct an empty state object, ready to receive updates.
 // This is suitable to use at program start.
 // Other peers will populate us with data.
-func newState(self mesh.PeerName, certInfo *RootCAPublicKey, apiservers []string, log_ptr *log.Logger) *state {
+func newState(self mesh.PeerName, certs []*RootCAPublicKey, apiservers []string, opts peerOptions, log_ptr *levelLogger) *state {
 	logger = log_ptr
 	st := &state{
 		set:  ClusterInfo{},
 		self: self,
+		opts: opts,
+	}
+
+	stamp := st.clock.stamp(self, time.Now())
+	for _, ca := range certs {
+		ca.Stamp = stamp
+	}
+	st.set, _ = mergeClusterInfo(st.set, ClusterInfo{RootCAs: certs, ApiserverURLs: apiservers})
+	st.local = certs
+	st.advertised = normalizeAPIServerURLs(apiservers)
+	st.generation = maxGeneration(st.set.RootCAs)
+	st.rotated = time.Now()
+	st.advertisedSince = map[string]time.Time{}
+	for _, u := range st.advertised {
+		// A clock reading, so that readding the URL after a removal
+		// we've seen brings it back.
+		st.advertisedSince[u] = st.clock.read(st.rotated)
 	}
+	st.warnExpiry(st.set.RootCAs, st.rotated)
 
-	st.set = ClusterInfo{RootCA: certInfo, ApiserverURLs: apiservers}
+	st.refresh(st.rotated)
 
-	logger.Printf("I have root CA which is not valid before %v", st.set.RootCA.NotBefore)
+	logger.Infof("I have %d root CA certificate(s) of generation %d", len(st.set.RootCAs), st.generation)
 
 	return st
 }
@@ -56,103 +235,733 @@ func (st *state) copy() *state {
 	st.mtx.RLock()
 	defer st.mtx.RUnlock()
 	return &state{
-		set: st.set,
+		set:         st.set,
+		sealer:      st.opts.sealer,
+		wireVersion: st.opts.wireVersion,
 	}
 }
 
 // Encode serializes our complete state to a slice of byte-slices.
-// In this simple example, we use a single JSON-encoded buffer.
+// In this simple example, we use a single buffer, in the wire format
+// of encodeClusterInfoVersion.
 func (st *state) Encode() [][]byte {
 	st.mtx.RLock()
 	defer st.mtx.RUnlock()
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(st.set); err != nil {
-		panic(err)
+	version := st.wireVersion
+	if version == 0 {
+		version = wireVersion
 	}
-	return [][]byte{buf.Bytes()}
+	return [][]byte{encodeClusterInfoVersion(st.set, st.sealer, version, st.compressOver)}
 }
 
 // Merge merges the other GossipData into this one,
-// and returns our resulting, complete state.
+// and returns our resulting, complete state. Mesh only merges states
+// that came out of our gossip callbacks, whose root CAs have already
+// been checked, including their self-signatures, by peer.admit.
 func (st *state) Merge(other mesh.GossipData) (complete mesh.GossipData) {
-	return st.mergeComplete(other.(*state).copy().set)
+	// Keep encoding as st does, for the channel mesh merges for.
+	merged := st.mergeComplete(other.(*state).copy().set).(*state)
+	merged.sealer, merged.wireVersion, merged.compressOver = st.sealer, st.wireVersion, st.compressOver
+	return merged
+}
+
+// mergeClusterInfo returns the union of ours and theirs, and the part of
+// theirs that we didn't already have. Both are kept sorted, so that peers
+// converge on identical state regardless of the order of merges.
+func mergeClusterInfo(ours, theirs ClusterInfo) (result, delta ClusterInfo) {
+	result.RootCAs, delta.RootCAs = mergeRootCAs(ours.RootCAs, theirs.RootCAs)
+	result.ApiserverURLs, delta.ApiserverURLs = mergeStrings(normalizeAPIServerURLs(ours.ApiserverURLs), normalizeAPIServerURLs(theirs.ApiserverURLs))
+	result.BootstrapTokens, delta.BootstrapTokens = mergeBootstrapTokens(ours.BootstrapTokens, theirs.BootstrapTokens)
+	result.BootstrapTokenTombstones, delta.BootstrapTokenTombstones = mergeBootstrapTokenTombstones(ours.BootstrapTokenTombstones, theirs.BootstrapTokenTombstones)
+	result.CASlots, delta.CASlots = mergeCASlots(ours.CASlots, theirs.CASlots)
+	result.CRLs, delta.CRLs = mergeCRLs(ours.CRLs, theirs.CRLs)
+	result.Probes, delta.Probes = mergeProbes(ours.Probes, theirs.Probes)
+	result.APIServerLeases, delta.APIServerLeases = mergeAPIServerLeases(ours.APIServerLeases, theirs.APIServerLeases)
+	result.APIServerTombstones, delta.APIServerTombstones = mergeAPIServerTombstones(ours.APIServerTombstones, theirs.APIServerTombstones)
+	result.APIServerSources, delta.APIServerSources = mergeAPIServerSources(ours.APIServerSources, theirs.APIServerSources)
+	result.ResolvedAPIServers, delta.ResolvedAPIServers = mergeResolvedAPIServers(ours.ResolvedAPIServers, theirs.ResolvedAPIServers)
+	result.Attestations, delta.Attestations = mergeAttestations(ours.Attestations, theirs.Attestations)
+	return result, delta
+}
+
+func mergeRootCAs(ours, theirs []*RootCAPublicKey) (result, delta []*RootCAPublicKey) {
+	all := append(append([]*RootCAPublicKey(nil), ours...), theirs...)
+	keep, changed := mergeKeyed(len(ours), len(theirs),
+		func(i int) string { return all[i].fingerprint() },
+		func(i, j int) bool { return preferRootCA(all[i], all[j]) })
+	for _, i := range keep {
+		result = append(result, all[i])
+	}
+	for _, i := range changed {
+		delta = append(delta, all[i])
+	}
+	sortRootCAs(result)
+	sortRootCAs(delta)
+	return result, delta
 }
 
-func shouldUseTheirRootCA(ours, theirs ClusterInfo) bool {
-	if ours.RootCA == nil {
-		// Our certificate doesn't exist yet, so take whatever they give us
-		return true
+// preferRootCA decides between two entries for the same certificate,
+// which may have been seeded by different peers, so that everyone
+// keeps the same one: the latest stamp, then the highest generation,
+// then the earliest retirement, then the lowest origin, then the
+// earliest introduction, then the lowest nickname, then the lowest
+// chain.
+func preferRootCA(a, b *RootCAPublicKey) bool {
+	if a.Stamp != b.Stamp {
+		return a.Stamp.after(b.Stamp)
 	}
-	if theirs.RootCA.NotBefore.After(ours.RootCA.NotBefore) {
-		// Their certificate is appears to have new validity period, we
-		// should take that and use it
-		return true
+	if a.Generation != b.Generation {
+		return a.Generation > b.Generation
 	}
-	if theirs.RootCA.NotBefore.Equal(ours.RootCA.NotBefore) {
-		// Both certificate has the same starting date of the validity
-		// period, we should always pick the same one
-		return bytes.Compare(theirs.RootCA.Signature, ours.RootCA.Signature) > 0
+	if !a.RetireAt.Equal(b.RetireAt) {
+		if a.RetireAt.IsZero() || b.RetireAt.IsZero() {
+			return b.RetireAt.IsZero()
+		}
+		return a.RetireAt.Before(b.RetireAt)
+	}
+	if a.Origin != b.Origin {
+		return a.Origin < b.Origin
+	}
+	if !a.Introduced.Equal(b.Introduced) {
+		if a.Introduced.IsZero() || b.Introduced.IsZero() {
+			return b.Introduced.IsZero()
+		}
+		return a.Introduced.Before(b.Introduced)
 	}
-	// Stick to what we have
-	return false
+	if a.OriginNickname != b.OriginNickname {
+		return a.OriginNickname < b.OriginNickname
+	}
+	return compareChains(a.Chain, b.Chain) < 0
 }
 
-func mergeClusterInfo(ours, theirs ClusterInfo) (result, delta ClusterInfo) {
+func compareChains(a, b [][]byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := bytes.Compare(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
 
-	if theirs.RootCA != nil {
-		if theirs.RootCA.Signature != nil {
-			logger.Println("theirs.RootCA.Signature:", theirs.RootCA.Signature[:8])
-		} else {
-			logger.Println("theirs.RootCA.Signature: nil")
+func sortRootCAs(cas []*RootCAPublicKey) {
+	sort.Slice(cas, func(i, j int) bool { return bytes.Compare(cas[i].Bytes, cas[j].Bytes) < 0 })
+}
+
+func mergeStrings(ours, theirs []string) (result, delta []string) {
+	existing := map[string]struct{}{}
+	for _, s := range ours {
+		if _, ok := existing[s]; ok {
+			continue
 		}
-	} else {
-		logger.Println("theirs.RootCA: nil")
+		existing[s] = struct{}{}
+		result = append(result, s)
 	}
-	if ours.RootCA != nil {
-		if ours.RootCA.Signature != nil {
-			logger.Println("ours.RootCA.Signature:", ours.RootCA.Signature[:8])
-		} else {
-			logger.Println("ours.RootCA.Signature: nil")
+	for _, s := range theirs {
+		if _, ok := existing[s]; ok {
+			continue
 		}
-	} else {
-		logger.Println("ours.RootCA: nil")
+		// Don't have, do want; merge in.
+		existing[s] = struct{}{}
+		result = append(result, s)
+		delta = append(delta, s)
 	}
+	sort.Strings(result)
+	sort.Strings(delta)
+	return result, delta
+}
 
-	result = ours
+func (info ClusterInfo) empty() bool {
+	return len(info.RootCAs) == 0 && len(info.ApiserverURLs) == 0 && len(info.BootstrapTokens) == 0 && len(info.BootstrapTokenTombstones) == 0 && len(info.Attestations) == 0 && len(info.CASlots) == 0 && len(info.CRLs) == 0 && len(info.Probes) == 0 && len(info.APIServerLeases) == 0 && len(info.APIServerTombstones) == 0 && len(info.APIServerSources) == 0 && len(info.ResolvedAPIServers) == 0
+}
 
-	if theirs.RootCA != nil {
-		if shouldUseTheirRootCA(ours, theirs) {
-			result.RootCA = theirs.RootCA
-			delta.RootCA = theirs.RootCA
+func maxGeneration(cas []*RootCAPublicKey) (generation uint64) {
+	for _, ca := range cas {
+		if ca.Generation > generation {
+			generation = ca.Generation
 		}
 	}
+	return generation
+}
 
-	existing := map[string]struct{}{}
-	incoming := map[string]struct{}{}
-	for _, url := range ours.ApiserverURLs {
-		existing[url] = struct{}{}
+// merge merges set into our state and returns what was new to us.
+// Callers must hold st.mtx.
+func (st *state) merge(set ClusterInfo, now time.Time) (delta ClusterInfo) {
+	// Only what we admit moves our clock.
+	set = st.admit(set, now)
+	st.clock.witness(set.maxClock(), now)
+	cl, d := mergeClusterInfo(st.set, set)
+	st.set = cl
+	st.rotate(now)
+	st.warnConflict(false)
+	d = st.admit(d, now)
+	// Nor pass on the root CAs or apiserver URLs that rotate just dropped.
+	d.RootCAs = keepRootCAs(d.RootCAs, st.set.RootCAs)
+	d.ApiserverURLs = keepStrings(d.ApiserverURLs, st.set.ApiserverURLs)
+	d.APIServerSources = keepAPIServerSources(d.APIServerSources, st.set.ApiserverURLs)
+	if len(d.ApiserverURLs) > 0 {
+		origins := apiserverOrigins(st.set.APIServerLeases, now)
+		for _, u := range d.ApiserverURLs {
+			logger.Infof("Learned apiserver URL %s, advertised by %s", u, formatOrigins(origins[u]))
+		}
+	}
+	st.warnExpiry(d.RootCAs, now)
+	return d
+}
+
+// admit filters out expired root CAs, bootstrap tokens and apiserver URLs,
+// and root CAs of a generation we have already retired, so that peers
+// which haven't caught up can't resurrect them; and entries stamped too
+// far ahead of our clock to be believed.
+func (st *state) admit(set ClusterInfo, now time.Time) ClusterInfo {
+	set, ahead := set.withoutClocksAhead(now)
+	if ahead > 0 {
+		logger.Warnf("Ignoring %d entries stamped more than %v ahead of our clock", ahead, maxClockSkew)
+	}
+	retired := now.Sub(st.rotated) >= st.opts.caOverlap
+	current := st.generation
+	if g := maxGeneration(set.RootCAs); g > current {
+		current = g
+	}
+	var cas []*RootCAPublicKey
+	for _, ca := range set.RootCAs {
+		if retired && ca.Generation < st.generation {
+			continue
+		}
+		if !ca.RetireAt.IsZero() && ca.Generation >= current {
+			// A previous root CA can't be newer than the current one.
+			logger.Debugf("Ignoring retirement at %v of root CA %s, which is of the current generation %d", ca.RetireAt, ca.fingerprint(), current)
+			c := *ca
+			c.RetireAt = time.Time{}
+			ca = &c
+		} else if !ca.RetireAt.IsZero() && !now.Before(ca.RetireAt) {
+			continue
+		}
+		if ca.expired(now) && !st.opts.allowExpiredCA {
+			logger.Infof("Discarding root CA %s which expired at %v", ca.fingerprint(), ca.NotAfter)
+			continue
+		}
+		cas = append(cas, ca)
+	}
+	set.RootCAs = cas
+	set.CASlots = filterCASlots(set.CASlots, caSlotsUnexpired(now, st.opts.allowExpiredCA))
+	var revocations []*BootstrapTokenTombstone
+	for _, t := range set.BootstrapTokenTombstones {
+		if !t.forgotten(now) {
+			revocations = append(revocations, t)
+		}
+	}
+	set.BootstrapTokenTombstones = revocations
+	// Revocations too apply whichever side of the merge they're on.
+	revocations = append(append([]*BootstrapTokenTombstone{}, st.set.BootstrapTokenTombstones...), revocations...)
+	var tokens []*BootstrapToken
+	for _, t := range set.BootstrapTokens {
+		if t.expired(now) {
+			logger.Infof("Discarding bootstrap token %s", t)
+			continue
+		}
+		if revokedBootstrapToken(t, revocations) {
+			logger.Debugf("Ignoring bootstrap token %s, which was revoked", t)
+			continue
+		}
+		tokens = append(tokens, t)
+	}
+	set.BootstrapTokens = tokens
+	var probes []*APIServerProbe
+	for _, pr := range set.Probes {
+		if !pr.stale(now) {
+			probes = append(probes, pr)
+		}
+	}
+	set.Probes = probes
+	// A lease long forgotten, from a peer that was away, still means
+	// its URL is no longer advertised.
+	incoming := set.APIServerLeases
+	var leases []*APIServerLease
+	for _, l := range set.APIServerLeases {
+		if !l.forgotten(now) {
+			leases = append(leases, l)
+		}
 	}
-	for _, url := range theirs.ApiserverURLs {
-		incoming[url] = struct{}{}
+	set.APIServerLeases = leases
+	var tombstones []*APIServerTombstone
+	for _, t := range set.APIServerTombstones {
+		if !t.forgotten(now) {
+			tombstones = append(tombstones, t)
+		}
+	}
+	set.APIServerTombstones = tombstones
+	var resolved []*ResolvedAPIServer
+	for _, r := range set.ResolvedAPIServers {
+		if !r.stale(now) {
+			resolved = append(resolved, r)
+		}
 	}
-	for url := range incoming {
-		if _, ok := existing[url]; !ok {
-			// Don't have, do want; merge in.
-			result.ApiserverURLs = append(result.ApiserverURLs, url)
-			delta.ApiserverURLs = append(delta.ApiserverURLs, url)
+	set.ResolvedAPIServers = resolved
+	// Leases and tombstones apply whichever side of the merge they're on.
+	allLeases := append(append([]*APIServerLease{}, st.set.APIServerLeases...), incoming...)
+	expired := expiredAPIServerURLs(allLeases, now)
+	removed := removedAPIServerURLs(append(append([]*APIServerTombstone{}, st.set.APIServerTombstones...), set.APIServerTombstones...), allLeases)
+	var urls []string
+	for _, u := range set.ApiserverURLs {
+		switch n := normalizeAPIServerURL(u); {
+		case removed[n]:
+			logger.Debugf("Ignoring apiserver URL %s, which was removed", u)
+		case expired[n]:
+			logger.Debugf("Ignoring apiserver URL %s, which is no longer advertised", u)
+		default:
+			urls = append(urls, u)
 		}
 	}
+	set.ApiserverURLs = urls
+	return set
+}
 
-	return result, delta
+// evictAPIServerURLs keeps at most opts.maxAPIServerURLs of our apiserver
+// URLs, so one misbehaving peer can't flood the mesh. The URLs we
+// advertise ourselves stay; of the rest, those refreshed longest ago go
+// first, then the lowest, so every peer evicts the same ones. Their
+// leases go too. Callers must hold st.mtx.
+func (st *state) evictAPIServerURLs() {
+	max := st.opts.maxAPIServerURLs
+	if max <= 0 || len(st.set.ApiserverURLs) <= max {
+		return
+	}
+	local := map[string]bool{}
+	for _, u := range st.advertised {
+		local[u] = true
+	}
+	refreshed := map[string]time.Time{}
+	for _, l := range st.set.APIServerLeases {
+		if u := normalizeAPIServerURL(l.URL); l.Refreshed.After(refreshed[u]) {
+			refreshed[u] = l.Refreshed
+		}
+	}
+	var candidates []string
+	for _, u := range st.set.ApiserverURLs {
+		if !local[u] {
+			candidates = append(candidates, u)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		ri, rj := refreshed[candidates[i]], refreshed[candidates[j]]
+		if !ri.Equal(rj) {
+			return ri.Before(rj)
+		}
+		return candidates[i] < candidates[j]
+	})
+	n := len(st.set.ApiserverURLs) - max
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+	evicted := map[string]bool{}
+	for _, u := range candidates[:n] {
+		evicted[u] = true
+	}
+	var urls []string
+	for _, u := range st.set.ApiserverURLs {
+		if !evicted[u] {
+			urls = append(urls, u)
+		}
+	}
+	st.set.ApiserverURLs = urls
+	var leases []*APIServerLease
+	for _, l := range st.set.APIServerLeases {
+		if !evicted[normalizeAPIServerURL(l.URL)] {
+			leases = append(leases, l)
+		}
+	}
+	st.set.APIServerLeases = leases
+	if key := strings.Join(candidates[:n], " "); key != st.evicted {
+		st.evicted = key
+		logger.Warnf("Evicted %d apiserver URL(s), keeping %d, the most -max-apiserver-urls allows: %s", n, len(urls), key)
+	}
+}
+
+// findConflict looks for different root CAs of the given generation that
+// were seeded by different peers, for instance because a control-plane
+// node was rebuilt with a new CA. Everybody must agree on which one wins,
+// so we pick by betterRootCA, and trust only what the winner's origin seeded.
+func findConflict(cas []*RootCAPublicKey, generation uint64) (winner *RootCAPublicKey, conflicting []*RootCAPublicKey) {
+	origins := map[mesh.PeerName]struct{}{}
+	for _, ca := range cas {
+		if ca.Generation != generation {
+			continue
+		}
+		origins[ca.Origin] = struct{}{}
+		conflicting = append(conflicting, ca)
+		if winner == nil || betterRootCA(ca, winner) {
+			winner = ca
+		}
+	}
+	if len(origins) < 2 {
+		return nil, nil
+	}
+	return winner, conflicting
+}
+
+// betterRootCA decides which of two different certificates is the newer:
+// the higher generation, then the later NotBefore, then the lowest
+// fingerprint. That is a total order on certificates, so whatever order
+// gossip arrives in, every peer picks the same one.
+func betterRootCA(a, b *RootCAPublicKey) bool {
+	if a.Generation != b.Generation {
+		return a.Generation > b.Generation
+	}
+	if !a.NotBefore.Equal(b.NotBefore) {
+		return a.NotBefore.After(b.NotBefore)
+	}
+	return a.fingerprint() < b.fingerprint()
+}
+
+// warnExpiry warns about root CAs that will expire within the
+// expiry warning window, so that rotation can be planned.
+func (st *state) warnExpiry(cas []*RootCAPublicKey, now time.Time) {
+	for _, ca := range cas {
+		notAfter := ca.notAfter()
+		if notAfter.IsZero() || now.After(notAfter) {
+			continue
+		}
+		if left := notAfter.Sub(now); left < st.opts.caExpiryWarning {
+			logger.Warnf("root CA %s expires in %v, at %v", ca.fingerprint(), left, notAfter)
+		}
+	}
+}
+
+// subjectConflict is root CAs of one generation that share a subject but
+// not a public key, which is a split brain or an attack; we trust neither.
+type subjectConflict struct {
+	Subject      string   `json:"subject"`
+	Generation   uint64   `json:"generation"`
+	Fingerprints []string `json:"fingerprints"`
+	PublicKeys   []string `json:"publicKeys"`
+}
+
+// findSubjectConflicts compares root CAs generation by generation, since a
+// rotation to a new key normally keeps the subject.
+func findSubjectConflicts(cas []*RootCAPublicKey) (conflicts []subjectConflict) {
+	type group struct {
+		subject      string
+		generation   uint64
+		fingerprints []string
+		keys         map[string]struct{}
+	}
+	groups := map[string]*group{}
+	var order []string
+	for _, ca := range cas {
+		cert, err := x509.ParseCertificate(ca.Bytes)
+		if err != nil {
+			continue
+		}
+		k := fmt.Sprintf("%d/%x", ca.Generation, cert.RawSubject)
+		g, ok := groups[k]
+		if !ok {
+			g = &group{subject: cert.Subject.String(), generation: ca.Generation, keys: map[string]struct{}{}}
+			groups[k] = g
+			order = append(order, k)
+		}
+		g.fingerprints = append(g.fingerprints, ca.fingerprint())
+		g.keys[spkiHash(cert)] = struct{}{}
+	}
+	for _, k := range order {
+		g := groups[k]
+		if len(g.keys) < 2 {
+			continue
+		}
+		c := subjectConflict{Subject: g.subject, Generation: g.generation, Fingerprints: g.fingerprints}
+		for key := range g.keys {
+			c.PublicKeys = append(c.PublicKeys, key)
+		}
+		sort.Strings(c.PublicKeys)
+		conflicts = append(conflicts, c)
+	}
+	return conflicts
+}
+
+// withoutSubjectConflicts is cas less any in conflicts.
+func withoutSubjectConflicts(cas []*RootCAPublicKey, conflicts []subjectConflict) []*RootCAPublicKey {
+	if len(conflicts) == 0 {
+		return cas
+	}
+	drop := map[string]struct{}{}
+	for _, c := range conflicts {
+		for _, fp := range c.Fingerprints {
+			drop[fp] = struct{}{}
+		}
+	}
+	var kept []*RootCAPublicKey
+	for _, ca := range cas {
+		if _, ok := drop[ca.fingerprint()]; !ok {
+			kept = append(kept, ca)
+		}
+	}
+	return kept
+}
+
+// firstExpiry is the earliest NotAfter of the root CAs we trust, or zero
+// if we don't know of any. Callers must hold st.mtx.
+func (st *state) firstExpiry() (first time.Time) {
+	for _, ca := range st.trustedRootCAs() {
+		if t := ca.notAfter(); !t.IsZero() && (first.IsZero() || t.Before(first)) {
+			first = t
+		}
+	}
+	return first
+}
+
+// prioritizedAPIServerURLs is our apiserver URLs, highest priority first,
+// but those we last found unhealthy last.
+// Callers must hold st.mtx.
+func (st *state) prioritizedAPIServerURLs(now time.Time) []string {
+	urls := prioritizeAPIServerURLs(st.set.ApiserverURLs, st.set.APIServerLeases, now)
+	return demoteUnhealthy(urls, st.set.Probes, st.self, now)
+}
+
+// apiserverURLsFor is prioritizedAPIServerURLs, less those that aren't
+// consensus-healthy if consumer opted into -consensus-healthy-only.
+// Callers must hold st.mtx.
+func (st *state) apiserverURLsFor(consumer string, now time.Time) []string {
+	urls := st.prioritizedAPIServerURLs(now)
+	if !st.opts.consensus.only[consumer] {
+		return urls
+	}
+	return consensusHealthyURLs(urls, st.set.Probes, st.opts.consensus, now)
+}
+
+// trustedRootCAs is our root CAs, less any with a subject conflict,
+// and the losers of any conflict between origins.
+// Callers must hold st.mtx.
+func (st *state) trustedRootCAs() []*RootCAPublicKey {
+	candidates := withoutSubjectConflicts(st.set.RootCAs, findSubjectConflicts(st.set.RootCAs))
+	winner, _ := findConflict(candidates, st.generation)
+	if winner == nil {
+		return candidates
+	}
+	var cas []*RootCAPublicKey
+	for _, ca := range candidates {
+		if ca.Generation == st.generation && ca.Origin != winner.Origin {
+			continue
+		}
+		cas = append(cas, ca)
+	}
+	return cas
+}
+
+// warnConflict logs any root CA conflict; unless always is set,
+// only when it first appears or is resolved.
+// Callers must hold st.mtx.
+func (st *state) warnConflict(always bool) {
+	subjects := findSubjectConflicts(st.set.RootCAs)
+	winner, conflicting := findConflict(withoutSubjectConflicts(st.set.RootCAs, subjects), st.generation)
+	var key string
+	for _, c := range subjects {
+		key += strings.Join(c.Fingerprints, "")
+	}
+	for _, ca := range conflicting {
+		key += ca.fingerprint() + ca.Origin.String()
+	}
+	if key == st.conflict && !always {
+		return
+	}
+	if key == "" && st.conflict != "" {
+		logger.Infof("Root CA conflict resolved")
+	}
+	st.conflict = key
+	for _, c := range subjects {
+		logger.Warnf("CONFLICTING ROOT CAs of generation %d share the subject %q but not a public key, trusting none of them:", c.Generation, c.Subject)
+		for _, fp := range c.Fingerprints {
+			logger.Warnf("  %s", fp)
+		}
+	}
+	if winner == nil {
+		return
+	}
+	logger.Warnf("CONFLICTING ROOT CAs of generation %d are being gossiped:", st.generation)
+	for _, ca := range conflicting {
+		verdict := "rejected"
+		if ca.Origin == winner.Origin {
+			verdict = "trusted"
+		}
+		logger.Warnf("  %s from peer %s, not valid before %v: %s", ca.fingerprint(), ca.Origin, ca.NotBefore, verdict)
+	}
+}
+
+// rotate moves us onto the newest root CA generation in our state, and
+// drops older generations once the overlap window has passed.
+// Callers must hold st.mtx.
+func (st *state) rotate(now time.Time) {
+	if g := maxGeneration(st.set.RootCAs); g > st.generation {
+		logger.Infof("Root CA rotated from generation %d to %d, trusting both for %v", st.generation, g, st.opts.caOverlap)
+		st.generation = g
+		st.rotated = now
+	}
+	n, urls := len(st.set.RootCAs), len(st.set.ApiserverURLs)
+	st.set = st.admit(st.set, now)
+	if dropped := n - len(st.set.RootCAs); dropped > 0 {
+		logger.Infof("Dropped %d root CA certificate(s) that are expired or older than generation %d", dropped, st.generation)
+	}
+	var evicted []*RootCAPublicKey
+	st.set.RootCAs, evicted = capRootCAs(st.set.RootCAs, st.opts.maxCAs)
+	for _, ca := range evicted {
+		logger.Warnf("Dropped root CA %s of generation %d, to keep no more than -max-cas %d", ca.fingerprint(), ca.Generation, st.opts.maxCAs)
+	}
+	if dropped := urls - len(st.set.ApiserverURLs); dropped > 0 {
+		logger.Infof("Dropped %d apiserver URL(s) that were removed or are no longer advertised", dropped)
+	}
+	st.evictAPIServerURLs()
+	// A URL's source goes with it, so if it comes back, it comes back
+	// with a new one.
+	st.set.APIServerSources = keepAPIServerSources(st.set.APIServerSources, st.set.ApiserverURLs)
+}
+
+// capRootCAs keeps the max newest of cas, by betterRootCA, so that every
+// peer keeps the same ones. A zero max keeps them all.
+func capRootCAs(cas []*RootCAPublicKey, max int) (kept, evicted []*RootCAPublicKey) {
+	if max <= 0 || len(cas) <= max {
+		return cas, nil
+	}
+	newest := append([]*RootCAPublicKey{}, cas...)
+	sort.Slice(newest, func(i, j int) bool { return betterRootCA(newest[i], newest[j]) })
+	kept = append([]*RootCAPublicKey{}, newest[:max]...)
+	sortRootCAs(kept)
+	return kept, newest[max:]
+}
+
+// keepRootCAs is those of cas that are also in have.
+func keepRootCAs(cas, have []*RootCAPublicKey) []*RootCAPublicKey {
+	fingerprints := map[string]bool{}
+	for _, ca := range have {
+		fingerprints[ca.fingerprint()] = true
+	}
+	var kept []*RootCAPublicKey
+	for _, ca := range cas {
+		if fingerprints[ca.fingerprint()] {
+			kept = append(kept, ca)
+		}
+	}
+	return kept
+}
+
+// keepStrings is those of ss that are also in have.
+func keepStrings(ss, have []string) []string {
+	in := map[string]bool{}
+	for _, s := range have {
+		in[s] = true
+	}
+	var kept []string
+	for _, s := range ss {
+		if in[s] {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
+
+// rotationView is a root CA rotation in progress: the root CAs of the
+// current and previous generation, and when the previous ones retire.
+type rotationView struct {
+	Current  []string  `json:"current"`
+	Previous []string  `json:"previous"`
+	RetireAt time.Time `json:"retireAt"`
+}
+
+// rotation reports the rotation in progress, if any.
+// Callers must hold st.mtx.
+func (st *state) rotation() *rotationView {
+	r := &rotationView{RetireAt: st.rotated.Add(st.opts.caOverlap)}
+	for _, ca := range st.set.RootCAs {
+		if ca.Generation == st.generation {
+			r.Current = append(r.Current, ca.fingerprint())
+			continue
+		}
+		r.Previous = append(r.Previous, ca.fingerprint())
+		if !ca.RetireAt.IsZero() && ca.RetireAt.Before(r.RetireAt) {
+			r.RetireAt = ca.RetireAt
+		}
+	}
+	if len(r.Previous) == 0 {
+		return nil
+	}
+	return r
+}
+
+// expire drops expired root CAs and bootstrap tokens, and retires old root CA generations whose
+// overlap window has passed, even if no gossip arrives in the meantime.
+// It also keeps reminding us of any root CA conflict until it's resolved.
+func (st *state) expire(now time.Time) (dropped bool) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	n := len(st.set.RootCAs)
+	st.rotate(now)
+	st.warnConflict(true)
+	return len(st.set.RootCAs) < n
+}
+
+// swapRootCAs replaces the root CAs we loaded ourselves with certs,
+// as the next generation, so that they supersede the old ones
+// across the mesh once the overlap window passes. If we hadn't loaded
+// any yet, certs get the configured generation instead.
+// It reports whether anything changed.
+func (st *state) swapRootCAs(certs []*x509.Certificate) bool {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+
+	if sameCertificates(st.local, certs) {
+		return false
+	}
+	now := time.Now()
+	stamp := st.clock.stamp(st.self, now)
+	generation := st.opts.caGeneration
+	var retiring []*RootCAPublicKey
+	if len(st.local) > 0 {
+		generation = st.generation + 1
+		// Tell everyone when to drop the root CAs we're rotating away from.
+		for _, ca := range st.local {
+			c := *ca
+			c.RetireAt = now.Add(st.opts.caOverlap)
+			c.Stamp = stamp
+			retiring = append(retiring, &c)
+		}
+	}
+	cas := newRootCAPublicKeys(certs, generation, st.self)
+	introduce(cas, st.nickname, now, st.local)
+	for _, ca := range cas {
+		ca.Stamp = stamp
+	}
+	st.merge(ClusterInfo{RootCAs: append(cas, retiring...)}, now)
+	st.local = cas
+	return true
+}
+
+func sameCertificates(cas []*RootCAPublicKey, certs []*x509.Certificate) bool {
+	have := map[string]struct{}{}
+	for _, ca := range cas {
+		have[string(ca.Bytes)] = struct{}{}
+		for _, der := range ca.Chain {
+			have[string(der)] = struct{}{}
+		}
+	}
+	if len(have) != len(certs) {
+		return false
+	}
+	for _, cert := range certs {
+		if _, ok := have[string(cert.Raw)]; !ok {
+			return false
+		}
+	}
+	return true
 }
 
 func (st *state) mergeReceived(set ClusterInfo) (received mesh.GossipData) {
 	st.mtx.Lock()
 	defer st.mtx.Unlock()
-	cl, _ := mergeClusterInfo(set, st.set)
-	st.set = cl
+
+	d := st.merge(set, time.Now())
+
+	// We must not return nil from mergeReceived.
 	return &state{
-		set: set,
+		set:         d,
+		sealer:      st.opts.sealer,
+		wireVersion: st.opts.wireVersion,
 	}
 }
 
@@ -160,15 +969,16 @@ func (st *state) mergeDelta(set ClusterInfo) (delta mesh.GossipData) {
 	st.mtx.Lock()
 	defer st.mtx.Unlock()
 
-	cl, d := mergeClusterInfo(set, st.set)
-	st.set = cl
+	d := st.merge(set, time.Now())
 
-	if len(set.ApiserverURLs) <= 0 && set.RootCA == nil {
+	if d.empty() {
 		return nil
 	}
 
 	return &state{
-		set: d,
+		set:         d,
+		sealer:      st.opts.sealer,
+		wireVersion: st.opts.wireVersion,
 	}
 }
 
@@ -176,9 +986,10 @@ func (st *state) mergeComplete(set ClusterInfo) (complete mesh.GossipData) {
 	st.mtx.Lock()
 	defer st.mtx.Unlock()
 
-	cl, _ := mergeClusterInfo(set, st.set)
-	st.set = cl
+	st.merge(set, time.Now())
 	return &state{
-		set: st.set,
+		set:         st.set,
+		sealer:      st.opts.sealer,
+		wireVersion: st.opts.wireVersion,
 	}
 }
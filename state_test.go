@@ -1,42 +1,60 @@
 package main
 
 import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/weaveworks/mesh"
 )
 
+var (
+	caA = &RootCAPublicKey{Bytes: []byte("a"), Signature: []byte("sig-a")}
+	caB = &RootCAPublicKey{Bytes: []byte("b"), Signature: []byte("sig-b")}
+	caC = &RootCAPublicKey{Bytes: []byte("c"), Signature: []byte("sig-c")}
+)
+
+func newTestState() *state {
+	return newState(999, nil, nil, peerOptions{}, newTextLogger(ioutil.Discard, "", 0))
+}
+
 func TestStateMergeReceived(t *testing.T) {
 	for _, testcase := range []struct {
-		initial map[mesh.PeerName]int
-		merge   map[mesh.PeerName]int
-		want    map[mesh.PeerName]int
+		initial ClusterInfo
+		merge   ClusterInfo
+		want    ClusterInfo
 	}{
 		{
-			map[mesh.PeerName]int{},
-			map[mesh.PeerName]int{123: 1, 456: 2},
-			map[mesh.PeerName]int{123: 1, 456: 2},
+			ClusterInfo{},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443", "https://b:6443"}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443", "https://b:6443"}},
 		},
 		{
-			map[mesh.PeerName]int{123: 1, 456: 2},
-			map[mesh.PeerName]int{123: 1, 456: 2},
-			map[mesh.PeerName]int{},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443", "https://b:6443"}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443", "https://b:6443"}},
+			ClusterInfo{},
 		},
 		{
-			map[mesh.PeerName]int{123: 1, 456: 2},
-			map[mesh.PeerName]int{789: 3},
-			map[mesh.PeerName]int{789: 3},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443"}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caB}, ApiserverURLs: []string{"https://c:6443"}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caB}, ApiserverURLs: []string{"https://c:6443"}},
 		},
 		{
-			map[mesh.PeerName]int{456: 3},
-			map[mesh.PeerName]int{123: 1, 456: 2},
-			map[mesh.PeerName]int{123: 1}, // we drop keys that don't semantically merge
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caB}, ApiserverURLs: []string{"https://b:6443"}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caC, caA, caB}, ApiserverURLs: []string{"https://b:6443", "https://a:6443"}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA, caC}, ApiserverURLs: []string{"https://a:6443"}}, // we drop what we already have
 		},
 	} {
-		initial, merge := testcase.initial, testcase.merge // mergeReceived modifies arguments
-		delta := newState(999).mergeComplete(initial).(*state).mergeReceived(merge)
-		if want, have := testcase.want, delta.(*state).set; !reflect.DeepEqual(want, have) {
+		st := newTestState()
+		st.mergeComplete(testcase.initial)
+		received := st.mergeReceived(testcase.merge)
+		if want, have := testcase.want, received.(*state).set; !reflect.DeepEqual(want, have) {
 			t.Errorf("%v mergeReceived %v: want %v, have %v", testcase.initial, testcase.merge, want, have)
 		}
 	}
@@ -44,40 +62,41 @@ func TestStateMergeReceived(t *testing.T) {
 
 func TestStateMergeDelta(t *testing.T) {
 	for _, testcase := range []struct {
-		initial map[mesh.PeerName]int
-		merge   map[mesh.PeerName]int
-		want    map[mesh.PeerName]int
+		initial ClusterInfo
+		merge   ClusterInfo
+		want    *ClusterInfo
 	}{
 		{
-			map[mesh.PeerName]int{},
-			map[mesh.PeerName]int{123: 1, 456: 2},
-			map[mesh.PeerName]int{123: 1, 456: 2},
+			ClusterInfo{},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443"}},
+			&ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443"}},
 		},
 		{
-			map[mesh.PeerName]int{123: 1, 456: 2},
-			map[mesh.PeerName]int{123: 1, 456: 2},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443"}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443"}},
 			nil,
 		},
 		{
-			map[mesh.PeerName]int{123: 1, 456: 2},
-			map[mesh.PeerName]int{789: 3},
-			map[mesh.PeerName]int{789: 3},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}},
+			ClusterInfo{},
+			nil,
 		},
 		{
-			map[mesh.PeerName]int{123: 1, 456: 2},
-			map[mesh.PeerName]int{456: 3},
-			map[mesh.PeerName]int{456: 3},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443"}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA, caB}},
+			&ClusterInfo{RootCAs: []*RootCAPublicKey{caB}},
 		},
 	} {
-		initial, merge := testcase.initial, testcase.merge // mergeDelta modifies arguments
-		delta := newState(999).mergeComplete(initial).(*state).mergeDelta(merge)
+		st := newTestState()
+		st.mergeComplete(testcase.initial)
+		delta := st.mergeDelta(testcase.merge)
 		if want := testcase.want; want == nil {
 			if delta != nil {
 				t.Errorf("%v mergeDelta %v: want nil, have non-nil", testcase.initial, testcase.merge)
 			}
 		} else {
-			if have := delta.(*state).set; !reflect.DeepEqual(want, have) {
-				t.Errorf("%v mergeDelta %v: want %v, have %v", testcase.initial, testcase.merge, want, have)
+			if have := delta.(*state).set; !reflect.DeepEqual(*want, have) {
+				t.Errorf("%v mergeDelta %v: want %v, have %v", testcase.initial, testcase.merge, *want, have)
 			}
 		}
 	}
@@ -85,34 +104,502 @@ func TestStateMergeDelta(t *testing.T) {
 
 func TestStateMergeComplete(t *testing.T) {
 	for _, testcase := range []struct {
-		initial map[mesh.PeerName]int
-		merge   map[mesh.PeerName]int
-		want    map[mesh.PeerName]int
+		initial ClusterInfo
+		merge   ClusterInfo
+		want    ClusterInfo
 	}{
 		{
-			map[mesh.PeerName]int{},
-			map[mesh.PeerName]int{123: 1, 456: 2},
-			map[mesh.PeerName]int{123: 1, 456: 2},
+			ClusterInfo{},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443"}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443"}},
 		},
 		{
-			map[mesh.PeerName]int{123: 1, 456: 2},
-			map[mesh.PeerName]int{123: 1, 456: 2},
-			map[mesh.PeerName]int{123: 1, 456: 2},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443"}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443"}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443"}},
 		},
 		{
-			map[mesh.PeerName]int{123: 1, 456: 2},
-			map[mesh.PeerName]int{789: 3},
-			map[mesh.PeerName]int{123: 1, 456: 2, 789: 3},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caB}, ApiserverURLs: []string{"https://b:6443"}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caC, caA}, ApiserverURLs: []string{"https://c:6443", "https://a:6443"}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA, caB, caC}, ApiserverURLs: []string{"https://a:6443", "https://b:6443", "https://c:6443"}},
 		},
 		{
-			map[mesh.PeerName]int{123: 1, 456: 2},
-			map[mesh.PeerName]int{123: 0, 456: 3},
-			map[mesh.PeerName]int{123: 1, 456: 3},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{{Bytes: []byte("a"), Signature: []byte("sig-a")}}},
+			ClusterInfo{RootCAs: []*RootCAPublicKey{caA}}, // deduplicated by fingerprint
+		},
+		{
+			ClusterInfo{ApiserverURLs: []string{"https://a:6443"}},
+			ClusterInfo{ApiserverURLs: []string{"https://a:6443/", "https://A:6443", "https://a:6443/healthz"}},
+			ClusterInfo{ApiserverURLs: []string{"https://a:6443", "https://a:6443/healthz"}}, // deduplicated once normalized
 		},
 	} {
-		st := newState(999).mergeComplete(testcase.initial).(*state).mergeComplete(testcase.merge).(*state)
+		st := newTestState()
+		st = st.mergeComplete(testcase.initial).(*state).mergeComplete(testcase.merge).(*state)
 		if want, have := testcase.want, st.set; !reflect.DeepEqual(want, have) {
 			t.Errorf("%v mergeComplete %v: want %v, have %v", testcase.initial, testcase.merge, want, have)
 		}
 	}
 }
+
+func TestStateRotation(t *testing.T) {
+	var (
+		gen1 = &RootCAPublicKey{Bytes: []byte("gen1"), Generation: 1}
+		gen2 = &RootCAPublicKey{Bytes: []byte("gen2"), Generation: 2}
+		now  = time.Now()
+	)
+	st := newState(999, []*RootCAPublicKey{gen1}, nil, peerOptions{caOverlap: time.Hour}, newTextLogger(ioutil.Discard, "", 0))
+
+	st.mtx.Lock()
+	st.merge(ClusterInfo{RootCAs: []*RootCAPublicKey{gen2}}, now)
+	st.mtx.Unlock()
+	if want, have := []*RootCAPublicKey{gen1, gen2}, st.set.RootCAs; !reflect.DeepEqual(want, have) {
+		t.Errorf("during overlap: want %v, have %v", want, have)
+	}
+	if want, have := uint64(2), st.generation; want != have {
+		t.Errorf("trusted generation: want %d, have %d", want, have)
+	}
+
+	st.expire(now.Add(2 * time.Hour))
+	if want, have := []*RootCAPublicKey{gen2}, st.set.RootCAs; !reflect.DeepEqual(want, have) {
+		t.Errorf("after overlap: want %v, have %v", want, have)
+	}
+
+	// A peer that hasn't caught up yet must not resurrect the old generation.
+	st.mtx.Lock()
+	delta := st.merge(ClusterInfo{RootCAs: []*RootCAPublicKey{gen1}}, now.Add(3*time.Hour))
+	st.mtx.Unlock()
+	if !delta.empty() {
+		t.Errorf("stale generation: want empty delta, have %v", delta)
+	}
+	if want, have := []*RootCAPublicKey{gen2}, st.set.RootCAs; !reflect.DeepEqual(want, have) {
+		t.Errorf("stale generation: want %v, have %v", want, have)
+	}
+}
+
+func TestStateRetireAt(t *testing.T) {
+	var (
+		now      = time.Now()
+		gen1     = &RootCAPublicKey{Bytes: []byte("gen1"), Generation: 1, RetireAt: now.Add(time.Hour)}
+		gen2     = &RootCAPublicKey{Bytes: []byte("gen2"), Generation: 2}
+		bogus    = &RootCAPublicKey{Bytes: []byte("bogus"), Generation: 2, RetireAt: now.Add(time.Minute)}
+		untagged = &RootCAPublicKey{Bytes: []byte("gen1"), Generation: 1}
+	)
+	// We'd keep the old generation for a day, but the seed says an hour.
+	st := newState(999, nil, nil, peerOptions{caOverlap: 24 * time.Hour}, newTextLogger(ioutil.Discard, "", 0))
+	st.mtx.Lock()
+	st.merge(ClusterInfo{RootCAs: []*RootCAPublicKey{untagged, gen2, bogus}}, now)
+	st.merge(ClusterInfo{RootCAs: []*RootCAPublicKey{gen1}}, now)
+	st.mtx.Unlock()
+	if want, have := gen1, st.set.RootCAs[1]; !reflect.DeepEqual(want, have) {
+		t.Errorf("want the retirement kept, have %v", have)
+	}
+	if r := st.rotation(); r == nil || !r.RetireAt.Equal(gen1.RetireAt) || len(r.Previous) != 1 || len(r.Current) != 2 {
+		t.Errorf("rotation: want %v retiring at %v, have %+v", gen1.fingerprint(), gen1.RetireAt, r)
+	}
+
+	st.expire(now.Add(2 * time.Hour))
+	// A retirement on the current generation is ignored.
+	if want, have := []*RootCAPublicKey{{Bytes: []byte("bogus"), Generation: 2}, gen2}, st.set.RootCAs; !reflect.DeepEqual(want, have) {
+		t.Errorf("after retirement: want %v, have %v", want, have)
+	}
+	if r := st.rotation(); r != nil {
+		t.Errorf("rotation: want none, have %+v", r)
+	}
+}
+
+func TestStateSwapRootCAsRetiresOld(t *testing.T) {
+	var (
+		oldCert = newTestCert(t, testCATemplate)
+		newCert = newTestCert(t, testCATemplate)
+	)
+	st := newState(999, []*RootCAPublicKey{newRootCAPublicKey(oldCert, 0, 999)}, nil, peerOptions{caOverlap: time.Hour}, newTextLogger(ioutil.Discard, "", 0))
+	before := time.Now()
+	st.swapRootCAs([]*x509.Certificate{newCert})
+	for _, ca := range st.set.RootCAs {
+		switch {
+		case bytes.Equal(ca.Bytes, oldCert.Raw):
+			if ca.RetireAt.Before(before.Add(time.Hour)) || ca.RetireAt.After(time.Now().Add(time.Hour)) {
+				t.Errorf("old root CA: want retirement in an hour, have %v", ca.RetireAt)
+			}
+		case bytes.Equal(ca.Bytes, newCert.Raw):
+			if !ca.RetireAt.IsZero() {
+				t.Errorf("new root CA: want no retirement, have %v", ca.RetireAt)
+			}
+		}
+	}
+}
+
+func TestIntroduce(t *testing.T) {
+	then := time.Date(2017, 1, 2, 3, 4, 5, 0, time.UTC)
+	now := then.Add(time.Hour)
+	previous := &RootCAPublicKey{Bytes: []byte("a"), Introduced: then}
+	reloaded := &RootCAPublicKey{Bytes: []byte("a"), Origin: 0xabcd}
+	added := &RootCAPublicKey{Bytes: []byte("b"), Origin: 0xabcd}
+	introduce([]*RootCAPublicKey{reloaded, added}, "master-1", now, []*RootCAPublicKey{previous})
+	if !reloaded.Introduced.Equal(then) {
+		t.Errorf("reloaded: want introduced at %v, have %v", then, reloaded.Introduced)
+	}
+	if !added.Introduced.Equal(now) {
+		t.Errorf("added: want introduced at %v, have %v", now, added.Introduced)
+	}
+	want := "CA " + added.fingerprint() + " introduced by peer 00:00:00:00:ab:cd (master-1) at 2017-01-02T04:04:05Z"
+	if have := added.provenance(); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
+
+func TestPreferRootCAIntroduced(t *testing.T) {
+	now := time.Now()
+	first := &RootCAPublicKey{Bytes: []byte("a"), OriginNickname: "master-1", Introduced: now}
+	restarted := &RootCAPublicKey{Bytes: []byte("a"), OriginNickname: "master-1", Introduced: now.Add(time.Hour)}
+	unknown := &RootCAPublicKey{Bytes: []byte("a")}
+	for _, testcase := range []struct {
+		a, b *RootCAPublicKey
+		want bool
+	}{
+		{first, restarted, true},
+		{restarted, first, false},
+		{restarted, unknown, true},
+		{unknown, first, false},
+	} {
+		if want, have := testcase.want, preferRootCA(testcase.a, testcase.b); want != have {
+			t.Errorf("preferRootCA(%v, %v): want %v, have %v", testcase.a.Introduced, testcase.b.Introduced, want, have)
+		}
+	}
+}
+
+func TestStateMergeDiscardsExpiredRootCAs(t *testing.T) {
+	var (
+		now     = time.Now()
+		expired = &RootCAPublicKey{Bytes: []byte("expired"), NotAfter: now.Add(-time.Minute)}
+		valid   = &RootCAPublicKey{Bytes: []byte("valid"), NotAfter: now.Add(time.Minute)}
+	)
+	for _, testcase := range []struct {
+		allowExpired bool
+		want         []*RootCAPublicKey
+	}{
+		{false, []*RootCAPublicKey{valid}},
+		{true, []*RootCAPublicKey{expired, valid}},
+	} {
+		st := newState(999, nil, nil, peerOptions{allowExpiredCA: testcase.allowExpired}, newTextLogger(ioutil.Discard, "", 0))
+		st.Merge(&state{set: ClusterInfo{RootCAs: []*RootCAPublicKey{expired, valid}}})
+		if want, have := testcase.want, st.set.RootCAs; !reflect.DeepEqual(want, have) {
+			t.Errorf("allowExpired=%v: want %v, have %v", testcase.allowExpired, want, have)
+		}
+	}
+}
+
+func TestStateCapsRootCAs(t *testing.T) {
+	now := time.Now()
+	var cas []*RootCAPublicKey
+	for i, name := range []string{"oldest", "older", "newer", "newest"} {
+		cas = append(cas, &RootCAPublicKey{Bytes: []byte(name), NotBefore: now.Add(time.Duration(i-10) * time.Hour), NotAfter: now.Add(time.Hour)})
+	}
+	st := newState(999, nil, nil, peerOptions{maxCAs: 2}, newTextLogger(ioutil.Discard, "", 0))
+	d := st.merge(ClusterInfo{RootCAs: cas[:3]}, now)
+	want := []*RootCAPublicKey{cas[2], cas[1]}
+	if have := st.set.RootCAs; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	if have := d.RootCAs; !reflect.DeepEqual(want, have) {
+		t.Errorf("want delta %v, have %v", want, have)
+	}
+	// Gossiping an evicted root CA back changes nothing.
+	if d := st.merge(ClusterInfo{RootCAs: cas[:1]}, now); len(d.RootCAs) != 0 {
+		t.Errorf("want no delta, have %v", d.RootCAs)
+	}
+	// A newer one evicts the oldest we have.
+	d = st.merge(ClusterInfo{RootCAs: cas}, now)
+	want = []*RootCAPublicKey{cas[2], cas[3]}
+	if have := st.set.RootCAs; !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	if want, have := []*RootCAPublicKey{cas[3]}, d.RootCAs; !reflect.DeepEqual(want, have) {
+		t.Errorf("want delta %v, have %v", want, have)
+	}
+
+	// The sweep reports what it drops, so we can broadcast it.
+	if st.expire(now) {
+		t.Error("want nothing dropped yet")
+	}
+	if !st.expire(now.Add(2 * time.Hour)) {
+		t.Error("want the expired root CAs dropped")
+	}
+	if len(st.set.RootCAs) != 0 {
+		t.Errorf("want no root CAs, have %v", st.set.RootCAs)
+	}
+}
+
+func TestStateRootCAConflict(t *testing.T) {
+	var (
+		now   = time.Now()
+		older = &RootCAPublicKey{Bytes: []byte("older"), NotBefore: now.Add(-time.Hour), Origin: 1}
+		newer = &RootCAPublicKey{Bytes: []byte("newer"), NotBefore: now, Origin: 2}
+		also2 = &RootCAPublicKey{Bytes: []byte("also2"), NotBefore: now.Add(-2 * time.Hour), Origin: 2}
+	)
+	for _, order := range [][]*RootCAPublicKey{{older, newer, also2}, {also2, newer, older}} {
+		st := newTestState()
+		for _, ca := range order {
+			st.mergeComplete(ClusterInfo{RootCAs: []*RootCAPublicKey{ca}})
+		}
+		if want, have := []*RootCAPublicKey{also2, newer}, st.trustedRootCAs(); !reflect.DeepEqual(want, have) {
+			t.Errorf("%v: want trusted %v, have %v", order, want, have)
+		}
+		if want, have := 3, len(st.set.RootCAs); want != have {
+			t.Errorf("%v: want all %d root CAs kept on record, have %d", order, want, have)
+		}
+	}
+
+	// The same certificate seeded by two peers is not a conflict,
+	// and everyone keeps the same entry for it.
+	st := newTestState()
+	st.mergeComplete(ClusterInfo{RootCAs: []*RootCAPublicKey{{Bytes: []byte("same"), Origin: 2}}})
+	st.mergeComplete(ClusterInfo{RootCAs: []*RootCAPublicKey{{Bytes: []byte("same"), Origin: 1}}})
+	if winner, _ := findConflict(st.set.RootCAs, st.generation); winner != nil {
+		t.Errorf("identical certificates: unexpected conflict, won by %v", winner)
+	}
+	if want, have := mesh.PeerName(1), st.set.RootCAs[0].Origin; want != have {
+		t.Errorf("identical certificates: want origin %s, have %s", want, have)
+	}
+}
+
+func TestStateSubjectConflict(t *testing.T) {
+	named := func(cn string) x509.Certificate {
+		template := testCATemplate
+		template.Subject = pkix.Name{CommonName: cn}
+		return template
+	}
+	var (
+		a     = newRootCAPublicKey(newTestCert(t, named("kubernetes")), 0, 1)
+		b     = newRootCAPublicKey(newTestCert(t, named("kubernetes")), 0, 1)
+		other = newRootCAPublicKey(newTestCert(t, named("front-proxy")), 0, 1)
+		next  = newRootCAPublicKey(newTestCert(t, named("kubernetes")), 1, 1)
+	)
+	for _, testcase := range []struct {
+		name      string
+		cas       []*RootCAPublicKey
+		trusted   []*RootCAPublicKey
+		conflicts int
+	}{
+		{"no conflict", []*RootCAPublicKey{a, other}, []*RootCAPublicKey{a, other}, 0},
+		{"same subject, different keys", []*RootCAPublicKey{a, b, other}, []*RootCAPublicKey{other}, 1},
+		{"rotation to a new key", []*RootCAPublicKey{a, next}, []*RootCAPublicKey{a, next}, 0},
+	} {
+		st := newState(999, nil, nil, peerOptions{caOverlap: time.Hour}, newTextLogger(ioutil.Discard, "", 0))
+		st.mergeComplete(ClusterInfo{RootCAs: testcase.cas})
+		want := append([]*RootCAPublicKey{}, testcase.trusted...)
+		sortRootCAs(want)
+		if have := st.trustedRootCAs(); !reflect.DeepEqual(want, have) {
+			t.Errorf("%s: want trusted %v, have %v", testcase.name, want, have)
+		}
+		if want, have := testcase.conflicts, len(findSubjectConflicts(st.set.RootCAs)); want != have {
+			t.Errorf("%s: want %d conflicts, have %d", testcase.name, want, have)
+		}
+	}
+}
+
+func TestBetterRootCA(t *testing.T) {
+	now := time.Now()
+	for _, testcase := range []struct {
+		a, b *RootCAPublicKey
+		want bool
+	}{
+		{&RootCAPublicKey{Generation: 2, NotBefore: now}, &RootCAPublicKey{Generation: 1, NotBefore: now.Add(time.Hour)}, true},
+		{&RootCAPublicKey{Generation: 1, NotBefore: now.Add(time.Hour)}, &RootCAPublicKey{Generation: 2, NotBefore: now}, false},
+		{&RootCAPublicKey{NotBefore: now, NotAfter: now.Add(time.Hour)}, &RootCAPublicKey{NotBefore: now.Add(time.Hour), NotAfter: now}, false},
+		{&RootCAPublicKey{NotBefore: now}, &RootCAPublicKey{NotBefore: now.Add(-time.Hour)}, true},
+		// sha256("a") = ca978112..., sha256("b") = 3e23e816...
+		{&RootCAPublicKey{Bytes: []byte("b")}, &RootCAPublicKey{Bytes: []byte("a")}, true},
+		{&RootCAPublicKey{Bytes: []byte("a")}, &RootCAPublicKey{Bytes: []byte("b")}, false},
+	} {
+		if want, have := testcase.want, betterRootCA(testcase.a, testcase.b); want != have {
+			t.Errorf("betterRootCA(%v, %v): want %v, have %v", testcase.a, testcase.b, want, have)
+		}
+	}
+}
+
+func TestMergeRootCAsConverges(t *testing.T) {
+	now := time.Now()
+	// Several entries per certificate, as seeded by different peers,
+	// generations, and rotations.
+	var entries []*RootCAPublicKey
+	for _, ca := range []*RootCAPublicKey{caA, caB, caC} {
+		for _, generation := range []uint64{1, 2} {
+			for _, origin := range []mesh.PeerName{1, 2} {
+				for _, retireAt := range []time.Time{{}, now.Add(time.Hour)} {
+					entry := *ca
+					entry.Generation, entry.Origin, entry.RetireAt = generation, origin, retireAt
+					entries = append(entries, &entry)
+				}
+			}
+		}
+	}
+	all, _ := mergeRootCAs(nil, entries)
+	if want, have := 3, len(all); want != have {
+		t.Fatalf("want %d root CAs, have %d", want, have)
+	}
+	winner, _ := findConflict(all, 2)
+
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		shuffled := append([]*RootCAPublicKey{}, entries...)
+		rng.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		// Merge in randomly sized messages, in the shuffled order.
+		var have []*RootCAPublicKey
+		for len(shuffled) > 0 {
+			n := 1 + rng.Intn(len(shuffled))
+			have, _ = mergeRootCAs(have, shuffled[:n])
+			shuffled = shuffled[n:]
+		}
+		if !reflect.DeepEqual(all, have) {
+			t.Fatalf("order %d: want %v, have %v", i, all, have)
+		}
+		// Idempotent, too.
+		if again, delta := mergeRootCAs(have, have); !reflect.DeepEqual(all, again) || len(delta) != 0 {
+			t.Fatalf("order %d: merging with itself gave %v, delta %v", i, again, delta)
+		}
+		if w, _ := findConflict(have, 2); w != winner {
+			t.Fatalf("order %d: want winner %v, have %v", i, winner, w)
+		}
+	}
+}
+
+// randomClusterInfo draws root CAs and apiserver URLs from small pools,
+// so that peers often hold different entries for the same certificate.
+func randomClusterInfo(rng *rand.Rand, now time.Time) ClusterInfo {
+	var info ClusterInfo
+	for i := rng.Intn(4); i > 0; i-- {
+		ca := &RootCAPublicKey{
+			Bytes:      []byte{byte('a' + rng.Intn(4))},
+			Generation: uint64(rng.Intn(3)),
+			Origin:     mesh.PeerName(1 + rng.Intn(3)),
+		}
+		ca.Signature = append([]byte("sig-"), ca.Bytes...)
+		if rng.Intn(3) == 0 {
+			ca.RetireAt = now.Add(time.Duration(1+rng.Intn(3)) * time.Hour)
+		}
+		if rng.Intn(2) == 0 {
+			ca.Stamp = Stamp{Clock: uint64(1 + rng.Intn(3)), Peer: ca.Origin}
+		}
+		info.RootCAs = append(info.RootCAs, ca)
+	}
+	for i := rng.Intn(3); i > 0; i-- {
+		info.ApiserverURLs = append(info.ApiserverURLs, fmt.Sprintf("https://10.0.0.%d:6443", rng.Intn(4)))
+	}
+	return info
+}
+
+// wire is what a peer receives when st is gossiped to it.
+func wire(t *testing.T, st mesh.GossipData) ClusterInfo {
+	set, err := decodeClusterInfo(st.Encode()[0], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return set
+}
+
+func TestMergeClusterInfoProperties(t *testing.T) {
+	now := time.Now()
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		a, b, c := randomClusterInfo(rng, now), randomClusterInfo(rng, now), randomClusterInfo(rng, now)
+		ab, _ := mergeClusterInfo(a, b)
+		ba, _ := mergeClusterInfo(b, a)
+		if !reflect.DeepEqual(ab, ba) {
+			t.Fatalf("not commutative:\n%v\n%v", ab, ba)
+		}
+		abc, _ := mergeClusterInfo(ab, c)
+		bc, _ := mergeClusterInfo(b, c)
+		abc2, _ := mergeClusterInfo(a, bc)
+		if !reflect.DeepEqual(abc, abc2) {
+			t.Fatalf("not associative:\n%v\n%v", abc, abc2)
+		}
+		if again, delta := mergeClusterInfo(ab, ab); !reflect.DeepEqual(ab, again) || !delta.empty() {
+			t.Fatalf("not idempotent:\n%v\n%v, delta %v", ab, again, delta)
+		}
+	}
+}
+
+func TestStateGossipConverges(t *testing.T) {
+	now := time.Now()
+	for seed := int64(0); seed < 50; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		peers := make([]*state, 2+rng.Intn(4))
+		for i := range peers {
+			peers[i] = newState(mesh.PeerName(i+1), nil, nil, peerOptions{caOverlap: time.Hour}, newTextLogger(ioutil.Discard, "", 0))
+			peers[i].mergeComplete(randomClusterInfo(rng, now))
+		}
+		// Gossip in a random order, the way each of mesh's callbacks would.
+		for i := 0; i < 20; i++ {
+			src, dst := peers[rng.Intn(len(peers))], peers[rng.Intn(len(peers))]
+			switch rng.Intn(4) {
+			case 0:
+				dst.mergeDelta(wire(t, src.copy()))
+			case 1:
+				dst.mergeReceived(wire(t, src.copy()))
+			case 2:
+				dst.mergeComplete(wire(t, src.copy()))
+			case 3:
+				// Mesh merges updates queued for a peer before sending them.
+				queued := src.copy()
+				queued.Merge(peers[rng.Intn(len(peers))].copy())
+				dst.mergeReceived(wire(t, queued))
+			}
+		}
+		// Then let every peer hear from every other, until nothing changes.
+		for changed := true; changed; {
+			changed = false
+			for _, src := range peers {
+				for _, dst := range peers {
+					if dst.mergeDelta(wire(t, src.copy())) != nil {
+						changed = true
+					}
+				}
+			}
+		}
+		want := wire(t, peers[0])
+		for i, p := range peers[1:] {
+			if have := wire(t, p); !reflect.DeepEqual(want, have) {
+				t.Fatalf("seed %d: peer %d has\n%v\npeer 1 has\n%v", seed, i+2, have, want)
+			}
+		}
+	}
+}
+
+func TestStateExpiryWarning(t *testing.T) {
+	now := time.Now()
+	soon := newTestCert(t, x509.Certificate{
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		NotAfter:              now.Add(24 * time.Hour),
+		Subject:               pkix.Name{CommonName: "soon"},
+	})
+	later := newTestCert(t, x509.Certificate{
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		Subject:               pkix.Name{CommonName: "later"},
+	})
+	// As gossiped by peers that predate NotAfter.
+	legacy := newRootCAPublicKey(soon, 0, 999)
+	legacy.NotAfter = time.Time{}
+
+	var logs bytes.Buffer
+	st := newState(999, nil, nil, peerOptions{caExpiryWarning: 30 * 24 * time.Hour}, newTextLogger(&logs, "", 0))
+	if have := st.firstExpiry(); !have.IsZero() {
+		t.Errorf("no root CAs: want no expiry, have %v", have)
+	}
+	st.mergeComplete(ClusterInfo{RootCAs: []*RootCAPublicKey{legacy, newRootCAPublicKey(later, 0, 999)}})
+	if want, have := soon.NotAfter, st.firstExpiry(); !want.Equal(have) {
+		t.Errorf("want first expiry %v, have %v", want, have)
+	}
+	logs.Reset()
+	st.warnExpiry(st.trustedRootCAs(), now)
+	if want := legacy.fingerprint() + " expires in"; !bytes.Contains(logs.Bytes(), []byte(want)) {
+		t.Errorf("want %q in the logs, have\n%s", want, logs.Bytes())
+	}
+	if bytes.Contains(logs.Bytes(), []byte(newRootCAPublicKey(later, 0, 999).fingerprint())) {
+		t.Errorf("want no warning about the later root CA, have\n%s", logs.Bytes())
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/weaveworks/mesh"
+)
+
+// stateRequestWire, as the whole of a unicast on nodeBootstrapChannelV1,
+// asks the receiver to unicast us its complete state. It is no wire
+// version, and only goes on v1, whose peers all know it, so none drop it
+// as of an unknown version.
+const stateRequestWire = 0x7f
+
+// stateRequestPoll is how often a peer looks for its first connection,
+// to ask it for the state.
+const stateRequestPoll = 100 * time.Millisecond
+
+// maxStateRequestBackoff caps how long we wait for an answer before
+// asking another peer.
+const maxStateRequestBackoff = time.Minute
+
+// stateAnswerInterval is how often, at most, we answer state requests
+// from the same peer, which only need repeating after a timeout, so that
+// no peer can have us unicast our complete state at it over and over.
+const stateAnswerInterval = 10 * stateRequestPoll
+
+var stateRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "kubelet_mesh",
+	Name:      "state_requests_total",
+	Help:      "Requests for a peer's complete state on joining, by whether we sent, answered or ignored them.",
+}, []string{"direction"})
+
+func init() {
+	prometheus.MustRegister(stateRequests)
+}
+
+// requestState asks a connected peer for its complete state as soon as
+// we have one, so that on joining we needn't wait for the next gossip
+// round, or its full sync, to learn the root CAs and apiservers. If no
+// complete state comes within timeout, it asks the next connected peer,
+// waiting twice as long each time, up to maxStateRequestBackoff. The
+// answer is an ordinary unicast, checked and merged as any other is; it
+// stops once one with a root CA or an apiserver is, as one without may
+// well be from a peer as new as we are, or once we know a root CA and an
+// apiserver anyway, say as a seed, or from gossip.
+func (p *peer) requestState(connected func() []mesh.PeerName, timeout time.Duration, quit <-chan struct{}) {
+	backoff := timeout
+	for attempt := 0; ; {
+		if p.knowsCAAndAPIServer() {
+			return
+		}
+		var wait time.Duration
+		if peers := connected(); len(peers) == 0 {
+			wait = stateRequestPoll
+		} else {
+			dst := peers[attempt%len(peers)]
+			attempt++
+			p.sendStateRequest(dst)
+			wait = backoff
+			if backoff *= 2; backoff > maxStateRequestBackoff {
+				backoff = maxStateRequestBackoff
+			}
+		}
+		select {
+		case <-p.synced:
+			return
+		case <-time.After(wait):
+		case <-quit:
+			return
+		}
+		if attempt > 0 {
+			p.logger.Debugf("No complete state after %d state request(s), asking again", attempt)
+		}
+	}
+}
+
+// sendStateRequest asks dst for its complete state, from the peer's
+// loop, which owns our channels.
+func (p *peer) sendStateRequest(dst mesh.PeerName) {
+	f := func() {
+		ch := p.channels[0]
+		if ch.send == nil {
+			return
+		}
+		if err := ch.send.GossipUnicast(dst, []byte{stateRequestWire}); err != nil {
+			p.logger.Debugf("State request to %s: %v", dst, err)
+			return
+		}
+		stateRequests.WithLabelValues("sent").Inc()
+		p.logger.Debugf("Asked %s for its complete state", dst)
+	}
+	select {
+	case p.actions <- f:
+	case <-p.quit:
+	}
+}
+
+// isStateRequest reports whether buf, on ch, is a stateRequestWire.
+func (p *peer) isStateRequest(ch *gossipChannel, buf []byte) bool {
+	return ch == p.channels[0] && len(buf) == 1 && buf[0] == stateRequestWire
+}
+
+// knowsCAAndAPIServer reports whether we know a root CA we trust and an
+// apiserver, which is what requestState is for.
+func (p *peer) knowsCAAndAPIServer() bool {
+	p.st.mtx.RLock()
+	defer p.st.mtx.RUnlock()
+	return len(p.st.trustedRootCAs()) > 0 && len(p.st.set.ApiserverURLs) > 0
+}
+
+// answerStateRequest unicasts src our complete state, unless we are
+// still doing so, or did within stateAnswerInterval. Not from mesh's
+// goroutine, which must not wait on our loop while it may be sending.
+func (p *peer) answerStateRequest(src mesh.PeerName) {
+	if !p.answers.start(src, time.Now()) {
+		stateRequests.WithLabelValues("ignored").Inc()
+		p.logger.Debugf("Ignoring state request from %s, which we answered just now", src)
+		return
+	}
+	stateRequests.WithLabelValues("answered").Inc()
+	go func() {
+		defer p.answers.done(src)
+		p.unicastComplete(src)
+	}()
+}
+
+// stateAnswers limits the state requests we answer, by the peer asking.
+type stateAnswers struct {
+	mtx  sync.Mutex
+	last map[mesh.PeerName]time.Time // when we last started an answer
+	busy map[mesh.PeerName]bool      // still answering
+}
+
+// start reports whether to answer src at now, and if so, notes that we
+// are, until done.
+func (a *stateAnswers) start(src mesh.PeerName, now time.Time) bool {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if a.last == nil {
+		a.last, a.busy = map[mesh.PeerName]time.Time{}, map[mesh.PeerName]bool{}
+	}
+	if last, ok := a.last[src]; a.busy[src] || ok && now.Sub(last) < stateAnswerInterval {
+		return false
+	}
+	for name, last := range a.last {
+		if now.Sub(last) >= stateAnswerInterval {
+			delete(a.last, name)
+		}
+	}
+	a.last[src], a.busy[src] = now, true
+	return true
+}
+
+// done notes that we have answered src.
+func (a *stateAnswers) done(src mesh.PeerName) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	delete(a.busy, src)
+}
+
+// markSynced notes that we have merged a complete state from a peer.
+func (p *peer) markSynced() {
+	p.syncedOnce.Do(func() { close(p.synced) })
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+func TestPeerRequestsStateOnJoin(t *testing.T) {
+	m := newMemMesh(t, peerOptions{skipCAValidation: true}, []testPeerSeed{
+		{cas: 1, apiservers: []string{"https://a:6443"}},
+		{},
+	})
+	defer m.stop()
+	m.link(0, 1)
+	seed, joiner := m.peers[0], m.peers[1]
+
+	// Peer 3 isn't there to answer, so the joiner asks again, of the
+	// seed, after the timeout; and no gossip round runs.
+	var polls int
+	connected := func() []mesh.PeerName {
+		if polls++; polls == 1 {
+			return nil
+		}
+		return []mesh.PeerName{3, seed.self}
+	}
+	done := make(chan struct{})
+	go func() {
+		joiner.requestState(connected, 10*time.Millisecond, joiner.quit)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no complete state from the seed")
+	}
+	m.wg.Wait()
+	if polls < 3 {
+		t.Errorf("want it to wait for a connection, then ask twice, have %d polls", polls)
+	}
+	snapshot := joiner.snapshot()
+	if len(snapshot.RootCAs) != 1 || len(snapshot.ApiserverURLs) != 1 {
+		t.Errorf("want the seed's root CA and apiserver, have %v and %v", snapshot.RootCAs, snapshot.ApiserverURLs)
+	}
+}
+
+func TestStateRequestOnlyOnV1(t *testing.T) {
+	p := newNodeBootstrapPeer(mesh.PeerName(1), "test", []*RootCAPublicKey{caA}, nil, peerOptions{
+		skipCAValidation: true,
+		channelCompat:    true,
+	}, newTextLogger(ioutil.Discard, "", 0))
+	defer p.stop()
+	v1, v0 := &recordingGossip{}, &recordingGossip{}
+	p.register(v1)
+	p.registerOn(p.channels[1], v0)
+
+	// On v0 it's a payload of an unknown version, dropped.
+	if err := (channelGossiper{p, p.channels[1]}).OnGossipUnicast(2, []byte{stateRequestWire}); err != nil {
+		t.Fatal(err)
+	}
+	// Asked again and again, we answer once.
+	for i := 0; i < 3; i++ {
+		if err := p.OnGossipUnicast(2, []byte{stateRequestWire}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, unicasts := v1.sent()
+		if len(unicasts[2]) > 0 {
+			if set, err := decodeClusterInfo(unicasts[2][0], nil); err != nil || len(set.RootCAs) != 1 {
+				t.Errorf("want our state, have %+v, %v", set, err)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no answer on v1")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, unicasts := v0.sent(); len(unicasts) != 0 {
+		t.Errorf("want no answer on v0, have %v", unicasts)
+	}
+	// Let any answer we shouldn't have sent through the loop.
+	done := make(chan struct{})
+	p.actions <- func() { close(done) }
+	<-done
+	if _, unicasts := v1.sent(); len(unicasts[2]) != 1 {
+		t.Errorf("want one answer, have %d", len(unicasts[2]))
+	}
+}
+
+func TestStateAnswers(t *testing.T) {
+	var a stateAnswers
+	now := time.Now()
+	for _, testcase := range []struct {
+		src  mesh.PeerName
+		at   time.Duration
+		done bool // whether to finish answering
+		want bool
+	}{
+		{1, 0, false, true},
+		{1, stateAnswerInterval, false, false}, // still answering
+		{2, 0, true, true},
+		{2, stateAnswerInterval / 2, false, false},
+		{2, stateAnswerInterval, true, true},
+		{1, stateAnswerInterval, false, false},
+	} {
+		if have := a.start(testcase.src, now.Add(testcase.at)); have != testcase.want {
+			t.Errorf("%s at %v: want %v, have %v", testcase.src, testcase.at, testcase.want, have)
+		}
+		if testcase.done {
+			a.done(testcase.src)
+		}
+	}
+	a.done(1)
+	if !a.start(1, now.Add(stateAnswerInterval)) {
+		t.Error("want 1 answered once done")
+	}
+}
+
+func TestSeedRequestsNoState(t *testing.T) {
+	p := newNodeBootstrapPeer(mesh.PeerName(1), "test", []*RootCAPublicKey{caA}, []string{"https://a:6443"}, peerOptions{skipCAValidation: true}, newTextLogger(ioutil.Discard, "", 0))
+	defer p.stop()
+	v1 := &recordingGossip{}
+	p.register(v1)
+	done := make(chan struct{})
+	go func() {
+		p.requestState(func() []mesh.PeerName { return []mesh.PeerName{2} }, time.Millisecond, p.quit)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("want a peer that knows a root CA and an apiserver not to ask")
+	}
+	if _, unicasts := v1.sent(); len(unicasts) != 0 {
+		t.Errorf("want no state requests, have %v", unicasts)
+	}
+}
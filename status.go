@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// logStatus logs a summary of our connections and state every interval,
+// until quit is closed.
+func logStatus(router *mesh.Router, p *peer, interval time.Duration, quit <-chan struct{}, logger *levelLogger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			logger.Infof("%v", statusLine(mesh.NewStatus(router), p.snapshot()))
+		case <-quit:
+			return
+		}
+	}
+}
+
+// logConnections polls our mesh connections every interval, until quit
+// is closed, and logs every one that comes, goes, or changes state, so
+// that flapping peers show up between status summaries. It counts the
+// failed attempts to connect to each target in retries, too.
+func logConnections(router *mesh.Router, interval time.Duration, retries *connRetries, quit <-chan struct{}, logger *levelLogger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var last []mesh.LocalConnectionStatus
+	for {
+		select {
+		case now := <-ticker.C:
+			conns := mesh.NewStatus(router).Connections
+			retries.observe(conns, now)
+			for _, line := range diffConnections(last, conns) {
+				logger.Infof("%s", line)
+			}
+			last = conns
+		case <-quit:
+			return
+		}
+	}
+}
+
+// diffConnections describes what changed from prev to conns.
+func diffConnections(prev, conns []mesh.LocalConnectionStatus) (lines []string) {
+	key := func(c mesh.LocalConnectionStatus) string {
+		return fmt.Sprintf("%s %v", c.Address, c.Outbound)
+	}
+	describe := func(c mesh.LocalConnectionStatus) string {
+		direction := "from"
+		if c.Outbound {
+			direction = "to"
+		}
+		return fmt.Sprintf("connection %s %s", direction, c.Address)
+	}
+	withInfo := func(c mesh.LocalConnectionStatus) string {
+		if c.Info == "" {
+			return c.State
+		}
+		return fmt.Sprintf("%s: %s", c.State, c.Info)
+	}
+	before := map[string]mesh.LocalConnectionStatus{}
+	for _, c := range prev {
+		before[key(c)] = c
+	}
+	now := map[string]bool{}
+	for _, c := range conns {
+		now[key(c)] = true
+		old, ok := before[key(c)]
+		switch {
+		case !ok:
+			lines = append(lines, fmt.Sprintf("Mesh %s added (%s)", describe(c), withInfo(c)))
+		case old.State != c.State:
+			lines = append(lines, fmt.Sprintf("Mesh %s went from %s to %s", describe(c), old.State, withInfo(c)))
+		}
+	}
+	for _, c := range prev {
+		if !now[key(c)] {
+			lines = append(lines, fmt.Sprintf("Mesh %s removed (was %s)", describe(c), c.State))
+		}
+	}
+	return lines
+}
+
+func statusLine(status *mesh.Status, snapshot stateSnapshot) string {
+	conns := make([]string, 0, len(status.Connections))
+	for _, conn := range status.Connections {
+		conns = append(conns, fmt.Sprintf("%s (%s)", conn.Address, conn.State))
+	}
+	line := fmt.Sprintf("Status: %d connection(s) [%s], %d root CA(s), %d apiserver URL(s), %d root CA(s) rejected",
+		len(conns), strings.Join(conns, ", "), len(snapshot.RootCAs), len(snapshot.ApiserverURLs),
+		snapshot.RejectedRootCAs+snapshot.CAHashMismatches)
+	if r := snapshot.Rotation; r != nil {
+		line += fmt.Sprintf(", rotating root CA from [%s] to [%s], retiring at %v",
+			strings.Join(r.Previous, ", "), strings.Join(r.Current, ", "), r.RetireAt)
+	}
+	for _, p := range snapshot.Provenance {
+		line += "; " + p
+	}
+	for _, r := range snapshot.ConnectionRetries {
+		line += "; connecting to " + r.String()
+	}
+	if len(snapshot.Channels) > 0 {
+		var channels []string
+		for _, c := range snapshot.Channels {
+			channels = append(channels, c.String())
+		}
+		line += "; gossiping on " + strings.Join(channels, " and ")
+	}
+	return line
+}
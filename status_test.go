@@ -0,0 +1,38 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/weaveworks/mesh"
+)
+
+func TestDiffConnections(t *testing.T) {
+	pending := mesh.LocalConnectionStatus{Address: "10.0.0.2:6783", Outbound: true, State: "pending"}
+	established := mesh.LocalConnectionStatus{Address: "10.0.0.2:6783", Outbound: true, State: "established"}
+	inbound := mesh.LocalConnectionStatus{Address: "10.0.0.3:41234", State: "established"}
+	failed := mesh.LocalConnectionStatus{Address: "10.0.0.4:6783", Outbound: true, State: "failed", Info: "connection refused"}
+	for _, testcase := range []struct {
+		name        string
+		prev, conns []mesh.LocalConnectionStatus
+		want        []string
+	}{
+		{"nothing", nil, nil, nil},
+		{"unchanged", []mesh.LocalConnectionStatus{established}, []mesh.LocalConnectionStatus{established}, nil},
+		{"added", nil, []mesh.LocalConnectionStatus{pending, inbound}, []string{
+			"Mesh connection to 10.0.0.2:6783 added (pending)",
+			"Mesh connection from 10.0.0.3:41234 added (established)",
+		}},
+		{"established", []mesh.LocalConnectionStatus{pending}, []mesh.LocalConnectionStatus{established}, []string{
+			"Mesh connection to 10.0.0.2:6783 went from pending to established",
+		}},
+		{"failed", []mesh.LocalConnectionStatus{established, inbound}, []mesh.LocalConnectionStatus{failed, inbound}, []string{
+			"Mesh connection to 10.0.0.4:6783 added (failed: connection refused)",
+			"Mesh connection to 10.0.0.2:6783 removed (was established)",
+		}},
+	} {
+		if have := diffConnections(testcase.prev, testcase.conns); !reflect.DeepEqual(testcase.want, have) {
+			t.Errorf("%s: want %q, have %q", testcase.name, testcase.want, have)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// tofuPin pins the public key of the first gossiped root CA we accept
+// (trust on first use), and remembers it in a file across restarts.
+// Only removing the file, e.g. with -tofu-reset, moves the pin; that
+// includes a root CA rotation to a new key.
+type tofuPin struct {
+	mtx  sync.Mutex
+	path string
+	hash string // empty until the first root CA is accepted
+}
+
+// loadTOFUPin reads the pin from path, if there is one yet.
+func loadTOFUPin(path string) (*tofuPin, error) {
+	t := &tofuPin{path: path}
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return t, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if t.hash, err = parseCAHash(strings.TrimSpace(string(buf))); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return t, nil
+}
+
+// check accepts ca if its public key is pinned, or pins it if nothing
+// is pinned yet. It reports whether it pinned ca.
+func (t *tofuPin) check(ca *RootCAPublicKey) (pinned bool, err error) {
+	cert, err := x509.ParseCertificate(ca.Bytes)
+	if err != nil {
+		return false, err
+	}
+	hash := spkiHash(cert)
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.hash == "" {
+		if err := writeFileAtomic(t.path, []byte(hash+"\n"), 0600); err != nil {
+			return false, fmt.Errorf("pinning public key hash %s: %v", hash, err)
+		}
+		t.hash = hash
+		return true, nil
+	}
+	if hash != t.hash {
+		return false, fmt.Errorf("public key hash %s does not match %s, pinned on first use in %s", hash, t.hash, t.path)
+	}
+	return false, nil
+}
+
+// allows reports, as an error, whether check would reject ca, but never
+// pins it: for root CAs that must pass more checks before they may take
+// the pin.
+func (t *tofuPin) allows(ca *RootCAPublicKey) error {
+	cert, err := x509.ParseCertificate(ca.Bytes)
+	if err != nil {
+		return err
+	}
+	hash := spkiHash(cert)
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.hash != "" && hash != t.hash {
+		return fmt.Errorf("public key hash %s does not match %s, pinned on first use in %s", hash, t.hash, t.path)
+	}
+	return nil
+}
+
+// matches reports whether hash is pinned. Unlike check, it never pins.
+func (t *tofuPin) matches(hash string) bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.hash != "" && hash == t.hash
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTOFUPin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet-mesh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ca-fingerprint")
+
+	certA, certB := newTestCert(t, testCATemplate), newTestCert(t, testCATemplate)
+	a, b := newRootCAPublicKey(certA, 0, 1), newRootCAPublicKey(certB, 0, 2)
+
+	pin, err := loadTOFUPin(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, testcase := range []struct {
+		ca     *RootCAPublicKey
+		pinned bool
+		ok     bool
+	}{
+		{a, true, true},
+		{a, false, true},
+		{b, false, false},
+	} {
+		pinned, err := pin.check(testcase.ca)
+		if want, have := testcase.pinned, pinned; want != have {
+			t.Errorf("%s: want pinned %v, have %v", testcase.ca.fingerprint(), want, have)
+		}
+		if want, have := testcase.ok, err == nil; want != have {
+			t.Errorf("%s: want ok %v, have %v (%v)", testcase.ca.fingerprint(), want, have, err)
+		}
+	}
+
+	// The pin survives a restart.
+	if pin, err = loadTOFUPin(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pin.check(b); err == nil {
+		t.Errorf("want %s rejected after reload", b.fingerprint())
+	}
+	if buf, _ := ioutil.ReadFile(path); strings.TrimSpace(string(buf)) != spkiHash(certA) {
+		t.Errorf("want %s in %s, have %q", spkiHash(certA), path, buf)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("md5:abc\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTOFUPin(path); err == nil {
+		t.Errorf("want error for a malformed pin file")
+	}
+}
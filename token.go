@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// BootstrapToken is a kubelet TLS bootstrap token, gossiped alongside
+// the root CAs so that a new node has everything it needs to join.
+type BootstrapToken struct {
+	// Token is of the form <id>.<secret>, as kubeadm generates them.
+	Token string
+	// Expires is when peers stop gossiping the token.
+	Expires time.Time
+	// Origin is the peer that seeded the token.
+	Origin mesh.PeerName
+	// Stamp is Origin's, from when it seeded the token.
+	Stamp Stamp
+}
+
+var bootstrapTokenRE = regexp.MustCompile(`^[a-z0-9]{6}\.[a-z0-9]{16}$`)
+
+// validateBootstrapToken checks that token looks like a bootstrap token.
+func validateBootstrapToken(token string) error {
+	if !bootstrapTokenRE.MatchString(token) {
+		return fmt.Errorf("bootstrap token must be of the form [a-z0-9]{6}.[a-z0-9]{16}")
+	}
+	return nil
+}
+
+// String keeps the secret half of the token out of logs.
+func (t *BootstrapToken) String() string {
+	return fmt.Sprintf("%s (expires %v)", redactToken(t.Token), t.Expires)
+}
+
+func (t *BootstrapToken) expired(now time.Time) bool {
+	return now.After(t.Expires)
+}
+
+// bootstrapTokenIDRE is the ID half of a bootstrap token.
+var bootstrapTokenIDRE = regexp.MustCompile(`^[a-z0-9]{6}$`)
+
+// validateBootstrapTokenID checks that id looks like a bootstrap token ID.
+func validateBootstrapTokenID(id string) error {
+	if !bootstrapTokenIDRE.MatchString(id) {
+		return fmt.Errorf("bootstrap token ID must be of the form [a-z0-9]{6}")
+	}
+	return nil
+}
+
+// bootstrapTokenID is the part of token before the dot.
+func bootstrapTokenID(token string) string {
+	if i := strings.Index(token, "."); i >= 0 {
+		return token[:i]
+	}
+	return token
+}
+
+// redactToken keeps only the token ID, which isn't secret.
+func redactToken(token string) string {
+	if i := strings.Index(token, "."); i >= 0 {
+		return token[:i] + ".<redacted>"
+	}
+	return "<redacted>"
+}
+
+func mergeBootstrapTokens(ours, theirs []*BootstrapToken) (result, delta []*BootstrapToken) {
+	all := append(append([]*BootstrapToken(nil), ours...), theirs...)
+	keep, changed := mergeKeyed(len(ours), len(theirs),
+		func(i int) string { return all[i].Token },
+		func(i, j int) bool { return preferBootstrapToken(all[i], all[j]) })
+	for _, i := range keep {
+		result = append(result, all[i])
+	}
+	for _, i := range changed {
+		delta = append(delta, all[i])
+	}
+	sortBootstrapTokens(result)
+	sortBootstrapTokens(delta)
+	return result, delta
+}
+
+// preferBootstrapToken decides between two entries for the same token,
+// as preferRootCA does for root CAs: the latest stamp, then the latest
+// expiry, then the lowest origin.
+func preferBootstrapToken(a, b *BootstrapToken) bool {
+	if a.Stamp != b.Stamp {
+		return a.Stamp.after(b.Stamp)
+	}
+	if !a.Expires.Equal(b.Expires) {
+		return a.Expires.After(b.Expires)
+	}
+	return a.Origin < b.Origin
+}
+
+func sortBootstrapTokens(tokens []*BootstrapToken) {
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].Token < tokens[j].Token })
+}
+
+// currentBootstrapToken is the unexpired token that lasts longest, if any.
+func currentBootstrapToken(tokens []*BootstrapToken, now time.Time) *BootstrapToken {
+	var current *BootstrapToken
+	for _, t := range tokens {
+		if t.expired(now) {
+			continue
+		}
+		if current == nil || preferBootstrapToken(t, current) {
+			current = t
+		}
+	}
+	return current
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateBootstrapToken(t *testing.T) {
+	for token, valid := range map[string]bool{
+		"abcdef.0123456789abcdef": true,
+		"ABCDEF.0123456789abcdef": false,
+		"abcdef0123456789abcdef":  false,
+		"abcde.0123456789abcdef":  false,
+		"abcdef.0123456789abcde":  false,
+		"":                        false,
+	} {
+		if want, have := valid, validateBootstrapToken(token) == nil; want != have {
+			t.Errorf("%q: want valid=%v, have %v", token, want, have)
+		}
+	}
+}
+
+func TestBootstrapTokenRedacted(t *testing.T) {
+	token := &BootstrapToken{Token: "abcdef.0123456789abcdef", Expires: time.Now()}
+	for _, s := range []string{
+		fmt.Sprint(token),
+		fmt.Sprintf("%v", ClusterInfo{BootstrapTokens: []*BootstrapToken{token}}),
+	} {
+		if strings.Contains(s, "0123456789abcdef") {
+			t.Errorf("secret in %q", s)
+		}
+		if !strings.Contains(s, "abcdef.") {
+			t.Errorf("token ID missing from %q", s)
+		}
+	}
+}
+
+func TestMergeBootstrapTokens(t *testing.T) {
+	now := time.Now()
+	var (
+		a     = &BootstrapToken{Token: "aaaaaa.aaaaaaaaaaaaaaaa", Expires: now.Add(time.Hour), Origin: 2}
+		aLate = &BootstrapToken{Token: "aaaaaa.aaaaaaaaaaaaaaaa", Expires: now.Add(2 * time.Hour), Origin: 3}
+		aLow  = &BootstrapToken{Token: "aaaaaa.aaaaaaaaaaaaaaaa", Expires: now.Add(time.Hour), Origin: 1}
+		b     = &BootstrapToken{Token: "bbbbbb.bbbbbbbbbbbbbbbb", Expires: now.Add(time.Hour), Origin: 2}
+	)
+	for _, testcase := range []struct {
+		ours, theirs []*BootstrapToken
+		result       []*BootstrapToken
+		delta        []*BootstrapToken
+	}{
+		{nil, []*BootstrapToken{a}, []*BootstrapToken{a}, []*BootstrapToken{a}},
+		{[]*BootstrapToken{a}, []*BootstrapToken{a}, []*BootstrapToken{a}, nil},
+		{[]*BootstrapToken{a}, []*BootstrapToken{aLate}, []*BootstrapToken{aLate}, []*BootstrapToken{aLate}},
+		{[]*BootstrapToken{aLate}, []*BootstrapToken{a}, []*BootstrapToken{aLate}, nil},
+		{[]*BootstrapToken{a}, []*BootstrapToken{aLow}, []*BootstrapToken{aLow}, []*BootstrapToken{aLow}},
+		{[]*BootstrapToken{b}, []*BootstrapToken{a}, []*BootstrapToken{a, b}, []*BootstrapToken{a}},
+	} {
+		result, delta := mergeBootstrapTokens(testcase.ours, testcase.theirs)
+		if want, have := testcase.result, result; !reflect.DeepEqual(want, have) {
+			t.Errorf("%v + %v: want result %v, have %v", testcase.ours, testcase.theirs, want, have)
+		}
+		if want, have := testcase.delta, delta; !reflect.DeepEqual(want, have) {
+			t.Errorf("%v + %v: want delta %v, have %v", testcase.ours, testcase.theirs, want, have)
+		}
+	}
+}
+
+func TestStateExpiresBootstrapTokens(t *testing.T) {
+	now := time.Now()
+	var (
+		stale = &BootstrapToken{Token: "aaaaaa.aaaaaaaaaaaaaaaa", Expires: now.Add(time.Minute)}
+		fresh = &BootstrapToken{Token: "bbbbbb.bbbbbbbbbbbbbbbb", Expires: now.Add(time.Hour)}
+		dead  = &BootstrapToken{Token: "cccccc.cccccccccccccccc", Expires: now.Add(-time.Minute)}
+	)
+	st := newTestState()
+	st.mergeComplete(ClusterInfo{BootstrapTokens: []*BootstrapToken{stale, fresh, dead}})
+	if want, have := []*BootstrapToken{stale, fresh}, st.set.BootstrapTokens; !reflect.DeepEqual(want, have) {
+		t.Errorf("merge: want %v, have %v", want, have)
+	}
+	if want, have := fresh, currentBootstrapToken(st.set.BootstrapTokens, now); want != have {
+		t.Errorf("current: want %v, have %v", want, have)
+	}
+	st.expire(now.Add(30 * time.Minute))
+	if want, have := []*BootstrapToken{fresh}, st.set.BootstrapTokens; !reflect.DeepEqual(want, have) {
+		t.Errorf("expire: want %v, have %v", want, have)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// Tombstones delete entries that every merge would otherwise keep, as
+// it keeps whatever either side has. A tombstone goes round like any
+// other entry, and suppresses the entry it deletes wherever it meets
+// it, on either side of a merge, until Keep after Removed, when it is
+// itself dropped. Removed is a reading of the remover's lamportClock,
+// so it is later than any version of the entry the remover had seen;
+// only a version from later still, which can't have been deleted,
+// comes back. To out-wait partitions, Keep should be longer than any
+// peer stays away.
+
+// APIServerTombstone says an apiserver URL is gone, whoever is still
+// advertising it. It wins over every lease of the URL that started
+// before Removed.
+type APIServerTombstone struct {
+	URL     string
+	Peer    mesh.PeerName
+	Removed time.Time
+	Keep    time.Duration
+}
+
+func (t *APIServerTombstone) String() string {
+	return fmt.Sprintf("%s removed by %s at %v", t.URL, t.Peer, t.Removed)
+}
+
+func (t *APIServerTombstone) forgotten(now time.Time) bool {
+	return now.Sub(t.Removed) > t.Keep
+}
+
+// mergeAPIServerTombstones keeps the latest removal of each URL.
+func mergeAPIServerTombstones(ours, theirs []*APIServerTombstone) (result, delta []*APIServerTombstone) {
+	all := append(append([]*APIServerTombstone(nil), ours...), theirs...)
+	keep, changed := mergeKeyed(len(ours), len(theirs),
+		func(i int) string { return all[i].URL },
+		func(i, j int) bool { return preferAPIServerTombstone(all[i], all[j]) })
+	for _, i := range keep {
+		result = append(result, all[i])
+	}
+	for _, i := range changed {
+		delta = append(delta, all[i])
+	}
+	sortAPIServerTombstones(result)
+	sortAPIServerTombstones(delta)
+	return result, delta
+}
+
+// preferAPIServerTombstone decides between two removals of the same URL:
+// the latest, then the one kept longest, then the lowest peer name.
+func preferAPIServerTombstone(a, b *APIServerTombstone) bool {
+	if !a.Removed.Equal(b.Removed) {
+		return a.Removed.After(b.Removed)
+	}
+	if a.Keep != b.Keep {
+		return a.Keep > b.Keep
+	}
+	return a.Peer < b.Peer
+}
+
+func sortAPIServerTombstones(tombstones []*APIServerTombstone) {
+	sort.Slice(tombstones, func(i, j int) bool { return tombstones[i].URL < tombstones[j].URL })
+}
+
+// removedAPIServerURLs is the URLs with a tombstone that no lease
+// started since.
+func removedAPIServerURLs(tombstones []*APIServerTombstone, leases []*APIServerLease) map[string]bool {
+	removed := map[string]time.Time{}
+	for _, t := range tombstones {
+		u := normalizeAPIServerURL(t.URL)
+		if t.Removed.After(removed[u]) {
+			removed[u] = t.Removed
+		}
+	}
+	result := map[string]bool{}
+	for u := range removed {
+		result[u] = true
+	}
+	for _, l := range leases {
+		u := normalizeAPIServerURL(l.URL)
+		if at, ok := removed[u]; ok && l.Since.After(at) {
+			result[u] = false
+		}
+	}
+	return result
+}
+
+// removeAPIServers tombstones urls across the mesh, for keep.
+func (p *peer) removeAPIServers(urls []string, now time.Time, keep time.Duration) {
+	var tombstones []*APIServerTombstone
+	removed := p.st.clock.read(now)
+	for _, u := range normalizeAPIServerURLs(urls) {
+		tombstones = append(tombstones, &APIServerTombstone{URL: u, Peer: p.self, Removed: removed, Keep: keep})
+		p.logger.Infof("Removing apiserver URL %s", u)
+	}
+	p.st.mergeComplete(ClusterInfo{APIServerTombstones: tombstones})
+	p.broadcast()
+}
+
+// BootstrapTokenTombstone says a bootstrap token is revoked, by its ID,
+// which unlike the rest of the token isn't secret. It wins over every
+// version of the token stamped before Removed.
+type BootstrapTokenTombstone struct {
+	ID      string
+	Peer    mesh.PeerName
+	Removed time.Time
+	Keep    time.Duration
+}
+
+func (t *BootstrapTokenTombstone) String() string {
+	return fmt.Sprintf("%s revoked by %s at %v", t.ID, t.Peer, t.Removed)
+}
+
+func (t *BootstrapTokenTombstone) forgotten(now time.Time) bool {
+	return now.Sub(t.Removed) > t.Keep
+}
+
+// mergeBootstrapTokenTombstones keeps the latest revocation of each
+// token ID.
+func mergeBootstrapTokenTombstones(ours, theirs []*BootstrapTokenTombstone) (result, delta []*BootstrapTokenTombstone) {
+	all := append(append([]*BootstrapTokenTombstone(nil), ours...), theirs...)
+	keep, changed := mergeKeyed(len(ours), len(theirs),
+		func(i int) string { return all[i].ID },
+		func(i, j int) bool { return preferBootstrapTokenTombstone(all[i], all[j]) })
+	for _, i := range keep {
+		result = append(result, all[i])
+	}
+	for _, i := range changed {
+		delta = append(delta, all[i])
+	}
+	sortBootstrapTokenTombstones(result)
+	sortBootstrapTokenTombstones(delta)
+	return result, delta
+}
+
+// preferBootstrapTokenTombstone decides between two revocations of the
+// same token ID, as preferAPIServerTombstone does.
+func preferBootstrapTokenTombstone(a, b *BootstrapTokenTombstone) bool {
+	if !a.Removed.Equal(b.Removed) {
+		return a.Removed.After(b.Removed)
+	}
+	if a.Keep != b.Keep {
+		return a.Keep > b.Keep
+	}
+	return a.Peer < b.Peer
+}
+
+func sortBootstrapTokenTombstones(tombstones []*BootstrapTokenTombstone) {
+	sort.Slice(tombstones, func(i, j int) bool { return tombstones[i].ID < tombstones[j].ID })
+}
+
+// revokedBootstrapToken reports whether a tombstone revokes t: one for
+// its ID, from no earlier than its stamp. Tokens from peers that don't
+// stamp them are older than any tombstone.
+func revokedBootstrapToken(t *BootstrapToken, tombstones []*BootstrapTokenTombstone) bool {
+	id := bootstrapTokenID(t.Token)
+	for _, r := range tombstones {
+		if r.ID == id && t.Stamp.Clock <= clockOf(r.Removed) {
+			return true
+		}
+	}
+	return false
+}
+
+// revokeBootstrapTokens tombstones the tokens with ids across the mesh,
+// for keep, or until the tokens we know of with them expire, if later,
+// so that a peer which missed the revocation can't bring them back.
+func (p *peer) revokeBootstrapTokens(ids []string, now time.Time, keep time.Duration) {
+	removed := p.st.clock.read(now)
+	p.st.mtx.RLock()
+	expires := map[string]time.Time{}
+	for _, t := range p.st.set.BootstrapTokens {
+		if id := bootstrapTokenID(t.Token); t.Expires.After(expires[id]) {
+			expires[id] = t.Expires
+		}
+	}
+	p.st.mtx.RUnlock()
+	var tombstones []*BootstrapTokenTombstone
+	for _, id := range ids {
+		k := keep
+		if until := expires[id].Sub(removed); until > k {
+			k = until
+		}
+		tombstones = append(tombstones, &BootstrapTokenTombstone{ID: id, Peer: p.self, Removed: removed, Keep: k})
+		p.logger.Infof("Revoking bootstrap token %s", id)
+	}
+	p.st.mergeComplete(ClusterInfo{BootstrapTokenTombstones: tombstones})
+	p.broadcast()
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+func TestMergeAPIServerTombstones(t *testing.T) {
+	t0 := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	a0 := &APIServerTombstone{URL: "https://a", Peer: 1, Removed: t0, Keep: time.Hour}
+	a1 := &APIServerTombstone{URL: "https://a", Peer: 2, Removed: t0.Add(time.Minute), Keep: time.Hour}
+	a0other := &APIServerTombstone{URL: "https://a", Peer: 2, Removed: t0, Keep: time.Hour}
+	b := &APIServerTombstone{URL: "https://b", Peer: 1, Removed: t0, Keep: time.Hour}
+	for _, testcase := range []struct {
+		ours, theirs  []*APIServerTombstone
+		result, delta []*APIServerTombstone
+	}{
+		{nil, []*APIServerTombstone{a0}, []*APIServerTombstone{a0}, []*APIServerTombstone{a0}},
+		{[]*APIServerTombstone{a0}, []*APIServerTombstone{a0}, []*APIServerTombstone{a0}, nil},
+		{[]*APIServerTombstone{a0}, []*APIServerTombstone{a1}, []*APIServerTombstone{a1}, []*APIServerTombstone{a1}},
+		{[]*APIServerTombstone{a1}, []*APIServerTombstone{a0}, []*APIServerTombstone{a1}, nil},
+		{[]*APIServerTombstone{a0other}, []*APIServerTombstone{a0}, []*APIServerTombstone{a0}, []*APIServerTombstone{a0}},
+		{[]*APIServerTombstone{b}, []*APIServerTombstone{a0}, []*APIServerTombstone{a0, b}, []*APIServerTombstone{a0}},
+	} {
+		result, delta := mergeAPIServerTombstones(testcase.ours, testcase.theirs)
+		if !reflect.DeepEqual(testcase.result, result) {
+			t.Errorf("mergeAPIServerTombstones(%v, %v): want result %v, have %v", testcase.ours, testcase.theirs, testcase.result, result)
+		}
+		if !reflect.DeepEqual(testcase.delta, delta) {
+			t.Errorf("mergeAPIServerTombstones(%v, %v): want delta %v, have %v", testcase.ours, testcase.theirs, testcase.delta, delta)
+		}
+	}
+}
+
+func TestRemovedAPIServerURLs(t *testing.T) {
+	t0 := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	tombstones := []*APIServerTombstone{
+		{URL: "https://a", Removed: t0},
+		{URL: "https://b", Removed: t0},
+	}
+	leases := []*APIServerLease{
+		{URL: "https://a", Peer: 1, Since: t0.Add(-time.Hour)},
+		{URL: "https://b", Peer: 1, Since: t0.Add(-time.Hour)},
+		{URL: "https://B:443", Peer: 2, Since: t0.Add(time.Hour)},
+		{URL: "https://c", Peer: 1, Since: t0.Add(-time.Hour)},
+	}
+	want := map[string]bool{"https://a": true, "https://b": false}
+	if have := removedAPIServerURLs(tombstones, leases); !reflect.DeepEqual(want, have) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+func TestPeerRemovesAPIServers(t *testing.T) {
+	logger := newTextLogger(ioutil.Discard, "", 0)
+	opts := peerOptions{skipCAValidation: true, apiserverTTL: time.Hour}
+	seed := newNodeBootstrapPeer(mesh.PeerName(1), "seed", nil, []string{"https://a:6443", "https://b:6443"}, opts, logger)
+	p := newNodeBootstrapPeer(mesh.PeerName(2), "test", nil, nil, opts, logger)
+	p.st.mergeComplete(seed.st.copy().set)
+
+	now := time.Now()
+	p.removeAPIServers([]string{"a:6443"}, now, 24*time.Hour)
+	if want, have := []string{"https://b:6443"}, p.st.set.ApiserverURLs; !reflect.DeepEqual(want, have) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+
+	// The removal wins over the seed, which still advertises the URL.
+	seed.st.mergeComplete(p.st.copy().set)
+	seed.st.refresh(now.Add(time.Minute))
+	p.st.mergeComplete(seed.st.copy().set)
+	for _, have := range [][]string{seed.st.set.ApiserverURLs, p.st.set.ApiserverURLs} {
+		if want := []string{"https://b:6443"}; !reflect.DeepEqual(want, have) {
+			t.Errorf("after the seed refreshed: want %v, have %v", want, have)
+		}
+	}
+
+	// A seed that starts advertising it afterwards brings it back.
+	time.Sleep(time.Millisecond)
+	readded := newNodeBootstrapPeer(mesh.PeerName(3), "readded", nil, []string{"https://a:6443"}, opts, logger)
+	p.st.mergeComplete(readded.st.copy().set)
+	if want, have := []string{"https://a:6443", "https://b:6443"}, p.st.set.ApiserverURLs; !reflect.DeepEqual(want, have) {
+		t.Errorf("after re-adding: want %v, have %v", want, have)
+	}
+
+	// Tombstones are forgotten after their keep window.
+	p.st.expire(now.Add(25 * time.Hour))
+	if len(p.st.set.APIServerTombstones) != 0 {
+		t.Errorf("want tombstones forgotten, have %v", p.st.set.APIServerTombstones)
+	}
+}
+
+func TestMergeBootstrapTokenTombstones(t *testing.T) {
+	t0 := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	a0 := &BootstrapTokenTombstone{ID: "aaaaaa", Peer: 1, Removed: t0, Keep: time.Hour}
+	a1 := &BootstrapTokenTombstone{ID: "aaaaaa", Peer: 2, Removed: t0.Add(time.Minute), Keep: time.Hour}
+	b := &BootstrapTokenTombstone{ID: "bbbbbb", Peer: 1, Removed: t0, Keep: time.Hour}
+	for _, testcase := range []struct {
+		ours, theirs  []*BootstrapTokenTombstone
+		result, delta []*BootstrapTokenTombstone
+	}{
+		{nil, []*BootstrapTokenTombstone{a0}, []*BootstrapTokenTombstone{a0}, []*BootstrapTokenTombstone{a0}},
+		{[]*BootstrapTokenTombstone{a0}, []*BootstrapTokenTombstone{a1}, []*BootstrapTokenTombstone{a1}, []*BootstrapTokenTombstone{a1}},
+		{[]*BootstrapTokenTombstone{a1}, []*BootstrapTokenTombstone{a0}, []*BootstrapTokenTombstone{a1}, nil},
+		{[]*BootstrapTokenTombstone{b}, []*BootstrapTokenTombstone{a0}, []*BootstrapTokenTombstone{a0, b}, []*BootstrapTokenTombstone{a0}},
+	} {
+		result, delta := mergeBootstrapTokenTombstones(testcase.ours, testcase.theirs)
+		if !reflect.DeepEqual(testcase.result, result) {
+			t.Errorf("mergeBootstrapTokenTombstones(%v, %v): want result %v, have %v", testcase.ours, testcase.theirs, testcase.result, result)
+		}
+		if !reflect.DeepEqual(testcase.delta, delta) {
+			t.Errorf("mergeBootstrapTokenTombstones(%v, %v): want delta %v, have %v", testcase.ours, testcase.theirs, testcase.delta, delta)
+		}
+	}
+}
+
+// mergeAt merges set into st as if at now.
+func mergeAt(st *state, set ClusterInfo, now time.Time) {
+	st.mtx.Lock()
+	defer st.mtx.Unlock()
+	st.merge(set, now)
+}
+
+func tokenIDs(st *state) []string {
+	st.mtx.RLock()
+	defer st.mtx.RUnlock()
+	var ids []string
+	for _, t := range st.set.BootstrapTokens {
+		ids = append(ids, bootstrapTokenID(t.Token))
+	}
+	return ids
+}
+
+const testToken = "abcdef.0123456789abcdef"
+
+func TestRevokeThenReAddBootstrapToken(t *testing.T) {
+	logger := newTextLogger(ioutil.Discard, "", 0)
+	seed := newNodeBootstrapPeer(mesh.PeerName(1), "seed", nil, nil, peerOptions{}, logger)
+	seed.addBootstrapToken(testToken, time.Now().Add(time.Hour))
+	p := newNodeBootstrapPeer(mesh.PeerName(2), "test", nil, nil, peerOptions{}, logger)
+	p.st.mergeComplete(seed.st.copy().set)
+
+	p.revokeBootstrapTokens([]string{"abcdef"}, time.Now(), time.Hour)
+	if ids := tokenIDs(p.st); len(ids) != 0 {
+		t.Fatalf("want the token revoked, have %v", ids)
+	}
+	// The seed still gossips its version, which is older.
+	p.st.mergeComplete(seed.st.copy().set)
+	seed.st.mergeComplete(p.st.copy().set)
+	for _, st := range []*state{p.st, seed.st} {
+		if ids := tokenIDs(st); len(ids) != 0 {
+			t.Errorf("after merging the seed's: want the token revoked, have %v", ids)
+		}
+	}
+
+	// Seeding it again, after seeing the revocation, brings it back.
+	seed.addBootstrapToken(testToken, time.Now().Add(time.Hour))
+	p.st.mergeComplete(seed.st.copy().set)
+	for _, st := range []*state{p.st, seed.st} {
+		if want, have := []string{"abcdef"}, tokenIDs(st); !reflect.DeepEqual(want, have) {
+			t.Errorf("after re-adding: want %v, have %v", want, have)
+		}
+	}
+}
+
+func TestConcurrentAddAndRevokeBootstrapToken(t *testing.T) {
+	now := time.Now().UTC()
+	logger := newTextLogger(ioutil.Discard, "", 0)
+	for _, testcase := range []struct {
+		name    string
+		added   time.Time // the token's stamp
+		revoked time.Time
+		want    []string
+	}{
+		{"add first", now, now.Add(time.Millisecond), nil},
+		{"revoke first", now.Add(time.Millisecond), now, []string{"abcdef"}},
+		// On a tie, the revocation wins.
+		{"same clock", now, now, nil},
+	} {
+		token := ClusterInfo{BootstrapTokens: []*BootstrapToken{{Token: testToken, Expires: now.Add(time.Hour), Origin: 1, Stamp: Stamp{Clock: clockOf(testcase.added), Peer: 1}}}}
+		revocation := ClusterInfo{BootstrapTokenTombstones: []*BootstrapTokenTombstone{{ID: "abcdef", Peer: 2, Removed: testcase.revoked, Keep: time.Hour}}}
+		// Whatever order each peer hears of them in, from whom, they
+		// all end up the same.
+		var peers []*state
+		for i, order := range [][]ClusterInfo{{token, revocation}, {revocation, token}} {
+			st := newState(mesh.PeerName(3+i), nil, nil, peerOptions{}, logger)
+			for _, set := range order {
+				mergeAt(st, set, now)
+			}
+			peers = append(peers, st)
+		}
+		relay := newState(5, nil, nil, peerOptions{}, logger)
+		for _, st := range peers {
+			mergeAt(relay, st.copy().set, now)
+		}
+		for _, st := range append(peers, relay) {
+			if have := tokenIDs(st); !reflect.DeepEqual(testcase.want, have) {
+				t.Errorf("%s: peer %s: want %v, have %v", testcase.name, st.self, testcase.want, have)
+			}
+		}
+	}
+}
+
+func TestOfflinePeerOutlivesTombstones(t *testing.T) {
+	now := time.Now().UTC()
+	logger := newTextLogger(ioutil.Discard, "", 0)
+	opts := peerOptions{apiserverTTL: time.Hour}
+	seed := newNodeBootstrapPeer(mesh.PeerName(1), "seed", nil, []string{"https://a:6443"}, opts, logger)
+	seed.addBootstrapToken(testToken, now.Add(48*time.Hour))
+	p := newNodeBootstrapPeer(mesh.PeerName(2), "test", nil, nil, opts, logger)
+	offline := newState(3, nil, nil, opts, logger)
+	mergeAt(p.st, seed.st.copy().set, now)
+	mergeAt(offline, seed.st.copy().set, now)
+	// The seed goes away for good, and offline, for a while.
+	seed.stop()
+
+	p.removeAPIServers([]string{"https://a:6443"}, now, time.Hour)
+	p.revokeBootstrapTokens([]string{"abcdef"}, now, time.Hour)
+	p.st.mtx.RLock()
+	revocations := p.st.set.BootstrapTokenTombstones
+	p.st.mtx.RUnlock()
+	if len(revocations) != 1 || revocations[0].Keep < 47*time.Hour {
+		t.Errorf("want the revocation kept until the token expires, have %v", revocations)
+	}
+
+	// Hours later, the apiserver tombstone is forgotten, but not the
+	// revocation; offline comes back, and gossips what it had.
+	later := now.Add(3 * time.Hour)
+	p.st.expire(later)
+	mergeAt(p.st, offline.copy().set, later)
+	mergeAt(offline, p.st.copy().set, later)
+	for _, st := range []*state{p.st, offline} {
+		st.mtx.RLock()
+		urls, tombstones := st.set.ApiserverURLs, st.set.APIServerTombstones
+		st.mtx.RUnlock()
+		if len(tombstones) != 0 {
+			t.Errorf("peer %s: want the apiserver tombstone forgotten, have %v", st.self, tombstones)
+		}
+		// The lease it carried expired while it was away, so can't
+		// bring the URL back.
+		if len(urls) != 0 {
+			t.Errorf("peer %s: want no apiserver URLs, have %v", st.self, urls)
+		}
+		if ids := tokenIDs(st); len(ids) != 0 {
+			t.Errorf("peer %s: want the token still revoked, have %v", st.self, ids)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+)
+
+// upstreamOptions configure the load balancer upstream file.
+type upstreamOptions struct {
+	// out is where to write the apiservers, if anywhere.
+	out string
+	// template renders them, or if nil, they're written one host:port
+	// per line.
+	template *template.Template
+	// pidFile, if set, holds the PID of the load balancer, which gets
+	// signal whenever out changes.
+	pidFile string
+	signal  syscall.Signal
+	// debounce is how long to wait for gossip to settle before writing.
+	debounce time.Duration
+}
+
+// upstreamServer is one apiserver, as the upstream template sees it.
+type upstreamServer struct {
+	URL    string
+	Host   string
+	Port   string
+	Labels map[string]string
+	// CertHashes are the gossiped spkiHash of its serving certificate.
+	CertHashes []string
+}
+
+// renderUpstream renders urls, highest priority first, with their labels
+// and serving certificate hashes.
+func renderUpstream(urls []string, labels map[string]map[string]string, certHashes map[string][]string, tmpl *template.Template) ([]byte, error) {
+	var servers []upstreamServer
+	for _, rawurl := range urls {
+		host, port, err := apiserverHostPort(rawurl)
+		if err != nil {
+			continue
+		}
+		servers = append(servers, upstreamServer{URL: rawurl, Host: host, Port: port, Labels: labels[rawurl], CertHashes: certHashes[rawurl]})
+	}
+	var buf bytes.Buffer
+	if tmpl == nil {
+		for _, s := range servers {
+			fmt.Fprintln(&buf, net.JoinHostPort(s.Host, s.Port))
+		}
+		return buf.Bytes(), nil
+	}
+	if err := tmpl.Execute(&buf, struct{ Servers []upstreamServer }{servers}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// signalPidFile sends sig to the process whose PID is in path.
+func signalPidFile(path string, sig syscall.Signal) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	return proc.Signal(sig)
+}
+
+// parseSignal parses a signal name such as HUP or SIGUSR2.
+func parseSignal(name string) (syscall.Signal, error) {
+	switch strings.TrimPrefix(strings.ToUpper(name), "SIG") {
+	case "HUP":
+		return syscall.SIGHUP, nil
+	case "USR1":
+		return syscall.SIGUSR1, nil
+	case "USR2":
+		return syscall.SIGUSR2, nil
+	}
+	return 0, fmt.Errorf("%q: not one of HUP, USR1 or USR2", name)
+}
+
+// scheduleUpstream writes the upstream file debounce after the first
+// change since it was last written, so a burst of gossip is one write.
+func (p *peer) scheduleUpstream() {
+	if p.st.opts.upstream.out == "" {
+		return
+	}
+	p.upstreamMtx.Lock()
+	defer p.upstreamMtx.Unlock()
+	if p.upstreamTimer != nil {
+		return
+	}
+	p.upstreamTimer = time.AfterFunc(p.st.opts.upstream.debounce, func() {
+		p.upstreamMtx.Lock()
+		p.upstreamTimer = nil
+		p.upstreamMtx.Unlock()
+		p.writeUpstream()
+	})
+}
+
+// writeUpstream writes our apiservers to the upstream file, unless
+// they're already there, and if it changed, signals the load balancer.
+func (p *peer) writeUpstream() {
+	opts := p.st.opts.upstream
+	p.st.mtx.RLock()
+	now := time.Now()
+	apiservers := p.st.apiserverURLsFor(consensusOutputs, now)
+	labels := apiserverLabels(p.st.set.APIServerLeases, now)
+	certHashes := servingCertHashes(p.st.set.APIServerLeases, now)
+	p.st.mtx.RUnlock()
+	if len(apiservers) == 0 {
+		return
+	}
+	data, err := renderUpstream(apiservers, labels, certHashes, opts.template)
+	if err != nil {
+		p.logger.Errorf("Rendering upstream file: %v", err)
+		return
+	}
+	p.outMtx.Lock()
+	defer p.outMtx.Unlock()
+	wrote, err := writeFileIfChanged(opts.out, data, 0644)
+	if err != nil {
+		p.logger.Errorf("Writing upstream file: %v", err)
+		return
+	}
+	if !wrote {
+		return
+	}
+	p.logger.Infof("Wrote %d apiserver(s) to %s", len(apiservers), opts.out)
+	if opts.pidFile == "" {
+		return
+	}
+	if err := signalPidFile(opts.pidFile, opts.signal); err != nil {
+		p.logger.Errorf("Signalling load balancer: %v", err)
+		return
+	}
+	p.logger.Infof("Sent %v to the process in %s", opts.signal, opts.pidFile)
+}
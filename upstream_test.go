@@ -0,0 +1,111 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+func TestRenderUpstream(t *testing.T) {
+	urls := []string{"https://b:6443", "https://a", "https://[fd00::1]:6443"}
+	labels := map[string]map[string]string{"https://b:6443": {"zone": "z1"}}
+	have, err := renderUpstream(urls, labels, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "b:6443\na:443\n[fd00::1]:6443\n"; want != string(have) {
+		t.Errorf("want\n%s\nhave\n%s", want, have)
+	}
+
+	tmpl := template.Must(template.New("haproxy").Parse("{{range $i, $s := .Servers}}server apiserver{{$i}} {{$s.Host}}:{{$s.Port}} check\n{{end}}"))
+	have, err = renderUpstream(urls, labels, nil, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "server apiserver0 b:6443 check\nserver apiserver1 a:443 check\nserver apiserver2 fd00::1:6443 check\n"; want != string(have) {
+		t.Errorf("want\n%s\nhave\n%s", want, have)
+	}
+
+	tmpl = template.Must(template.New("zone").Parse("{{range .Servers}}{{if eq .Labels.zone \"z1\"}}{{.URL}}\n{{end}}{{end}}"))
+	have, err = renderUpstream(urls, labels, nil, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "https://b:6443\n"; want != string(have) {
+		t.Errorf("want\n%s\nhave\n%s", want, have)
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	for _, testcase := range []struct {
+		name string
+		want syscall.Signal
+	}{
+		{"HUP", syscall.SIGHUP},
+		{"SIGUSR2", syscall.SIGUSR2},
+		{"usr1", syscall.SIGUSR1},
+		{"KILL", 0},
+	} {
+		have, err := parseSignal(testcase.name)
+		if testcase.want == 0 && err == nil {
+			t.Errorf("%s: want an error, have %v", testcase.name, have)
+		} else if testcase.want != 0 && (err != nil || have != testcase.want) {
+			t.Errorf("%s: want %v, have %v, %v", testcase.name, testcase.want, have, err)
+		}
+	}
+}
+
+func TestPeerWritesUpstream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet-mesh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	out, pidFile := filepath.Join(dir, "upstream"), filepath.Join(dir, "haproxy.pid")
+	if err := ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	reloads := make(chan os.Signal, 10)
+	signal.Notify(reloads, syscall.SIGUSR2)
+	defer signal.Stop(reloads)
+
+	p := newNodeBootstrapPeer(mesh.PeerName(999), "test", nil, nil, peerOptions{
+		skipCAValidation: true,
+		upstream:         upstreamOptions{out: out, pidFile: pidFile, signal: syscall.SIGUSR2, debounce: 50 * time.Millisecond},
+	}, newTextLogger(ioutil.Discard, "", 0))
+
+	// A burst of changes is one write, and one reload.
+	for _, u := range []string{"https://a:6443", "https://b:6443", "https://c:6443"} {
+		p.st.mergeComplete(ClusterInfo{ApiserverURLs: []string{u}})
+		p.onChange()
+	}
+	select {
+	case <-reloads:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reload")
+	}
+	have, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a:6443\nb:6443\nc:6443\n"; want != string(have) {
+		t.Errorf("want\n%s\nhave\n%s", want, have)
+	}
+
+	// Gossip that changes nothing we write doesn't reload.
+	p.st.mergeComplete(ClusterInfo{BootstrapTokens: []*BootstrapToken{{Token: "abcdef.0123456789abcdef", Expires: time.Now().Add(time.Hour)}}})
+	p.onChange()
+	select {
+	case sig := <-reloads:
+		t.Errorf("want no more reloads, have %v", sig)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
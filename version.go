@@ -0,0 +1,22 @@
+package main
+
+import "fmt"
+
+// Set at build time, with
+// -ldflags "-X main.version=... -X main.commit=... -X main.date=...".
+var version, commit, date string
+
+// versionString says which build this is, for -version and the logs.
+func versionString() string {
+	orUnknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+	v := version
+	if v == "" {
+		v = "dev"
+	}
+	return fmt.Sprintf("kubelet-mesh %s (commit %s, built %s)", v, orUnknown(commit), orUnknown(date))
+}
@@ -0,0 +1,15 @@
+package main
+
+import "testing"
+
+func TestVersionString(t *testing.T) {
+	defer func(v, c, d string) { version, commit, date = v, c, d }(version, commit, date)
+	version, commit, date = "", "", ""
+	if want, have := "kubelet-mesh dev (commit unknown, built unknown)", versionString(); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+	version, commit, date = "v0.3.0", "a2af628", "2016-11-02T10:00:00Z"
+	if want, have := "kubelet-mesh v0.3.0 (commit a2af628, built 2016-11-02T10:00:00Z)", versionString(); want != have {
+		t.Errorf("want %q, have %q", want, have)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+type fileStamp struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+func statFile(path string) fileStamp {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{exists: true, size: fi.Size(), modTime: fi.ModTime()}
+}
+
+// watchFiles polls paths every interval, and calls changed once any of them
+// has been created or modified and then left alone for a whole interval,
+// so that we don't act on half-written files or on every step of a
+// write-to-temp-and-rename. Deletions are logged, but otherwise ignored.
+// It looks at paths once before it returns, so that what happens to them
+// from then on counts, and goes on polling until quit is closed.
+func watchFiles(paths []string, interval time.Duration, quit <-chan struct{}, logger *levelLogger, changed func()) {
+	stamps := map[string]fileStamp{}
+	for _, path := range paths {
+		stamps[path] = statFile(path)
+	}
+	go pollFiles(paths, stamps, interval, quit, logger, changed)
+}
+
+// pollFiles is the loop of watchFiles, from the stamps of its first look.
+func pollFiles(paths []string, stamps map[string]fileStamp, interval time.Duration, quit <-chan struct{}, logger *levelLogger, changed func()) {
+	pending := map[string]bool{}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-quit:
+			return
+		}
+		fire := false
+		for _, path := range paths {
+			prev, cur := stamps[path], statFile(path)
+			stamps[path] = cur
+			switch {
+			case prev.exists && !cur.exists:
+				logger.Warnf("%s was deleted, keeping what we loaded from it", path)
+				pending[path] = false
+			case cur != prev:
+				pending[path] = true
+			case pending[path]:
+				pending[path] = false
+				fire = true
+			}
+		}
+		if fire {
+			changed()
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubelet-mesh-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ca.crt")
+
+	changed := make(chan struct{}, 10)
+	quit := make(chan struct{})
+	defer close(quit)
+	watchFiles([]string{path}, 10*time.Millisecond, quit, newTextLogger(ioutil.Discard, "", 0), func() {
+		changed <- struct{}{}
+	})
+
+	expect := func(what string, want bool) {
+		select {
+		case <-changed:
+			if !want {
+				t.Errorf("%s: unexpected change", what)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if want {
+				t.Errorf("%s: no change seen", what)
+			}
+		}
+	}
+
+	// A burst of writes is only reported once.
+	for i := 0; i < 3; i++ {
+		if err := ioutil.WriteFile(path, []byte(string(rune('a'+i))), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect("create", true)
+	expect("settled", false)
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	expect("delete", false)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// wireVersion is the first byte of every payload on nodeBootstrapChannel,
+// and says how the rest is encoded: protobuf, as in wire.proto. Bump it
+// for any change that older peers would misread, rather than just
+// ignore, as protobuf does with fields it doesn't know.
+const wireVersion = 2
+
+// legacyWireVersion is gob-encoded ClusterInfo, which peers sent before
+// wire.proto. We still decode it, and send it with -wire-version 1, so
+// that a mesh can be upgraded a peer at a time; it goes in the next
+// release.
+const legacyWireVersion = 1
+
+// compressedWire is set in the version byte of a payload whose body is
+// gzipped, under any encryption, as encrypted bytes don't compress.
+// Peers from before it drop those payloads as of an unknown version.
+const compressedWire = 0x80
+
+// defaultMaxInflatedBytes is the most a compressed body may inflate to
+// without -max-payload-bytes, so that a zip bomb can't exhaust memory.
+const defaultMaxInflatedBytes = 64 << 20
+
+var (
+	gossipCompressedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "kubelet_mesh",
+		Name:      "gossip_compressed_bytes_total",
+		Help:      "Bytes of the gossip payloads we compressed, after compressing.",
+	})
+	gossipUncompressedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "kubelet_mesh",
+		Name:      "gossip_uncompressed_bytes_total",
+		Help:      "Bytes of the gossip payloads we compressed, before compressing.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(gossipCompressedBytes, gossipUncompressedBytes)
+}
+
+// encodeClusterInfoVersion encodes set in the given wire version,
+// gzips it if that is over compressOver bytes, and compressOver isn't
+// zero, encrypts it if we have a sealer, and puts the version in front.
+func encodeClusterInfoVersion(set ClusterInfo, s *sealer, version byte, compressOver int) []byte {
+	var body []byte
+	switch version {
+	case wireVersion:
+		body = marshalClusterInfo(set)
+	case legacyWireVersion:
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(set); err != nil {
+			panic(err)
+		}
+		body = buf.Bytes()
+	default:
+		panic(fmt.Sprintf("no wire version %d", version))
+	}
+	if compressOver > 0 && len(body) > compressOver {
+		// Only if it saves something, which for a body of certificates
+		// and random tokens it need not.
+		if compressed := gzipBytes(body); len(compressed) < len(body) {
+			gossipUncompressedBytes.Add(float64(len(body)))
+			gossipCompressedBytes.Add(float64(len(compressed)))
+			body, version = compressed, version|compressedWire
+		}
+	}
+	if s != nil {
+		body = s.seal(body)
+	}
+	return append([]byte{version}, body...)
+}
+
+// decodeClusterInfo reverses encodeClusterInfoVersion, for the current
+// and the legacy wire version, refusing payloads of any other.
+func decodeClusterInfo(buf []byte, s *sealer) (set ClusterInfo, err error) {
+	return decodeClusterInfoLimited(buf, s, defaultMaxInflatedBytes)
+}
+
+// decodeClusterInfoLimited is decodeClusterInfo, refusing compressed
+// bodies that inflate to more than maxInflated bytes.
+func decodeClusterInfoLimited(buf []byte, s *sealer, maxInflated int) (set ClusterInfo, err error) {
+	if len(buf) == 0 {
+		return set, errors.New("empty payload")
+	}
+	version, compressed := buf[0]&^compressedWire, buf[0]&compressedWire != 0
+	if version != wireVersion && version != legacyWireVersion {
+		return set, fmt.Errorf("wire version %d, but we only understand %d and %d", buf[0], wireVersion, legacyWireVersion)
+	}
+	buf = buf[1:]
+	if s != nil {
+		if buf, err = s.open(buf); err != nil {
+			return set, err
+		}
+	}
+	if compressed {
+		if buf, err = gunzipBytes(buf, maxInflated); err != nil {
+			return set, err
+		}
+	}
+	if version == legacyWireVersion {
+		err = gob.NewDecoder(bytes.NewReader(buf)).Decode(&set)
+		return set, err
+	}
+	return unmarshalClusterInfo(buf)
+}
+
+func gzipBytes(body []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(body) // a bytes.Buffer can't fail
+	w.Close()
+	return buf.Bytes()
+}
+
+// gunzipBytes inflates a gzipped body, reading one byte past max to see
+// whether it inflates to more, without ever holding more than that.
+func gunzipBytes(buf []byte, max int) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing payload: %v", err)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, fmt.Errorf("decompressing payload: %v", err)
+	}
+	if len(body) > max {
+		return nil, overLimit("inflated", "payload inflating to over %d bytes, the limit", max)
+	}
+	return body, nil
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/gob"
+	"io/ioutil"
+	"math/big"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+	_ "google.golang.org/protobuf/types/known/durationpb"
+	_ "google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// encodeGossip is set as we gossip it on nodeBootstrapChannel, in the
+// current wire version, sealed by s if it isn't nil.
+func encodeGossip(set ClusterInfo, s *sealer) []byte {
+	ch := newGossipChannel(nodeBootstrapChannel, wireVersion, 0)
+	return ch.encoding(&state{set: set}, s).Encode()[0]
+}
+
+func TestWireFormat(t *testing.T) {
+	set := ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443"}}
+	buf := encodeGossip(set, nil)
+	if buf[0] != wireVersion {
+		t.Fatalf("want wire version %d first, have %d", wireVersion, buf[0])
+	}
+	have, err := decodeClusterInfo(buf, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(set, have) {
+		t.Errorf("want %v, have %v", set, have)
+	}
+
+	// What peers sent before there was a wire version.
+	var old bytes.Buffer
+	if err := gob.NewEncoder(&old).Encode(set); err != nil {
+		t.Fatal(err)
+	}
+	future := append([]byte{wireVersion + 1}, buf[1:]...)
+	corrupted := append([]byte{}, buf...)
+	for i := len(corrupted) / 2; i < len(corrupted); i++ {
+		corrupted[i] = 0xff
+	}
+	for _, testcase := range []struct {
+		name string
+		buf  []byte
+		err  string
+	}{
+		{"empty", nil, "empty payload"},
+		{"unversioned", old.Bytes(), "wire version"},
+		{"future", future, "wire version 3"},
+		{"corrupted", corrupted, ""},
+	} {
+		_, err := decodeClusterInfo(testcase.buf, nil)
+		if err == nil || !strings.Contains(err.Error(), testcase.err) {
+			t.Errorf("%s: want error containing %q, have %v", testcase.name, testcase.err, err)
+		}
+	}
+}
+
+// fullClusterInfo has every field of ClusterInfo, and of what's in it,
+// set, in UTC, as we gossip times.
+func fullClusterInfo() ClusterInfo {
+	t0 := time.Date(2017, 1, 2, 3, 4, 5, 6, time.UTC)
+	ca := &RootCAPublicKey{
+		Bytes: []byte("der"), NotBefore: t0, NotAfter: t0.Add(time.Hour), Signature: []byte("sig"),
+		Generation: 3, Origin: 0xc2ffee, Chain: [][]byte{[]byte("int-1"), []byte("int-2")},
+		RetireAt: t0.Add(2 * time.Hour), OriginNickname: "seed", Introduced: t0.Add(-time.Hour),
+		Stamp: Stamp{Clock: 42, Peer: 0xc2ffee},
+	}
+	return ClusterInfo{
+		RootCAs:       []*RootCAPublicKey{ca},
+		ApiserverURLs: []string{"https://a:6443", "https://b:6443"},
+		APIServerLeases: []*APIServerLease{{
+			URL: "https://a:6443", Peer: 1, Refreshed: t0, TTL: 90 * time.Second, Since: t0.Add(-time.Minute),
+			Priority: -2, Weight: 5, Labels: map[string]string{"zone": "a", "rack": "3"},
+			ServingCertHash: "sha256:aa", Nickname: "seed", Stamp: Stamp{Clock: 43, Peer: 2},
+		}},
+		APIServerTombstones:      []*APIServerTombstone{{URL: "https://c:6443", Peer: 2, Removed: t0, Keep: time.Hour}},
+		ResolvedAPIServers:       []*ResolvedAPIServer{{URL: "https://a:6443", IPs: []string{"10.0.0.1", "fd00::1"}, Peer: 1, Resolved: t0}},
+		BootstrapTokens:          []*BootstrapToken{{Token: "abcdef.0123456789abcdef", Expires: t0.Add(time.Hour), Origin: 1, Stamp: Stamp{Clock: 44, Peer: 1}}},
+		CASlots:                  map[string][]*RootCAPublicKey{"etcd": {ca}, "front-proxy": {ca}},
+		CRLs:                     []*CRL{{Bytes: []byte("crl"), Issuer: []byte("issuer"), Number: big.NewInt(258), ThisUpdate: t0, NextUpdate: t0.Add(time.Hour)}},
+		Probes:                   []*APIServerProbe{{URL: "https://a:6443", Peer: 2, Healthy: true, Checked: t0}, {URL: "https://b:6443", Peer: 2, Checked: t0, Error: "refused"}},
+		Attestations:             []*Attestation{{Origin: 1, RootCA: []byte("der"), ApiserverURLs: []string{"https://a:6443"}, Signed: t0, Signature: []byte("sig")}},
+		APIServerSources:         []*APIServerSource{{URL: "https://a:6443", Peer: 1, FirstSeen: t0}},
+		BootstrapTokenTombstones: []*BootstrapTokenTombstone{{ID: "ghijkl", Peer: 2, Removed: t0, Keep: time.Hour}},
+	}
+}
+
+func TestWireFormatRoundTrip(t *testing.T) {
+	set := fullClusterInfo()
+	for _, version := range []byte{wireVersion, legacyWireVersion} {
+		buf := encodeClusterInfoVersion(set, nil, version, 0)
+		if buf[0] != version {
+			t.Errorf("version %d: want it first, have %d", version, buf[0])
+		}
+		have, err := decodeClusterInfo(buf, nil)
+		if err != nil {
+			t.Errorf("version %d: %v", version, err)
+			continue
+		}
+		if !reflect.DeepEqual(set, have) {
+			t.Errorf("version %d: want %+v, have %+v", version, set, have)
+		}
+	}
+	sealer, err := newSealer([]byte("password"), []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, err := decodeClusterInfo(encodeGossip(set, sealer), sealer); err != nil || !reflect.DeepEqual(set, have) {
+		t.Errorf("sealed: want %+v, have %+v, %v", set, have, err)
+	}
+	// Nothing set encodes to nothing at all.
+	if buf := encodeGossip(ClusterInfo{}, nil); len(buf) != 1 {
+		t.Errorf("empty: want just the version, have %x", buf)
+	}
+}
+
+func TestWireFormatSkipsUnknownFields(t *testing.T) {
+	set := ClusterInfo{RootCAs: []*RootCAPublicKey{caA}, ApiserverURLs: []string{"https://a:6443"}}
+	body := marshalClusterInfo(set)
+	// What a newer peer might add: a message, a varint and a fixed64 in
+	// ClusterInfo, and a string in a root CA.
+	body = protowire.AppendBytes(protowire.AppendTag(body, 99, protowire.BytesType), []byte("future"))
+	body = protowire.AppendVarint(protowire.AppendTag(body, 100, protowire.VarintType), 42)
+	body = protowire.AppendFixed64(protowire.AppendTag(body, 101, protowire.Fixed64Type), 42)
+	ca := protowire.AppendString(protowire.AppendTag(marshalRootCA(caB), 50, protowire.BytesType), "future")
+	body = protowire.AppendBytes(protowire.AppendTag(body, 1, protowire.BytesType), ca)
+	have, err := decodeClusterInfo(append([]byte{wireVersion}, body...), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := ClusterInfo{RootCAs: []*RootCAPublicKey{caA, caB}, ApiserverURLs: []string{"https://a:6443"}}
+	if !reflect.DeepEqual(want, have) {
+		t.Errorf("want %+v, have %+v", want, have)
+	}
+
+	// But a truncated payload is an error.
+	if _, err := decodeClusterInfo(append([]byte{wireVersion}, body[:len(body)-1]...), nil); err == nil {
+		t.Error("truncated: want an error")
+	}
+}
+
+// TestWireFormatMatchesProto decodes what we marshal with a decoder built
+// from wire.proto itself, so that wirepb.go can't drift from it: every
+// field wire.proto declares must come out, under its own name, and
+// nothing it doesn't; and what that decoder encodes, we must decode.
+func TestWireFormatMatchesProto(t *testing.T) {
+	file, err := protodesc.NewFile(parseWireProto(t, "wire.proto"), protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatalf("wire.proto: %v", err)
+	}
+	set := fullClusterInfo()
+	msg := dynamicpb.NewMessage(file.Messages().ByName("ClusterInfo"))
+	if err := proto.Unmarshal(marshalClusterInfo(set), msg); err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[protoreflect.FullName]bool{}
+	walkPBMessage(t, msg, seen)
+	for i := 0; i < file.Messages().Len(); i++ {
+		fields := file.Messages().Get(i).Fields()
+		for j := 0; j < fields.Len(); j++ {
+			if name := fields.Get(j).FullName(); !seen[name] {
+				t.Errorf("want %s, from fullClusterInfo, have none", name)
+			}
+		}
+	}
+
+	// Where fields of one type could be swapped unnoticed.
+	t0 := time.Date(2017, 1, 2, 3, 4, 5, 6, time.UTC)
+	for _, testcase := range []struct {
+		path string
+		want interface{}
+	}{
+		{"root_cas.0.der", []byte("der")},
+		{"root_cas.0.signature", []byte("sig")},
+		{"root_cas.0.not_before.seconds", t0.Unix()},
+		{"root_cas.0.not_after.seconds", t0.Add(time.Hour).Unix()},
+		{"root_cas.0.retire_at.seconds", t0.Add(2 * time.Hour).Unix()},
+		{"root_cas.0.introduced.seconds", t0.Add(-time.Hour).Unix()},
+		{"root_cas.0.not_before.nanos", int32(6)},
+		{"root_cas.0.generation", uint64(3)},
+		{"root_cas.0.origin", uint64(0xc2ffee)},
+		{"root_cas.0.stamp.clock", uint64(42)},
+		{"apiserver_leases.0.refreshed.seconds", t0.Unix()},
+		{"apiserver_leases.0.since.seconds", t0.Add(-time.Minute).Unix()},
+		{"apiserver_leases.0.ttl.seconds", int64(90)},
+		{"apiserver_leases.0.priority", int64(-2)},
+		{"apiserver_leases.0.weight", int64(5)},
+		{"apiserver_leases.0.labels.zone", "a"},
+		{"apiserver_leases.0.serving_cert_hash", "sha256:aa"},
+		{"apiserver_leases.0.nickname", "seed"},
+		{"ca_slots.0.name", "etcd"},
+		{"crls.0.der", []byte("crl")},
+		{"crls.0.issuer", []byte("issuer")},
+		{"crls.0.number", big.NewInt(258).Bytes()},
+		{"crls.0.next_update.seconds", t0.Add(time.Hour).Unix()},
+		{"probes.1.error", "refused"},
+		{"attestations.0.root_ca", []byte("der")},
+		{"attestations.0.signature", []byte("sig")},
+		{"bootstrap_token_tombstones.0.id", "ghijkl"},
+	} {
+		if have := pbPath(t, msg, testcase.path); !reflect.DeepEqual(testcase.want, have) {
+			t.Errorf("%s: want %v, have %v", testcase.path, testcase.want, have)
+		}
+	}
+
+	buf, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, err := unmarshalClusterInfo(buf); err != nil || !reflect.DeepEqual(set, have) {
+		t.Errorf("want %+v, have %+v, %v", set, have, err)
+	}
+}
+
+// walkPBMessage notes, in seen, each field set in m and what's in it,
+// and fails t on any field that m's message doesn't declare.
+func walkPBMessage(t *testing.T, m protoreflect.Message, seen map[protoreflect.FullName]bool) {
+	if unknown := m.GetUnknown(); len(unknown) > 0 {
+		t.Errorf("%s: want only fields wire.proto declares, have %x too", m.Descriptor().FullName(), unknown)
+	}
+	m.Range(func(fd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+		seen[fd.FullName()] = true
+		switch {
+		case fd.IsMap() || fd.Message() == nil:
+		case fd.IsList():
+			for i := 0; i < v.List().Len(); i++ {
+				walkPBMessage(t, v.List().Get(i).Message(), seen)
+			}
+		default:
+			walkPBMessage(t, v.Message(), seen)
+		}
+		return true
+	})
+}
+
+// pbPath is the value at path in m: field names, list indices and map
+// keys, dot-separated.
+func pbPath(t *testing.T, m protoreflect.Message, path string) interface{} {
+	parts := strings.Split(path, ".")
+	for len(parts) > 0 {
+		fd := m.Descriptor().Fields().ByName(protoreflect.Name(parts[0]))
+		if fd == nil {
+			t.Fatalf("%s: no field %s in %s", path, parts[0], m.Descriptor().FullName())
+		}
+		v := m.Get(fd)
+		parts = parts[1:]
+		switch {
+		case fd.IsList():
+			i, err := strconv.Atoi(parts[0])
+			if err != nil || i >= v.List().Len() {
+				t.Fatalf("%s: no %s in %s", path, parts[0], fd.FullName())
+			}
+			v, parts = v.List().Get(i), parts[1:]
+		case fd.IsMap():
+			v, parts = v.Map().Get(protoreflect.ValueOfString(parts[0]).MapKey()), parts[1:]
+		}
+		if fd.Message() == nil || fd.IsMap() {
+			return v.Interface()
+		}
+		m = v.Message()
+	}
+	t.Fatalf("%s: a message, not a value", path)
+	return nil
+}
+
+var protoToken = regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_.]*|[0-9]+|"[^"]*"|\S`)
+
+// parseWireProto parses what little of the proto3 language wire.proto
+// uses: imports, and messages of scalar, message, optional, repeated and
+// map fields, but nothing nested. Anything else fails t, rather than
+// being misread.
+func parseWireProto(t *testing.T, path string) *descriptorpb.FileDescriptorProto {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var toks []string
+	for _, line := range strings.Split(string(buf), "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		toks = append(toks, protoToken.FindAllString(line, -1)...)
+	}
+	next := func() string {
+		if len(toks) == 0 {
+			t.Fatalf("%s: unexpected end", path)
+		}
+		tok := toks[0]
+		toks = toks[1:]
+		return tok
+	}
+	expect := func(want string) {
+		if tok := next(); tok != want {
+			t.Fatalf("%s: want %q, have %q", path, want, tok)
+		}
+	}
+	number := func() *int32 {
+		expect("=")
+		n, err := strconv.Atoi(next())
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		expect(";")
+		return proto.Int32(int32(n))
+	}
+	file := &descriptorpb.FileDescriptorProto{Name: proto.String(path)}
+	scalars := map[string]descriptorpb.FieldDescriptorProto_Type{
+		"bool":   descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+		"bytes":  descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+		"int64":  descriptorpb.FieldDescriptorProto_TYPE_INT64,
+		"string": descriptorpb.FieldDescriptorProto_TYPE_STRING,
+		"uint64": descriptorpb.FieldDescriptorProto_TYPE_UINT64,
+	}
+	field := func(name, typ string, num *int32) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{Name: proto.String(name), Number: num, Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()}
+		if scalar, ok := scalars[typ]; ok {
+			f.Type = scalar.Enum()
+			return f
+		}
+		if !strings.Contains(typ, ".") {
+			typ = file.GetPackage() + "." + typ
+		}
+		f.Type, f.TypeName = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE.Enum(), proto.String("."+typ)
+		return f
+	}
+	for len(toks) > 0 {
+		switch tok := next(); tok {
+		case "syntax":
+			expect("=")
+			file.Syntax = proto.String(strings.Trim(next(), `"`))
+			expect(";")
+		case "package":
+			file.Package = proto.String(next())
+			expect(";")
+		case "import":
+			file.Dependency = append(file.Dependency, strings.Trim(next(), `"`))
+			expect(";")
+		case "message":
+			msg := &descriptorpb.DescriptorProto{Name: proto.String(next())}
+			expect("{")
+			for tok := next(); tok != "}"; tok = next() {
+				switch tok {
+				case "repeated":
+					typ, name := next(), next()
+					f := field(name, typ, number())
+					f.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+					msg.Field = append(msg.Field, f)
+				case "optional":
+					typ, name := next(), next()
+					f := field(name, typ, number())
+					f.Proto3Optional, f.OneofIndex = proto.Bool(true), proto.Int32(int32(len(msg.OneofDecl)))
+					msg.OneofDecl = append(msg.OneofDecl, &descriptorpb.OneofDescriptorProto{Name: proto.String("_" + name)})
+					msg.Field = append(msg.Field, f)
+				case "map":
+					expect("<")
+					key := next()
+					expect(",")
+					value := next()
+					expect(">")
+					name := next()
+					// As protoc names it: labels' is LabelsEntry.
+					var entryName string
+					for _, word := range strings.Split(name, "_") {
+						entryName += strings.ToUpper(word[:1]) + word[1:]
+					}
+					entry := &descriptorpb.DescriptorProto{
+						Name:    proto.String(entryName + "Entry"),
+						Field:   []*descriptorpb.FieldDescriptorProto{field("key", key, proto.Int32(1)), field("value", value, proto.Int32(2))},
+						Options: &descriptorpb.MessageOptions{MapEntry: proto.Bool(true)},
+					}
+					msg.NestedType = append(msg.NestedType, entry)
+					f := field(name, file.GetPackage()+"."+msg.GetName()+"."+entry.GetName(), number())
+					f.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+					msg.Field = append(msg.Field, f)
+				default:
+					msg.Field = append(msg.Field, field(next(), tok, number()))
+				}
+			}
+			file.MessageType = append(file.MessageType, msg)
+		default:
+			t.Fatalf("%s: unexpected %q", path, tok)
+		}
+	}
+	return file
+}
+
+func TestWireFormatCompressed(t *testing.T) {
+	set := fullClusterInfo()
+	sealed, err := newSealer([]byte("password"), []byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := encodeGossip(set, nil)
+	for _, testcase := range []struct {
+		name         string
+		version      byte
+		s            *sealer
+		compressOver int
+		compressed   bool
+	}{
+		{"over", wireVersion, nil, 1, true},
+		{"over, sealed", wireVersion, sealed, 1, true},
+		{"over, legacy", legacyWireVersion, nil, 1, true},
+		{"under", wireVersion, nil, len(plain), false},
+		{"off", wireVersion, nil, 0, false},
+	} {
+		buf := encodeClusterInfoVersion(set, testcase.s, testcase.version, testcase.compressOver)
+		want := testcase.version
+		if testcase.compressed {
+			want |= compressedWire
+		}
+		if buf[0] != want {
+			t.Errorf("%s: want version byte %#x, have %#x", testcase.name, want, buf[0])
+		}
+		have, err := decodeClusterInfo(buf, testcase.s)
+		if err != nil {
+			t.Errorf("%s: %v", testcase.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(set, have) {
+			t.Errorf("%s: want %+v, have %+v", testcase.name, set, have)
+		}
+	}
+	if buf := encodeClusterInfoVersion(set, nil, wireVersion, 1); len(buf) >= len(plain) {
+		t.Errorf("want compression to save something on %d bytes, have %d", len(plain), len(buf))
+	}
+
+	// A body that doesn't shrink goes as it is.
+	random := make([]byte, 4<<10)
+	rand.Read(random)
+	incompressible := ClusterInfo{RootCAs: []*RootCAPublicKey{{Bytes: random}}}
+	if buf := encodeClusterInfoVersion(incompressible, nil, wireVersion, 1); buf[0] != wireVersion {
+		t.Errorf("incompressible: want it uncompressed, have version byte %#x", buf[0])
+	}
+
+	// Nor may a body inflate to more than the limit, however small
+	// the payload.
+	bomb := append([]byte{wireVersion | compressedWire}, gzipBytes(make([]byte, 1<<20))...)
+	if len(bomb) > 4<<10 {
+		t.Fatalf("want a small bomb, have %d bytes", len(bomb))
+	}
+	if _, err := decodeClusterInfoLimited(bomb, nil, 1<<10); err == nil {
+		t.Error("bomb: want an error")
+	} else if e, ok := err.(*payloadLimitError); !ok || e.limit != "inflated" {
+		t.Errorf("bomb: want over the inflated limit, have %v", err)
+	}
+	if _, err := decodeClusterInfo(append([]byte{wireVersion | compressedWire}, "not gzip"...), nil); err == nil {
+		t.Error("not gzip: want an error")
+	}
+}
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"math/big"
+	"sort"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/weaveworks/mesh"
+)
+
+// The protobuf encoding of ClusterInfo, as in wire.proto. It's written
+// by hand with protowire, rather than generated, so that building needs
+// no protoc, and so that ClusterInfo stays what the rest of the code
+// works with. Unknown fields are skipped, so older peers ignore what
+// newer ones add, as wire.proto promises.
+
+func appendPBTag(b []byte, num protowire.Number, typ protowire.Type) []byte {
+	return protowire.AppendTag(b, num, typ)
+}
+
+// appendPBBytes appends a singular bytes field, unless it's empty.
+func appendPBBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	return appendPBElement(b, num, v)
+}
+
+// appendPBElement appends a bytes field even if it's empty, as repeated
+// fields and messages must be.
+func appendPBElement(b []byte, num protowire.Number, v []byte) []byte {
+	return protowire.AppendBytes(appendPBTag(b, num, protowire.BytesType), v)
+}
+
+func appendPBString(b []byte, num protowire.Number, v string) []byte {
+	if v == "" {
+		return b
+	}
+	return protowire.AppendString(appendPBTag(b, num, protowire.BytesType), v)
+}
+
+func appendPBStrings(b []byte, num protowire.Number, vs []string) []byte {
+	for _, v := range vs {
+		b = protowire.AppendString(appendPBTag(b, num, protowire.BytesType), v)
+	}
+	return b
+}
+
+func appendPBVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	return protowire.AppendVarint(appendPBTag(b, num, protowire.VarintType), v)
+}
+
+func appendPBBool(b []byte, num protowire.Number, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendPBVarint(b, num, 1)
+}
+
+// appendPBTime appends t as a google.protobuf.Timestamp, unless it's
+// the zero time.
+func appendPBTime(b []byte, num protowire.Number, t time.Time) []byte {
+	if t.IsZero() {
+		return b
+	}
+	var m []byte
+	m = appendPBVarint(m, 1, uint64(t.Unix()))
+	m = appendPBVarint(m, 2, uint64(t.Nanosecond()))
+	return appendPBElement(b, num, m)
+}
+
+// appendPBDuration appends d as a google.protobuf.Duration, unless it's
+// zero.
+func appendPBDuration(b []byte, num protowire.Number, d time.Duration) []byte {
+	if d == 0 {
+		return b
+	}
+	var m []byte
+	m = appendPBVarint(m, 1, uint64(int64(d/time.Second)))
+	m = appendPBVarint(m, 2, uint64(int64(d%time.Second)))
+	return appendPBElement(b, num, m)
+}
+
+// appendPBStamp appends s as a Stamp, unless it's zero.
+func appendPBStamp(b []byte, num protowire.Number, s Stamp) []byte {
+	if s.IsZero() {
+		return b
+	}
+	var m []byte
+	m = appendPBVarint(m, 1, s.Clock)
+	m = appendPBVarint(m, 2, uint64(s.Peer))
+	return appendPBElement(b, num, m)
+}
+
+// pbField is one field of a message: v for a varint, b for bytes.
+type pbField struct {
+	num protowire.Number
+	v   uint64
+	b   []byte
+}
+
+// bytes is a copy of the field, which otherwise aliases the payload.
+func (f pbField) bytes() []byte {
+	return append([]byte(nil), f.b...)
+}
+
+// eachPBField calls fn with each varint and bytes field of buf, in order.
+// Fields of other wire types, which we never send, are skipped, as are,
+// in fn, fields it doesn't know. A known field of the wrong wire type
+// reads as its zero value.
+func eachPBField(buf []byte, fn func(pbField) error) error {
+	for len(buf) > 0 {
+		num, typ, n := protowire.ConsumeTag(buf)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		buf = buf[n:]
+		f := pbField{num: num}
+		switch typ {
+		case protowire.VarintType:
+			f.v, n = protowire.ConsumeVarint(buf)
+		case protowire.BytesType:
+			f.b, n = protowire.ConsumeBytes(buf)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, buf)
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		buf = buf[n:]
+		if typ != protowire.VarintType && typ != protowire.BytesType {
+			continue
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pbSecondsNanos reads a google.protobuf.Timestamp or Duration.
+func pbSecondsNanos(buf []byte) (seconds, nanos int64, err error) {
+	err = eachPBField(buf, func(f pbField) error {
+		switch f.num {
+		case 1:
+			seconds = int64(f.v)
+		case 2:
+			nanos = int64(int32(f.v))
+		}
+		return nil
+	})
+	return seconds, nanos, err
+}
+
+// pbTime reads a google.protobuf.Timestamp, in UTC, as we gossip times.
+func pbTime(buf []byte) (time.Time, error) {
+	seconds, nanos, err := pbSecondsNanos(buf)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(seconds, nanos).UTC(), nil
+}
+
+func pbStamp(buf []byte) (s Stamp, err error) {
+	err = eachPBField(buf, func(f pbField) error {
+		switch f.num {
+		case 1:
+			s.Clock = f.v
+		case 2:
+			s.Peer = mesh.PeerName(f.v)
+		}
+		return nil
+	})
+	return s, err
+}
+
+func pbDuration(buf []byte) (time.Duration, error) {
+	seconds, nanos, err := pbSecondsNanos(buf)
+	return time.Duration(seconds)*time.Second + time.Duration(nanos), err
+}
+
+func marshalClusterInfo(set ClusterInfo) []byte {
+	var b []byte
+	for _, ca := range set.RootCAs {
+		b = appendPBElement(b, 1, marshalRootCA(ca))
+	}
+	b = appendPBStrings(b, 2, set.ApiserverURLs)
+	for _, l := range set.APIServerLeases {
+		b = appendPBElement(b, 3, marshalAPIServerLease(l))
+	}
+	for _, t := range set.APIServerTombstones {
+		var m []byte
+		m = appendPBString(m, 1, t.URL)
+		m = appendPBVarint(m, 2, uint64(t.Peer))
+		m = appendPBTime(m, 3, t.Removed)
+		m = appendPBDuration(m, 4, t.Keep)
+		b = appendPBElement(b, 4, m)
+	}
+	for _, r := range set.ResolvedAPIServers {
+		var m []byte
+		m = appendPBString(m, 1, r.URL)
+		m = appendPBStrings(m, 2, r.IPs)
+		m = appendPBVarint(m, 3, uint64(r.Peer))
+		m = appendPBTime(m, 4, r.Resolved)
+		b = appendPBElement(b, 5, m)
+	}
+	for _, t := range set.BootstrapTokens {
+		var m []byte
+		m = appendPBString(m, 1, t.Token)
+		m = appendPBTime(m, 2, t.Expires)
+		m = appendPBVarint(m, 3, uint64(t.Origin))
+		m = appendPBStamp(m, 4, t.Stamp)
+		b = appendPBElement(b, 6, m)
+	}
+	var slots []string
+	for slot := range set.CASlots {
+		slots = append(slots, slot)
+	}
+	sort.Strings(slots)
+	for _, slot := range slots {
+		m := appendPBString(nil, 1, slot)
+		for _, ca := range set.CASlots[slot] {
+			m = appendPBElement(m, 2, marshalRootCA(ca))
+		}
+		b = appendPBElement(b, 7, m)
+	}
+	for _, crl := range set.CRLs {
+		var m []byte
+		m = appendPBBytes(m, 1, crl.Bytes)
+		m = appendPBBytes(m, 2, crl.Issuer)
+		if crl.Number != nil {
+			m = appendPBElement(m, 3, crl.Number.Bytes())
+		}
+		m = appendPBTime(m, 4, crl.ThisUpdate)
+		m = appendPBTime(m, 5, crl.NextUpdate)
+		b = appendPBElement(b, 8, m)
+	}
+	for _, pr := range set.Probes {
+		var m []byte
+		m = appendPBString(m, 1, pr.URL)
+		m = appendPBVarint(m, 2, uint64(pr.Peer))
+		m = appendPBBool(m, 3, pr.Healthy)
+		m = appendPBTime(m, 4, pr.Checked)
+		m = appendPBString(m, 5, pr.Error)
+		b = appendPBElement(b, 9, m)
+	}
+	for _, a := range set.Attestations {
+		var m []byte
+		m = appendPBVarint(m, 1, uint64(a.Origin))
+		m = appendPBBytes(m, 2, a.RootCA)
+		m = appendPBStrings(m, 3, a.ApiserverURLs)
+		m = appendPBTime(m, 4, a.Signed)
+		m = appendPBBytes(m, 5, a.Signature)
+		b = appendPBElement(b, 10, m)
+	}
+	for _, s := range set.APIServerSources {
+		var m []byte
+		m = appendPBString(m, 1, s.URL)
+		m = appendPBVarint(m, 2, uint64(s.Peer))
+		m = appendPBTime(m, 3, s.FirstSeen)
+		b = appendPBElement(b, 11, m)
+	}
+	for _, t := range set.BootstrapTokenTombstones {
+		var m []byte
+		m = appendPBString(m, 1, t.ID)
+		m = appendPBVarint(m, 2, uint64(t.Peer))
+		m = appendPBTime(m, 3, t.Removed)
+		m = appendPBDuration(m, 4, t.Keep)
+		b = appendPBElement(b, 12, m)
+	}
+	return b
+}
+
+func marshalRootCA(ca *RootCAPublicKey) []byte {
+	var m []byte
+	m = appendPBBytes(m, 1, ca.Bytes)
+	m = appendPBTime(m, 2, ca.NotBefore)
+	m = appendPBTime(m, 3, ca.NotAfter)
+	m = appendPBBytes(m, 4, ca.Signature)
+	m = appendPBVarint(m, 5, ca.Generation)
+	m = appendPBVarint(m, 6, uint64(ca.Origin))
+	for _, der := range ca.Chain {
+		m = appendPBElement(m, 7, der)
+	}
+	m = appendPBTime(m, 8, ca.RetireAt)
+	m = appendPBString(m, 9, ca.OriginNickname)
+	m = appendPBTime(m, 10, ca.Introduced)
+	m = appendPBStamp(m, 11, ca.Stamp)
+	return m
+}
+
+func marshalAPIServerLease(l *APIServerLease) []byte {
+	var m []byte
+	m = appendPBString(m, 1, l.URL)
+	m = appendPBVarint(m, 2, uint64(l.Peer))
+	m = appendPBTime(m, 3, l.Refreshed)
+	m = appendPBDuration(m, 4, l.TTL)
+	m = appendPBTime(m, 5, l.Since)
+	m = appendPBVarint(m, 6, uint64(int64(l.Priority)))
+	m = appendPBVarint(m, 7, uint64(int64(l.Weight)))
+	var keys []string
+	for k := range l.Labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		// A map entry is a message of key = 1 and value = 2, both set.
+		var e []byte
+		e = protowire.AppendString(appendPBTag(e, 1, protowire.BytesType), k)
+		e = protowire.AppendString(appendPBTag(e, 2, protowire.BytesType), l.Labels[k])
+		m = appendPBElement(m, 8, e)
+	}
+	m = appendPBString(m, 9, l.ServingCertHash)
+	m = appendPBString(m, 10, l.Nickname)
+	m = appendPBStamp(m, 11, l.Stamp)
+	return m
+}
+
+func unmarshalClusterInfo(buf []byte) (set ClusterInfo, err error) {
+	err = eachPBField(buf, func(f pbField) error {
+		switch f.num {
+		case 1:
+			ca, err := unmarshalRootCA(f.b)
+			if err != nil {
+				return err
+			}
+			set.RootCAs = append(set.RootCAs, ca)
+		case 2:
+			set.ApiserverURLs = append(set.ApiserverURLs, string(f.b))
+		case 3:
+			l, err := unmarshalAPIServerLease(f.b)
+			if err != nil {
+				return err
+			}
+			set.APIServerLeases = append(set.APIServerLeases, l)
+		case 4:
+			t := &APIServerTombstone{}
+			if err := eachPBField(f.b, func(f pbField) (err error) {
+				switch f.num {
+				case 1:
+					t.URL = string(f.b)
+				case 2:
+					t.Peer = mesh.PeerName(f.v)
+				case 3:
+					t.Removed, err = pbTime(f.b)
+				case 4:
+					t.Keep, err = pbDuration(f.b)
+				}
+				return err
+			}); err != nil {
+				return err
+			}
+			set.APIServerTombstones = append(set.APIServerTombstones, t)
+		case 5:
+			r := &ResolvedAPIServer{}
+			if err := eachPBField(f.b, func(f pbField) (err error) {
+				switch f.num {
+				case 1:
+					r.URL = string(f.b)
+				case 2:
+					r.IPs = append(r.IPs, string(f.b))
+				case 3:
+					r.Peer = mesh.PeerName(f.v)
+				case 4:
+					r.Resolved, err = pbTime(f.b)
+				}
+				return err
+			}); err != nil {
+				return err
+			}
+			set.ResolvedAPIServers = append(set.ResolvedAPIServers, r)
+		case 6:
+			t := &BootstrapToken{}
+			if err := eachPBField(f.b, func(f pbField) (err error) {
+				switch f.num {
+				case 1:
+					t.Token = string(f.b)
+				case 2:
+					t.Expires, err = pbTime(f.b)
+				case 3:
+					t.Origin = mesh.PeerName(f.v)
+				case 4:
+					t.Stamp, err = pbStamp(f.b)
+				}
+				return err
+			}); err != nil {
+				return err
+			}
+			set.BootstrapTokens = append(set.BootstrapTokens, t)
+		case 7:
+			var (
+				slot string
+				cas  []*RootCAPublicKey
+			)
+			if err := eachPBField(f.b, func(f pbField) error {
+				switch f.num {
+				case 1:
+					slot = string(f.b)
+				case 2:
+					ca, err := unmarshalRootCA(f.b)
+					if err != nil {
+						return err
+					}
+					cas = append(cas, ca)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			if set.CASlots == nil {
+				set.CASlots = map[string][]*RootCAPublicKey{}
+			}
+			set.CASlots[slot] = append(set.CASlots[slot], cas...)
+		case 8:
+			crl := &CRL{}
+			if err := eachPBField(f.b, func(f pbField) (err error) {
+				switch f.num {
+				case 1:
+					crl.Bytes = f.bytes()
+				case 2:
+					crl.Issuer = f.bytes()
+				case 3:
+					crl.Number = new(big.Int).SetBytes(f.b)
+				case 4:
+					crl.ThisUpdate, err = pbTime(f.b)
+				case 5:
+					crl.NextUpdate, err = pbTime(f.b)
+				}
+				return err
+			}); err != nil {
+				return err
+			}
+			set.CRLs = append(set.CRLs, crl)
+		case 9:
+			pr := &APIServerProbe{}
+			if err := eachPBField(f.b, func(f pbField) (err error) {
+				switch f.num {
+				case 1:
+					pr.URL = string(f.b)
+				case 2:
+					pr.Peer = mesh.PeerName(f.v)
+				case 3:
+					pr.Healthy = f.v != 0
+				case 4:
+					pr.Checked, err = pbTime(f.b)
+				case 5:
+					pr.Error = string(f.b)
+				}
+				return err
+			}); err != nil {
+				return err
+			}
+			set.Probes = append(set.Probes, pr)
+		case 10:
+			a := &Attestation{}
+			if err := eachPBField(f.b, func(f pbField) (err error) {
+				switch f.num {
+				case 1:
+					a.Origin = mesh.PeerName(f.v)
+				case 2:
+					a.RootCA = f.bytes()
+				case 3:
+					a.ApiserverURLs = append(a.ApiserverURLs, string(f.b))
+				case 4:
+					a.Signed, err = pbTime(f.b)
+				case 5:
+					a.Signature = f.bytes()
+				}
+				return err
+			}); err != nil {
+				return err
+			}
+			set.Attestations = append(set.Attestations, a)
+		case 11:
+			s := &APIServerSource{}
+			if err := eachPBField(f.b, func(f pbField) (err error) {
+				switch f.num {
+				case 1:
+					s.URL = string(f.b)
+				case 2:
+					s.Peer = mesh.PeerName(f.v)
+				case 3:
+					s.FirstSeen, err = pbTime(f.b)
+				}
+				return err
+			}); err != nil {
+				return err
+			}
+			set.APIServerSources = append(set.APIServerSources, s)
+		case 12:
+			t := &BootstrapTokenTombstone{}
+			if err := eachPBField(f.b, func(f pbField) (err error) {
+				switch f.num {
+				case 1:
+					t.ID = string(f.b)
+				case 2:
+					t.Peer = mesh.PeerName(f.v)
+				case 3:
+					t.Removed, err = pbTime(f.b)
+				case 4:
+					t.Keep, err = pbDuration(f.b)
+				}
+				return err
+			}); err != nil {
+				return err
+			}
+			set.BootstrapTokenTombstones = append(set.BootstrapTokenTombstones, t)
+		}
+		return nil
+	})
+	return set, err
+}
+
+func unmarshalRootCA(buf []byte) (*RootCAPublicKey, error) {
+	ca := &RootCAPublicKey{}
+	err := eachPBField(buf, func(f pbField) (err error) {
+		switch f.num {
+		case 1:
+			ca.Bytes = f.bytes()
+		case 2:
+			ca.NotBefore, err = pbTime(f.b)
+		case 3:
+			ca.NotAfter, err = pbTime(f.b)
+		case 4:
+			ca.Signature = f.bytes()
+		case 5:
+			ca.Generation = f.v
+		case 6:
+			ca.Origin = mesh.PeerName(f.v)
+		case 7:
+			ca.Chain = append(ca.Chain, f.bytes())
+		case 8:
+			ca.RetireAt, err = pbTime(f.b)
+		case 9:
+			ca.OriginNickname = string(f.b)
+		case 10:
+			ca.Introduced, err = pbTime(f.b)
+		case 11:
+			ca.Stamp, err = pbStamp(f.b)
+		}
+		return err
+	})
+	return ca, err
+}
+
+func unmarshalAPIServerLease(buf []byte) (*APIServerLease, error) {
+	l := &APIServerLease{}
+	err := eachPBField(buf, func(f pbField) (err error) {
+		switch f.num {
+		case 1:
+			l.URL = string(f.b)
+		case 2:
+			l.Peer = mesh.PeerName(f.v)
+		case 3:
+			l.Refreshed, err = pbTime(f.b)
+		case 4:
+			l.TTL, err = pbDuration(f.b)
+		case 5:
+			l.Since, err = pbTime(f.b)
+		case 6:
+			l.Priority = int(int64(f.v))
+		case 7:
+			l.Weight = int(int64(f.v))
+		case 8:
+			var k, v string
+			if err := eachPBField(f.b, func(f pbField) error {
+				switch f.num {
+				case 1:
+					k = string(f.b)
+				case 2:
+					v = string(f.b)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			if l.Labels == nil {
+				l.Labels = map[string]string{}
+			}
+			l.Labels[k] = v
+		case 9:
+			l.ServingCertHash = string(f.b)
+		case 10:
+			l.Nickname = string(f.b)
+		case 11:
+			l.Stamp, err = pbStamp(f.b)
+		}
+		return err
+	})
+	return l, err
+}